@@ -0,0 +1,71 @@
+package main
+
+import (
+	"github.com/charmbracelet/log"
+	"github.com/mnemosynefs/mnemo/internal/atlas"
+)
+
+// Verifies the object store under root, returning the exit code of the
+// command. Damage is logged per object.
+func scrub(root string, key []byte) int {
+	files, err := openAtlas(root, key)
+	if err != nil {
+		return 2
+	}
+
+	report, err := files.Scrub()
+	if err != nil {
+		log.Errorf("Failed to scrub atlas at %v: %v", root, err)
+		return 2
+	}
+
+	for _, issue := range report.Corrupt {
+		log.Errorf("Corrupt object %v, held by %v", issue.Object, issue.Paths)
+	}
+	for _, issue := range report.Missing {
+		log.Errorf("Missing object %v, held by %v", issue.Object, issue.Paths)
+	}
+	log.Infof("Checked %d objects, %d bytes: %d corrupt, %d missing", report.Checked, report.Bytes, len(report.Corrupt), len(report.Missing))
+
+	if !report.OK() {
+		return 1
+	}
+	return 0
+}
+
+// Re-encrypts the object store under root with the master key held by
+// keyFile, returning the exit code of the command. The server must not be
+// running meanwhile.
+func rekey(root string, key []byte, keyFile string) int {
+	next, err := atlas.LoadKey(keyFile)
+	if err != nil {
+		log.Errorf("Failed to load new master key from %v: %v", keyFile, err)
+		return 2
+	}
+
+	files, err := openAtlas(root, key)
+	if err != nil {
+		return 2
+	}
+
+	report, err := files.Rekey(next)
+	if err != nil {
+		log.Errorf("Failed to rekey atlas at %v: %v", root, err)
+		return 1
+	}
+
+	log.Infof("Rekeyed %d objects and encrypted %d plaintext objects", report.Rekeyed, report.Encrypted)
+	return 0
+}
+
+func openAtlas(root string, key []byte) (*atlas.Atlas, error) {
+	files, err := atlas.OpenAtlas(root)
+	if err == nil {
+		err = files.SetEncryptionKey(key)
+	}
+	if err != nil {
+		log.Errorf("Failed to open atlas at %v: %v", root, err)
+		return nil, err
+	}
+	return files, nil
+}
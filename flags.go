@@ -2,23 +2,50 @@ package main
 
 import (
 	"flag"
+	"time"
+
+	"github.com/mnemosynefs/mnemo/internal/atlas"
 )
 
 type FlagOptions struct {
-	address string
-	root    string
+	address   string
+	root      string
+	versions  int
+	trashAge  time.Duration
+	uploadAge time.Duration
+	quota     int64
+	scrub     bool
+	compress  bool
+	keyFile   string
+	rekey     string
 }
 
 var Flags FlagOptions
 
 func ParseFlags() {
 	address := flag.String("address", "0.0.0.0:80", "address:port")
-	root := flag.String("root", ".", "path to dir location")
+	root := flag.String("root", ".", "path to dir location, s3://bucket/prefix to keep files in object storage, or memory: to keep them in memory")
+	versions := flag.Int("versions", atlas.DefaultVersionLimit, "versions kept per file, 0 keeps all")
+	quota := flag.Int64("user-quota", 0, "bytes each user may store unless atlas/quotas.json says otherwise, 0 is unlimited")
+	trashAge := flag.Duration("trash-age", atlas.DefaultTrashAge, "age after which deleted files are purged from the trash, 0 keeps them")
+	uploadAge := flag.Duration("upload-age", atlas.DefaultUploadAge, "age after which uploads receiving no more content are removed, 0 keeps them")
+	scrub := flag.Bool("scrub", false, "verify every stored file against its checksum and exit")
+	compress := flag.Bool("compress", false, "store text-like files gzipped")
+	keyFile := flag.String("key-file", "", "file holding the base64 master key files are encrypted with, defaults to $"+atlas.KeyEnv)
+	rekey := flag.String("rekey", "", "re-encrypt every stored file under the master key held by this file and exit")
 
 	flag.Parse()
 
 	Flags = FlagOptions{
-		address: *address,
-		root:    *root,
+		address:   *address,
+		root:      *root,
+		versions:  *versions,
+		trashAge:  *trashAge,
+		uploadAge: *uploadAge,
+		quota:     *quota,
+		scrub:     *scrub,
+		compress:  *compress,
+		keyFile:   *keyFile,
+		rekey:     *rekey,
 	}
 }
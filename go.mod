@@ -6,7 +6,9 @@ require (
 	github.com/charmbracelet/log v0.4.2
 	github.com/google/go-cmp v0.5.8
 	github.com/google/uuid v1.6.0
+	github.com/klauspost/compress v1.18.0
 	github.com/stretchr/testify v1.11.1
+	golang.org/x/image v0.25.0
 )
 
 require (
@@ -0,0 +1,607 @@
+package atlas
+
+import (
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrInvalidTag       = errors.New("tag is not valid")
+	ErrInvalidPath      = errors.New("path is not valid")
+	ErrResourceNotFound = errors.New("resource does not exist")
+	ErrUploadToRoot     = errors.New("Cannot write to root")
+	ErrIsFolder         = errors.New("Expecting file, found folder")
+	ErrIsFile           = errors.New("Expecting folder, found file")
+	ErrTagExists        = errors.New("tag already exists")
+	ErrTagNotFound      = errors.New("tag does not exist")
+)
+
+const (
+	filePerm = 0644
+	dirPerm  = 0755
+)
+
+var tag_validate = regexp.MustCompile(`^[\w\-. ]+$`)
+
+func ValidateTag(tag string) error {
+	if tag == "." || tag == ".." || !tag_validate.Match([]byte(tag)) {
+		return ErrInvalidTag
+	}
+	return nil
+}
+
+func ValidatePath(path string) error {
+	clean := filepath.Clean(path)
+	if filepath.IsAbs(clean) {
+		return fmt.Errorf("%w: absolute paths are not allowed: %s", ErrInvalidPath, path)
+	}
+
+	rel, err := filepath.Rel(".", clean)
+	if err != nil {
+		return fmt.Errorf("%w: cannot evaluate path: %w", ErrInvalidPath, err)
+	}
+
+	if strings.HasPrefix(rel, "..") {
+		return fmt.Errorf("%w: path escapes base directory: %s", ErrInvalidPath, path)
+	}
+
+	return nil
+}
+
+type Path string
+
+func NewPath(path string) Path {
+	return Path(path)
+}
+
+// Key returns the manifest key of the path, the empty string being the root
+func (p *Path) Key() string {
+	key := filepath.ToSlash(filepath.Clean(string(*p)))
+	if key == "." {
+		return ""
+	}
+	return key
+}
+
+func (p *Path) Stat(atlas *Atlas) (os.FileInfo, error) {
+	atlas.mu.Lock()
+	defer atlas.mu.Unlock()
+
+	entry, ok := atlas.curr.Get(p.Key())
+	if !ok {
+		return nil, ErrResourceNotFound
+	}
+
+	return entryInfo{name: path.Base(p.Key()), entry: entry}, nil
+}
+
+func (p *Path) Validate() error {
+	return ValidatePath(string(*p))
+}
+
+// Root reports whether the path points at the top of the working tree
+func (p *Path) Root() bool {
+	return p.Key() == ""
+}
+
+type Atlas struct {
+	backend Backend
+
+	// Guards the working tree manifest, the version history, the trash and
+	// the object reference counts
+	mu      sync.Mutex
+	curr    *Manifest
+	history map[string][]Version
+	trash   map[string][]*trashed
+	refs    map[string]int
+	quotas  Quotas
+	// Metadata of the objects, keyed by object
+	metadata map[string]Metadata
+	// Whether new objects of compressible files are stored gzipped
+	compress bool
+	// Master key of encrypted objects, nil when objects are stored plainly
+	key atomic.Pointer[cipher.AEAD]
+	// Upload sessions currently receiving a chunk
+	uploading map[string]bool
+
+	versionLimit int
+	// Decide which files a user may read and change, every file if nil
+	readable func(username string, key string) bool
+	writable func(username string, key string) bool
+	// Decides which users are administrators, every user if nil
+	admin func(username string) bool
+	// Bounds of archive extractions, the defaults where zero
+	extractLimits ExtractLimits
+	// Recent events and their subscribers
+	events eventLog
+}
+
+// Creates new filesystem and creates basic dir structure
+func NewAtlas(root string) (*Atlas, error) {
+	dir := filepath.Join(root, "atlas")
+	if err := os.MkdirAll(dir, dirPerm); err != nil {
+		return nil, err
+	}
+
+	// Everything below dir is resolved through the handle, so links placed in
+	// the store cannot lead outside of it
+	legacy, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer legacy.Close()
+
+	for _, sub := range []string{"objects", "previews", "tags", "tmp", "uploads"} {
+		if err := legacy.MkdirAll(sub, dirPerm); err != nil {
+			return nil, err
+		}
+	}
+
+	backend, err := NewLocalBackend(dir)
+	if err != nil {
+		return nil, err
+	}
+	return openAtlas(backend, legacy)
+}
+
+// Opens the atlas kept in backend
+func NewAtlasWithBackend(backend Backend) (*Atlas, error) {
+	return openAtlas(backend, nil)
+}
+
+// Opens the atlas kept in backend. Plain trees written before the object
+// store existed are imported from the local directory legacy, if given.
+func openAtlas(backend Backend, legacy *os.Root) (*Atlas, error) {
+	atlas := &Atlas{
+		backend:      backend,
+		curr:         NewManifest(),
+		history:      map[string][]Version{},
+		trash:        map[string][]*trashed{},
+		uploading:    map[string]bool{},
+		metadata:     map[string]Metadata{},
+		versionLimit: DefaultVersionLimit,
+		events:       newEventLog(),
+	}
+
+	// Content staged by writes that never finished is of no use anymore
+	if err := atlas.clearTmp(); err != nil {
+		return nil, err
+	}
+
+	err := atlas.loadJSON(atlas.currFile(), atlas.curr)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	err = atlas.loadJSON(atlas.historyFile(), &atlas.history)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	err = atlas.loadJSON(atlas.trashFile(), &atlas.trash)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	if err := atlas.loadQuotas(); err != nil {
+		return nil, err
+	}
+
+	if err := atlas.loadMetadata(); err != nil {
+		return nil, err
+	}
+
+	if legacy != nil {
+		if err := atlas.migrateTrees(legacy); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := atlas.countReferences(); err != nil {
+		return nil, err
+	}
+
+	return atlas, nil
+}
+
+func (f *Atlas) currFile() string {
+	return "curr.json"
+}
+
+func (f *Atlas) clearTmp() error {
+	infos, err := f.backend.List("tmp/")
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if err := f.backend.Remove(info.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Imports the plain curr and tag directories below root used before the
+// object store
+func (f *Atlas) migrateTrees(root *os.Root) error {
+	if info, err := root.Lstat("curr"); err == nil && info.IsDir() {
+		manifest, err := f.importTree(root, "curr")
+		if err != nil {
+			return err
+		}
+		f.curr = manifest
+		if err := f.saveJSON(f.currFile(), f.curr); err != nil {
+			return err
+		}
+		if err := root.RemoveAll("curr"); err != nil {
+			return err
+		}
+	}
+
+	entries, err := fs.ReadDir(root.FS(), "tags")
+	if err != nil {
+		return err
+	}
+	for _, dirEntry := range entries {
+		if !dirEntry.IsDir() {
+			continue
+		}
+
+		tagDir := path.Join("tags", dirEntry.Name())
+		t := &tag{}
+		content, err := root.ReadFile(filepath.Join(tagDir, tagInfoFile))
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(content, &t.TagInfo); err != nil {
+			return err
+		}
+		manifest, err := f.importTree(root, path.Join(tagDir, tagTreeDir))
+		if err != nil {
+			return err
+		}
+		t.Manifest = *manifest
+
+		if err := f.saveJSON(f.tagFile(t.Name), t); err != nil {
+			return err
+		}
+		if err := root.RemoveAll(tagDir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *Atlas) Exists(path Path) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, ok := f.curr.Get(path.Key())
+	return ok
+}
+
+// FileWriter stages the content of a file in atlas/tmp. Nothing is visible to
+// readers until Commit atomically publishes the content into curr; Abort drops
+// it and leaves the current file untouched. Exactly one of them takes effect,
+// so deferring Abort after a successful Commit is safe.
+type FileWriter struct {
+	atlas  *Atlas
+	key    string
+	author string
+	object *objectWriter
+	done   bool
+	// Bytes the quotas allowed when the writer was opened, -1 if unlimited
+	budget int64
+	// Checksum the content must match, if any
+	checksum string
+	// State the current file must be in to be replaced
+	condition Condition
+	// Entry of the file once committed
+	entry Entry
+}
+
+func (w *FileWriter) Write(p []byte) (int, error) {
+	if w.done {
+		return 0, os.ErrClosed
+	}
+	if w.budget >= 0 && w.object.size+int64(len(p)) > w.budget {
+		return 0, ErrQuotaExceeded
+	}
+	return w.object.Write(p)
+}
+
+// Publishes the written content as the current file
+func (w *FileWriter) Commit() error {
+	if w.done {
+		return os.ErrClosed
+	}
+	w.done = true
+	if w.checksum != "" && w.checksum != w.object.checksum() {
+		w.object.discard()
+		return ErrChecksumMismatch
+	}
+	entry, err := w.atlas.publish(w.key, w.author, w.object, w.condition)
+	if err != nil {
+		return err
+	}
+	w.entry = entry
+	return nil
+}
+
+// Drops the written content. Does nothing once committed.
+func (w *FileWriter) Abort() {
+	if w.done {
+		return
+	}
+	w.done = true
+	w.object.discard()
+}
+
+// Stores staged content and makes it the current file at key if the current
+// file satisfies cond, returning its entry. The replaced file is kept as a
+// version.
+func (f *Atlas) publish(key string, author string, w *objectWriter, cond Condition) (Entry, error) {
+	meta := f.inspectStaged(w, key)
+	err := f.compressObject(w, key)
+	if err == nil {
+		err = f.encryptObject(w)
+	}
+	if err != nil {
+		w.discard()
+		return Entry{}, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	current, exists := f.curr.Get(key)
+	err = cond.check(current, exists)
+	if err == nil {
+		err = f.checkPermission(author, key)
+	}
+	if err == nil {
+		err = f.checkWritable(key)
+	}
+	if err == nil {
+		err = f.checkQuota([]string{key}, map[string]Entry{
+			key: {Type: EntryFile, Size: w.size, Author: author},
+		})
+	}
+	if err != nil {
+		w.discard()
+		return Entry{}, err
+	}
+
+	object, err := f.storeObject(w)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	now := time.Now().UTC()
+	if err := f.curr.MakeParents(key, now); err != nil {
+		return Entry{}, err
+	}
+
+	entry := Entry{
+		Type:     EntryFile,
+		Object:   object,
+		Size:     w.size,
+		Modified: now,
+		Author:   author,
+		Version:  f.nextVersion(key),
+	}
+	if exists {
+		entry.Annotations = current.Annotations
+	}
+
+	f.archive(f.curr.Remove(key))
+	f.curr.Put(key, entry)
+	f.retainObject(object)
+
+	if err := f.saveCurr(); err != nil {
+		return Entry{}, err
+	}
+	f.recordMetadata(map[string]*Metadata{object: meta})
+
+	event := Event{Type: EventCreated, Path: key, EntryType: EntryFile, Author: author}
+	if exists {
+		event.Type = EventModified
+	}
+	f.emit(event)
+	return entry, nil
+}
+
+// Checks that key can hold a file. Must be called with the atlas lock held.
+func (f *Atlas) checkWritable(key string) error {
+	if entry, ok := f.curr.Get(key); ok && entry.IsDir() {
+		return ErrIsFolder
+	}
+	return f.checkParents(key)
+}
+
+// Checks that no file stands where a folder above key is needed. Must be
+// called with the atlas lock held.
+func (f *Atlas) checkParents(key string) error {
+	for dir := parentKey(key); dir != ""; dir = parentKey(dir) {
+		if entry, ok := f.curr.Get(dir); ok && !entry.IsDir() {
+			return ErrIsFile
+		}
+	}
+	return nil
+}
+
+// Persists the working tree together with its history. Must be called with the
+// atlas lock held.
+func (f *Atlas) saveCurr() error {
+	if err := f.saveJSON(f.historyFile(), f.history); err != nil {
+		return err
+	}
+	return f.saveJSON(f.currFile(), f.curr)
+}
+
+// Opens a file for writing on behalf of author. The content replaces the
+// current file once the writer is committed.
+func (f *Atlas) Write(path Path, author string) (*FileWriter, error) {
+	if err := path.Validate(); err != nil {
+		return nil, err
+	}
+
+	if path.Root() {
+		return nil, ErrUploadToRoot
+	}
+
+	f.mu.Lock()
+	err := f.checkPermission(author, path.Key())
+	if err == nil {
+		err = f.checkWritable(path.Key())
+	}
+	budget := f.quotaBudget(author, path.Key())
+	f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	object, err := f.newObject()
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileWriter{atlas: f, key: path.Key(), author: author, object: object, budget: budget}, nil
+}
+
+// Creates an empty folder on behalf of author, along with the folders leading
+// up to it
+func (f *Atlas) MakeDir(path Path, author string) error {
+	if err := path.Validate(); err != nil {
+		return err
+	}
+	if path.Root() {
+		return ErrDestinationExists
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := path.Key()
+	if _, ok := f.curr.Get(key); ok {
+		return ErrDestinationExists
+	}
+	if err := f.checkPermission(author, key); err != nil {
+		return err
+	}
+	if err := f.checkParents(key); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	if err := f.curr.MakeParents(key, now); err != nil {
+		return err
+	}
+	f.curr.Put(key, Entry{Type: EntryDir, Modified: now, Author: author})
+
+	if err := f.saveCurr(); err != nil {
+		return err
+	}
+	f.emit(Event{Type: EventCreated, Path: key, EntryType: EntryDir, Author: author})
+	return nil
+}
+
+// File is an open file of the atlas together with the entry it was opened from
+type File struct {
+	io.ReadSeekCloser
+	Key   string
+	Entry Entry
+}
+
+// Strong entity tag of the file, derived from its object and version
+func (file *File) ETag() string {
+	return file.Entry.ETag()
+}
+
+func (f *Atlas) openFile(key string, entry Entry) (*File, error) {
+	object, err := f.openObject(entry.Object, entry.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	return &File{ReadSeekCloser: object, Key: key, Entry: entry}, nil
+}
+
+// Opens the current content of a file on behalf of user
+func (f *Atlas) Read(path Path, user string) (*File, error) {
+	if err := path.Validate(); err != nil {
+		return nil, err
+	}
+
+	// Open while holding the lock so garbage collection cannot remove the
+	// object in between
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	entry, ok := f.curr.Get(path.Key())
+	if !ok || !f.canRead(user, path.Key()) {
+		return nil, ErrResourceNotFound
+	}
+	if entry.IsDir() {
+		return nil, ErrIsFolder
+	}
+
+	return f.openFile(path.Key(), entry)
+}
+
+// Deletes a file or folder on behalf of user. It is moved into the trash of
+// the user and deleted files keep their version history.
+func (f *Atlas) Delete(path Path, user string) error {
+	return f.DeleteIf(path, user, Condition{})
+}
+
+// Deletes a file or folder like Delete if it satisfies cond
+func (f *Atlas) DeleteIf(path Path, user string, cond Condition) error {
+	if err := path.Validate(); err != nil {
+		return err
+	}
+	if path.Root() {
+		return ErrUploadToRoot
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := path.Key()
+	entry, ok := f.curr.Get(key)
+	if err := cond.check(entry, ok); err != nil {
+		return err
+	}
+	if !ok {
+		return ErrResourceNotFound
+	}
+	if err := f.checkPermission(user, key); err != nil {
+		return err
+	}
+
+	removed := f.curr.Remove(key)
+	f.moveToTrash(user, key, removed)
+	f.archive(removed)
+
+	if err := f.saveTrash(); err != nil {
+		return err
+	}
+	if err := f.saveCurr(); err != nil {
+		return err
+	}
+	f.emit(Event{Type: EventDeleted, Path: key, EntryType: entry.Type, Author: user})
+	return nil
+}
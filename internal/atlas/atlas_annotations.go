@@ -0,0 +1,274 @@
+package atlas
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Annotations are labels and key/value properties users attach to files and
+// folders. They live on the entries of the tree, so moves, copies, tags and
+// the trash carry them along, and a file keeps its annotations when its
+// content is replaced. Versions remember the annotations they had.
+
+var ErrInvalidAnnotation = errors.New("annotation is not valid")
+
+const (
+	// Most labels and most properties a single entry may have
+	MaxAnnotations = 64
+	// Longest label or property name, in bytes
+	MaxAnnotationName = 128
+	// Longest property value, in bytes
+	MaxPropertyValue = 1024
+)
+
+// Labels and property names are letters, digits, and the characters _ - . :
+var annotationName = regexp.MustCompile(`^[\p{L}\p{N}_\-.:]+$`)
+
+type Annotations struct {
+	Labels     []string          `json:"labels,omitempty"`
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
+// Changes to the annotations of an entry. Properties with a nil value are
+// removed.
+type AnnotationPatch struct {
+	Labels       []string           `json:"labels,omitempty"`
+	RemoveLabels []string           `json:"remove_labels,omitempty"`
+	Properties   map[string]*string `json:"properties,omitempty"`
+}
+
+// Entries matching all of the labels and all of the properties
+type AnnotationQuery struct {
+	Labels     []string
+	Properties map[string]string
+}
+
+func validateAnnotationName(name string) error {
+	if len(name) > MaxAnnotationName || !annotationName.MatchString(name) {
+		return fmt.Errorf("%w: %q is not a valid name", ErrInvalidAnnotation, name)
+	}
+	return nil
+}
+
+func (a Annotations) Validate() error {
+	if len(a.Labels) > MaxAnnotations || len(a.Properties) > MaxAnnotations {
+		return fmt.Errorf("%w: more than %d labels or properties", ErrInvalidAnnotation, MaxAnnotations)
+	}
+	for _, label := range a.Labels {
+		if err := validateAnnotationName(label); err != nil {
+			return err
+		}
+	}
+	for name, value := range a.Properties {
+		if err := validateAnnotationName(name); err != nil {
+			return err
+		}
+		if len(value) > MaxPropertyValue {
+			return fmt.Errorf("%w: value of %q is longer than %d bytes", ErrInvalidAnnotation, name, MaxPropertyValue)
+		}
+	}
+	return nil
+}
+
+func (a Annotations) HasLabel(label string) bool {
+	return slices.Contains(a.Labels, label)
+}
+
+// Returns a copy with sorted, distinct labels. Empty annotations have nil
+// fields so they are left out of the manifest.
+func (a Annotations) normalize() Annotations {
+	normalized := Annotations{}
+	if len(a.Labels) > 0 {
+		normalized.Labels = slices.Compact(slices.Sorted(slices.Values(a.Labels)))
+	}
+	if len(a.Properties) > 0 {
+		normalized.Properties = maps.Clone(a.Properties)
+	}
+	return normalized
+}
+
+// Returns the annotations with the patch applied, leaving a untouched
+func (a Annotations) apply(patch AnnotationPatch) Annotations {
+	labels := slices.Clone(a.Labels)
+	labels = slices.DeleteFunc(labels, func(label string) bool {
+		return slices.Contains(patch.RemoveLabels, label)
+	})
+	labels = append(labels, patch.Labels...)
+
+	properties := maps.Clone(a.Properties)
+	if properties == nil {
+		properties = map[string]string{}
+	}
+	for name, value := range patch.Properties {
+		if value == nil {
+			delete(properties, name)
+		} else {
+			properties[name] = *value
+		}
+	}
+
+	return Annotations{Labels: labels, Properties: properties}.normalize()
+}
+
+func (q AnnotationQuery) Validate() error {
+	for _, label := range q.Labels {
+		if err := validateAnnotationName(label); err != nil {
+			return err
+		}
+	}
+	for name := range q.Properties {
+		if err := validateAnnotationName(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q AnnotationQuery) matches(a Annotations) bool {
+	for _, label := range q.Labels {
+		if !a.HasLabel(label) {
+			return false
+		}
+	}
+	for name, value := range q.Properties {
+		if current, ok := a.Properties[name]; !ok || current != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the annotations of the file or folder at path. Entries the user may
+// not read are reported missing.
+func (f *Atlas) Annotations(p Path, user string) (Annotations, error) {
+	if err := p.Validate(); err != nil {
+		return Annotations{}, err
+	}
+	if p.Root() {
+		return Annotations{}, nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	entry, ok := f.curr.Get(p.Key())
+	if !ok || !f.canRead(user, p.Key()) {
+		return Annotations{}, ErrResourceNotFound
+	}
+	return entry.Annotations.normalize(), nil
+}
+
+// Replaces the annotations of the file or folder at path on behalf of user
+func (f *Atlas) Annotate(p Path, annotations Annotations, user string) (Annotations, error) {
+	return f.updateAnnotations(p, user, func(Annotations) Annotations {
+		return annotations.normalize()
+	})
+}
+
+// Applies a patch to the annotations of the file or folder at path on behalf
+// of user
+func (f *Atlas) PatchAnnotations(p Path, patch AnnotationPatch, user string) (Annotations, error) {
+	return f.updateAnnotations(p, user, func(current Annotations) Annotations {
+		return current.apply(patch)
+	})
+}
+
+// Updates the annotations of the file or folder at path, which user must be
+// allowed to change. Annotating changes neither the modification time nor
+// the version of an entry, its content stays the same.
+func (f *Atlas) updateAnnotations(p Path, user string, update func(Annotations) Annotations) (Annotations, error) {
+	if err := p.Validate(); err != nil {
+		return Annotations{}, err
+	}
+	if p.Root() {
+		return Annotations{}, ErrUploadToRoot
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := p.Key()
+	entry, ok := f.curr.Get(key)
+	if !ok || !f.canRead(user, key) {
+		return Annotations{}, ErrResourceNotFound
+	}
+	if !f.canWrite(user, key) {
+		return Annotations{}, ErrPermissionDenied
+	}
+
+	annotations := update(entry.Annotations)
+	if err := annotations.Validate(); err != nil {
+		return Annotations{}, err
+	}
+	entry.Annotations = annotations
+	f.curr.Put(key, entry)
+
+	if err := f.saveCurr(); err != nil {
+		return Annotations{}, err
+	}
+	f.emit(Event{Type: EventAnnotated, Path: key, EntryType: entry.Type, Author: user})
+	return annotations, nil
+}
+
+// Lists the files and folders below path matching the query, sorted by path.
+// Entries the user may not read are left out, folders are listed with the
+// total size of the files they contain.
+func (f *Atlas) Query(p Path, query AnnotationQuery, user string) (*Listing, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	if err := query.Validate(); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	key := p.Key()
+	folder, ok := f.curr.Get(key)
+	if !ok || !f.canRead(user, key) {
+		f.mu.Unlock()
+		return nil, ErrResourceNotFound
+	}
+	if !folder.IsDir() {
+		f.mu.Unlock()
+		return nil, ErrIsFile
+	}
+	subtree := f.curr.Subtree(key)
+	matched := map[string]Entry{}
+	described := map[string]Metadata{}
+	for k, entry := range subtree {
+		if k == key || !query.matches(entry.Annotations) || !f.canRead(user, k) {
+			continue
+		}
+		matched[k] = entry
+		if meta, ok := f.metadata[entry.Object]; ok && !entry.IsDir() {
+			described[entry.Object] = meta
+		}
+	}
+	f.mu.Unlock()
+
+	entries := make([]ListEntry, 0, len(matched))
+	for k, entry := range matched {
+		listEntry := newListEntry(k, entry)
+		if meta, ok := described[entry.Object]; ok && !entry.IsDir() {
+			listEntry.ContentType = meta.ContentType
+			listEntry.Metadata = &meta
+		}
+		if entry.IsDir() {
+			for file, fileEntry := range subtree {
+				if !fileEntry.IsDir() && isWithin(file, k) {
+					listEntry.Size += fileEntry.Size
+				}
+			}
+		}
+		entries = append(entries, listEntry)
+	}
+	slices.SortFunc(entries, func(a, b ListEntry) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+
+	return &Listing{Path: key, Total: len(entries), Entries: entries}, nil
+}
@@ -0,0 +1,243 @@
+package atlas_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mnemosynefs/mnemo/internal/atlas"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func annotate(t *testing.T, files *atlas.Atlas, path string, properties map[string]string, labels ...string) {
+	t.Helper()
+	_, err := files.Annotate(atlas.NewPath(path), atlas.Annotations{Labels: labels, Properties: properties}, "tester")
+	require.NoError(t, err)
+}
+
+func annotations(t *testing.T, files *atlas.Atlas, path string) atlas.Annotations {
+	t.Helper()
+	annotations, err := files.Annotations(atlas.NewPath(path), "tester")
+	require.NoError(t, err)
+	return annotations
+}
+
+func TestAnnotate(t *testing.T) {
+	files := newTestAtlas(t)
+	writeFile(t, files, "docs/a.pdf", "a")
+
+	annotate(t, files, "docs/a.pdf", map[string]string{"year": "2025"}, "invoice", "paid", "invoice")
+	assert.Equal(t, atlas.Annotations{
+		Labels:     []string{"invoice", "paid"},
+		Properties: map[string]string{"year": "2025"},
+	}, annotations(t, files, "docs/a.pdf"))
+
+	// Annotating leaves the content and its version alone
+	versions, err := files.Versions(atlas.NewPath("docs/a.pdf"), "tester")
+	require.NoError(t, err)
+	assert.Len(t, versions, 1)
+
+	client := "ACME"
+	updated, err := files.PatchAnnotations(atlas.NewPath("docs/a.pdf"), atlas.AnnotationPatch{
+		Labels:       []string{"archived"},
+		RemoveLabels: []string{"paid"},
+		Properties:   map[string]*string{"client": &client, "year": nil},
+	}, "tester")
+	require.NoError(t, err)
+	assert.Equal(t, atlas.Annotations{
+		Labels:     []string{"archived", "invoice"},
+		Properties: map[string]string{"client": "ACME"},
+	}, updated)
+
+	annotate(t, files, "docs", nil, "finance")
+	assert.Equal(t, []string{"finance"}, annotations(t, files, "docs").Labels)
+
+	for _, invalid := range []atlas.Annotations{
+		{Labels: []string{"two words"}},
+		{Labels: []string{""}},
+		{Properties: map[string]string{"a/b": "x"}},
+		{Properties: map[string]string{"note": strings.Repeat("x", atlas.MaxPropertyValue+1)}},
+	} {
+		_, err := files.Annotate(atlas.NewPath("docs/a.pdf"), invalid, "tester")
+		assert.ErrorIs(t, err, atlas.ErrInvalidAnnotation)
+	}
+	_, err = files.Annotate(atlas.NewPath("missing"), atlas.Annotations{Labels: []string{"x"}}, "tester")
+	assert.ErrorIs(t, err, atlas.ErrResourceNotFound)
+
+	// Files the user may not read have no annotations to show
+	files.SetReadPermission(func(username string, key string) bool { return username == "tester" })
+	_, err = files.Annotations(atlas.NewPath("docs/a.pdf"), "guest")
+	assert.ErrorIs(t, err, atlas.ErrResourceNotFound)
+	_, err = files.Annotate(atlas.NewPath("docs/a.pdf"), atlas.Annotations{}, "guest")
+	assert.ErrorIs(t, err, atlas.ErrResourceNotFound)
+}
+
+func TestAnnotate_WritePermission(t *testing.T) {
+	files := newTestAtlas(t)
+	writeFile(t, files, "docs/a.pdf", "a")
+	annotate(t, files, "docs/a.pdf", nil, "invoice")
+	files.SetWritePermission(func(username string, key string) bool { return username == "tester" })
+	sub, err := files.Subscribe(atlas.NewPath(""), "tester", 0, false)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	// Users who may only read see annotations but cannot change them
+	_, err = files.Annotate(atlas.NewPath("docs/a.pdf"), atlas.Annotations{}, "guest")
+	assert.ErrorIs(t, err, atlas.ErrPermissionDenied)
+	_, err = files.PatchAnnotations(atlas.NewPath("docs/a.pdf"), atlas.AnnotationPatch{RemoveLabels: []string{"invoice"}}, "guest")
+	assert.ErrorIs(t, err, atlas.ErrPermissionDenied)
+	assert.Equal(t, []string{"invoice"}, annotations(t, files, "docs/a.pdf").Labels)
+
+	_, err = files.PatchAnnotations(atlas.NewPath("docs/a.pdf"), atlas.AnnotationPatch{Labels: []string{"paid"}}, "tester")
+	require.NoError(t, err)
+	events := drain(sub)
+	require.Len(t, events, 1)
+	assert.Equal(t, atlas.EventAnnotated, events[0].Type)
+	assert.Equal(t, "tester", events[0].Author)
+}
+
+func TestAnnotations_Persist(t *testing.T) {
+	backend := atlas.NewMemoryBackend()
+	files, err := atlas.NewAtlasWithBackend(backend)
+	require.NoError(t, err)
+	writeFile(t, files, "a.txt", "a")
+	annotate(t, files, "a.txt", map[string]string{"year": "2025"}, "invoice")
+
+	files, err = atlas.NewAtlasWithBackend(backend)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"invoice"}, annotations(t, files, "a.txt").Labels)
+}
+
+func TestAnnotations_CarriedAlong(t *testing.T) {
+	files := newTestAtlas(t)
+	writeFile(t, files, "docs/a.txt", "one")
+	annotate(t, files, "docs/a.txt", map[string]string{"year": "2025"}, "invoice")
+	annotate(t, files, "docs", nil, "finance")
+
+	// New content keeps the annotations, the old version remembers its own
+	writeFile(t, files, "docs/a.txt", "two")
+	assert.Equal(t, []string{"invoice"}, annotations(t, files, "docs/a.txt").Labels)
+	annotate(t, files, "docs/a.txt", nil, "draft")
+	versions, err := files.Versions(atlas.NewPath("docs/a.txt"), "tester")
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	assert.Equal(t, []string{"draft"}, versions[0].Labels)
+	assert.Equal(t, []string{"invoice"}, versions[1].Labels)
+
+	// Promoting keeps the annotations of the file
+	require.NoError(t, files.PromoteVersion(atlas.NewPath("docs/a.txt"), versions[1].ID, "tester"))
+	assert.Equal(t, "one", readFile(t, files, "docs/a.txt"))
+	assert.Equal(t, []string{"draft"}, annotations(t, files, "docs/a.txt").Labels)
+
+	_, err = files.Copy(atlas.NewPath("docs"), atlas.NewPath("copy"), false, "tester")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"finance"}, annotations(t, files, "copy").Labels)
+	assert.Equal(t, []string{"draft"}, annotations(t, files, "copy/a.txt").Labels)
+
+	_, err = files.Move(atlas.NewPath("copy/a.txt"), atlas.NewPath("moved.txt"), false, "tester")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"draft"}, annotations(t, files, "moved.txt").Labels)
+
+	// Tags and the trash hand annotations back when restoring
+	_, err = files.CreateTag("before", "tester")
+	require.NoError(t, err)
+	annotate(t, files, "docs/a.txt", nil)
+	require.NoError(t, files.Restore("before", atlas.NewPath("docs"), "tester"))
+	assert.Equal(t, []string{"draft"}, annotations(t, files, "docs/a.txt").Labels)
+
+	require.NoError(t, files.Delete(atlas.NewPath("moved.txt"), "tester"))
+	trash := files.Trash("tester")
+	require.Len(t, trash, 1)
+	_, err = files.RestoreTrash("tester", trash[0].ID, atlas.NewPath(""), false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"draft"}, annotations(t, files, "moved.txt").Labels)
+}
+
+func TestQuery(t *testing.T) {
+	files := newTestAtlas(t)
+	writeFile(t, files, "2025/march.pdf", "march")
+	writeFile(t, files, "2025/april.pdf", "april")
+	writeFile(t, files, "2024/december.pdf", "december")
+	writeFile(t, files, "private/secret.pdf", "secret")
+	annotate(t, files, "2025/march.pdf", map[string]string{"year": "2025"}, "invoice")
+	annotate(t, files, "2025/april.pdf", map[string]string{"year": "2025"}, "receipt")
+	annotate(t, files, "2024/december.pdf", map[string]string{"year": "2024"}, "invoice")
+	annotate(t, files, "private/secret.pdf", map[string]string{"year": "2025"}, "invoice")
+	annotate(t, files, "2025", map[string]string{"year": "2025"})
+
+	query := func(path string, query atlas.AnnotationQuery, user string) []string {
+		t.Helper()
+		listing, err := files.Query(atlas.NewPath(path), query, user)
+		require.NoError(t, err)
+		return listPaths(listing)
+	}
+
+	invoices2025 := atlas.AnnotationQuery{Labels: []string{"invoice"}, Properties: map[string]string{"year": "2025"}}
+	assert.Equal(t, []string{"2025/march.pdf", "private/secret.pdf"}, query("", invoices2025, "tester"))
+	assert.Equal(t, []string{"2025/march.pdf"}, query("2025", invoices2025, "tester"))
+	assert.Equal(t, []string{"2024/december.pdf", "2025/march.pdf", "private/secret.pdf"},
+		query("", atlas.AnnotationQuery{Labels: []string{"invoice"}}, "tester"))
+
+	listing, err := files.Query(atlas.NewPath(""), atlas.AnnotationQuery{Properties: map[string]string{"year": "2025"}}, "tester")
+	require.NoError(t, err)
+	require.Equal(t, []string{"2025", "2025/april.pdf", "2025/march.pdf", "private/secret.pdf"}, listPaths(listing))
+	assert.Equal(t, int64(len("march")+len("april")), listing.Entries[0].Size)
+	assert.Equal(t, []string{"receipt"}, listing.Entries[1].Labels)
+
+	files.SetReadPermission(func(username string, key string) bool {
+		return username == "tester" || !strings.HasPrefix(key, "private")
+	})
+	assert.Equal(t, []string{"2025/march.pdf"}, query("", invoices2025, "guest"))
+
+	_, err = files.Query(atlas.NewPath("2025/march.pdf"), invoices2025, "tester")
+	assert.ErrorIs(t, err, atlas.ErrIsFile)
+	_, err = files.Query(atlas.NewPath(""), atlas.AnnotationQuery{Labels: []string{"not valid"}}, "tester")
+	assert.ErrorIs(t, err, atlas.ErrInvalidAnnotation)
+}
+
+func TestHandlers_Annotations(t *testing.T) {
+	files := newTestAtlas(t)
+	mux := newTestMux(files)
+	mux.HandleFunc("GET /annotations/{path...}", files.AnnotationsHandler)
+	mux.HandleFunc("PUT /annotations/{path...}", files.AnnotateHandler)
+	mux.HandleFunc("PATCH /annotations/{path...}", files.PatchAnnotationsHandler)
+	mux.HandleFunc("GET /query/{path...}", files.QueryHandler)
+	writeFile(t, files, "docs/a.pdf", "a")
+	writeFile(t, files, "docs/b.pdf", "b")
+
+	rec := serve(mux, http.MethodPut, "/annotations/docs/a.pdf", `{"labels":["invoice"],"properties":{"year":"2025"}}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = serve(mux, http.MethodPut, "/annotations/docs/b.pdf", `{"labels":["invoice"],"properties":{"year":"2024"}}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = serve(mux, http.MethodPatch, "/annotations/docs/a.pdf", `{"labels":["paid"],"properties":{"year":null}}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = serve(mux, http.MethodGet, "/annotations/docs/a.pdf", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	got := atlas.Annotations{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	assert.Equal(t, atlas.Annotations{Labels: []string{"invoice", "paid"}}, got)
+
+	rec = serve(mux, http.MethodGet, "/query/docs?label=invoice&property=year=2024", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	listing := atlas.Listing{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &listing))
+	assert.Equal(t, []string{"docs/b.pdf"}, listPaths(&listing))
+	assert.Equal(t, map[string]string{"year": "2024"}, listing.Entries[0].Properties)
+
+	assert.Equal(t, http.StatusBadRequest, serve(mux, http.MethodGet, "/query/docs?property=year", "").Code)
+	assert.Equal(t, http.StatusBadRequest, serve(mux, http.MethodPut, "/annotations/docs/a.pdf", `{"labels":`).Code)
+	assert.Equal(t, http.StatusBadRequest, serve(mux, http.MethodPut, "/annotations/docs/a.pdf", `{"labels":["a b"]}`).Code)
+	assert.Equal(t, http.StatusNotFound, serve(mux, http.MethodGet, "/annotations/missing", "").Code)
+
+	files.SetWritePermission(func(username string, key string) bool { return username == "tester" })
+	req := httptest.NewRequest(http.MethodPatch, "/annotations/docs/a.pdf", strings.NewReader(`{"labels":["x"]}`))
+	req.Header.Set("username", "guest")
+	assert.Equal(t, http.StatusForbidden, serveRequest(mux, req).Code)
+	req = httptest.NewRequest(http.MethodPut, "/annotations/docs/a.pdf", strings.NewReader(`{"labels":["x"]}`))
+	req.Header.Set("username", "tester")
+	assert.Equal(t, http.StatusOK, serveRequest(mux, req).Code)
+}
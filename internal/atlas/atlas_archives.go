@@ -0,0 +1,234 @@
+package atlas
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/charmbracelet/log"
+)
+
+// Archives bundle a folder, a selection of paths or a tag into a single zip
+// or tar.gz stream. The entries are chosen up front, the content of each file
+// is only opened once the archive reaches it, so neither memory nor disk
+// holds more than the file being written.
+
+var ErrInvalidArchive = errors.New("archive request is not valid")
+
+const (
+	ArchiveZip   = "zip"
+	ArchiveTarGz = "tar.gz"
+)
+
+// Selects what goes into an archive
+type ArchiveSelection struct {
+	// Files and folders to include, the whole tree if empty. Each lands in the
+	// archive under its base name.
+	Paths []Path
+	// Reads the selection from this tag instead of the working tree
+	Tag string
+	// Name of the user downloading the archive, whose read permission
+	// decides which entries are included
+	User string
+}
+
+type archiveEntry struct {
+	name  string
+	key   string
+	entry Entry
+}
+
+// Archive is the list of entries of a download, ready to be written
+type Archive struct {
+	f       *Atlas
+	Name    string
+	entries []archiveEntry
+}
+
+func ValidateArchiveFormat(format string) error {
+	if format != ArchiveZip && format != ArchiveTarGz {
+		return ErrInvalidArchive
+	}
+	return nil
+}
+
+// Gathers the entries of an archive. Missing paths fail the whole request,
+// entries the user may not read are skipped.
+func (f *Atlas) Archive(sel ArchiveSelection) (*Archive, error) {
+	paths := sel.Paths
+	if len(paths) == 0 {
+		paths = []Path{NewPath("")}
+	}
+	for _, p := range paths {
+		if err := p.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	manifest := f.curr
+	if sel.Tag != "" {
+		t, err := f.loadTag(sel.Tag)
+		if err != nil {
+			return nil, err
+		}
+		manifest = &t.Manifest
+	}
+
+	archive := &Archive{f: f, Name: "atlas"}
+	if sel.Tag != "" {
+		archive.Name = sel.Tag
+	}
+	if len(paths) == 1 && !paths[0].Root() {
+		archive.Name = path.Base(paths[0].Key())
+	}
+
+	names := map[string]bool{}
+	for _, p := range paths {
+		key := p.Key()
+		if _, ok := manifest.Get(key); !ok {
+			return nil, ErrResourceNotFound
+		}
+
+		// Entries are named relative to the parent of the selected path
+		base := parentKey(key)
+		for k, entry := range manifest.Subtree(key) {
+			if !f.canRead(sel.User, k) {
+				continue
+			}
+
+			name := k
+			if base != "" {
+				name = strings.TrimPrefix(k, base+"/")
+			}
+			if names[name] {
+				return nil, ErrInvalidArchive
+			}
+			names[name] = true
+			archive.entries = append(archive.entries, archiveEntry{name: name, key: k, entry: entry})
+		}
+	}
+
+	// Folders sort ahead of their content
+	slices.SortFunc(archive.entries, func(a, b archiveEntry) int {
+		return strings.Compare(a.name, b.name)
+	})
+
+	return archive, nil
+}
+
+// Number of files and folders in the archive
+func (a *Archive) Len() int {
+	return len(a.entries)
+}
+
+// Opens the content of an entry. The lock keeps garbage collection from
+// removing the object while it is opened.
+func (a *Archive) open(e archiveEntry) (io.ReadCloser, error) {
+	a.f.mu.Lock()
+	defer a.f.mu.Unlock()
+
+	return a.f.openObject(e.entry.Object, e.entry.Size)
+}
+
+// Streams the archive to w in the given format. Files whose content vanished
+// since the entries were gathered are skipped, the response has long been
+// under way by the time they are reached.
+func (a *Archive) Write(w io.Writer, format string) error {
+	switch format {
+	case ArchiveZip:
+		return a.writeZip(w)
+	case ArchiveTarGz:
+		return a.writeTarGz(w)
+	default:
+		return ErrInvalidArchive
+	}
+}
+
+func (a *Archive) writeZip(w io.Writer) error {
+	zw := zip.NewWriter(w)
+	for _, e := range a.entries {
+		header := &zip.FileHeader{
+			Name:     e.name,
+			Modified: e.entry.Modified,
+			Method:   zip.Deflate,
+		}
+		if e.entry.IsDir() {
+			header.Name += "/"
+			header.Method = zip.Store
+			header.SetMode(fs.ModeDir | dirPerm)
+			if _, err := zw.CreateHeader(header); err != nil {
+				return err
+			}
+			continue
+		}
+		header.SetMode(filePerm)
+
+		content, err := a.open(e)
+		if err != nil {
+			log.Warnf("Skipped %v in archive: %v", e.key, err)
+			continue
+		}
+
+		dst, err := zw.CreateHeader(header)
+		if err == nil {
+			_, err = io.Copy(dst, content)
+		}
+		content.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func (a *Archive) writeTarGz(w io.Writer) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	for _, e := range a.entries {
+		header := &tar.Header{
+			Name:    e.name,
+			ModTime: e.entry.Modified,
+			Format:  tar.FormatPAX,
+		}
+		if e.entry.IsDir() {
+			header.Name += "/"
+			header.Typeflag = tar.TypeDir
+			header.Mode = dirPerm
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			continue
+		}
+		header.Typeflag = tar.TypeReg
+		header.Mode = filePerm
+		header.Size = e.entry.Size
+
+		content, err := a.open(e)
+		if err != nil {
+			log.Warnf("Skipped %v in archive: %v", e.key, err)
+			continue
+		}
+
+		err = tw.WriteHeader(header)
+		if err == nil {
+			_, err = io.Copy(tw, content)
+		}
+		content.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
@@ -0,0 +1,184 @@
+package atlas_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/mnemosynefs/mnemo/internal/atlas"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Reads a zip archive into a map of entry names to content
+func readZip(t *testing.T, data []byte) map[string]string {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+
+	entries := map[string]string{}
+	for _, file := range zr.File {
+		reader, err := file.Open()
+		require.NoError(t, err)
+		content, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		reader.Close()
+		entries[file.Name] = string(content)
+	}
+	return entries
+}
+
+// Reads a tar.gz archive into a map of entry names to content
+func readTarGz(t *testing.T, data []byte) map[string]string {
+	t.Helper()
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	tr := tar.NewReader(gr)
+
+	entries := map[string]string{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		content, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		entries[header.Name] = string(content)
+	}
+	return entries
+}
+
+// Writes an archive as zip
+func mustZip(t *testing.T, archive *atlas.Archive) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	require.NoError(t, archive.Write(buf, atlas.ArchiveZip))
+	return buf.Bytes()
+}
+
+func newArchiveAtlas(t *testing.T) *atlas.Atlas {
+	t.Helper()
+	files := newTestAtlas(t)
+	writeFile(t, files, "notes.txt", "notes")
+	writeFile(t, files, "docs/readme.md", "hello")
+	writeFile(t, files, "docs/img/logo.png", "png")
+	writeFile(t, files, "docs/private/secret.txt", "secret")
+	return files
+}
+
+func TestArchive(t *testing.T) {
+	files := newArchiveAtlas(t)
+
+	archive, err := files.Archive(atlas.ArchiveSelection{Paths: []atlas.Path{atlas.NewPath("docs")}})
+	require.NoError(t, err)
+	assert.Equal(t, "docs", archive.Name)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, archive.Write(buf, atlas.ArchiveZip))
+	assert.Equal(t, map[string]string{
+		"docs/":                   "",
+		"docs/img/":               "",
+		"docs/img/logo.png":       "png",
+		"docs/private/":           "",
+		"docs/private/secret.txt": "secret",
+		"docs/readme.md":          "hello",
+	}, readZip(t, buf.Bytes()))
+
+	buf.Reset()
+	require.NoError(t, archive.Write(buf, atlas.ArchiveTarGz))
+	assert.Equal(t, readZip(t, mustZip(t, archive)), readTarGz(t, buf.Bytes()))
+
+	assert.ErrorIs(t, archive.Write(io.Discard, "rar"), atlas.ErrInvalidArchive)
+}
+
+func TestArchive_Selection(t *testing.T) {
+	files := newArchiveAtlas(t)
+
+	archive, err := files.Archive(atlas.ArchiveSelection{
+		Paths: []atlas.Path{atlas.NewPath("notes.txt"), atlas.NewPath("docs/img")},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "atlas", archive.Name)
+	assert.Equal(t, map[string]string{
+		"notes.txt":    "notes",
+		"img/":         "",
+		"img/logo.png": "png",
+	}, readZip(t, mustZip(t, archive)))
+
+	_, err = files.Archive(atlas.ArchiveSelection{Paths: []atlas.Path{atlas.NewPath("missing")}})
+	assert.ErrorIs(t, err, atlas.ErrResourceNotFound)
+
+	// Two selected entries would land on the same name
+	writeFile(t, files, "other/readme.md", "other")
+	_, err = files.Archive(atlas.ArchiveSelection{
+		Paths: []atlas.Path{atlas.NewPath("docs/readme.md"), atlas.NewPath("other/readme.md")},
+	})
+	assert.ErrorIs(t, err, atlas.ErrInvalidArchive)
+}
+
+func TestArchive_TagAndPermissions(t *testing.T) {
+	files := newArchiveAtlas(t)
+	_, err := files.CreateTag("v1", "tester")
+	require.NoError(t, err)
+	writeFile(t, files, "docs/readme.md", "changed")
+	writeFile(t, files, "later.txt", "later")
+
+	files.SetReadPermission(func(username string, key string) bool {
+		return username == "admin" || !strings.HasPrefix(key, "docs/private")
+	})
+
+	archive, err := files.Archive(atlas.ArchiveSelection{Tag: "v1", User: "guest"})
+	require.NoError(t, err)
+	assert.Equal(t, "v1", archive.Name)
+	assert.Equal(t, map[string]string{
+		"notes.txt":         "notes",
+		"docs/":             "",
+		"docs/readme.md":    "hello",
+		"docs/img/":         "",
+		"docs/img/logo.png": "png",
+	}, readZip(t, mustZip(t, archive)))
+
+	archive, err = files.Archive(atlas.ArchiveSelection{Paths: []atlas.Path{atlas.NewPath("docs/private")}, User: "admin"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, archive.Len())
+
+	_, err = files.Archive(atlas.ArchiveSelection{Tag: "missing"})
+	assert.ErrorIs(t, err, atlas.ErrTagNotFound)
+}
+
+func TestHandlers_Archive(t *testing.T) {
+	files := newArchiveAtlas(t)
+	mux := newTestMux(files)
+	mux.HandleFunc("GET /archive/{path...}", files.ArchiveHandler)
+
+	rec := serve(mux, http.MethodGet, "/archive/docs", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/zip", rec.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename=docs.zip`, rec.Header().Get("Content-Disposition"))
+	assert.Len(t, readZip(t, rec.Body.Bytes()), 6)
+
+	rec = serve(mux, http.MethodGet, "/archive/docs?format=tar.gz&select=readme.md&select=img", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/gzip", rec.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename=docs.tar.gz`, rec.Header().Get("Content-Disposition"))
+	assert.Equal(t, map[string]string{
+		"readme.md":    "hello",
+		"img/":         "",
+		"img/logo.png": "png",
+	}, readTarGz(t, rec.Body.Bytes()))
+
+	rec = serve(mux, http.MethodGet, "/archive/", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `attachment; filename=atlas.zip`, rec.Header().Get("Content-Disposition"))
+	assert.Len(t, readZip(t, rec.Body.Bytes()), 7)
+
+	assert.Equal(t, http.StatusBadRequest, serve(mux, http.MethodGet, "/archive/docs?format=rar", "").Code)
+	assert.Equal(t, http.StatusNotFound, serve(mux, http.MethodGet, "/archive/missing", "").Code)
+	assert.Equal(t, http.StatusNotFound, serve(mux, http.MethodGet, "/archive/?tag=missing", "").Code)
+}
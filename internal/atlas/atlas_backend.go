@@ -0,0 +1,290 @@
+package atlas
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Backend stores the files of an atlas: objects, manifests, tags and upload
+// sessions. Names are slash separated and relative to the store. Missing files
+// are reported with errors wrapping fs.ErrNotExist.
+type Backend interface {
+	Open(name string) (io.ReadSeekCloser, error)
+	// Starts writing a file. The content only appears once committed,
+	// replacing any file of the same name.
+	Create(name string) (BackendWriter, error)
+	Stat(name string) (BackendInfo, error)
+	// Lists every file whose name starts with prefix, ordered by name
+	List(prefix string) ([]BackendInfo, error)
+	Remove(name string) error
+	// Renames a file, replacing any file at to
+	Rename(from string, to string) error
+}
+
+type BackendWriter interface {
+	io.Writer
+	// Publishes the content under the name given to Create
+	Commit() error
+	// Drops the content. Does nothing after Commit.
+	Abort()
+}
+
+type BackendInfo struct {
+	Name     string
+	Size     int64
+	Modified time.Time
+}
+
+// Opens the atlas at location, which is either a local directory,
+// s3://<bucket>/<prefix> for a bucket configured by the usual AWS environment
+// variables, or memory: for a store that lives as long as the process
+func OpenAtlas(location string) (*Atlas, error) {
+	var backend Backend
+	var err error
+	switch {
+	case location == "memory:":
+		backend = NewMemoryBackend()
+	case strings.HasPrefix(location, "s3://"):
+		bucket, prefix, _ := strings.Cut(strings.TrimPrefix(location, "s3://"), "/")
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		backend, err = NewS3Backend(S3ConfigFromEnv(bucket, prefix))
+	default:
+		return NewAtlas(location)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return NewAtlasWithBackend(backend)
+}
+
+// Directory of the local backend holding files being written
+const localStaging = ".staging"
+
+// localBackend keeps files in a directory on the local disk. Writes are
+// fsynced and renamed into place so a crash never leaves half a file behind.
+// Every access is resolved by the kernel relative to a handle on the
+// directory, so neither a symbolic link nor a concurrent rename can lead it
+// outside the store.
+type localBackend struct {
+	root *os.Root
+}
+
+// Returns a backend keeping files below dir
+func NewLocalBackend(dir string) (Backend, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Files being written when the process stopped are of no use anymore
+	if err := root.RemoveAll(localStaging); err != nil {
+		root.Close()
+		return nil, err
+	}
+	if err := root.Mkdir(localStaging, dirPerm); err != nil {
+		root.Close()
+		return nil, err
+	}
+
+	return &localBackend{root: root}, nil
+}
+
+// Converts a backend name into a path below the root, rejecting names that
+// are not local to it
+func (b *localBackend) path(op string, name string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		return "", &fs.PathError{Op: op, Path: name, Err: ErrInvalidPath}
+	}
+	return filepath.FromSlash(name), nil
+}
+
+func (b *localBackend) Open(name string) (io.ReadSeekCloser, error) {
+	p, err := b.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := b.root.Open(p)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only regular files are part of the store
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		file.Close()
+		return nil, notExist("open", name)
+	}
+	return file, nil
+}
+
+type localWriter struct {
+	backend *localBackend
+	file    *os.File
+	staged  string
+	name    string
+	done    bool
+}
+
+func (b *localBackend) Create(name string) (BackendWriter, error) {
+	if _, err := b.path("create", name); err != nil {
+		return nil, err
+	}
+
+	staged := filepath.Join(localStaging, "file-"+uuid.NewString())
+	file, err := b.root.OpenFile(staged, os.O_WRONLY|os.O_CREATE|os.O_EXCL, filePerm)
+	if err != nil {
+		return nil, err
+	}
+	return &localWriter{backend: b, file: file, staged: staged, name: name}, nil
+}
+
+func (w *localWriter) Write(p []byte) (int, error) {
+	return w.file.Write(p)
+}
+
+func (w *localWriter) Commit() error {
+	if w.done {
+		return os.ErrClosed
+	}
+	w.done = true
+	defer w.backend.root.Remove(w.staged)
+
+	err := w.file.Sync()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return w.backend.move(w.staged, filepath.FromSlash(w.name))
+}
+
+func (w *localWriter) Abort() {
+	if w.done {
+		return
+	}
+	w.done = true
+	w.file.Close()
+	w.backend.root.Remove(w.staged)
+}
+
+func (b *localBackend) Stat(name string) (BackendInfo, error) {
+	p, err := b.path("stat", name)
+	if err != nil {
+		return BackendInfo{}, err
+	}
+	info, err := b.root.Lstat(p)
+	if err != nil {
+		return BackendInfo{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return BackendInfo{}, notExist("stat", name)
+	}
+
+	return BackendInfo{Name: name, Size: info.Size(), Modified: info.ModTime().UTC()}, nil
+}
+
+func (b *localBackend) List(prefix string) ([]BackendInfo, error) {
+	// Only the directory holding the prefix needs walking
+	dir := path.Clean(prefix)
+	if !strings.HasSuffix(prefix, "/") {
+		dir = path.Dir(dir)
+	}
+	if dir != "." && !fs.ValidPath(dir) {
+		return nil, &fs.PathError{Op: "list", Path: prefix, Err: ErrInvalidPath}
+	}
+
+	infos := []BackendInfo{}
+	err := fs.WalkDir(b.root.FS(), dir, func(name string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			if name == localStaging {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		// Symbolic links are never followed, whether they stay in the store
+		// or not
+		if !d.Type().IsRegular() || !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		infos = append(infos, BackendInfo{Name: name, Size: info.Size(), Modified: info.ModTime().UTC()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Walking orders a folder before names sorting between it and its content
+	slices.SortFunc(infos, func(a, b BackendInfo) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return infos, nil
+}
+
+func (b *localBackend) Remove(name string) error {
+	p, err := b.path("remove", name)
+	if err != nil {
+		return err
+	}
+	return b.root.Remove(p)
+}
+
+func (b *localBackend) Rename(from string, to string) error {
+	src, err := b.path("rename", from)
+	if err != nil {
+		return err
+	}
+	dst, err := b.path("rename", to)
+	if err != nil {
+		return err
+	}
+	return b.move(src, dst)
+}
+
+func (b *localBackend) move(from string, to string) error {
+	if err := b.root.MkdirAll(filepath.Dir(to), dirPerm); err != nil {
+		return err
+	}
+	if err := b.root.Rename(from, to); err != nil {
+		return err
+	}
+	return syncDir(b.root, filepath.Dir(to))
+}
+
+// Flushes a directory so renames into it survive a crash
+func syncDir(root *os.Root, dir string) error {
+	d, err := root.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,139 @@
+package atlas
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryBackend keeps files in memory. Everything is lost with the process,
+// which makes it a fit for tests and throwaway servers.
+type memoryBackend struct {
+	mu    sync.Mutex
+	files map[string]memoryFile
+}
+
+type memoryFile struct {
+	content  []byte
+	modified time.Time
+}
+
+func NewMemoryBackend() Backend {
+	return &memoryBackend{files: map[string]memoryFile{}}
+}
+
+func notExist(op string, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (memoryReader) Close() error {
+	return nil
+}
+
+func (b *memoryBackend) Open(name string) (io.ReadSeekCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	file, ok := b.files[name]
+	if !ok {
+		return nil, notExist("open", name)
+	}
+	// Content is never modified in place, so readers can share it
+	return memoryReader{bytes.NewReader(file.content)}, nil
+}
+
+type memoryWriter struct {
+	backend *memoryBackend
+	name    string
+	buf     bytes.Buffer
+	done    bool
+}
+
+func (b *memoryBackend) Create(name string) (BackendWriter, error) {
+	return &memoryWriter{backend: b, name: name}, nil
+}
+
+func (w *memoryWriter) Write(p []byte) (int, error) {
+	if w.done {
+		return 0, os.ErrClosed
+	}
+	return w.buf.Write(p)
+}
+
+func (w *memoryWriter) Commit() error {
+	if w.done {
+		return os.ErrClosed
+	}
+	w.done = true
+
+	w.backend.mu.Lock()
+	defer w.backend.mu.Unlock()
+
+	w.backend.files[w.name] = memoryFile{content: w.buf.Bytes(), modified: time.Now().UTC()}
+	return nil
+}
+
+func (w *memoryWriter) Abort() {
+	w.done = true
+}
+
+func (b *memoryBackend) Stat(name string) (BackendInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	file, ok := b.files[name]
+	if !ok {
+		return BackendInfo{}, notExist("stat", name)
+	}
+	return BackendInfo{Name: name, Size: int64(len(file.content)), Modified: file.modified}, nil
+}
+
+func (b *memoryBackend) List(prefix string) ([]BackendInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	infos := []BackendInfo{}
+	for name, file := range b.files {
+		if strings.HasPrefix(name, prefix) {
+			infos = append(infos, BackendInfo{Name: name, Size: int64(len(file.content)), Modified: file.modified})
+		}
+	}
+	slices.SortFunc(infos, func(a, b BackendInfo) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return infos, nil
+}
+
+func (b *memoryBackend) Remove(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.files[name]; !ok {
+		return notExist("remove", name)
+	}
+	delete(b.files, name)
+	return nil
+}
+
+func (b *memoryBackend) Rename(from string, to string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	file, ok := b.files[from]
+	if !ok {
+		return notExist("rename", from)
+	}
+	delete(b.files, from)
+	b.files[to] = file
+	return nil
+}
@@ -0,0 +1,413 @@
+package atlas
+
+import (
+	"cmp"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// s3Backend keeps files as objects in a bucket of an S3 compatible service,
+// addressed path style and signed with AWS Signature Version 4. Renames are
+// copies followed by deletes, so they are not atomic and limited to the
+// largest object a single copy supports.
+type s3Backend struct {
+	config S3Config
+	client *http.Client
+}
+
+type S3Config struct {
+	// Base URL of the service, e.g. https://s3.eu-central-1.amazonaws.com
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prepended to every name, so several atlases can share a bucket
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// Only needed with temporary credentials
+	SessionToken string
+	// Defaults to http.DefaultClient
+	Client *http.Client
+}
+
+// Hash of an empty payload, sent with every request without a body
+const emptyPayload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// Configures an S3 backend from the environment variables the AWS tools use,
+// storing files in bucket below prefix
+func S3ConfigFromEnv(bucket string, prefix string) S3Config {
+	region := cmp.Or(os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1")
+	return S3Config{
+		Endpoint:     cmp.Or(os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL"), "https://s3."+region+".amazonaws.com"),
+		Region:       region,
+		Bucket:       bucket,
+		Prefix:       prefix,
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+}
+
+func NewS3Backend(config S3Config) (Backend, error) {
+	if _, err := url.Parse(config.Endpoint); err != nil || config.Endpoint == "" || config.Bucket == "" {
+		return nil, fmt.Errorf("s3: endpoint and bucket are required")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	config.Endpoint = strings.TrimSuffix(config.Endpoint, "/")
+
+	client := config.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &s3Backend{config: config, client: client}, nil
+}
+
+// Escapes s the way Signature Version 4 expects, keeping slashes if asked to
+func s3Escape(s string, slash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', slash && c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Sends a request for the object key, or for the bucket when key is empty.
+// Responses other than 2xx are turned into errors, 404 into fs.ErrNotExist.
+func (b *s3Backend) do(method string, key string, query url.Values, header http.Header, body io.Reader, length int64, payload string) (*http.Response, error) {
+	uri := "/" + s3Escape(b.config.Bucket, false)
+	if key != "" {
+		uri += "/" + s3Escape(b.config.Prefix+key, true)
+	}
+
+	var params []string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, s3Escape(name, false)+"="+s3Escape(value, false))
+		}
+	}
+	slices.Sort(params)
+	rawQuery := strings.Join(params, "&")
+
+	target := b.config.Endpoint + uri
+	if rawQuery != "" {
+		target += "?" + rawQuery
+	}
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.ContentLength = length
+	}
+
+	now := time.Now().UTC()
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	if b.config.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", b.config.SessionToken)
+	}
+
+	// Every x-amz header is signed together with the host
+	signed := []string{"host"}
+	canonical := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") {
+			signed = append(signed, lower)
+			canonical[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	slices.Sort(signed)
+	var headers strings.Builder
+	for _, name := range signed {
+		headers.WriteString(name + ":" + canonical[name] + "\n")
+	}
+	signedHeaders := strings.Join(signed, ";")
+
+	request := strings.Join([]string{method, uri, rawQuery, headers.String(), signedHeaders, payload}, "\n")
+	sum := sha256.Sum256([]byte(request))
+	scope := date + "/" + b.config.Region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+b.config.SecretKey), date)
+	signingKey = hmacSHA256(signingKey, b.config.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		b.config.AccessKey, scope, signedHeaders, signature))
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("s3: %s %s: %w", method, uri, os.ErrNotExist)
+	}
+	return nil, s3Error(method, uri, resp)
+}
+
+type s3ErrorBody struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func s3Error(method string, uri string, resp *http.Response) error {
+	body := s3ErrorBody{}
+	content, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if xml.Unmarshal(content, &body) != nil || body.Code == "" {
+		return fmt.Errorf("s3: %s %s: %s", method, uri, resp.Status)
+	}
+	return fmt.Errorf("s3: %s %s: %s: %s", method, uri, body.Code, body.Message)
+}
+
+// s3Reader reads an object with ranged requests, starting a new one whenever
+// a seek moves away from where the current response is
+type s3Reader struct {
+	backend *s3Backend
+	key     string
+	size    int64
+	offset  int64
+	body    io.ReadCloser
+	// Offset the body continues at
+	position int64
+}
+
+func (b *s3Backend) Open(name string) (io.ReadSeekCloser, error) {
+	info, err := b.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Reader{backend: b, key: name, size: info.Size}, nil
+}
+
+func (r *s3Reader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+
+	if r.body != nil && r.position != r.offset {
+		r.body.Close()
+		r.body = nil
+	}
+	if r.body == nil {
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-", r.offset)}}
+		resp, err := r.backend.do(http.MethodGet, r.key, nil, header, nil, 0, emptyPayload)
+		if err != nil {
+			return 0, err
+		}
+		r.body = resp.Body
+		r.position = r.offset
+	}
+
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	r.position = r.offset
+	if errors.Is(err, io.EOF) && r.offset < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *s3Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("s3: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("s3: negative position")
+	}
+
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *s3Reader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	return r.body.Close()
+}
+
+// s3Writer buffers content in a local temporary file, since uploads need to
+// know their length and hash before they start
+type s3Writer struct {
+	backend *s3Backend
+	name    string
+	file    *os.File
+	hash    hash.Hash
+	size    int64
+	done    bool
+}
+
+func (b *s3Backend) Create(name string) (BackendWriter, error) {
+	file, err := os.CreateTemp("", "mnemo-s3-")
+	if err != nil {
+		return nil, err
+	}
+	return &s3Writer{backend: b, name: name, file: file, hash: sha256.New()}, nil
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.hash.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *s3Writer) Commit() error {
+	if w.done {
+		return os.ErrClosed
+	}
+	w.done = true
+	defer os.Remove(w.file.Name())
+	defer w.file.Close()
+
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	resp, err := w.backend.do(http.MethodPut, w.name, nil, nil, w.file, w.size, hex.EncodeToString(w.hash.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (w *s3Writer) Abort() {
+	if w.done {
+		return
+	}
+	w.done = true
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+func (b *s3Backend) Stat(name string) (BackendInfo, error) {
+	resp, err := b.do(http.MethodHead, name, nil, nil, nil, 0, emptyPayload)
+	if err != nil {
+		return BackendInfo{}, err
+	}
+	resp.Body.Close()
+
+	modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return BackendInfo{Name: name, Size: resp.ContentLength, Modified: modified.UTC()}, nil
+}
+
+type s3Listing struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (b *s3Backend) List(prefix string) ([]BackendInfo, error) {
+	infos := []BackendInfo{}
+	query := url.Values{"list-type": {"2"}, "prefix": {b.config.Prefix + prefix}}
+	for {
+		resp, err := b.do(http.MethodGet, "", query, nil, nil, 0, emptyPayload)
+		if err != nil {
+			return nil, err
+		}
+		listing := s3Listing{}
+		err = xml.NewDecoder(resp.Body).Decode(&listing)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3: listing %s: %w", prefix, err)
+		}
+
+		for _, object := range listing.Contents {
+			infos = append(infos, BackendInfo{
+				Name:     strings.TrimPrefix(object.Key, b.config.Prefix),
+				Size:     object.Size,
+				Modified: object.LastModified.UTC(),
+			})
+		}
+		if !listing.IsTruncated {
+			return infos, nil
+		}
+		query.Set("continuation-token", listing.NextContinuationToken)
+	}
+}
+
+func (b *s3Backend) Remove(name string) error {
+	// Deleting is idempotent in S3, so a missing file is only noticed by
+	// asking first
+	if _, err := b.Stat(name); err != nil {
+		return err
+	}
+
+	resp, err := b.do(http.MethodDelete, name, nil, nil, nil, 0, emptyPayload)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (b *s3Backend) Rename(from string, to string) error {
+	source := "/" + s3Escape(b.config.Bucket, false) + "/" + s3Escape(b.config.Prefix+from, true)
+	header := http.Header{"X-Amz-Copy-Source": {source}}
+	resp, err := b.do(http.MethodPut, to, nil, header, nil, 0, emptyPayload)
+	if err != nil {
+		return err
+	}
+
+	// A copy can fail after it was answered with 200, the error then being
+	// the body
+	content, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if body := (s3ErrorBody{}); xml.Unmarshal(content, &body) == nil && body.Code != "" {
+		return fmt.Errorf("s3: copying %s: %s: %s", from, body.Code, body.Message)
+	}
+
+	resp, err = b.do(http.MethodDelete, from, nil, nil, nil, 0, emptyPayload)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
@@ -0,0 +1,457 @@
+package atlas_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mnemosynefs/mnemo/internal/atlas"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeS3 stands in for an S3 compatible service, implementing the requests
+// the backend sends against a single bucket held in memory
+type fakeS3 struct {
+	t       *testing.T
+	mu      sync.Mutex
+	bucket  string
+	objects map[string][]byte
+	// Keys listed per page, small to exercise continuation
+	pageSize int
+}
+
+func newFakeS3(t *testing.T) atlas.S3Config {
+	fake := &fakeS3{t: t, bucket: "mnemo", objects: map[string][]byte{}, pageSize: 2}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	return atlas.S3Config{
+		Endpoint:  server.URL,
+		Region:    "eu-central-1",
+		Bucket:    "mnemo",
+		Prefix:    "store/",
+		AccessKey: "access",
+		SecretKey: "secret",
+	}
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=access/") ||
+		!strings.Contains(auth, "/eu-central-1/s3/aws4_request") || r.Header.Get("X-Amz-Date") == "" {
+		s.error(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != s.bucket {
+		s.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		s.list(w, r)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		source, err := url.PathUnescape(strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), "/"+s.bucket+"/"))
+		require.NoError(s.t, err)
+		content, ok := s.objects[source]
+		if !ok {
+			s.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		s.objects[key] = content
+		fmt.Fprint(w, "<CopyObjectResult><ETag>\"x\"</ETag></CopyObjectResult>")
+	case r.Method == http.MethodPut:
+		content, err := io.ReadAll(r.Body)
+		require.NoError(s.t, err)
+		sum := sha256.Sum256(content)
+		if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+			s.error(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch")
+			return
+		}
+		s.objects[key] = content
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		content, ok := s.objects[key]
+		if !ok {
+			s.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		if start, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes="); ok {
+			offset, err := strconv.Atoi(strings.TrimSuffix(start, "-"))
+			require.NoError(s.t, err)
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)-offset))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(content[offset:])
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		if r.Method == http.MethodGet {
+			w.Write(content)
+		}
+	default:
+		s.error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (s *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	type object struct {
+		Key          string
+		Size         int
+		LastModified time.Time
+	}
+	type result struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []object
+		IsTruncated           bool
+		NextContinuationToken string
+	}
+
+	prefix := r.URL.Query().Get("prefix")
+	keys := []string{}
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) && key > r.URL.Query().Get("continuation-token") {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	res := result{}
+	if len(keys) > s.pageSize {
+		keys = keys[:s.pageSize]
+		res.IsTruncated = true
+		res.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, key := range keys {
+		res.Contents = append(res.Contents, object{Key: key, Size: len(s.objects[key]), LastModified: time.Now().UTC()})
+	}
+	xml.NewEncoder(w).Encode(res)
+}
+
+func (s *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func backends(t *testing.T) map[string]func() atlas.Backend {
+	return map[string]func() atlas.Backend{
+		"local": func() atlas.Backend {
+			backend, err := atlas.NewLocalBackend(t.TempDir())
+			require.NoError(t, err)
+			return backend
+		},
+		"memory": atlas.NewMemoryBackend,
+		"s3": func() atlas.Backend {
+			config := newFakeS3(t)
+			backend, err := atlas.NewS3Backend(config)
+			require.NoError(t, err)
+			return backend
+		},
+	}
+}
+
+func put(t *testing.T, backend atlas.Backend, name string, content string) {
+	t.Helper()
+	w, err := backend.Create(name)
+	require.NoError(t, err)
+	_, err = io.WriteString(w, content)
+	require.NoError(t, err)
+	require.NoError(t, w.Commit())
+}
+
+func get(t *testing.T, backend atlas.Backend, name string) string {
+	t.Helper()
+	r, err := backend.Open(name)
+	require.NoError(t, err)
+	defer r.Close()
+	content, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return string(content)
+}
+
+func listNames(t *testing.T, backend atlas.Backend, prefix string) []string {
+	t.Helper()
+	infos, err := backend.List(prefix)
+	require.NoError(t, err)
+	names := []string{}
+	for _, info := range infos {
+		names = append(names, info.Name)
+	}
+	return names
+}
+
+func TestBackends(t *testing.T) {
+	for name, newBackend := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			backend := newBackend()
+
+			w, err := backend.Create("docs/a b.txt")
+			require.NoError(t, err)
+			_, err = io.WriteString(w, "hello")
+			require.NoError(t, err)
+			_, err = backend.Stat("docs/a b.txt")
+			assert.ErrorIs(t, err, fs.ErrNotExist, "visible before commit")
+			require.NoError(t, w.Commit())
+			w.Abort()
+
+			assert.Equal(t, "hello", get(t, backend, "docs/a b.txt"))
+			info, err := backend.Stat("docs/a b.txt")
+			require.NoError(t, err)
+			assert.Equal(t, int64(5), info.Size)
+
+			w, err = backend.Create("docs/aborted.txt")
+			require.NoError(t, err)
+			_, err = io.WriteString(w, "nope")
+			require.NoError(t, err)
+			w.Abort()
+			_, err = backend.Stat("docs/aborted.txt")
+			assert.ErrorIs(t, err, fs.ErrNotExist)
+
+			put(t, backend, "docs/a b.txt", "replaced")
+			put(t, backend, "docs/sub/c.txt", "c")
+			put(t, backend, "docs-other.txt", "other")
+			put(t, backend, "uploads/x.part-01", "1")
+			put(t, backend, "uploads/x.part-00", "0")
+			put(t, backend, "uploads/xy.json", "{}")
+			assert.Equal(t, "replaced", get(t, backend, "docs/a b.txt"))
+
+			assert.Equal(t, []string{"docs/a b.txt", "docs/sub/c.txt"}, listNames(t, backend, "docs/"))
+			assert.Equal(t, []string{"uploads/x.part-00", "uploads/x.part-01"}, listNames(t, backend, "uploads/x.part-"))
+			assert.Empty(t, listNames(t, backend, "missing/"))
+
+			reader, err := backend.Open("docs/a b.txt")
+			require.NoError(t, err)
+			_, err = reader.Seek(2, io.SeekStart)
+			require.NoError(t, err)
+			part := make([]byte, 3)
+			_, err = io.ReadFull(reader, part)
+			require.NoError(t, err)
+			assert.Equal(t, "pla", string(part))
+			end, err := reader.Seek(-2, io.SeekEnd)
+			require.NoError(t, err)
+			assert.Equal(t, int64(6), end)
+			rest, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			assert.Equal(t, "ed", string(rest))
+			require.NoError(t, reader.Close())
+
+			require.NoError(t, backend.Rename("docs/sub/c.txt", "moved/c.txt"))
+			assert.Equal(t, "c", get(t, backend, "moved/c.txt"))
+			_, err = backend.Stat("docs/sub/c.txt")
+			assert.ErrorIs(t, err, fs.ErrNotExist)
+			require.NoError(t, backend.Rename("moved/c.txt", "docs-other.txt"))
+			assert.Equal(t, "c", get(t, backend, "docs-other.txt"))
+
+			require.NoError(t, backend.Remove("docs-other.txt"))
+			assert.ErrorIs(t, backend.Remove("docs-other.txt"), fs.ErrNotExist)
+			assert.ErrorIs(t, backend.Rename("docs-other.txt", "x"), fs.ErrNotExist)
+			_, err = backend.Open("docs-other.txt")
+			assert.ErrorIs(t, err, fs.ErrNotExist)
+		})
+	}
+}
+
+func TestBackends_Atlas(t *testing.T) {
+	for name, newBackend := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			backend := newBackend()
+			key := newKey(t)
+			files, err := atlas.NewAtlasWithBackend(backend)
+			require.NoError(t, err)
+			files.SetCompression(true)
+			require.NoError(t, files.SetEncryptionKey(key))
+
+			text := strings.Repeat("backend ", 200)
+			writeFile(t, files, "docs/notes.txt", text)
+			writeFile(t, files, "docs/readme.md", "v1")
+			writeFile(t, files, "docs/readme.md", "v2")
+			_, err = files.CreateTag("v1", "tester")
+			require.NoError(t, err)
+			_, err = files.Move(atlas.NewPath("docs/readme.md"), atlas.NewPath("readme.md"), false, "tester")
+			require.NoError(t, err)
+			require.NoError(t, files.Delete(atlas.NewPath("docs/notes.txt"), "tester"))
+
+			upload, err := files.CreateUpload(atlas.NewPath("up.bin"), "tester", 6, checksum("abcdef"))
+			require.NoError(t, err)
+			_, err = files.AppendUpload(upload.ID, 0, strings.NewReader("abc"))
+			require.NoError(t, err)
+			_, err = files.AppendUpload(upload.ID, 3, strings.NewReader("def"))
+			require.NoError(t, err)
+			assert.Empty(t, listNames(t, backend, "uploads/"))
+
+			// Everything is found again by a new atlas on the same backend
+			reopened, err := atlas.NewAtlasWithBackend(backend)
+			require.NoError(t, err)
+			_, err = reopened.Read(atlas.NewPath("readme.md"), "tester")
+			assert.ErrorIs(t, err, atlas.ErrEncryptionKey)
+			require.NoError(t, reopened.SetEncryptionKey(key))
+
+			gc, err := reopened.CollectGarbage()
+			require.NoError(t, err)
+			assert.Zero(t, gc.Removed)
+			report, err := reopened.Scrub()
+			require.NoError(t, err)
+			assert.True(t, report.OK())
+			assert.Equal(t, 4, report.Checked)
+
+			assert.Equal(t, "v2", readFile(t, reopened, "readme.md"))
+			assert.Equal(t, "abcdef", readFile(t, reopened, "up.bin"))
+			assert.Equal(t, "v1", readVersion(t, reopened, "readme.md", 1))
+			assert.Len(t, reopened.Trash("tester"), 1)
+			tagged, err := reopened.ReadTag("v1", atlas.NewPath("docs/notes.txt"), "tester")
+			require.NoError(t, err)
+			content, err := io.ReadAll(tagged)
+			tagged.Close()
+			require.NoError(t, err)
+			assert.Equal(t, text, string(content))
+
+			assert.Empty(t, listNames(t, backend, "tmp/"))
+		})
+	}
+}
+
+func TestLocalBackend_Escapes(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644))
+
+	backend, err := atlas.NewLocalBackend(dir)
+	require.NoError(t, err)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "objects"), 0755))
+	require.NoError(t, os.Symlink(outside, filepath.Join(dir, "objects", "ab")))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "secret"), filepath.Join(dir, "curr.json")))
+
+	for _, name := range []string{"objects/ab/secret", "curr.json", "../secret", "/etc/passwd"} {
+		_, err := backend.Open(name)
+		assert.Error(t, err, name)
+		_, err = backend.Stat(name)
+		assert.Error(t, err, name)
+	}
+	assert.Error(t, backend.Remove("objects/ab/secret"))
+	assert.FileExists(t, filepath.Join(outside, "secret"))
+
+	w, err := backend.Create("objects/ab/planted")
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "planted")
+	require.NoError(t, err)
+	assert.Error(t, w.Commit())
+
+	put(t, backend, "tmp/staged", "staged")
+	assert.Error(t, backend.Rename("tmp/staged", "objects/ab/planted"))
+	assert.Error(t, backend.Rename("tmp/staged", "../planted"))
+	assert.NoFileExists(t, filepath.Join(outside, "planted"))
+	assert.NoFileExists(t, filepath.Join(filepath.Dir(dir), "planted"))
+
+	_, err = backend.Create("../planted")
+	assert.ErrorIs(t, err, atlas.ErrInvalidPath)
+
+	assert.Equal(t, []string{"tmp/staged"}, listNames(t, backend, ""))
+}
+
+func TestLocalBackend_SwappedLink(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "file"), []byte("secret"), 0644))
+
+	backend, err := atlas.NewLocalBackend(dir)
+	require.NoError(t, err)
+	objects := filepath.Join(dir, "objects", "ab")
+	require.NoError(t, os.MkdirAll(objects, 0755))
+
+	// Keeps replacing the folder by a link out of the store while files are
+	// written and read through it
+	done := make(chan struct{})
+	swapped := make(chan struct{})
+	go func() {
+		defer close(swapped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			os.RemoveAll(objects)
+			os.Symlink(outside, objects)
+			os.Remove(objects)
+			os.Mkdir(objects, 0755)
+		}
+	}()
+
+	for i := range 200 {
+		if w, err := backend.Create("objects/ab/file"); err == nil {
+			fmt.Fprintf(w, "written %d", i)
+			w.Commit()
+		}
+		if r, err := backend.Open("objects/ab/file"); err == nil {
+			content, _ := io.ReadAll(r)
+			r.Close()
+			assert.NotEqual(t, "secret", string(content))
+		}
+	}
+	close(done)
+	<-swapped
+
+	content, err := os.ReadFile(filepath.Join(outside, "file"))
+	require.NoError(t, err)
+	assert.Equal(t, "secret", string(content))
+	entries, err := os.ReadDir(outside)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestS3Backend_Errors(t *testing.T) {
+	_, err := atlas.NewS3Backend(atlas.S3Config{Endpoint: "http://localhost"})
+	assert.Error(t, err)
+
+	config := newFakeS3(t)
+	config.AccessKey = "stranger"
+	backend, err := atlas.NewS3Backend(config)
+	require.NoError(t, err)
+
+	_, err = backend.Stat("anything")
+	require.Error(t, err)
+	assert.False(t, errors.Is(err, fs.ErrNotExist))
+
+	w, err := backend.Create("anything")
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "content")
+	require.NoError(t, err)
+	assert.ErrorContains(t, w.Commit(), "AccessDenied")
+}
+
+func TestOpenAtlas(t *testing.T) {
+	files, err := atlas.OpenAtlas("memory:")
+	require.NoError(t, err)
+	writeFile(t, files, "a.txt", "memory")
+	assert.Equal(t, "memory", readFile(t, files, "a.txt"))
+
+	root := t.TempDir()
+	files, err = atlas.OpenAtlas(root)
+	require.NoError(t, err)
+	writeFile(t, files, "a.txt", "local")
+	assert.FileExists(t, objectFile(root, "local"))
+}
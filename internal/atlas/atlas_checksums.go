@@ -0,0 +1,171 @@
+package atlas
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+)
+
+// Every object is named by the SHA-256 of its content, so the checksum of a
+// file is recorded the moment it is written. Checksums are exchanged as
+// "sha256:<hex>" and as RFC 9530 digest fields over HTTP.
+
+var ErrInvalidChecksum = errors.New("checksum is not valid")
+
+func validateChecksum(checksum string) error {
+	if checksum == "" {
+		return nil
+	}
+
+	sum, ok := strings.CutPrefix(checksum, "sha256:")
+	if decoded, err := hex.DecodeString(sum); !ok || err != nil || len(decoded) != sha256.Size {
+		return ErrInvalidChecksum
+	}
+	return nil
+}
+
+// Checksum of the file content as "sha256:<hex>"
+func (file *File) Checksum() string {
+	return "sha256:" + file.Entry.Object
+}
+
+// Digest field value of the file content, as sent in Repr-Digest
+func (file *File) Digest() string {
+	sum, _ := hex.DecodeString(file.Entry.Object)
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum) + ":"
+}
+
+// Parses the SHA-256 member of a digest field into a checksum. Both the
+// RFC 9530 form (sha-256=:<base64>:) and the older RFC 3230 form
+// (SHA-256=<base64>) are understood. Fields without a SHA-256 member yield
+// an empty checksum.
+func ParseDigest(field string) (string, error) {
+	for member := range strings.SplitSeq(field, ",") {
+		algorithm, value, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if !ok || !strings.EqualFold(algorithm, "sha-256") {
+			continue
+		}
+
+		value = strings.TrimSuffix(strings.TrimPrefix(value, ":"), ":")
+		sum, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(sum) != sha256.Size {
+			return "", ErrInvalidChecksum
+		}
+		return "sha256:" + hex.EncodeToString(sum), nil
+	}
+	return "", nil
+}
+
+// Makes Commit refuse content that does not hash to checksum, given as
+// "sha256:<hex>"
+func (w *FileWriter) Expect(checksum string) error {
+	if err := validateChecksum(checksum); err != nil {
+		return err
+	}
+	w.checksum = strings.ToLower(checksum)
+	return nil
+}
+
+type ScrubIssue struct {
+	Object string `json:"object"`
+	// Files of curr holding the object. Objects only held by versions, tags or
+	// the trash list none.
+	Paths []string `json:"paths"`
+}
+
+type ScrubReport struct {
+	Checked int          `json:"checked"`
+	Bytes   int64        `json:"bytes"`
+	Corrupt []ScrubIssue `json:"corrupt"`
+	Missing []ScrubIssue `json:"missing"`
+}
+
+// OK reports whether every object was found intact
+func (r *ScrubReport) OK() bool {
+	return len(r.Corrupt) == 0 && len(r.Missing) == 0
+}
+
+// Re-hashes every referenced object and reports those whose content no longer
+// matches their name or that are gone. The store is not locked while hashing,
+// so scrubbing a large store does not hold up other requests.
+func (f *Atlas) Scrub() (*ScrubReport, error) {
+	f.mu.Lock()
+	if err := f.countReferences(); err != nil {
+		f.mu.Unlock()
+		return nil, err
+	}
+	objects := make([]string, 0, len(f.refs))
+	for object := range f.refs {
+		objects = append(objects, object)
+	}
+	f.mu.Unlock()
+	slices.Sort(objects)
+
+	report := &ScrubReport{Corrupt: []ScrubIssue{}, Missing: []ScrubIssue{}}
+	var missing []string
+	for _, object := range objects {
+		size, sum, err := f.hashObject(object)
+		if errors.Is(err, ErrResourceNotFound) {
+			missing = append(missing, object)
+			continue
+		} else if errors.Is(err, ErrEncryptionKey) {
+			return nil, err
+		}
+
+		// Content that cannot be read back is as damaged as content that
+		// reads back wrong
+		report.Checked++
+		report.Bytes += size
+		if err != nil || sum != object {
+			report.Corrupt = append(report.Corrupt, ScrubIssue{Object: object})
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	paths := map[string][]string{}
+	f.curr.EachFile(func(key string, entry Entry) {
+		paths[entry.Object] = append(paths[entry.Object], key)
+	})
+	for i := range report.Corrupt {
+		report.Corrupt[i].Paths = sortedPaths(paths[report.Corrupt[i].Object])
+	}
+	for _, object := range missing {
+		// Collected while hashing rather than lost
+		if f.refs[object] == 0 {
+			continue
+		}
+		report.Missing = append(report.Missing, ScrubIssue{Object: object, Paths: sortedPaths(paths[object])})
+	}
+
+	return report, nil
+}
+
+func sortedPaths(paths []string) []string {
+	if paths == nil {
+		return []string{}
+	}
+	slices.Sort(paths)
+	return paths
+}
+
+func (f *Atlas) hashObject(object string) (int64, string, error) {
+	// The size is only needed for seeking from the end
+	file, err := f.openObject(object, -1)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,142 @@
+package atlas_test
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mnemosynefs/mnemo/internal/atlas"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func digest(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+}
+
+func objectFile(root string, content string) string {
+	object := strings.TrimPrefix(checksum(content), "sha256:")
+	return filepath.Join(root, "atlas", "objects", object[:2], object)
+}
+
+func TestParseDigest(t *testing.T) {
+	sum := sha256.Sum256([]byte("hello"))
+	encoded := base64.StdEncoding.EncodeToString(sum[:])
+
+	for _, field := range []string{
+		"sha-256=:" + encoded + ":",
+		"sha-512=:AAAA:, sha-256=:" + encoded + ":",
+		"SHA-256=" + encoded,
+	} {
+		parsed, err := atlas.ParseDigest(field)
+		require.NoError(t, err, field)
+		assert.Equal(t, checksum("hello"), parsed, field)
+	}
+
+	parsed, err := atlas.ParseDigest("md5=:AAAA:")
+	require.NoError(t, err)
+	assert.Empty(t, parsed)
+
+	_, err = atlas.ParseDigest("sha-256=:AAAA:")
+	assert.ErrorIs(t, err, atlas.ErrInvalidChecksum)
+}
+
+func TestWrite_Checksum(t *testing.T) {
+	files := newTestAtlas(t)
+
+	writer, err := files.Write(atlas.NewPath("a.txt"), "tester")
+	require.NoError(t, err)
+	assert.ErrorIs(t, writer.Expect("sha256:abc"), atlas.ErrInvalidChecksum)
+	require.NoError(t, writer.Expect(checksum("hello")))
+	_, err = io.WriteString(writer, "hellO")
+	require.NoError(t, err)
+	assert.ErrorIs(t, writer.Commit(), atlas.ErrChecksumMismatch)
+	assert.False(t, files.Exists(atlas.NewPath("a.txt")))
+
+	writer, err = files.Write(atlas.NewPath("a.txt"), "tester")
+	require.NoError(t, err)
+	require.NoError(t, writer.Expect("sha256:"+strings.ToUpper(strings.TrimPrefix(checksum("hello"), "sha256:"))))
+	_, err = io.WriteString(writer, "hello")
+	require.NoError(t, err)
+	require.NoError(t, writer.Commit())
+
+	file, err := files.Read(atlas.NewPath("a.txt"), "tester")
+	require.NoError(t, err)
+	defer file.Close()
+	assert.Equal(t, checksum("hello"), file.Checksum())
+	assert.Equal(t, digest("hello"), file.Digest())
+}
+
+func TestScrub(t *testing.T) {
+	root := t.TempDir()
+	files, err := atlas.NewAtlas(root)
+	require.NoError(t, err)
+	writeFile(t, files, "docs/a.txt", "intact")
+	writeFile(t, files, "docs/b.txt", "rotten")
+	writeFile(t, files, "c.txt", "rotten")
+	writeFile(t, files, "d.txt", "vanished")
+
+	report, err := files.Scrub()
+	require.NoError(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, 3, report.Checked)
+	assert.Equal(t, int64(20), report.Bytes)
+
+	require.NoError(t, os.WriteFile(objectFile(root, "rotten"), []byte("r0tten"), 0644))
+	require.NoError(t, os.Remove(objectFile(root, "vanished")))
+
+	report, err = files.Scrub()
+	require.NoError(t, err)
+	assert.False(t, report.OK())
+	assert.Equal(t, 2, report.Checked)
+	assert.Equal(t, []atlas.ScrubIssue{{
+		Object: strings.TrimPrefix(checksum("rotten"), "sha256:"),
+		Paths:  []string{"c.txt", "docs/b.txt"},
+	}}, report.Corrupt)
+	assert.Equal(t, []atlas.ScrubIssue{{
+		Object: strings.TrimPrefix(checksum("vanished"), "sha256:"),
+		Paths:  []string{"d.txt"},
+	}}, report.Missing)
+}
+
+func TestHandlers_Checksum(t *testing.T) {
+	files := newTestAtlas(t)
+	mux := newTestMux(files)
+	mux.HandleFunc("POST /scrub", files.ScrubHandler)
+
+	put := func(header string, value string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/files/a.txt", strings.NewReader(body))
+		req.Header.Set("username", "tester")
+		req.Header.Set(header, value)
+		return serveRequest(mux, req)
+	}
+
+	rec := put("Repr-Digest", digest("hello"), "hello")
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	rec = put("Content-Digest", digest("hello"), "world")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, "hello", readFile(t, files, "a.txt"))
+
+	rec = put("Repr-Digest", "sha-256=:not base64:", "world")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = serve(mux, http.MethodGet, "/files/a.txt", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, digest("hello"), rec.Header().Get("Repr-Digest"))
+
+	rec = serve(mux, http.MethodPost, "/scrub", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var report atlas.ScrubReport
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+	assert.Equal(t, 1, report.Checked)
+	assert.Empty(t, report.Corrupt)
+}
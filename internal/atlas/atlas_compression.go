@@ -0,0 +1,215 @@
+package atlas
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"path"
+	"strings"
+)
+
+// Objects of compressible files can be stored gzipped as <hash>.gz. They keep
+// the hash of their uncompressed content, so checksums, entity tags and
+// deduplication do not change, and are decompressed transparently on read.
+
+const compressedSuffix = ".gz"
+
+// Files smaller than this are not worth compressing
+const minCompressSize = 512
+
+var compressibleTypes = []string{
+	"text/",
+	"application/json",
+	"application/xml",
+	"application/javascript",
+	"application/x-ndjson",
+	"application/yaml",
+	"application/sql",
+	"image/svg+xml",
+}
+
+var compressibleExtensions = []string{
+	".csv", ".tsv", ".log", ".txt", ".md", ".json", ".jsonl", ".ndjson",
+	".xml", ".yaml", ".yml", ".sql", ".html", ".css", ".js", ".svg",
+}
+
+// Reports whether the file at key is worth compressing, judged by its
+// extension and the content type that implies
+func compressible(key string) bool {
+	ext := strings.ToLower(path.Ext(key))
+	for _, candidate := range compressibleExtensions {
+		if ext == candidate {
+			return true
+		}
+	}
+
+	t := contentType(key)
+	for _, prefix := range compressibleTypes {
+		if strings.HasPrefix(t, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Enables compression of newly written compressible files. Objects already
+// stored are left as they are.
+func (f *Atlas) SetCompression(enabled bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.compress = enabled
+}
+
+// Replaces staged content by its gzipped form when compression is enabled,
+// the file is compressible and compressing saves at least a tenth.
+func (f *Atlas) compressObject(w *objectWriter, key string) error {
+	f.mu.Lock()
+	enabled := f.compress
+	f.mu.Unlock()
+	if !enabled || w.size < minCompressSize || !compressible(key) {
+		return nil
+	}
+
+	name, size, err := f.restage(w, func(dst io.Writer, src io.Reader) error {
+		gz := gzip.NewWriter(dst)
+		if _, err := io.Copy(gz, src); err != nil {
+			return err
+		}
+		return gz.Close()
+	})
+	if err != nil {
+		return err
+	}
+	if size > w.size-w.size/10 {
+		return f.backend.Remove(name)
+	}
+
+	f.backend.Remove(w.name)
+	w.name = name
+	w.compressed = true
+	return nil
+}
+
+// decompressor reads a gzipped object as if it was stored plainly. Seeking is
+// lazy: seeking ahead skips decompressed content on the next read, seeking
+// back starts over from the beginning.
+type decompressor struct {
+	file io.ReadSeekCloser
+	gz   *gzip.Reader
+	// Uncompressed size, or -1 when unknown
+	size   int64
+	pos    int64
+	offset int64
+}
+
+func newDecompressor(file io.ReadSeekCloser, size int64) (*decompressor, error) {
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &decompressor{file: file, gz: gz, size: size}, nil
+}
+
+func (d *decompressor) Read(p []byte) (int, error) {
+	if d.size >= 0 && d.offset >= d.size {
+		return 0, io.EOF
+	}
+
+	if d.offset < d.pos {
+		if _, err := d.file.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		if err := d.gz.Reset(d.file); err != nil {
+			return 0, err
+		}
+		d.pos = 0
+	}
+	if d.offset > d.pos {
+		n, err := io.CopyN(io.Discard, d.gz, d.offset-d.pos)
+		d.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := d.gz.Read(p)
+	d.pos += int64(n)
+	d.offset = d.pos
+	return n, err
+}
+
+func (d *decompressor) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.offset
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, errors.New("decompressor: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("decompressor: negative position")
+	}
+
+	d.offset = offset
+	return offset, nil
+}
+
+func (d *decompressor) Close() error {
+	return d.file.Close()
+}
+
+type StorageReport struct {
+	Objects    int `json:"objects"`
+	Compressed int `json:"compressed"`
+	Encrypted  int `json:"encrypted"`
+	// Bytes of content held by the objects
+	Size int64 `json:"size"`
+	// Bytes the objects take up on disk
+	Stored int64 `json:"stored"`
+	Saved  int64 `json:"saved"`
+}
+
+// Reports how much space the object store takes up and how much compression
+// saves
+func (f *Atlas) Storage() (*StorageReport, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sizes := map[string]int64{}
+	err := f.eachReference(func(object string, size int64) {
+		sizes[object] = size
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	infos, err := f.backend.List("objects/")
+	if err != nil {
+		return nil, err
+	}
+
+	report := &StorageReport{}
+	for _, info := range infos {
+		report.Objects++
+		report.Stored += info.Size
+		object, compressed, encrypted := objectName(path.Base(info.Name))
+		if size, ok := sizes[object]; ok {
+			report.Size += size
+		} else {
+			report.Size += info.Size
+		}
+		if compressed {
+			report.Compressed++
+		}
+		if encrypted {
+			report.Encrypted++
+		}
+	}
+
+	report.Saved = report.Size - report.Stored
+	return report, nil
+}
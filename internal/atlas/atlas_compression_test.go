@@ -0,0 +1,155 @@
+package atlas_test
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mnemosynefs/mnemo/internal/atlas"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newCompressingAtlas(t *testing.T) (*atlas.Atlas, string) {
+	t.Helper()
+	root := t.TempDir()
+	files, err := atlas.NewAtlas(root)
+	require.NoError(t, err)
+	files.SetCompression(true)
+	return files, root
+}
+
+func TestCompression(t *testing.T) {
+	files, root := newCompressingAtlas(t)
+	text := strings.Repeat("the quick brown fox jumps over the lazy dog\n", 100)
+	writeFile(t, files, "notes.txt", text)
+
+	assert.NoFileExists(t, objectFile(root, text))
+	assert.FileExists(t, objectFile(root, text)+".gz")
+	assert.Equal(t, text, readFile(t, files, "notes.txt"))
+
+	file, err := files.Read(atlas.NewPath("notes.txt"), "tester")
+	require.NoError(t, err)
+	defer file.Close()
+	assert.Equal(t, checksum(text), file.Checksum())
+
+	listing, err := files.List(atlas.NewPath(""), atlas.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, listing.Entries, 1)
+	assert.Equal(t, int64(len(text)), listing.Entries[0].Size)
+
+	report, err := files.Storage()
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Objects)
+	assert.Equal(t, 1, report.Compressed)
+	assert.Equal(t, int64(len(text)), report.Size)
+	assert.Less(t, report.Stored, report.Size)
+	assert.Equal(t, report.Size-report.Stored, report.Saved)
+}
+
+func TestCompression_Skipped(t *testing.T) {
+	files, root := newCompressingAtlas(t)
+
+	noise := make([]byte, 4096)
+	_, err := rand.Read(noise)
+	require.NoError(t, err)
+	random := hex.EncodeToString(noise)[:4096]
+	writeFile(t, files, "image.png", strings.Repeat("a", 4096))
+	writeFile(t, files, "short.txt", "short")
+	writeFile(t, files, "noise.txt", string(noise))
+
+	assert.FileExists(t, objectFile(root, strings.Repeat("a", 4096)))
+	assert.FileExists(t, objectFile(root, "short"))
+	assert.FileExists(t, objectFile(root, string(noise)))
+	assert.Equal(t, string(noise), readFile(t, files, "noise.txt"))
+
+	// Already stored plainly, the compressed form is not added next to it
+	files.SetCompression(false)
+	writeFile(t, files, "plain.txt", random)
+	files.SetCompression(true)
+	writeFile(t, files, "again.txt", random)
+	assert.FileExists(t, objectFile(root, random))
+	assert.NoFileExists(t, objectFile(root, random)+".gz")
+}
+
+func TestCompression_Range(t *testing.T) {
+	files, _ := newCompressingAtlas(t)
+	mux := newTestMux(files)
+	text := strings.Repeat("0123456789", 100)
+	serve(mux, http.MethodPut, "/files/digits.txt", text)
+
+	req := httptest.NewRequest(http.MethodGet, "/files/digits.txt", nil)
+	req.Header.Set("Range", "bytes=502-505")
+	rec := serveRequest(mux, req)
+	require.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, "2345", rec.Body.String())
+	assert.Equal(t, "bytes 502-505/1000", rec.Header().Get("Content-Range"))
+
+	req.Header.Set("Range", "bytes=990-991,-2")
+	rec = serveRequest(mux, req)
+	require.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Contains(t, rec.Body.String(), "01")
+	assert.Contains(t, rec.Body.String(), "89")
+
+	rec = serve(mux, http.MethodGet, "/files/digits.txt", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "1000", rec.Header().Get("Content-Length"))
+	assert.Equal(t, text, rec.Body.String())
+
+	file, err := files.Read(atlas.NewPath("digits.txt"), "tester")
+	require.NoError(t, err)
+	defer file.Close()
+	_, err = file.Seek(-3, io.SeekEnd)
+	require.NoError(t, err)
+	tail, err := io.ReadAll(file)
+	require.NoError(t, err)
+	assert.Equal(t, "789", string(tail))
+	_, err = file.Seek(1, io.SeekStart)
+	require.NoError(t, err)
+	head := make([]byte, 3)
+	_, err = io.ReadFull(file, head)
+	require.NoError(t, err)
+	assert.Equal(t, "123", string(head))
+}
+
+func TestCompression_Scrub(t *testing.T) {
+	files, root := newCompressingAtlas(t)
+	text := strings.Repeat("compressible ", 100)
+	writeFile(t, files, "a.txt", text)
+
+	report, err := files.Scrub()
+	require.NoError(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, int64(len(text)), report.Bytes)
+
+	require.NoError(t, os.WriteFile(objectFile(root, text)+".gz", []byte("not gzip"), 0644))
+	report, err = files.Scrub()
+	require.NoError(t, err)
+	require.Len(t, report.Corrupt, 1)
+	assert.Equal(t, []string{"a.txt"}, report.Corrupt[0].Paths)
+}
+
+func TestCompression_CollectGarbage(t *testing.T) {
+	files, root := newCompressingAtlas(t)
+	text := strings.Repeat("compressible ", 100)
+	writeFile(t, files, "a.txt", text)
+
+	report, err := files.CollectGarbage()
+	require.NoError(t, err)
+	assert.Zero(t, report.Removed)
+	assert.Equal(t, text, readFile(t, files, "a.txt"))
+
+	orphan := objectFile(root, "orphan") + ".gz"
+	require.NoError(t, os.MkdirAll(filepath.Dir(orphan), 0755))
+	require.NoError(t, os.WriteFile(orphan, []byte("orphan"), 0644))
+	report, err = files.CollectGarbage()
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Removed)
+	assert.NoFileExists(t, orphan)
+}
@@ -0,0 +1,124 @@
+package atlas
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// Condition restricts a change to the state of the file the client last saw,
+// as given by the If-Match and If-None-Match fields. Files are identified by
+// their entity tag, folders only match "*". Entity tags name the content and
+// the version of a file, so a file changed and changed back does not match
+// the tags handed out before.
+type Condition struct {
+	// The change only applies when the target matches one of these entity
+	// tags, "*" matching any existing target
+	IfMatch []string
+	// The change only applies when the target matches none of these entity
+	// tags, "*" matching any existing target
+	IfNoneMatch []string
+}
+
+// Parses a comma separated list of entity tags as sent in If-Match and
+// If-None-Match. Weak tags are kept with their W/ prefix so they never match
+// strongly.
+func ParseETags(field string) []string {
+	tags := []string{}
+	for {
+		field = strings.TrimLeft(field, " \t,")
+		if field == "" {
+			return tags
+		}
+		if strings.HasPrefix(field, "*") {
+			tags = append(tags, "*")
+			field = field[1:]
+			continue
+		}
+
+		weak := strings.HasPrefix(field, "W/")
+		rest := strings.TrimPrefix(field, "W/")
+		// Entity tags are quoted and cannot contain quotes
+		end := -1
+		if strings.HasPrefix(rest, `"`) {
+			end = strings.IndexByte(rest[1:], '"')
+		}
+		if end < 0 {
+			next := strings.IndexByte(field, ',')
+			if next < 0 {
+				return tags
+			}
+			field = field[next:]
+			continue
+		}
+
+		tag := rest[:end+2]
+		if weak {
+			tag = "W/" + tag
+		}
+		tags = append(tags, tag)
+		field = rest[end+2:]
+	}
+}
+
+// Strong entity tag of a file
+func (e Entry) ETag() string {
+	return fmt.Sprintf(`"%s-%d"`, e.Object, e.Version)
+}
+
+// Reports whether the target, as given by its entry if it exists, matches one
+// of tags
+func matchesETag(tags []string, entry Entry, exists bool) bool {
+	if !exists {
+		return false
+	}
+	for _, tag := range tags {
+		if tag == "*" || (!entry.IsDir() && tag == entry.ETag()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks the condition against the target, as given by its entry if it
+// exists
+func (c Condition) check(entry Entry, exists bool) error {
+	if c.IfMatch != nil && !matchesETag(c.IfMatch, entry, exists) {
+		return ErrPreconditionFailed
+	}
+	if c.IfNoneMatch != nil && matchesETag(c.IfNoneMatch, entry, exists) {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
+
+// Checks cond against the file or folder at path as it is now. Writers use it
+// to refuse requests that cannot succeed before reading their content, such
+// as If-None-Match: * on an existing file; Commit checks again.
+func (f *Atlas) CheckCondition(path Path, cond Condition) error {
+	if err := path.Validate(); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	entry, exists := f.curr.Get(path.Key())
+	return cond.check(entry, exists)
+}
+
+// Makes Commit only replace the current file when it satisfies cond, so
+// concurrent writers cannot overwrite each other unnoticed
+func (w *FileWriter) Require(cond Condition) {
+	w.condition = cond
+}
+
+// Entity tag of the committed file, empty before Commit succeeded
+func (w *FileWriter) ETag() string {
+	if w.entry.Object == "" {
+		return ""
+	}
+	return w.entry.ETag()
+}
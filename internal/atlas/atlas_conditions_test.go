@@ -0,0 +1,161 @@
+package atlas_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mnemosynefs/mnemo/internal/atlas"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseETags(t *testing.T) {
+	assert.Equal(t, []string{`"abc"`}, atlas.ParseETags(`"abc"`))
+	assert.Equal(t, []string{`"a"`, `W/"b"`, `"c,d"`}, atlas.ParseETags(` "a", W/"b" ,"c,d"`))
+	assert.Equal(t, []string{"*"}, atlas.ParseETags("*"))
+	assert.Equal(t, []string{`"b"`}, atlas.ParseETags(`unquoted, "b"`))
+	assert.Empty(t, atlas.ParseETags(`"unterminated`))
+}
+
+func TestWrite_Conditional(t *testing.T) {
+	files := newTestAtlas(t)
+	writeFile(t, files, "readme.md", "hello")
+
+	file, err := files.Read(atlas.NewPath("readme.md"), "tester")
+	require.NoError(t, err)
+	etag := file.ETag()
+	file.Close()
+
+	// Two writers saw the same content, only the first one to commit wins
+	first, err := files.Write(atlas.NewPath("readme.md"), "alice")
+	require.NoError(t, err)
+	first.Require(atlas.Condition{IfMatch: []string{etag}})
+	second, err := files.Write(atlas.NewPath("readme.md"), "bob")
+	require.NoError(t, err)
+	second.Require(atlas.Condition{IfMatch: []string{etag}})
+
+	_, err = io.WriteString(first, "from alice")
+	require.NoError(t, err)
+	_, err = io.WriteString(second, "from bob")
+	require.NoError(t, err)
+	require.NoError(t, first.Commit())
+	assert.ErrorIs(t, second.Commit(), atlas.ErrPreconditionFailed)
+	assert.Equal(t, "from alice", readFile(t, files, "readme.md"))
+
+	// Create-only writes fail once the file exists
+	create, err := files.Write(atlas.NewPath("new.md"), "alice")
+	require.NoError(t, err)
+	create.Require(atlas.Condition{IfNoneMatch: []string{"*"}})
+	require.NoError(t, create.Commit())
+	create, err = files.Write(atlas.NewPath("new.md"), "bob")
+	require.NoError(t, err)
+	create.Require(atlas.Condition{IfNoneMatch: []string{"*"}})
+	assert.ErrorIs(t, create.Commit(), atlas.ErrPreconditionFailed)
+
+	assert.ErrorIs(t, files.DeleteIf(atlas.NewPath("readme.md"), "bob", atlas.Condition{IfMatch: []string{etag}}), atlas.ErrPreconditionFailed)
+	assert.ErrorIs(t, files.DeleteIf(atlas.NewPath("missing.md"), "bob", atlas.Condition{IfMatch: []string{"*"}}), atlas.ErrPreconditionFailed)
+	assert.ErrorIs(t, files.DeleteIf(atlas.NewPath("missing.md"), "bob", atlas.Condition{IfNoneMatch: []string{"*"}}), atlas.ErrResourceNotFound)
+}
+
+func TestHandlers_ConditionalWrites(t *testing.T) {
+	files := newTestAtlas(t)
+	mux := newTestMux(files)
+	mux.HandleFunc("POST /move/{path...}", files.MoveHandler)
+
+	request := func(method string, target string, body string, header string, value string) *httptest.ResponseRecorder {
+		var reader io.Reader
+		if body != "" {
+			reader = strings.NewReader(body)
+		}
+		req := httptest.NewRequest(method, target, reader)
+		req.Header.Set("username", "tester")
+		req.Header.Set(header, value)
+		return serveRequest(mux, req)
+	}
+
+	rec := request(http.MethodPut, "/files/readme.md", "hello", "If-None-Match", "*")
+	require.Equal(t, http.StatusCreated, rec.Code)
+	etag := rec.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+	assert.Equal(t, etag, serve(mux, http.MethodGet, "/files/readme.md", "").Header().Get("ETag"))
+
+	rec = request(http.MethodPut, "/files/readme.md", "again", "If-None-Match", "*")
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+
+	rec = request(http.MethodPut, "/files/readme.md", "hello world", "If-Match", etag)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	updated := rec.Header().Get("ETag")
+	assert.NotEqual(t, etag, updated)
+
+	// A client still holding the first entity tag cannot clobber the update
+	rec = request(http.MethodPut, "/files/readme.md", "stale", "If-Match", etag)
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+	rec = request(http.MethodPut, "/files/readme.md", "weak", "If-Match", "W/"+updated)
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+	assert.Equal(t, "hello world", readFile(t, files, "readme.md"))
+
+	rec = request(http.MethodPost, "/move/readme.md?to=moved.md", "", "If-Match", etag)
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+	writeFile(t, files, "other.md", "other")
+	rec = request(http.MethodPost, "/move/readme.md?to=other.md&overwrite=true", "", "If-None-Match", "*")
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+	rec = request(http.MethodPost, "/move/readme.md?to=moved.md", "", "If-Match", `"other", `+updated)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	rec = request(http.MethodDelete, "/files/moved.md", "", "If-Match", etag)
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+	rec = request(http.MethodDelete, "/files/moved.md", "", "If-Match", updated)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.False(t, files.Exists(atlas.NewPath("moved.md")))
+}
+
+func TestConditions_ReusedContent(t *testing.T) {
+	files := newTestAtlas(t)
+	writeFile(t, files, "readme.md", "hello")
+	file, err := files.Read(atlas.NewPath("readme.md"), "tester")
+	require.NoError(t, err)
+	file.Close()
+	etag := file.ETag()
+
+	// Content changed and changed back is a new version with a new tag
+	writeFile(t, files, "readme.md", "changed")
+	writeFile(t, files, "readme.md", "hello")
+	file, err = files.Read(atlas.NewPath("readme.md"), "tester")
+	require.NoError(t, err)
+	file.Close()
+	assert.NotEqual(t, etag, file.ETag())
+
+	writer, err := files.Write(atlas.NewPath("readme.md"), "tester")
+	require.NoError(t, err)
+	writer.Require(atlas.Condition{IfMatch: []string{etag}})
+	io.WriteString(writer, "lost update")
+	assert.ErrorIs(t, writer.Commit(), atlas.ErrPreconditionFailed)
+	assert.Equal(t, "hello", readFile(t, files, "readme.md"))
+}
+
+// unreadBody fails the test when a handler reads it
+type unreadBody struct {
+	t *testing.T
+}
+
+func (b unreadBody) Read([]byte) (int, error) {
+	b.t.Error("request body was read")
+	return 0, io.EOF
+}
+
+func TestHandlers_ConditionBeforeBody(t *testing.T) {
+	files := newTestAtlas(t)
+	mux := newTestMux(files)
+	writeFile(t, files, "readme.md", "hello")
+
+	for header, value := range map[string]string{"If-None-Match": "*", "If-Match": `"stale"`} {
+		req := httptest.NewRequest(http.MethodPut, "/files/readme.md", unreadBody{t})
+		req.Header.Set("username", "tester")
+		req.Header.Set(header, value)
+		assert.Equal(t, http.StatusPreconditionFailed, serveRequest(mux, req).Code)
+	}
+	assert.Equal(t, "hello", readFile(t, files, "readme.md"))
+}
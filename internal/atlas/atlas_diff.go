@@ -0,0 +1,154 @@
+package atlas
+
+import (
+	"sort"
+	"time"
+)
+
+type TreeDiff struct {
+	Added    []string `json:"added"`
+	Removed  []string `json:"removed"`
+	Modified []string `json:"modified"`
+}
+
+// Returns the manifest of a tag, or a copy of curr for an empty tag name. Must
+// be called with the atlas lock held.
+func (f *Atlas) tree(name string) (*Manifest, error) {
+	if name == "" {
+		return f.curr.Clone(), nil
+	}
+
+	t, err := f.loadTag(name)
+	if err != nil {
+		return nil, err
+	}
+	return &t.Manifest, nil
+}
+
+// Compares the tree of tag from against the tree of tag to. An empty tag name
+// refers to the working tree in curr. Files user may not read are left out.
+func (f *Atlas) Diff(from string, to string, user string) (*TreeDiff, error) {
+	f.mu.Lock()
+	fromTree, err := f.tree(from)
+	if err != nil {
+		f.mu.Unlock()
+		return nil, err
+	}
+	toTree, err := f.tree(to)
+	if err != nil {
+		f.mu.Unlock()
+		return nil, err
+	}
+	readable := map[string]bool{}
+	for _, tree := range []*Manifest{fromTree, toTree} {
+		tree.EachFile(func(key string, _ Entry) {
+			readable[key] = f.canRead(user, key)
+		})
+	}
+	f.mu.Unlock()
+
+	diff := &TreeDiff{
+		Added:    []string{},
+		Removed:  []string{},
+		Modified: []string{},
+	}
+
+	fromTree.EachFile(func(key string, fromEntry Entry) {
+		toEntry, ok := toTree.Get(key)
+		switch {
+		case !readable[key]:
+		case !ok || toEntry.IsDir():
+			diff.Removed = append(diff.Removed, key)
+		case toEntry.Object != fromEntry.Object:
+			diff.Modified = append(diff.Modified, key)
+		}
+	})
+
+	toTree.EachFile(func(key string, toEntry Entry) {
+		if fromEntry, ok := fromTree.Get(key); readable[key] && (!ok || fromEntry.IsDir()) {
+			diff.Added = append(diff.Added, key)
+		}
+	})
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Modified)
+
+	return diff, nil
+}
+
+// Rolls curr back to the content of the tag on behalf of user, who must be
+// allowed to change everything it replaces. Only the given path is restored,
+// the root path restores the whole working tree.
+func (f *Atlas) Restore(name string, path Path, user string) error {
+	if err := path.Validate(); err != nil {
+		return err
+	}
+	if name == "" {
+		return ErrInvalidTag
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t, err := f.loadTag(name)
+	if err != nil {
+		return err
+	}
+
+	key := path.Key()
+	tagged, ok := t.Get(key)
+	if !ok || !f.canRead(user, key) {
+		return ErrResourceNotFound
+	}
+	restored := t.Subtree(key)
+
+	// Anything in the way of the restored path is replaced, including files
+	// sitting where the tag has parent folders
+	replaced := []string{key}
+	for dir := parentKey(key); dir != ""; dir = parentKey(dir) {
+		if entry, ok := f.curr.Get(dir); ok && !entry.IsDir() {
+			replaced = append(replaced, dir)
+		}
+	}
+	for _, k := range replaced {
+		if err := f.checkPermission(user, k); err != nil {
+			return err
+		}
+	}
+	for k := range restored {
+		if !f.canWrite(user, k) {
+			return ErrPermissionDenied
+		}
+	}
+	if err := f.checkQuota(replaced, restored); err != nil {
+		return err
+	}
+	_, existed := f.curr.Get(key)
+	for _, k := range replaced {
+		f.archive(f.curr.Remove(k))
+	}
+
+	if err := f.curr.MakeParents(key, time.Now().UTC()); err != nil {
+		return err
+	}
+	// Restored files are new versions, so entity tags handed out before
+	// the restore no longer match
+	for k, entry := range restored {
+		if !entry.IsDir() {
+			entry.Version = f.nextVersion(k)
+		}
+		f.curr.Put(k, entry)
+	}
+	f.retain(restored)
+
+	if err := f.saveCurr(); err != nil {
+		return err
+	}
+	event := Event{Type: EventCreated, Path: key, EntryType: tagged.Type, Author: user}
+	if existed {
+		event.Type = EventModified
+	}
+	f.emit(event)
+	return nil
+}
@@ -0,0 +1,480 @@
+package atlas
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// Objects can be encrypted at rest with AES-256-GCM and stored as <hash>.enc,
+// or <hash>.gz.enc when compressed first. Every object has its own random data
+// key, stored in the object header wrapped by the master key, so rotating the
+// master key only rewrites headers. Content is sealed in chunks so ranges can
+// be read without decrypting the whole object. Chunks of resumable uploads and
+// cached previews are sealed the same way.
+//
+// Encryption hides content, not its identity. Objects stay named by the
+// SHA-256 of their plaintext, which manifests record as well and which is the
+// checksum files are served with. Manifests and the metadata index are not
+// encrypted, the index leaving out EXIF tags. Anyone holding a copy of the
+// store can thus confirm whether it holds a file they already have, see which
+// paths share content, and read names, sizes and history.
+
+var (
+	ErrInvalidKey    = errors.New("encryption key is not valid")
+	ErrEncryptionKey = errors.New("encryption key is missing")
+	// Returned for objects whose header or content fails authentication
+	ErrObjectCorrupt = errors.New("object is corrupt or encrypted with another key")
+)
+
+// Environment variable holding the master key when no key file is given
+const KeyEnv = "MNEMO_MASTER_KEY"
+
+const (
+	encryptedSuffix = ".enc"
+	encryptedMagic  = "MNEMOAE1"
+	// Magic, then the nonce and sealed data key
+	encryptedHeader = len(encryptedMagic) + 12 + 32 + 16
+	encryptedChunk  = 64 << 10
+	sealedChunk     = encryptedChunk + 16
+)
+
+// Suffixes an object file may carry, compression being applied before
+// encryption
+var objectSuffixes = []string{"", compressedSuffix, encryptedSuffix, compressedSuffix + encryptedSuffix}
+
+// Splits the name of a file in atlas/objects into the object it holds and how
+// it is stored
+func objectName(name string) (object string, compressed bool, encrypted bool) {
+	object, encrypted = strings.CutSuffix(name, encryptedSuffix)
+	object, compressed = strings.CutSuffix(object, compressedSuffix)
+	return object, compressed, encrypted
+}
+
+// Parses a base64 encoded 256-bit key
+func ParseKey(text string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(text))
+	if err != nil || len(key) != 32 {
+		return nil, ErrInvalidKey
+	}
+	return key, nil
+}
+
+// Loads the master key from file, or from the KeyEnv environment variable when
+// file is empty. No key at all yields nil.
+func LoadKey(file string) ([]byte, error) {
+	if file == "" {
+		text, ok := os.LookupEnv(KeyEnv)
+		if !ok {
+			return nil, nil
+		}
+		return ParseKey(text)
+	}
+
+	text, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKey(string(text))
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, ErrInvalidKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Sets the master key new objects are encrypted with and existing ones are
+// decrypted with. A nil key stores new objects in plaintext.
+func (f *Atlas) SetEncryptionKey(key []byte) error {
+	if key == nil {
+		f.key.Store(nil)
+		return nil
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	f.key.Store(&aead)
+	return nil
+}
+
+// Master key, read without the atlas lock since objects are opened both with
+// and without it held
+func (f *Atlas) masterKey() cipher.AEAD {
+	if key := f.key.Load(); key != nil {
+		return *key
+	}
+	return nil
+}
+
+func chunkNonce(index int64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], uint64(index))
+	return nonce
+}
+
+// Additional data of a chunk marks the last one, so truncation is detected
+func chunkData(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// Header holding the data key wrapped by master
+func sealHeader(key []byte, master cipher.AEAD) []byte {
+	nonce := make([]byte, master.NonceSize())
+	rand.Read(nonce)
+
+	header := append([]byte(encryptedMagic), nonce...)
+	return master.Seal(header, nonce, key, []byte(encryptedMagic))
+}
+
+// Reads a header and returns its data key unwrapped by master
+func readHeader(src io.Reader, master cipher.AEAD) ([]byte, error) {
+	header := make([]byte, encryptedHeader)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return nil, ErrObjectCorrupt
+	}
+	if string(header[:len(encryptedMagic)]) != encryptedMagic {
+		return nil, ErrObjectCorrupt
+	}
+
+	nonce := header[len(encryptedMagic) : len(encryptedMagic)+12]
+	key, err := master.Open(nil, nonce, header[len(encryptedMagic)+12:], []byte(encryptedMagic))
+	if err != nil {
+		return nil, ErrObjectCorrupt
+	}
+	return key, nil
+}
+
+// Encrypts src into dst under a new data key. Content is always closed by a
+// final chunk, which is empty when src fills whole chunks.
+func encrypt(dst io.Writer, src io.Reader, master cipher.AEAD) error {
+	key := make([]byte, 32)
+	rand.Read(key)
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	if _, err := dst.Write(sealHeader(key, master)); err != nil {
+		return err
+	}
+
+	buf := make([]byte, encryptedChunk)
+	sealed := make([]byte, 0, sealedChunk)
+	for index := int64(0); ; index++ {
+		n, err := io.ReadFull(src, buf)
+		final := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+		if err != nil && !final {
+			return err
+		}
+
+		sealed = aead.Seal(sealed[:0], chunkNonce(index), buf[:n], chunkData(final))
+		if _, err := dst.Write(sealed); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+// Replaces staged content by its encrypted form when a master key is set
+func (f *Atlas) encryptObject(w *objectWriter) error {
+	master := f.masterKey()
+	if master == nil {
+		return nil
+	}
+
+	name, _, err := f.restage(w, func(dst io.Writer, src io.Reader) error {
+		return encrypt(dst, src, master)
+	})
+	if err != nil {
+		return err
+	}
+
+	f.backend.Remove(w.name)
+	w.name = name
+	w.encrypted = true
+	return nil
+}
+
+// decrypter reads an encrypted object, decrypting the chunk holding the
+// current offset
+type decrypter struct {
+	file   io.ReadSeekCloser
+	aead   cipher.AEAD
+	size   int64
+	chunks int64
+	offset int64
+	// Index and content of the chunk decrypted last, -1 for none
+	index int64
+	chunk []byte
+	buf   []byte
+}
+
+func (f *Atlas) newDecrypter(file io.ReadSeekCloser) (*decrypter, error) {
+	master := f.masterKey()
+	if master == nil {
+		return nil, ErrEncryptionKey
+	}
+
+	stored, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	key, err := readHeader(file, master)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	size, chunks, ok := plaintextSize(stored)
+	if !ok {
+		return nil, ErrObjectCorrupt
+	}
+
+	return &decrypter{
+		file:   file,
+		aead:   aead,
+		size:   size,
+		chunks: chunks,
+		index:  -1,
+		buf:    make([]byte, sealedChunk),
+	}, nil
+}
+
+// Returns the size of the content of an encrypted file of the stored size,
+// together with its number of chunks. Every chunk carries a tag, the last one
+// possibly nothing else.
+func plaintextSize(stored int64) (int64, int64, bool) {
+	body := stored - int64(encryptedHeader)
+	chunks := (body + sealedChunk - 1) / sealedChunk
+	if body < 16 || body-(chunks-1)*sealedChunk < 16 {
+		return 0, 0, false
+	}
+	return body - chunks*16, chunks, true
+}
+
+func (d *decrypter) load(index int64) error {
+	if index == d.index {
+		return nil
+	}
+
+	if _, err := d.file.Seek(int64(encryptedHeader)+index*sealedChunk, io.SeekStart); err != nil {
+		return err
+	}
+	n, err := io.ReadFull(d.file, d.buf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+
+	d.index = -1
+	d.chunk, err = d.aead.Open(d.chunk[:0], chunkNonce(index), d.buf[:n], chunkData(index == d.chunks-1))
+	if err != nil {
+		return ErrObjectCorrupt
+	}
+	d.index = index
+	return nil
+}
+
+func (d *decrypter) Read(p []byte) (int, error) {
+	if d.offset >= d.size {
+		// Still authenticates the final chunk, which may be empty
+		if err := d.load(d.chunks - 1); err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+
+	if err := d.load(d.offset / encryptedChunk); err != nil {
+		return 0, err
+	}
+	n := copy(p, d.chunk[d.offset%encryptedChunk:])
+	d.offset += int64(n)
+	return n, nil
+}
+
+func (d *decrypter) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.offset
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, errors.New("decrypter: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("decrypter: negative position")
+	}
+
+	d.offset = offset
+	return offset, nil
+}
+
+func (d *decrypter) Close() error {
+	return d.file.Close()
+}
+
+type RekeyReport struct {
+	// Objects whose data key was wrapped by the new master key
+	Rekeyed int `json:"rekeyed"`
+	// Objects stored in plaintext before and encrypted now
+	Encrypted int `json:"encrypted"`
+	// Objects already under the new master key, left by an interrupted rekey
+	Skipped int `json:"skipped,omitempty"`
+	// Cached previews removed, to be rendered anew under the new master key
+	Previews int `json:"previews,omitempty"`
+}
+
+// Wraps the data key of every object and upload chunk by key instead of the
+// current master key, which then becomes key. Content still stored in
+// plaintext is encrypted. Cached previews, sealed under the old key or not at
+// all, are removed. Only headers are rewritten, but every object is
+// copied so a crash never leaves one half written. Objects already under key
+// are skipped, so a rekey that failed partway is finished by running it again
+// with the same keys. Meant to run while the atlas is not serving.
+func (f *Atlas) Rekey(key []byte) (*RekeyReport, error) {
+	next, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	current := f.masterKey()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	infos, err := f.backend.List("objects/")
+	if err != nil {
+		return nil, err
+	}
+	uploads, err := f.backend.List("uploads/")
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range uploads {
+		if strings.Contains(path.Base(info.Name), ".part-") {
+			infos = append(infos, info)
+		}
+	}
+
+	report := &RekeyReport{}
+	for _, info := range infos {
+		_, _, encrypted := objectName(path.Base(info.Name))
+		if encrypted {
+			done, err := f.sealedBy(info.Name, next)
+			if err != nil {
+				return nil, fmt.Errorf("rekeying %v: %w", path.Base(info.Name), err)
+			}
+			if done {
+				report.Skipped++
+				continue
+			}
+			if current == nil {
+				return nil, ErrEncryptionKey
+			}
+		}
+
+		dst := info.Name
+		if !encrypted {
+			dst += encryptedSuffix
+		}
+		if err := f.rewriteObject(info.Name, dst, current, next); err != nil {
+			return nil, fmt.Errorf("rekeying %v: %w", path.Base(info.Name), err)
+		}
+		if !encrypted {
+			report.Encrypted++
+			if err := f.backend.Remove(info.Name); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		report.Rekeyed++
+	}
+
+	if err := f.dropPreviews(report); err != nil {
+		return nil, err
+	}
+	if err := f.dropEXIF(); err != nil {
+		return nil, err
+	}
+	return report, f.SetEncryptionKey(key)
+}
+
+// Reports whether the header of the encrypted file at name opens with master
+func (f *Atlas) sealedBy(name string, master cipher.AEAD) (bool, error) {
+	in, err := f.backend.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+
+	_, err = readHeader(in, master)
+	if errors.Is(err, ErrObjectCorrupt) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Writes the object at src to dst under the next master key. Encrypted
+// objects keep their data key and content.
+func (f *Atlas) rewriteObject(src string, dst string, current cipher.AEAD, next cipher.AEAD) error {
+	in, err := f.backend.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := f.backend.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(src, encryptedSuffix) {
+		err = rewrapHeader(out, in, current, next)
+	} else {
+		err = encrypt(out, in, next)
+	}
+	if err != nil {
+		out.Abort()
+		return err
+	}
+	return out.Commit()
+}
+
+func rewrapHeader(dst io.Writer, src io.Reader, current cipher.AEAD, next cipher.AEAD) error {
+	key, err := readHeader(src, current)
+	if err != nil {
+		return err
+	}
+
+	if _, err := dst.Write(sealHeader(key, next)); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, src)
+	return err
+}
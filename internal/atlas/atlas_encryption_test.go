@@ -0,0 +1,364 @@
+package atlas_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mnemosynefs/mnemo/internal/atlas"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	return key
+}
+
+func newEncryptingAtlas(t *testing.T) (*atlas.Atlas, string, []byte) {
+	t.Helper()
+	root := t.TempDir()
+	files, err := atlas.NewAtlas(root)
+	require.NoError(t, err)
+	key := newKey(t)
+	require.NoError(t, files.SetEncryptionKey(key))
+	return files, root, key
+}
+
+func reopen(t *testing.T, root string, key []byte) *atlas.Atlas {
+	t.Helper()
+	files, err := atlas.NewAtlas(root)
+	require.NoError(t, err)
+	require.NoError(t, files.SetEncryptionKey(key))
+	return files
+}
+
+func TestParseKey(t *testing.T) {
+	key := newKey(t)
+	parsed, err := atlas.ParseKey(base64.StdEncoding.EncodeToString(key) + "\n")
+	require.NoError(t, err)
+	assert.Equal(t, key, parsed)
+
+	_, err = atlas.ParseKey("c2hvcnQ=")
+	assert.ErrorIs(t, err, atlas.ErrInvalidKey)
+	_, err = atlas.ParseKey("not base64")
+	assert.ErrorIs(t, err, atlas.ErrInvalidKey)
+}
+
+func TestLoadKey(t *testing.T) {
+	key := newKey(t)
+	file := filepath.Join(t.TempDir(), "master.key")
+	require.NoError(t, os.WriteFile(file, []byte(base64.StdEncoding.EncodeToString(key)), 0600))
+
+	loaded, err := atlas.LoadKey(file)
+	require.NoError(t, err)
+	assert.Equal(t, key, loaded)
+
+	t.Setenv(atlas.KeyEnv, base64.StdEncoding.EncodeToString(key))
+	loaded, err = atlas.LoadKey("")
+	require.NoError(t, err)
+	assert.Equal(t, key, loaded)
+
+	os.Unsetenv(atlas.KeyEnv)
+	loaded, err = atlas.LoadKey("")
+	require.NoError(t, err)
+	assert.Nil(t, loaded)
+}
+
+func TestEncryption(t *testing.T) {
+	files, root, key := newEncryptingAtlas(t)
+	writeFile(t, files, "secret.bin", "top secret content")
+	writeFile(t, files, "empty.bin", "")
+
+	assert.NoFileExists(t, objectFile(root, "top secret content"))
+	stored, err := os.ReadFile(objectFile(root, "top secret content") + ".enc")
+	require.NoError(t, err)
+	assert.NotContains(t, string(stored), "top secret")
+
+	assert.Equal(t, "top secret content", readFile(t, files, "secret.bin"))
+	assert.Equal(t, "", readFile(t, files, "empty.bin"))
+	assert.Equal(t, "top secret content", readFile(t, reopen(t, root, key), "secret.bin"))
+
+	// Objects stored before the key was set stay readable
+	plain, err := atlas.NewAtlas(t.TempDir())
+	require.NoError(t, err)
+	writeFile(t, plain, "old.txt", "old")
+	require.NoError(t, plain.SetEncryptionKey(key))
+	assert.Equal(t, "old", readFile(t, plain, "old.txt"))
+
+	_, err = reopen(t, root, nil).Read(atlas.NewPath("secret.bin"), "tester")
+	assert.ErrorIs(t, err, atlas.ErrEncryptionKey)
+	_, err = reopen(t, root, newKey(t)).Read(atlas.NewPath("secret.bin"), "tester")
+	assert.ErrorIs(t, err, atlas.ErrObjectCorrupt)
+}
+
+func TestEncryption_Range(t *testing.T) {
+	files, _, _ := newEncryptingAtlas(t)
+	mux := newTestMux(files)
+
+	content := make([]byte, 200_000)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+	serve(mux, http.MethodPut, "/files/data.bin", string(content))
+
+	req := httptest.NewRequest(http.MethodGet, "/files/data.bin", nil)
+	req.Header.Set("Range", "bytes=65530-65545")
+	rec := serveRequest(mux, req)
+	require.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, content[65530:65546], rec.Body.Bytes())
+
+	rec = serve(mux, http.MethodGet, "/files/data.bin", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "200000", rec.Header().Get("Content-Length"))
+	assert.True(t, bytes.Equal(content, rec.Body.Bytes()))
+
+	// Whole chunks end with an empty final one
+	exact := strings.Repeat("x", 64<<10)
+	writeFile(t, files, "exact.bin", exact)
+	assert.Equal(t, exact, readFile(t, files, "exact.bin"))
+}
+
+func TestEncryption_Compressed(t *testing.T) {
+	files, root, _ := newEncryptingAtlas(t)
+	files.SetCompression(true)
+	text := strings.Repeat("compressible and secret ", 100)
+	writeFile(t, files, "notes.txt", text)
+
+	assert.FileExists(t, objectFile(root, text)+".gz.enc")
+	assert.Equal(t, text, readFile(t, files, "notes.txt"))
+
+	report, err := files.Storage()
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Compressed)
+	assert.Equal(t, 1, report.Encrypted)
+	assert.Equal(t, int64(len(text)), report.Size)
+}
+
+func TestEncryption_Tampered(t *testing.T) {
+	files, root, _ := newEncryptingAtlas(t)
+	content := strings.Repeat("tamper ", 20_000)
+	writeFile(t, files, "a.bin", content)
+	writeFile(t, files, "b.bin", "intact")
+
+	name := objectFile(root, content) + ".enc"
+	stored, err := os.ReadFile(name)
+	require.NoError(t, err)
+	stored[len(stored)/2] ^= 1
+	require.NoError(t, os.WriteFile(name, stored, 0644))
+
+	file, err := files.Read(atlas.NewPath("a.bin"), "tester")
+	require.NoError(t, err)
+	_, err = io.ReadAll(file)
+	file.Close()
+	assert.ErrorIs(t, err, atlas.ErrObjectCorrupt)
+
+	report, err := files.Scrub()
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Checked)
+	require.Len(t, report.Corrupt, 1)
+	assert.Equal(t, []string{"a.bin"}, report.Corrupt[0].Paths)
+
+	// Truncation is noticed as well
+	require.NoError(t, os.WriteFile(name, stored[:len(stored)-100], 0644))
+	report, err = files.Scrub()
+	require.NoError(t, err)
+	assert.Len(t, report.Corrupt, 1)
+
+	_, err = reopen(t, root, nil).Scrub()
+	assert.ErrorIs(t, err, atlas.ErrEncryptionKey)
+}
+
+func TestRekey(t *testing.T) {
+	root := t.TempDir()
+	files, err := atlas.NewAtlas(root)
+	require.NoError(t, err)
+	writeFile(t, files, "plain.txt", "written before encryption")
+
+	first := newKey(t)
+	report, err := files.Rekey(first)
+	require.NoError(t, err)
+	assert.Equal(t, &atlas.RekeyReport{Encrypted: 1}, report)
+	assert.NoFileExists(t, objectFile(root, "written before encryption"))
+	writeFile(t, files, "secret.txt", "written encrypted")
+
+	second := newKey(t)
+	report, err = files.Rekey(second)
+	require.NoError(t, err)
+	assert.Equal(t, &atlas.RekeyReport{Rekeyed: 2}, report)
+	assert.Equal(t, "written encrypted", readFile(t, files, "secret.txt"))
+
+	reopened := reopen(t, root, second)
+	assert.Equal(t, "written before encryption", readFile(t, reopened, "plain.txt"))
+	assert.Equal(t, "written encrypted", readFile(t, reopened, "secret.txt"))
+	_, err = reopen(t, root, first).Read(atlas.NewPath("secret.txt"), "tester")
+	assert.ErrorIs(t, err, atlas.ErrObjectCorrupt)
+
+	_, err = reopen(t, root, nil).Rekey(first)
+	assert.ErrorIs(t, err, atlas.ErrEncryptionKey)
+	_, err = reopen(t, root, first).Rekey(newKey(t))
+	assert.ErrorIs(t, err, atlas.ErrObjectCorrupt)
+}
+
+func TestRekey_Previews(t *testing.T) {
+	backend := atlas.NewMemoryBackend()
+	files, err := atlas.NewAtlasWithBackend(backend)
+	require.NoError(t, err)
+	writeFile(t, files, "shot.png", encodeImage(t, "png", 400, 400))
+	plain, err := files.Preview(atlas.NewPath("shot.png"), "small", "tester")
+	require.NoError(t, err)
+
+	// Previews cached in plaintext do not outlive encryption being turned on
+	first := newKey(t)
+	report, err := files.Rekey(first)
+	require.NoError(t, err)
+	assert.Equal(t, &atlas.RekeyReport{Encrypted: 1, Previews: 1}, report)
+	cached, err := backend.List("previews/")
+	require.NoError(t, err)
+	assert.Empty(t, cached)
+
+	// Nor do those sealed under a retired key
+	_, err = files.Preview(atlas.NewPath("shot.png"), "small", "tester")
+	require.NoError(t, err)
+	report, err = files.Rekey(newKey(t))
+	require.NoError(t, err)
+	assert.Equal(t, &atlas.RekeyReport{Rekeyed: 1, Previews: 1}, report)
+	cached, err = backend.List("previews/")
+	require.NoError(t, err)
+	assert.Empty(t, cached)
+
+	// They are rendered again, sealed under the new key
+	preview, err := files.Preview(atlas.NewPath("shot.png"), "small", "tester")
+	require.NoError(t, err)
+	assert.Equal(t, plain.Data, preview.Data)
+	cached, err = backend.List("previews/")
+	require.NoError(t, err)
+	require.Len(t, cached, 1)
+	assert.True(t, strings.HasSuffix(cached[0].Name, "-small.enc"))
+	stored, err := backend.Open(cached[0].Name)
+	require.NoError(t, err)
+	defer stored.Close()
+	data, err := io.ReadAll(stored)
+	require.NoError(t, err)
+	assert.False(t, bytes.Contains(data, plain.Data))
+}
+
+// failingBackend refuses to create files once its budget is spent, like a
+// store that fills up or goes away
+type failingBackend struct {
+	atlas.Backend
+	creates int
+}
+
+func (b *failingBackend) Create(name string) (atlas.BackendWriter, error) {
+	if b.creates == 0 {
+		return nil, errors.New("store unavailable")
+	}
+	b.creates--
+	return b.Backend.Create(name)
+}
+
+func TestRekey_Resume(t *testing.T) {
+	backend := &failingBackend{Backend: atlas.NewMemoryBackend(), creates: -1}
+	files, err := atlas.NewAtlasWithBackend(backend)
+	require.NoError(t, err)
+	first := newKey(t)
+	require.NoError(t, files.SetEncryptionKey(first))
+	for _, name := range []string{"a.txt", "b.txt", "c.txt", "d.txt"} {
+		writeFile(t, files, name, "content of "+name)
+	}
+
+	// The rekey fails after rewriting some of the objects
+	second := newKey(t)
+	backend.creates = 2
+	_, err = files.Rekey(second)
+	require.Error(t, err)
+
+	// Running it again with the same keys finishes the job
+	backend.creates = -1
+	report, err := files.Rekey(second)
+	require.NoError(t, err)
+	assert.Equal(t, &atlas.RekeyReport{Rekeyed: 2, Skipped: 2}, report)
+
+	reopened, err := atlas.NewAtlasWithBackend(backend)
+	require.NoError(t, err)
+	require.NoError(t, reopened.SetEncryptionKey(second))
+	for _, name := range []string{"a.txt", "b.txt", "c.txt", "d.txt"} {
+		assert.Equal(t, "content of "+name, readFile(t, reopened, name))
+	}
+
+	// Once done, nothing is left to rewrite even without the old key
+	report, err = reopened.Rekey(second)
+	require.NoError(t, err)
+	assert.Equal(t, &atlas.RekeyReport{Skipped: 4}, report)
+}
+
+func TestEncryption_Uploads(t *testing.T) {
+	files, root, key := newEncryptingAtlas(t)
+	upload, err := files.CreateUpload(atlas.NewPath("a.txt"), "tester", 25, "")
+	require.NoError(t, err)
+	_, err = files.AppendUpload(upload.ID, 0, &brokenReader{strings.NewReader("staged secret")})
+	assert.Error(t, err)
+
+	// Staged chunks are sealed like objects
+	chunks, err := filepath.Glob(filepath.Join(root, "atlas", "uploads", upload.ID+".part-*"))
+	require.NoError(t, err)
+	require.Len(t, chunks, 1)
+	assert.True(t, strings.HasSuffix(chunks[0], ".enc"))
+	stored, err := os.ReadFile(chunks[0])
+	require.NoError(t, err)
+	assert.NotContains(t, string(stored), "staged secret")
+
+	// Rekeying covers them, and the upload resumes under the new key
+	next := newKey(t)
+	_, err = reopen(t, root, key).Rekey(next)
+	require.NoError(t, err)
+	files = reopen(t, root, next)
+	upload, err = files.Upload(upload.ID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(13), upload.Offset)
+
+	_, err = files.AppendUpload(upload.ID, upload.Offset, strings.NewReader(", now public"))
+	require.NoError(t, err)
+	assert.Equal(t, "staged secret, now public", readFile(t, files, "a.txt"))
+}
+
+func TestEncryption_EXIF(t *testing.T) {
+	root := t.TempDir()
+	files, err := atlas.NewAtlas(root)
+	require.NoError(t, err)
+	photo := withEXIF(t, encodeImage(t, "jpeg", 40, 10))
+	writeFile(t, files, "before.jpg", photo)
+	index := filepath.Join(root, "atlas", "metadata.json")
+	stored, err := os.ReadFile(index)
+	require.NoError(t, err)
+	require.Contains(t, string(stored), "Canon")
+
+	// Encrypting the atlas drops EXIF tags from the plain index, and later
+	// writes never put them there
+	key := newKey(t)
+	_, err = files.Rekey(key)
+	require.NoError(t, err)
+	writeFile(t, files, "after.jpg", withEXIF(t, encodeImage(t, "jpeg", 20, 10)))
+	stored, err = os.ReadFile(index)
+	require.NoError(t, err)
+	assert.NotContains(t, string(stored), "Canon")
+	assert.NotContains(t, string(stored), "exif")
+
+	// They are still read from the content on request
+	for _, name := range []string{"before.jpg", "after.jpg"} {
+		meta, err := reopen(t, root, key).Metadata(atlas.NewPath(name), "tester")
+		require.NoError(t, err)
+		assert.Equal(t, "Canon", meta.Image.EXIF["Make"], name)
+	}
+}
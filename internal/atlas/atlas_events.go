@@ -0,0 +1,229 @@
+package atlas
+
+import (
+	"errors"
+	"time"
+)
+
+// Events report changes to the tree as they happen. The most recent ones are
+// kept in memory so subscribers that lose their connection can resume where
+// they left off. Subscribers that resume from further back, or from before a
+// restart, get a reset event instead and have to list the tree again.
+
+var ErrInvalidEventID = errors.New("event id is not valid")
+
+const (
+	EventCreated   = "created"
+	EventModified  = "modified"
+	EventDeleted   = "deleted"
+	EventMoved     = "moved"
+	EventAnnotated = "annotated"
+	// Tag events name no path and reach every subscriber
+	EventTagCreated = "tag_created"
+	EventTagDeleted = "tag_deleted"
+	// Takes the place of events a resuming subscriber missed that are no
+	// longer kept
+	EventReset = "reset"
+)
+
+// Number of recent events kept for resuming subscribers unless configured
+// otherwise
+const DefaultEventBacklog = 1000
+
+// Events a subscriber may fall behind by before it is dropped
+const subscriberBuffer = 256
+
+type Event struct {
+	ID   uint64 `json:"id"`
+	Type string `json:"type"`
+	Path string `json:"path,omitempty"`
+	// Previous path of moved files and folders
+	From      string    `json:"from,omitempty"`
+	EntryType EntryType `json:"entry_type,omitempty"`
+	Tag       string    `json:"tag,omitempty"`
+	Author    string    `json:"author,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+type eventLog struct {
+	// ID of the next event. It starts at the time the atlas was opened in
+	// microseconds, so IDs grow across restarts and stay exact in JSON
+	// numbers.
+	next        uint64
+	backlog     []Event
+	limit       int
+	subscribers map[*Subscription]bool
+}
+
+func newEventLog() eventLog {
+	return eventLog{
+		next:        uint64(time.Now().UnixMicro()),
+		limit:       DefaultEventBacklog,
+		subscribers: map[*Subscription]bool{},
+	}
+}
+
+// Subscription receives the events below a path that its user may read
+type Subscription struct {
+	f      *Atlas
+	prefix string
+	user   string
+	events chan Event
+}
+
+// Delivers the events of the subscription. The channel is closed when the
+// subscription is closed or dropped for falling behind.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+func (s *Subscription) Close() {
+	s.f.mu.Lock()
+	defer s.f.mu.Unlock()
+
+	s.f.unsubscribe(s)
+}
+
+// Shapes the event as the subscriber gets to see it, reporting whether it
+// sees it at all. Moves across the edge of what the subscriber sees become a
+// deletion or a creation. Must be called with the atlas lock held.
+func (s *Subscription) view(event Event) (Event, bool) {
+	if event.Type == EventTagCreated || event.Type == EventTagDeleted || event.Type == EventReset {
+		return event, true
+	}
+
+	// Changes to a folder above the prefix, such as the root, reach
+	// everything the subscriber sees
+	above := func(key string) bool {
+		return key != s.prefix && isWithin(s.prefix, key)
+	}
+	if above(event.Path) || event.Type == EventMoved && above(event.From) {
+		return s.replaced(event)
+	}
+
+	visible := func(key string) bool {
+		return isWithin(key, s.prefix) && s.f.canRead(s.user, key)
+	}
+	if event.Type != EventMoved {
+		return event, visible(event.Path)
+	}
+
+	from, to := visible(event.From), visible(event.Path)
+	switch {
+	case from && to:
+		return event, true
+	case from:
+		event.Type = EventDeleted
+		event.Path, event.From = event.From, ""
+	case to:
+		event.Type = EventCreated
+		event.From = ""
+	}
+	return event, from || to
+}
+
+// Shapes an event about a folder above the prefix. Removing it removes the
+// prefix, while anything put in its place calls for a reset, as the subscriber
+// cannot tell what changed below. Must be called with the atlas lock held.
+func (s *Subscription) replaced(event Event) (Event, bool) {
+	switch {
+	case event.Type == EventAnnotated:
+		return event, false
+	case event.Type == EventDeleted || event.Type == EventMoved && !isWithin(s.prefix, event.Path):
+		deleted := Event{ID: event.ID, Type: EventDeleted, Path: s.prefix, Author: event.Author, Time: event.Time}
+		return deleted, s.f.canRead(s.user, s.prefix)
+	default:
+		return Event{ID: event.ID, Type: EventReset, Time: event.Time}, true
+	}
+}
+
+// Hands the event to the subscriber, dropping subscribers too far behind.
+// Must be called with the atlas lock held.
+func (s *Subscription) send(event Event) {
+	event, ok := s.view(event)
+	if !ok {
+		return
+	}
+	select {
+	case s.events <- event:
+	default:
+		s.f.unsubscribe(s)
+	}
+}
+
+// Sets how many recent events are kept for resuming subscribers
+func (f *Atlas) SetEventBacklog(limit int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.events.limit = max(limit, 0)
+	f.trimEvents()
+}
+
+func (f *Atlas) trimEvents() {
+	if excess := len(f.events.backlog) - f.events.limit; excess > 0 {
+		f.events.backlog = append([]Event{}, f.events.backlog[excess:]...)
+	}
+}
+
+// Records an event and hands it to the subscribers. Must be called with the
+// atlas lock held.
+func (f *Atlas) emit(event Event) {
+	event.ID = f.events.next
+	event.Time = time.Now().UTC()
+	f.events.next++
+
+	f.events.backlog = append(f.events.backlog, event)
+	f.trimEvents()
+	for s := range f.events.subscribers {
+		s.send(event)
+	}
+}
+
+// Subscribes user to the events below path. With resume set, the events
+// after the one with the given ID are delivered first, or a reset event when
+// they are no longer kept.
+func (f *Atlas) Subscribe(path Path, user string, after uint64, resume bool) (*Subscription, error) {
+	if err := path.Validate(); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s := &Subscription{
+		f:      f,
+		prefix: path.Key(),
+		user:   user,
+		events: make(chan Event, f.events.limit+subscriberBuffer),
+	}
+	f.events.subscribers[s] = true
+
+	if !resume {
+		return s, nil
+	}
+
+	latest := f.events.next - 1
+	oldest := f.events.next
+	if len(f.events.backlog) > 0 {
+		oldest = f.events.backlog[0].ID
+	}
+	if after < oldest-1 || after > latest {
+		s.send(Event{ID: latest, Type: EventReset, Time: time.Now().UTC()})
+		return s, nil
+	}
+	for _, event := range f.events.backlog {
+		if event.ID > after {
+			s.send(event)
+		}
+	}
+	return s, nil
+}
+
+// Must be called with the atlas lock held
+func (f *Atlas) unsubscribe(s *Subscription) {
+	if f.events.subscribers[s] {
+		delete(f.events.subscribers, s)
+		close(s.events)
+	}
+}
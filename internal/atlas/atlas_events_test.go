@@ -0,0 +1,309 @@
+package atlas_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mnemosynefs/mnemo/internal/atlas"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Collects the events already delivered to a subscription
+func drain(sub *atlas.Subscription) []atlas.Event {
+	events := []atlas.Event{}
+	for {
+		select {
+		case event, ok := <-sub.Events():
+			if !ok {
+				return events
+			}
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+// Describes events as "type path", with " from" for moves and tags in
+// place of paths
+func describe(events []atlas.Event) []string {
+	described := []string{}
+	for _, event := range events {
+		text := event.Type + " " + event.Path + event.Tag
+		if event.From != "" {
+			text += " " + event.From
+		}
+		described = append(described, text)
+	}
+	return described
+}
+
+func TestSubscribe(t *testing.T) {
+	files := newTestAtlas(t)
+	sub, err := files.Subscribe(atlas.NewPath(""), "tester", 0, false)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	writeFile(t, files, "docs/a.txt", "a")
+	writeFile(t, files, "docs/a.txt", "b")
+	require.NoError(t, files.MakeDir(atlas.NewPath("empty"), "tester"))
+	_, err = files.Move(atlas.NewPath("docs/a.txt"), atlas.NewPath("b.txt"), false, "tester")
+	require.NoError(t, err)
+	_, err = files.Copy(atlas.NewPath("b.txt"), atlas.NewPath("c.txt"), false, "tester")
+	require.NoError(t, err)
+	_, err = files.Annotate(atlas.NewPath("c.txt"), atlas.Annotations{Labels: []string{"x"}}, "tester")
+	require.NoError(t, err)
+	_, err = files.CreateTag("release", "tester")
+	require.NoError(t, err)
+	require.NoError(t, files.Delete(atlas.NewPath("c.txt"), "tester"))
+	require.NoError(t, files.DeleteTag("release", "tester"))
+
+	events := drain(sub)
+	assert.Equal(t, []string{
+		"created docs/a.txt",
+		"modified docs/a.txt",
+		"created empty",
+		"moved b.txt docs/a.txt",
+		"created c.txt",
+		"annotated c.txt",
+		"tag_created release",
+		"deleted c.txt",
+		"tag_deleted release",
+	}, describe(events))
+	assert.Equal(t, atlas.EntryDir, events[2].EntryType)
+	assert.Equal(t, "tester", events[0].Author)
+	for i := 1; i < len(events); i++ {
+		assert.Equal(t, events[i-1].ID+1, events[i].ID)
+	}
+}
+
+func TestSubscribe_Filtered(t *testing.T) {
+	files := newTestAtlas(t)
+	files.SetReadPermission(func(username string, key string) bool {
+		return username == "tester" || !strings.HasPrefix(key, "private")
+	})
+	sub, err := files.Subscribe(atlas.NewPath("docs"), "guest", 0, false)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	writeFile(t, files, "docs/a.txt", "a")
+	writeFile(t, files, "other/b.txt", "b")
+	writeFile(t, files, "private/c.txt", "c")
+	writeFile(t, files, "documents.txt", "d")
+
+	// Moves across the edge of what the subscriber sees are a creation or a
+	// deletion
+	_, err = files.Move(atlas.NewPath("other/b.txt"), atlas.NewPath("docs/b.txt"), false, "tester")
+	require.NoError(t, err)
+	_, err = files.Move(atlas.NewPath("docs/a.txt"), atlas.NewPath("private/a.txt"), false, "tester")
+	require.NoError(t, err)
+	_, err = files.Move(atlas.NewPath("private/c.txt"), atlas.NewPath("private/d.txt"), false, "tester")
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"created docs/a.txt",
+		"created docs/b.txt",
+		"deleted docs/a.txt",
+	}, describe(drain(sub)))
+}
+
+func TestSubscribe_Ancestors(t *testing.T) {
+	files := newTestAtlas(t)
+	writeFile(t, files, "projects/x/a.txt", "a")
+	writeFile(t, files, "projects/y.txt", "y")
+	_, err := files.CreateTag("release", "tester")
+	require.NoError(t, err)
+	sub, err := files.Subscribe(atlas.NewPath("projects/x"), "tester", 0, false)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	// Removing a folder above the prefix removes the prefix, annotating it
+	// changes nothing below
+	_, err = files.Annotate(atlas.NewPath("projects"), atlas.Annotations{Labels: []string{"x"}}, "tester")
+	require.NoError(t, err)
+	_, err = files.Move(atlas.NewPath("projects"), atlas.NewPath("archive"), false, "tester")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"deleted projects/x"}, describe(drain(sub)))
+
+	// Putting something in the place of a folder above the prefix is a reset
+	_, err = files.Move(atlas.NewPath("archive"), atlas.NewPath("projects"), false, "tester")
+	require.NoError(t, err)
+	events := drain(sub)
+	assert.Equal(t, []string{"reset "}, describe(events))
+	assert.NotZero(t, events[0].ID)
+
+	require.NoError(t, files.Delete(atlas.NewPath("projects"), "tester"))
+	assert.Equal(t, []string{"deleted projects/x"}, describe(drain(sub)))
+
+	require.NoError(t, files.Restore("release", atlas.NewPath(""), "tester"))
+	assert.Equal(t, []string{"reset "}, describe(drain(sub)))
+	assert.Equal(t, "a", readFile(t, files, "projects/x/a.txt"))
+}
+
+func TestSubscribe_Resume(t *testing.T) {
+	files := newTestAtlas(t)
+	files.SetEventBacklog(3)
+
+	writeFile(t, files, "a.txt", "a")
+	first, err := files.Subscribe(atlas.NewPath(""), "tester", 0, false)
+	require.NoError(t, err)
+	writeFile(t, files, "b.txt", "b")
+	writeFile(t, files, "c.txt", "c")
+	seen := drain(first)
+	require.Len(t, seen, 2)
+	first.Close()
+	_, ok := <-first.Events()
+	assert.False(t, ok)
+
+	// Missed events are delivered once the subscriber is back
+	writeFile(t, files, "d.txt", "d")
+	sub, err := files.Subscribe(atlas.NewPath(""), "tester", seen[0].ID, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"created c.txt", "created d.txt"}, describe(drain(sub)))
+	sub.Close()
+
+	// Nothing was missed when resuming from the latest event
+	sub, err = files.Subscribe(atlas.NewPath(""), "tester", seen[1].ID+1, true)
+	require.NoError(t, err)
+	assert.Empty(t, drain(sub))
+	sub.Close()
+
+	// Events that fell off the backlog are replaced by a reset
+	writeFile(t, files, "e.txt", "e")
+	writeFile(t, files, "f.txt", "f")
+	for _, after := range []uint64{seen[0].ID, seen[0].ID + 100} {
+		sub, err = files.Subscribe(atlas.NewPath(""), "tester", after, true)
+		require.NoError(t, err)
+		events := drain(sub)
+		require.Len(t, events, 1)
+		assert.Equal(t, atlas.EventReset, events[0].Type)
+		sub.Close()
+	}
+}
+
+func TestSubscribe_Dropped(t *testing.T) {
+	files := newTestAtlas(t)
+	files.SetEventBacklog(0)
+	sub, err := files.Subscribe(atlas.NewPath(""), "tester", 0, false)
+	require.NoError(t, err)
+
+	// A subscriber that does not keep up is dropped instead of holding
+	// back the atlas
+	for i := range 300 {
+		writeFile(t, files, "f"+strconv.Itoa(i), "x")
+	}
+	events := 0
+	for range sub.Events() {
+		events++
+	}
+	assert.Less(t, events, 300)
+}
+
+// Reads the next Server-Sent Event, skipping comments
+func readSSE(t *testing.T, reader *bufio.Reader) map[string]string {
+	t.Helper()
+	fields := map[string]string{}
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" && len(fields) > 0 {
+			return fields
+		}
+		if name, value, ok := strings.Cut(line, ": "); ok && name != "" {
+			fields[name] = value
+		}
+	}
+}
+
+func TestHandlers_Events(t *testing.T) {
+	files := newTestAtlas(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /events/{path...}", files.EventsHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	writeFile(t, files, "docs/old.txt", "old")
+	res, err := http.Get(server.URL + "/events/docs")
+	require.NoError(t, err)
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+	reader := bufio.NewReader(res.Body)
+
+	writeFile(t, files, "other.txt", "x")
+	writeFile(t, files, "docs/new.txt", "new")
+	fields := readSSE(t, reader)
+	res.Body.Close()
+	assert.Equal(t, "created", fields["event"])
+	event := atlas.Event{}
+	require.NoError(t, json.Unmarshal([]byte(fields["data"]), &event))
+	assert.Equal(t, "docs/new.txt", event.Path)
+	assert.Equal(t, strconv.FormatUint(event.ID, 10), fields["id"])
+
+	// Reconnecting clients get what they missed
+	writeFile(t, files, "docs/missed.txt", "missed")
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/events/docs", nil)
+	req.Header.Set("Last-Event-ID", fields["id"])
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	fields = readSSE(t, bufio.NewReader(res.Body))
+	res.Body.Close()
+	assert.Contains(t, fields["data"], `"path":"docs/missed.txt"`)
+
+	res, err = http.Get(server.URL + "/events/docs?last_event_id=latest")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestHandlers_EventsWebSocket(t *testing.T) {
+	files := newTestAtlas(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /events/{path...}", files.EventsHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	io.WriteString(conn, "GET /events/ HTTP/1.1\r\nHost: atlas\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", res.Header.Get("Sec-WebSocket-Accept"))
+
+	writeFile(t, files, "a.txt", "a")
+
+	header := make([]byte, 2)
+	_, err = io.ReadFull(reader, header)
+	require.NoError(t, err)
+	assert.Equal(t, byte(0x81), header[0])
+	length := int(header[1])
+	if length == 126 {
+		ext := make([]byte, 2)
+		_, err = io.ReadFull(reader, ext)
+		require.NoError(t, err)
+		length = int(binary.BigEndian.Uint16(ext))
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(reader, payload)
+	require.NoError(t, err)
+
+	event := atlas.Event{}
+	require.NoError(t, json.Unmarshal(payload, &event))
+	assert.Equal(t, atlas.EventCreated, event.Type)
+	assert.Equal(t, "a.txt", event.Path)
+}
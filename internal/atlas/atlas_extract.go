@@ -0,0 +1,454 @@
+package atlas
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Uploaded archives are unpacked into objects first and only then published
+// into curr in a single step, so a failing extraction leaves the tree as it
+// was. Entry names are validated like any other path and the content written
+// is bounded to defuse archive bombs.
+
+var (
+	ErrUnsupportedArchive = errors.New("archive format is not supported")
+	ErrArchiveTooLarge    = errors.New("archive exceeds the extraction limits")
+)
+
+// Extraction limits applied when none are configured
+const (
+	DefaultExtractEntries = 10000
+	DefaultExtractSize    = 1 << 30
+)
+
+// Bounds an extraction. Zero fields fall back to the defaults.
+type ExtractLimits struct {
+	// Number of entries the archive may hold
+	Entries int
+	// Bytes all files of the archive may add up to once unpacked
+	Size int64
+}
+
+// Outcome of a single archive entry
+const (
+	ExtractCreated  = "created"
+	ExtractReplaced = "replaced"
+	ExtractSkipped  = "skipped"
+)
+
+type ExtractResult struct {
+	// Name of the entry in the archive
+	Name string `json:"name"`
+	// Path the entry was extracted to, empty when the name was refused
+	Path   string `json:"path,omitempty"`
+	Status string `json:"status"`
+	Size   int64  `json:"size,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type ExtractReport struct {
+	Path     string          `json:"path"`
+	Created  int             `json:"created"`
+	Replaced int             `json:"replaced"`
+	Skipped  int             `json:"skipped"`
+	Entries  []ExtractResult `json:"entries"`
+}
+
+func (r *ExtractReport) add(result ExtractResult) {
+	switch result.Status {
+	case ExtractCreated:
+		r.Created++
+	case ExtractReplaced:
+		r.Replaced++
+	case ExtractSkipped:
+		r.Skipped++
+	}
+	r.Entries = append(r.Entries, result)
+}
+
+func (r *ExtractReport) skip(name string, key string, err error) {
+	r.add(ExtractResult{Name: name, Path: key, Status: ExtractSkipped, Error: err.Error()})
+}
+
+func (f *Atlas) SetExtractLimits(limits ExtractLimits) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.extractLimits = limits
+}
+
+func (f *Atlas) limits() ExtractLimits {
+	f.mu.Lock()
+	limits := f.extractLimits
+	f.mu.Unlock()
+
+	if limits.Entries <= 0 {
+		limits.Entries = DefaultExtractEntries
+	}
+	if limits.Size <= 0 {
+		limits.Size = DefaultExtractSize
+	}
+	return limits
+}
+
+// archiveItem is an entry read from an uploaded archive
+type archiveItem struct {
+	name    string
+	mode    os.FileMode
+	content io.Reader
+}
+
+// Calls fn for every entry of a zip archive. The archive is spooled to a
+// temporary file first, zip keeps its index at the end.
+func eachZipItem(r io.Reader, limits ExtractLimits, fn func(archiveItem) error) error {
+	spool, err := os.CreateTemp("", "mnemo-extract-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	// Stored entries take their size plus some headers, anything beyond is
+	// not an archive within the limits
+	limit := limits.Size + int64(limits.Entries)*1024
+	size, err := io.Copy(spool, io.LimitReader(r, limit+1))
+	if err != nil {
+		return err
+	}
+	if size > limit {
+		return ErrArchiveTooLarge
+	}
+
+	zr, err := zip.NewReader(spool, size)
+	if err != nil && !errors.Is(err, zip.ErrInsecurePath) {
+		return fmt.Errorf("%w: %w", ErrInvalidArchive, err)
+	}
+	if len(zr.File) > limits.Entries {
+		return ErrArchiveTooLarge
+	}
+
+	for _, file := range zr.File {
+		item := archiveItem{name: file.Name, mode: file.Mode()}
+		if item.mode.IsRegular() {
+			content, err := file.Open()
+			if err != nil {
+				return fmt.Errorf("%w: %w", ErrInvalidArchive, err)
+			}
+			item.content = content
+			err = fn(item)
+			content.Close()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Calls fn for every entry of a tar archive, read as it streams in
+func eachTarItem(r io.Reader, fn func(archiveItem) error) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidArchive, err)
+		}
+
+		item := archiveItem{name: header.Name, mode: header.FileInfo().Mode()}
+		if item.mode.IsRegular() {
+			item.content = tr
+		}
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+}
+
+// Largest window a zstd frame may ask for. The decoder holds the window in
+// memory, so frames asking for more are refused rather than allocated.
+const maxZstdWindow = 64 << 20
+
+// Detects the format of an archive from its first bytes and calls fn for
+// every entry
+func eachArchiveItem(r io.Reader, limits ExtractLimits, fn func(archiveItem) error) error {
+	in := bufio.NewReader(r)
+	magic, _ := in.Peek(512)
+
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")), bytes.HasPrefix(magic, []byte("PK\x05\x06")):
+		return eachZipItem(in, limits, fn)
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidArchive, err)
+		}
+		defer gz.Close()
+		return eachTarItem(gz, fn)
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zr, err := zstd.NewReader(in,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxWindow(maxZstdWindow),
+			zstd.WithDecoderMaxMemory(maxZstdWindow))
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidArchive, err)
+		}
+		defer zr.Close()
+		return eachTarItem(zr, fn)
+	case len(magic) >= 262 && string(magic[257:262]) == "ustar":
+		return eachTarItem(in, fn)
+	default:
+		return ErrUnsupportedArchive
+	}
+}
+
+// extracted is an entry of an archive waiting to be published
+type extracted struct {
+	name   string
+	key    string
+	dir    bool
+	object *objectWriter
+	meta   *Metadata
+}
+
+// Extracts a zip, tar, tar.gz or tar.zst archive into the folder at dir on
+// behalf of author. Either every accepted entry is published or, when the
+// archive is damaged, breaks the limits or the quotas, none is. Entries with
+// names escaping dir, links, special files and entries author may not change
+// are skipped and reported.
+func (f *Atlas) Extract(dir Path, author string, archive io.Reader) (*ExtractReport, error) {
+	if err := dir.Validate(); err != nil {
+		return nil, err
+	}
+
+	limits := f.limits()
+	report := &ExtractReport{Path: dir.Key(), Entries: []ExtractResult{}}
+	pending := map[string]*extracted{}
+	order := []string{}
+	discard := func() {
+		for _, e := range pending {
+			if e.object != nil {
+				e.object.discard()
+			}
+		}
+	}
+
+	count := 0
+	var total int64
+	err := eachArchiveItem(archive, limits, func(item archiveItem) error {
+		count++
+		if count > limits.Entries {
+			return ErrArchiveTooLarge
+		}
+
+		if err := ValidatePath(item.name); err != nil {
+			report.skip(item.name, "", err)
+			return nil
+		}
+		entryPath := NewPath(path.Join(dir.Key(), item.name))
+		key := entryPath.Key()
+		if key == dir.Key() {
+			return nil
+		}
+		if !item.mode.IsDir() && !item.mode.IsRegular() {
+			report.skip(item.name, key, fmt.Errorf("%w: %v entries are not supported", ErrInvalidArchive, item.mode.Type()))
+			return nil
+		}
+
+		// Later entries of the same name win, as when unpacking by hand
+		if previous, ok := pending[key]; ok {
+			if previous.object != nil {
+				previous.object.discard()
+			}
+		} else {
+			order = append(order, key)
+		}
+
+		e := &extracted{name: item.name, key: key, dir: item.mode.IsDir()}
+		pending[key] = e
+		if e.dir {
+			return nil
+		}
+
+		object, err := f.newObject()
+		if err != nil {
+			return err
+		}
+		e.object = object
+
+		n, err := io.Copy(object, io.LimitReader(item.content, limits.Size-total+1))
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidArchive, err)
+		}
+		if total += n; total > limits.Size {
+			return ErrArchiveTooLarge
+		}
+
+		e.meta = f.inspectStaged(object, key)
+		if err := f.compressObject(object, key); err != nil {
+			return err
+		}
+		return f.encryptObject(object)
+	})
+	if err != nil {
+		discard()
+		return nil, err
+	}
+
+	if err := f.publishExtracted(dir.Key(), author, order, pending, report); err != nil {
+		discard()
+		return nil, err
+	}
+	return report, nil
+}
+
+// Publishes the extracted entries in one step, skipping those clashing with
+// the tree
+func (f *Atlas) publishExtracted(dir string, author string, order []string, pending map[string]*extracted, report *ExtractReport) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	entry, ok := f.curr.Get(dir)
+	if ok && !entry.IsDir() {
+		return ErrIsFile
+	}
+	if !ok && dir != "" && !f.canWrite(author, dir) {
+		return ErrPermissionDenied
+	}
+	if err := f.checkParents(dir); err != nil {
+		return err
+	}
+
+	// Entries are tried against a copy of the tree, parents first, so clashes
+	// within the archive show up like clashes with existing files
+	slices.Sort(order)
+	tree := f.curr.Clone()
+	now := time.Now().UTC()
+	if _, ok := tree.Get(dir); !ok {
+		tree.MakeParents(dir, now)
+		tree.Put(dir, Entry{Type: EntryDir, Modified: now, Author: author})
+	}
+
+	accepted := []*extracted{}
+	add := map[string]Entry{}
+	for _, key := range order {
+		e := pending[key]
+		var err error
+		for parent := parentKey(key); parent != "" && err == nil; parent = parentKey(parent) {
+			if entry, ok := tree.Get(parent); ok && !entry.IsDir() {
+				err = ErrIsFile
+			}
+		}
+		if err == nil && !f.canWrite(author, key) {
+			err = ErrPermissionDenied
+		}
+		current, exists := tree.Get(key)
+		if err == nil && exists && current.IsDir() != e.dir {
+			err = ErrIsFolder
+			if e.dir {
+				err = ErrIsFile
+			}
+		}
+		if err != nil {
+			report.skip(e.name, key, err)
+			if e.object != nil {
+				e.object.discard()
+				e.object = nil
+			}
+			continue
+		}
+
+		if e.dir {
+			if !exists {
+				tree.MakeParents(key, now)
+				tree.Put(key, Entry{Type: EntryDir, Modified: now, Author: author})
+				report.add(ExtractResult{Name: e.name, Path: key, Status: ExtractCreated})
+			}
+			continue
+		}
+
+		tree.MakeParents(key, now)
+		tree.Put(key, Entry{Type: EntryFile, Size: e.object.size, Author: author})
+		add[key] = tree.Entries[key]
+		accepted = append(accepted, e)
+	}
+
+	replaced := []string{}
+	for key := range add {
+		if entry, ok := f.curr.Get(key); ok && !entry.IsDir() {
+			replaced = append(replaced, key)
+		}
+	}
+	if err := f.checkQuota(replaced, add); err != nil {
+		return err
+	}
+
+	// Nothing is referenced until every object made it into the store
+	objects := map[string]string{}
+	described := map[string]*Metadata{}
+	for _, e := range accepted {
+		object, err := f.storeObject(e.object)
+		if err != nil {
+			return err
+		}
+		e.object = nil
+		objects[e.key] = object
+		described[object] = e.meta
+	}
+
+	for _, e := range accepted {
+		status := ExtractCreated
+		entry := tree.Entries[e.key]
+		if current, ok := f.curr.Get(e.key); ok {
+			status = ExtractReplaced
+			entry.Annotations = current.Annotations
+		}
+		entry.Object = objects[e.key]
+		entry.Modified = now
+		entry.Version = f.nextVersion(e.key)
+		tree.Put(e.key, entry)
+
+		f.archive(f.curr.Remove(e.key))
+		f.retainObject(entry.Object)
+		report.add(ExtractResult{Name: e.name, Path: e.key, Status: status, Size: entry.Size})
+	}
+
+	// Replaced files left curr for the history above, the tree takes over
+	// everything else
+	f.curr = tree
+	if err := f.saveCurr(); err != nil {
+		return err
+	}
+	f.recordMetadata(described)
+
+	for _, result := range report.Entries {
+		event := Event{Type: EventCreated, Path: result.Path, Author: author}
+		switch result.Status {
+		case ExtractSkipped:
+			continue
+		case ExtractReplaced:
+			event.Type = EventModified
+		}
+		event.EntryType = f.curr.Entries[result.Path].Type
+		f.emit(event)
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package atlas_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/mnemosynefs/mnemo/internal/atlas"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Builds a zip archive of the given entries, names ending in a slash being
+// folders
+func buildZip(t *testing.T, entries ...string) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for i := 0; i+1 < len(entries); i += 2 {
+		w, err := zw.Create(entries[i])
+		require.NoError(t, err)
+		_, err = w.Write([]byte(entries[i+1]))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+// Builds a tar archive of the given headers and contents
+func buildTar(t *testing.T, compress bool, headers []*tar.Header, contents ...string) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	var gz *gzip.Writer
+	tw := tar.NewWriter(buf)
+	if compress {
+		gz = gzip.NewWriter(buf)
+		tw = tar.NewWriter(gz)
+	}
+	for i, header := range headers {
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(contents[i]))
+		}
+		require.NoError(t, tw.WriteHeader(header))
+		if header.Typeflag == tar.TypeReg {
+			_, err := tw.Write([]byte(contents[i]))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	if gz != nil {
+		require.NoError(t, gz.Close())
+	}
+	return buf.Bytes()
+}
+
+func statuses(report *atlas.ExtractReport) map[string]string {
+	statuses := map[string]string{}
+	for _, result := range report.Entries {
+		statuses[result.Name] = result.Status
+	}
+	return statuses
+}
+
+func TestExtract_Zip(t *testing.T) {
+	files := newTestAtlas(t)
+	writeFile(t, files, "project/readme.md", "old")
+
+	archive := buildZip(t,
+		"readme.md", "new",
+		"src/", "",
+		"src/main.go", "package main",
+		"../escape.txt", "evil",
+		"/etc/passwd", "evil",
+	)
+	report, err := files.Extract(atlas.NewPath("project"), "tester", bytes.NewReader(archive))
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]string{
+		"readme.md":     atlas.ExtractReplaced,
+		"src/":          atlas.ExtractCreated,
+		"src/main.go":   atlas.ExtractCreated,
+		"../escape.txt": atlas.ExtractSkipped,
+		"/etc/passwd":   atlas.ExtractSkipped,
+	}, statuses(report))
+	assert.Equal(t, 2, report.Created)
+	assert.Equal(t, 1, report.Replaced)
+	assert.Equal(t, 2, report.Skipped)
+
+	assert.Equal(t, "new", readFile(t, files, "project/readme.md"))
+	assert.Equal(t, "package main", readFile(t, files, "project/src/main.go"))
+	assert.False(t, files.Exists(atlas.NewPath("escape.txt")))
+
+	// The replaced file stays available as a version
+	versions, err := files.Versions(atlas.NewPath("project/readme.md"), "tester")
+	require.NoError(t, err)
+	assert.Len(t, versions, 2)
+}
+
+func TestExtract_Tar(t *testing.T) {
+	files := newTestAtlas(t)
+
+	headers := []*tar.Header{
+		{Name: "docs/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "docs/a.txt", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "docs/link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"},
+		{Name: "docs/a.txt/b.txt", Typeflag: tar.TypeReg, Mode: 0644},
+	}
+	contents := []string{"", "aaa", "", "bbb"}
+
+	for _, compress := range []bool{false, true} {
+		report, err := files.Extract(atlas.NewPath(""), "tester", bytes.NewReader(buildTar(t, compress, headers, contents...)))
+		require.NoError(t, err)
+		assert.Equal(t, atlas.ExtractSkipped, statuses(report)["docs/link"])
+		assert.Equal(t, atlas.ExtractSkipped, statuses(report)["docs/a.txt/b.txt"])
+		assert.Equal(t, "aaa", readFile(t, files, "docs/a.txt"))
+		assert.False(t, files.Exists(atlas.NewPath("docs/link")))
+	}
+}
+
+func compressZstd(t *testing.T, data []byte) []byte {
+	t.Helper()
+	zw, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	defer zw.Close()
+	return zw.EncodeAll(data, nil)
+}
+
+func TestExtract_TarZstd(t *testing.T) {
+	files := newTestAtlas(t)
+
+	headers := []*tar.Header{
+		{Name: "docs/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "docs/a.txt", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "docs/big.txt", Typeflag: tar.TypeReg, Mode: 0644},
+	}
+	big := strings.Repeat("0123456789", 20000)
+	archive := compressZstd(t, buildTar(t, false, headers, "", "aaa", big))
+
+	report, err := files.Extract(atlas.NewPath(""), "tester", bytes.NewReader(archive))
+	require.NoError(t, err)
+	assert.Equal(t, 3, report.Created)
+	assert.Equal(t, "aaa", readFile(t, files, "docs/a.txt"))
+	assert.Equal(t, big, readFile(t, files, "docs/big.txt"))
+
+	// A truncated stream extracts nothing
+	truncated := archive[:len(archive)-10]
+	_, err = files.Extract(atlas.NewPath("other"), "tester", bytes.NewReader(truncated))
+	assert.ErrorIs(t, err, atlas.ErrInvalidArchive)
+	assert.False(t, files.Exists(atlas.NewPath("other")))
+
+	// Frames asking for a window of 2 GiB are refused before anything is
+	// allocated
+	huge := binary.LittleEndian.AppendUint32(nil, 0xfd2fb528)
+	huge = append(huge, 0x00, 21<<3, 1, 0, 0)
+	_, err = files.Extract(atlas.NewPath("other"), "tester", bytes.NewReader(huge))
+	assert.ErrorIs(t, err, atlas.ErrInvalidArchive)
+}
+
+func TestExtract_Atomic(t *testing.T) {
+	files := newTestAtlas(t)
+	files.SetExtractLimits(atlas.ExtractLimits{Entries: 3, Size: 10})
+
+	_, err := files.Extract(atlas.NewPath("a"), "tester", bytes.NewReader(buildZip(t, "1", "1", "2", "2", "3", "3", "4", "4")))
+	assert.ErrorIs(t, err, atlas.ErrArchiveTooLarge)
+
+	// A bomb is caught by what it unpacks to, not by what it claims
+	bomb := buildZip(t, "small.txt", "12345", "large.txt", strings.Repeat("0", 1000))
+	_, err = files.Extract(atlas.NewPath("a"), "tester", bytes.NewReader(bomb))
+	assert.ErrorIs(t, err, atlas.ErrArchiveTooLarge)
+	assert.False(t, files.Exists(atlas.NewPath("a")))
+
+	require.NoError(t, files.SetQuotas(atlas.Quotas{Folders: map[string]int64{"a": 4}}))
+	_, err = files.Extract(atlas.NewPath("a"), "tester", bytes.NewReader(buildZip(t, "small.txt", "12345")))
+	assert.ErrorIs(t, err, atlas.ErrQuotaExceeded)
+	assert.False(t, files.Exists(atlas.NewPath("a/small.txt")))
+
+	_, err = files.Extract(atlas.NewPath("a"), "tester", strings.NewReader("not an archive"))
+	assert.ErrorIs(t, err, atlas.ErrUnsupportedArchive)
+
+	writeFile(t, files, "file", "x")
+	_, err = files.Extract(atlas.NewPath("file"), "tester", bytes.NewReader(buildZip(t, "x", "x")))
+	assert.ErrorIs(t, err, atlas.ErrIsFile)
+
+	report, err := files.CollectGarbage()
+	require.NoError(t, err)
+	assert.Zero(t, report.Removed)
+}
+
+func TestHandlers_Extract(t *testing.T) {
+	files := newTestAtlas(t)
+	mux := newTestMux(files)
+	mux.HandleFunc("POST /extract/{path...}", files.ExtractHandler)
+
+	rec := serve(mux, http.MethodPost, "/extract/seed", string(buildZip(t, "a.txt", "a", "b/c.txt", "c")))
+	require.Equal(t, http.StatusOK, rec.Code)
+	report := atlas.ExtractReport{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+	assert.Equal(t, "seed", report.Path)
+	assert.Equal(t, 2, report.Created)
+	assert.Equal(t, "c", readFile(t, files, "seed/b/c.txt"))
+
+	rec = serve(mux, http.MethodPost, "/extract/seed", "plain text")
+	assert.Equal(t, http.StatusUnsupportedMediaType, rec.Code)
+
+	files.SetExtractLimits(atlas.ExtractLimits{Entries: 1})
+	rec = serve(mux, http.MethodPost, "/extract/seed", string(buildZip(t, "a.txt", "a", "b.txt", "b")))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+}
@@ -0,0 +1,1080 @@
+package atlas
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/mnemosynefs/mnemo/internal/networking"
+)
+
+// Maps Atlas errors onto the HTTP status returned to the client
+func ErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrResourceNotFound), errors.Is(err, ErrTagNotFound),
+		errors.Is(err, ErrVersionNotFound), errors.Is(err, ErrUploadNotFound),
+		errors.Is(err, ErrTrashNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrIsFolder), errors.Is(err, ErrIsFile), errors.Is(err, ErrTagExists),
+		errors.Is(err, ErrUploadOffset), errors.Is(err, ErrUploadBusy),
+		errors.Is(err, ErrDestinationExists):
+		return http.StatusConflict
+	case errors.Is(err, ErrNotAuthenticated):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrUploadToRoot), errors.Is(err, ErrPermissionDenied):
+		return http.StatusForbidden
+	case errors.Is(err, ErrPreconditionFailed):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, ErrUploadTooLarge), errors.Is(err, ErrArchiveTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrUnsupportedArchive), errors.Is(err, ErrNoPreview):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, ErrQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, ErrInvalidTag), errors.Is(err, ErrInvalidPath),
+		errors.Is(err, ErrInvalidVersion), errors.Is(err, ErrInvalidListing),
+		errors.Is(err, ErrInvalidUpload), errors.Is(err, ErrChecksumMismatch),
+		errors.Is(err, ErrInvalidTransfer), errors.Is(err, ErrInvalidChecksum),
+		errors.Is(err, ErrInvalidArchive), errors.Is(err, ErrInvalidPreview),
+		errors.Is(err, ErrInvalidAnnotation), errors.Is(err, ErrInvalidEventID):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status := ErrorStatus(err)
+	if status == http.StatusInternalServerError {
+		http.Error(w, "Internal server error", status)
+		log.Errorf("Internal atlas error on %v %v: %v", r.Method, r.URL.Path, err)
+		return
+	}
+
+	http.Error(w, err.Error(), status)
+	log.Infof("Rejected %v %v: %v", r.Method, r.URL.Path, err)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warnf("Failed to encode response: %v", err)
+	}
+}
+
+// Serves an open file. Range requests, If-Modified-Since and If-None-Match are
+// answered by http.ServeContent against the modification time and the strong
+// entity tag of the file.
+func ServeFile(w http.ResponseWriter, r *http.Request, file *File) {
+	w.Header().Set("ETag", file.ETag())
+	w.Header().Set("Repr-Digest", file.Digest())
+	w.Header().Set("Content-Type", contentType(file.Key))
+	w.Header().Set("Cache-Control", "private, no-cache")
+
+	http.ServeContent(w, r, path.Base(file.Key), file.Entry.Modified, file)
+}
+
+// Reads the user a request changing files is made on behalf of. Guests
+// admitted without a session may only read.
+func requestAuthor(r *http.Request) (string, error) {
+	username := r.Header.Get("username")
+	if username == "" {
+		return "", ErrNotAuthenticated
+	}
+	return username, nil
+}
+
+// Parses the version query parameter, reporting whether one was given
+func versionParam(r *http.Request) (int, bool, error) {
+	value := r.URL.Query().Get("version")
+	if value == "" {
+		return 0, false, nil
+	}
+
+	id, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, true, ErrInvalidVersion
+	}
+	return id, true, nil
+}
+
+// Serves the current content of a file, or an older version of it when the
+// version query parameter is given
+func (f *Atlas) ReadHandler(w http.ResponseWriter, r *http.Request) {
+	path := NewPath(r.PathValue("path"))
+
+	username := r.Header.Get("username")
+
+	var file *File
+	id, ok, err := versionParam(r)
+	if err == nil && ok {
+		file, err = f.ReadVersion(path, id, username)
+	} else if err == nil {
+		file, err = f.Read(path, username)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer file.Close()
+
+	ServeFile(w, r, file)
+}
+
+// Reads the checksum a client sent along with content in a Repr-Digest,
+// Content-Digest or legacy Digest header
+func requestChecksum(r *http.Request) (string, error) {
+	for _, header := range []string{"Repr-Digest", "Content-Digest", "Digest"} {
+		if field := r.Header.Get(header); field != "" {
+			return ParseDigest(field)
+		}
+	}
+	return "", nil
+}
+
+// Reads the If-Match and If-None-Match fields of a request
+func RequestCondition(r *http.Request) Condition {
+	cond := Condition{}
+	if field := r.Header.Get("If-Match"); field != "" {
+		cond.IfMatch = ParseETags(field)
+	}
+	if field := r.Header.Get("If-None-Match"); field != "" {
+		cond.IfNoneMatch = ParseETags(field)
+	}
+	return cond
+}
+
+// Stores the request body as the file content. When the request carries a
+// SHA-256 digest the content is only stored if it matches. If-Match and
+// If-None-Match make the write conditional on the file it replaces, so
+// If-None-Match: * only creates files. Conditions are checked before the body
+// is read and again when it is stored.
+func (f *Atlas) WriteHandler(w http.ResponseWriter, r *http.Request) {
+	path := NewPath(r.PathValue("path"))
+
+	username, err := requestAuthor(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	checksum, err := requestChecksum(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	cond := RequestCondition(r)
+	if err := f.CheckCondition(path, cond); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writer, err := f.Write(path, username)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer writer.Abort()
+
+	if err := writer.Expect(checksum); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writer.Require(cond)
+
+	_, err = io.Copy(writer, r.Body)
+	if err == nil {
+		err = writer.Commit()
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	log.Infof("User %q wrote %v", username, path)
+	w.Header().Set("ETag", writer.ETag())
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Deletes a file or folder, if it satisfies If-Match and If-None-Match
+func (f *Atlas) DeleteHandler(w http.ResponseWriter, r *http.Request) {
+	path := NewPath(r.PathValue("path"))
+
+	username, err := requestAuthor(r)
+	if err == nil {
+		err = f.DeleteIf(path, username, RequestCondition(r))
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	log.Infof("User %q deleted %v", username, path)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Parses the overwrite query parameter of moves and copies, false if omitted
+func overwriteParam(r *http.Request) (bool, error) {
+	value := r.URL.Query().Get("overwrite")
+	if value == "" {
+		return false, nil
+	}
+
+	overwrite, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, ErrInvalidTransfer
+	}
+	return overwrite, nil
+}
+
+// Answers a move, copy or rename with 201 when the destination was created
+// and 204 when it replaced an existing one
+func writeTransfer(w http.ResponseWriter, created bool) {
+	if created {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Moves a file or folder to the path given by the "to" query parameter.
+// Existing destinations are only replaced with overwrite=true. If-Match applies
+// to the source and If-None-Match to the destination.
+func (f *Atlas) MoveHandler(w http.ResponseWriter, r *http.Request) {
+	src := NewPath(r.PathValue("path"))
+	dst := NewPath(r.URL.Query().Get("to"))
+
+	username, err := requestAuthor(r)
+	var overwrite bool
+	if err == nil {
+		overwrite, err = overwriteParam(r)
+	}
+	if err == nil && dst == "" {
+		err = ErrInvalidTransfer
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	created, err := f.MoveIf(src, dst, overwrite, username, RequestCondition(r))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	log.Infof("User %q moved %v to %v", username, src, dst)
+	writeTransfer(w, created)
+}
+
+// Copies a file or folder to the path given by the "to" query parameter.
+// Existing destinations are only replaced with overwrite=true. If-Match applies
+// to the source and If-None-Match to the destination.
+func (f *Atlas) CopyHandler(w http.ResponseWriter, r *http.Request) {
+	src := NewPath(r.PathValue("path"))
+	dst := NewPath(r.URL.Query().Get("to"))
+
+	username, err := requestAuthor(r)
+	var overwrite bool
+	if err == nil {
+		overwrite, err = overwriteParam(r)
+	}
+	if err == nil && dst == "" {
+		err = ErrInvalidTransfer
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	created, err := f.CopyIf(src, dst, overwrite, username, RequestCondition(r))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	log.Infof("User %q copied %v to %v", username, src, dst)
+	writeTransfer(w, created)
+}
+
+// Renames a file or folder to the name given by the name query parameter,
+// with the same conditions as moves
+func (f *Atlas) RenameHandler(w http.ResponseWriter, r *http.Request) {
+	path := NewPath(r.PathValue("path"))
+	name := r.URL.Query().Get("name")
+
+	username, err := requestAuthor(r)
+	var overwrite bool
+	if err == nil {
+		overwrite, err = overwriteParam(r)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	created, err := f.RenameIf(path, name, overwrite, username, RequestCondition(r))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	log.Infof("User %q renamed %v to %q", username, path, name)
+	writeTransfer(w, created)
+}
+
+// Page size of listings when the client does not ask for one
+const DefaultListLimit = 1000
+
+func listOptions(r *http.Request) (ListOptions, error) {
+	query := r.URL.Query()
+	options := ListOptions{
+		Sort:        query.Get("sort"),
+		Limit:       DefaultListLimit,
+		ContentType: query.Get("content_type"),
+	}
+
+	var err error
+	if value := query.Get("recursive"); value != "" {
+		if options.Recursive, err = strconv.ParseBool(value); err != nil {
+			return options, ErrInvalidListing
+		}
+	}
+	if value := query.Get("offset"); value != "" {
+		if options.Offset, err = strconv.Atoi(value); err != nil {
+			return options, ErrInvalidListing
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		if options.Limit, err = strconv.Atoi(value); err != nil {
+			return options, ErrInvalidListing
+		}
+	}
+
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		options.Reverse = true
+	default:
+		return options, ErrInvalidListing
+	}
+
+	return options, nil
+}
+
+// Lists a folder. Supports the recursive, sort, order, offset, limit and
+// content_type query parameters.
+func (f *Atlas) ListHandler(w http.ResponseWriter, r *http.Request) {
+	options, err := listOptions(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	options.User = r.Header.Get("username")
+
+	listing, err := f.List(NewPath(r.PathValue("path")), options)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, listing)
+}
+
+// Describes the content of a file: its sniffed content type and what could
+// be read from it, such as image dimensions or line counts
+func (f *Atlas) MetadataHandler(w http.ResponseWriter, r *http.Request) {
+	meta, err := f.Metadata(NewPath(r.PathValue("path")), r.Header.Get("username"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, meta)
+}
+
+//
+// Annotations
+//
+
+func (f *Atlas) AnnotationsHandler(w http.ResponseWriter, r *http.Request) {
+	annotations, err := f.Annotations(NewPath(r.PathValue("path")), r.Header.Get("username"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, annotations)
+}
+
+// Replaces the annotations of a file or folder with the labels and properties
+// of the JSON request body
+func (f *Atlas) AnnotateHandler(w http.ResponseWriter, r *http.Request) {
+	path := NewPath(r.PathValue("path"))
+
+	username, err := requestAuthor(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	var annotations Annotations
+	if err := json.NewDecoder(r.Body).Decode(&annotations); err != nil {
+		writeError(w, r, fmt.Errorf("%w: %w", ErrInvalidAnnotation, err))
+		return
+	}
+	annotations, err = f.Annotate(path, annotations, username)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	log.Infof("User %q annotated %v", username, path)
+	writeJSON(w, http.StatusOK, annotations)
+}
+
+// Changes the annotations of a file or folder. The JSON request body lists
+// labels to add and remove_labels to remove, and properties to set, a null
+// value removing the property.
+func (f *Atlas) PatchAnnotationsHandler(w http.ResponseWriter, r *http.Request) {
+	path := NewPath(r.PathValue("path"))
+
+	username, err := requestAuthor(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	var patch AnnotationPatch
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		writeError(w, r, fmt.Errorf("%w: %w", ErrInvalidAnnotation, err))
+		return
+	}
+	annotations, err := f.PatchAnnotations(path, patch, username)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	log.Infof("User %q annotated %v", username, path)
+	writeJSON(w, http.StatusOK, annotations)
+}
+
+// Finds the files and folders below the path carrying every label given by
+// the repeated label query parameter and every property given by the repeated
+// property parameter, as in property=year=2025
+func (f *Atlas) QueryHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	search := AnnotationQuery{Labels: query["label"], Properties: map[string]string{}}
+	for _, filter := range query["property"] {
+		name, value, ok := strings.Cut(filter, "=")
+		if !ok {
+			writeError(w, r, fmt.Errorf("%w: %q is not of the form name=value", ErrInvalidAnnotation, filter))
+			return
+		}
+		search.Properties[name] = value
+	}
+
+	listing, err := f.Query(NewPath(r.PathValue("path")), search, r.Header.Get("username"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, listing)
+}
+
+//
+// Uploads
+//
+
+func setUploadHeaders(w http.ResponseWriter, upload *Upload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// Looks up the upload named in the request. Uploads of other users are
+// reported as missing.
+func (f *Atlas) requestUpload(r *http.Request) (*Upload, error) {
+	username, err := requestAuthor(r)
+	if err != nil {
+		return nil, err
+	}
+	upload, err := f.Upload(r.PathValue("id"))
+	if err != nil {
+		return nil, err
+	}
+	if upload.Author != username {
+		return nil, ErrUploadNotFound
+	}
+	return upload, nil
+}
+
+// Starts a resumable upload. The size of the file is given by the
+// Upload-Length header, an optional Upload-Checksum header of the form
+// "sha256:<hex>" is verified once the upload is complete.
+func (f *Atlas) CreateUploadHandler(w http.ResponseWriter, r *http.Request) {
+	username, err := requestAuthor(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil {
+		writeError(w, r, ErrInvalidUpload)
+		return
+	}
+
+	upload, err := f.CreateUpload(NewPath(r.PathValue("path")), username, length, r.Header.Get("Upload-Checksum"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	log.Infof("User %q started upload %v of %v", username, upload.ID, upload.Path)
+	setUploadHeaders(w, upload)
+	w.Header().Set("Location", "/uploads/"+upload.ID)
+	writeJSON(w, http.StatusCreated, upload)
+}
+
+// Reports the state of an upload. The Upload-Offset header tells the client
+// where to resume.
+func (f *Atlas) UploadHandler(w http.ResponseWriter, r *http.Request) {
+	upload, err := f.requestUpload(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	setUploadHeaders(w, upload)
+	writeJSON(w, http.StatusOK, upload)
+}
+
+// Appends the request body to an upload at the offset given by the
+// Upload-Offset header. Answers 201 once the file is complete and published.
+func (f *Atlas) AppendUploadHandler(w http.ResponseWriter, r *http.Request) {
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		writeError(w, r, ErrInvalidUpload)
+		return
+	}
+
+	upload, err := f.requestUpload(r)
+	if err == nil {
+		upload, err = f.AppendUpload(upload.ID, offset, r.Body)
+	}
+	if upload != nil {
+		setUploadHeaders(w, upload)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if upload.Complete() {
+		log.Infof("User %q finished upload %v of %v", upload.Author, upload.ID, upload.Path)
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *Atlas) CancelUploadHandler(w http.ResponseWriter, r *http.Request) {
+	upload, err := f.requestUpload(r)
+	if err == nil {
+		err = f.CancelUpload(upload.ID)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	log.Infof("User %q cancelled upload %v of %v", upload.Author, upload.ID, upload.Path)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Reports the storage used by the requesting user and by every top-level
+// folder, together with their quotas
+func (f *Atlas) UsageHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, f.Usage(r.Header.Get("username")))
+}
+
+//
+// Trash
+//
+
+func (f *Atlas) ListTrashHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, f.Trash(r.Header.Get("username")))
+}
+
+// Restores a trash item to its original path, or to the path given by the
+// "to" query parameter. Existing files are only replaced with overwrite=true.
+func (f *Atlas) RestoreTrashHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	username, err := requestAuthor(r)
+	var overwrite bool
+	if err == nil {
+		overwrite, err = overwriteParam(r)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	created, err := f.RestoreTrash(username, id, NewPath(r.URL.Query().Get("to")), overwrite)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	log.Infof("User %q restored trash item %v", username, id)
+	writeTransfer(w, created)
+}
+
+func (f *Atlas) PurgeTrashHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	username, err := requestAuthor(r)
+	if err == nil {
+		err = f.PurgeTrash(username, id)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	log.Infof("User %q purged trash item %v", username, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *Atlas) EmptyTrashHandler(w http.ResponseWriter, r *http.Request) {
+	username, err := requestAuthor(r)
+	if err == nil {
+		err = f.EmptyTrash(username)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	log.Infof("User %q emptied their trash", username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//
+// Versions
+//
+
+func (f *Atlas) ListVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	versions, err := f.Versions(NewPath(r.PathValue("path")), r.Header.Get("username"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, versions)
+}
+
+// Promotes the version given by the version query parameter back to current
+func (f *Atlas) PromoteVersionHandler(w http.ResponseWriter, r *http.Request) {
+	path := NewPath(r.PathValue("path"))
+
+	username, err := requestAuthor(r)
+	var id int
+	var ok bool
+	if err == nil {
+		id, ok, err = versionParam(r)
+	}
+	if err == nil && !ok {
+		err = ErrInvalidVersion
+	}
+	if err == nil {
+		err = f.PromoteVersion(path, id, username)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	log.Infof("User %q promoted version %d of %v", username, id, path)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//
+// Tags
+//
+
+func (f *Atlas) CreateTagHandler(w http.ResponseWriter, r *http.Request) {
+	username, err := requestAuthor(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	info, err := f.CreateTag(r.PathValue("tag"), username)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	log.Infof("User %q created tag %q", username, info.Name)
+	writeJSON(w, http.StatusCreated, info)
+}
+
+func (f *Atlas) ListTagsHandler(w http.ResponseWriter, r *http.Request) {
+	tags, err := f.Tags()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, tags)
+}
+
+func (f *Atlas) DeleteTagHandler(w http.ResponseWriter, r *http.Request) {
+	tag := r.PathValue("tag")
+
+	username, err := requestAuthor(r)
+	if err == nil {
+		err = f.DeleteTag(tag, username)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	log.Infof("User %q deleted tag %q", username, tag)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *Atlas) ReadTagHandler(w http.ResponseWriter, r *http.Request) {
+	path := NewPath(r.PathValue("path"))
+
+	file, err := f.ReadTag(r.PathValue("tag"), path, r.Header.Get("username"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer file.Close()
+
+	ServeFile(w, r, file)
+}
+
+// Compares a tag against another tag given by the "to" query parameter, or
+// against curr when it is omitted
+func (f *Atlas) DiffTagHandler(w http.ResponseWriter, r *http.Request) {
+	diff, err := f.Diff(r.PathValue("tag"), r.URL.Query().Get("to"), r.Header.Get("username"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, diff)
+}
+
+func (f *Atlas) RestoreTagHandler(w http.ResponseWriter, r *http.Request) {
+	tag := r.PathValue("tag")
+	path := NewPath(r.PathValue("path"))
+
+	username, err := requestAuthor(r)
+	if err == nil {
+		err = f.Restore(tag, path, username)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	log.Infof("User %q restored %q from tag %q", username, path, tag)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//
+// Object store
+//
+
+func (f *Atlas) CollectGarbageHandler(w http.ResponseWriter, r *http.Request) {
+	username, err := requestAuthor(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	report, err := f.CollectGarbage()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	log.Infof("User %q collected garbage: %d objects, %d bytes", username, report.Removed, report.Freed)
+	writeJSON(w, http.StatusOK, report)
+}
+
+// Verifies the whole object store. Damage found is part of the report, not an
+// error of the request. The report names damaged paths whatever the user may
+// read, and re-hashing the store is costly, so the route is for
+// administrators.
+func (f *Atlas) ScrubHandler(w http.ResponseWriter, r *http.Request) {
+	report, err := f.Scrub()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	log.Infof("User %q scrubbed %d objects: %d corrupt, %d missing", r.Header.Get("username"), report.Checked, len(report.Corrupt), len(report.Missing))
+	writeJSON(w, http.StatusOK, report)
+}
+
+// Reports usage and compression of the whole store, which is for
+// administrators
+func (f *Atlas) StorageHandler(w http.ResponseWriter, r *http.Request) {
+	report, err := f.Storage()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+//
+// Archives
+//
+
+var archiveContentTypes = map[string]string{
+	ArchiveZip:   "application/zip",
+	ArchiveTarGz: "application/gzip",
+}
+
+// Downloads a file or folder as an archive streamed in the format given by
+// the format query parameter, zip or tar.gz, zip if omitted. Repeated select
+// parameters pick several entries below the path instead, and the tag
+// parameter reads them from a tag. Entries the user may not read are left
+// out.
+func (f *Atlas) ArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	username := r.Header.Get("username")
+
+	format := query.Get("format")
+	if format == "" {
+		format = ArchiveZip
+	}
+	if err := ValidateArchiveFormat(format); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	dir := r.PathValue("path")
+	sel := ArchiveSelection{Tag: query.Get("tag"), User: username}
+	for _, name := range query["select"] {
+		sel.Paths = append(sel.Paths, NewPath(path.Join(dir, name)))
+	}
+	if len(sel.Paths) == 0 {
+		sel.Paths = []Path{NewPath(dir)}
+	}
+
+	archive, err := f.Archive(sel)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	// Selections are named after the folder they were picked from
+	if len(query["select"]) > 0 && dir != "" {
+		archive.Name = path.Base(dir)
+	}
+
+	filename := archive.Name + "." + format
+	w.Header().Set("Content-Type", archiveContentTypes[format])
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	// The status is long sent when writing fails, the client sees a truncated
+	// archive
+	if err := archive.Write(w, format); err != nil {
+		log.Warnf("Archive %v for user %q was cut short: %v", filename, username, err)
+		return
+	}
+	log.Infof("User %q downloaded %v with %d entries", username, filename, archive.Len())
+}
+
+// Extracts the zip, tar, tar.gz or tar.zst archive sent as the request body
+// into the folder at the path, which is created if missing. The report lists
+// the outcome of every entry. Nothing is extracted when the archive is damaged
+// or exceeds the extraction limits or the quotas.
+func (f *Atlas) ExtractHandler(w http.ResponseWriter, r *http.Request) {
+	dir := NewPath(r.PathValue("path"))
+
+	username, err := requestAuthor(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	report, err := f.Extract(dir, username, r.Body)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	log.Infof("User %q extracted an archive into %v: %d created, %d replaced, %d skipped",
+		username, dir, report.Created, report.Replaced, report.Skipped)
+	writeJSON(w, http.StatusOK, report)
+}
+
+//
+// Previews
+//
+
+// Serves a preview of an image in the size given by the size query parameter,
+// small, medium or large, medium if omitted. Previews are revalidated against
+// their entity tag, which changes with the file they show.
+func (f *Atlas) PreviewHandler(w http.ResponseWriter, r *http.Request) {
+	size := r.URL.Query().Get("size")
+	if size == "" {
+		size = DefaultPreviewSize
+	}
+
+	preview, err := f.Preview(NewPath(r.PathValue("path")), size, r.Header.Get("username"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", preview.ETag())
+	w.Header().Set("Content-Type", preview.ContentType)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	http.ServeContent(w, r, "", preview.Modified, bytes.NewReader(preview.Data))
+}
+
+//
+// Events
+//
+
+// Interval of the keep-alive messages that stop proxies from closing idle
+// event streams
+const eventKeepAlive = 30 * time.Second
+
+// Reads the ID of the last event a resuming client saw from the Last-Event-ID
+// header, which browsers send when reconnecting, or from the last_event_id
+// query parameter. Reports whether one was given.
+func lastEventID(r *http.Request) (uint64, bool, error) {
+	value := r.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = r.URL.Query().Get("last_event_id")
+	}
+	if value == "" {
+		return 0, false, nil
+	}
+
+	id, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, false, ErrInvalidEventID
+	}
+	return id, true, nil
+}
+
+// Streams the changes below the path that the user may read, as Server-Sent
+// Events or as JSON messages over a WebSocket when the request asks for an
+// upgrade. Clients resume after the event given by the Last-Event-ID header
+// or the last_event_id query parameter. The stream ends when the client falls
+// too far behind, resuming picks up where it ended.
+func (f *Atlas) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	path := NewPath(r.PathValue("path"))
+	username := r.Header.Get("username")
+
+	after, resume, err := lastEventID(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	sub, err := f.Subscribe(path, username, after, resume)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer sub.Close()
+
+	log.Infof("User %q subscribed to the events below %v", username, path)
+	if networking.IsWebSocketRequest(r) {
+		streamWebSocket(w, r, sub)
+	} else {
+		streamEvents(w, r, sub)
+	}
+}
+
+func streamEvents(w http.ResponseWriter, r *http.Request, sub *Subscription) {
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	// Keeps reverse proxies such as nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		log.Warnf("Cannot stream events on %v: %v", r.URL.Path, err)
+		return
+	}
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			_, err = io.WriteString(w, ": keep-alive\n\n")
+		case event, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(event)
+			_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func streamWebSocket(w http.ResponseWriter, r *http.Request, sub *Subscription) {
+	ws, err := networking.UpgradeWebSocket(w, r)
+	if err != nil {
+		log.Infof("Rejected %v %v: %v", r.Method, r.URL.Path, err)
+		return
+	}
+	defer ws.Close(networking.CloseGoingAway)
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-ws.Done():
+			return
+		case <-keepAlive.C:
+			err = ws.Ping()
+		case event, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(event)
+			err = ws.WriteText(data)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
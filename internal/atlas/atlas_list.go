@@ -0,0 +1,211 @@
+package atlas
+
+import (
+	"cmp"
+	"errors"
+	"mime"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+var ErrInvalidListing = errors.New("listing options are not valid")
+
+const (
+	SortName     = "name"
+	SortSize     = "size"
+	SortModified = "modified"
+	SortType     = "type"
+)
+
+type ListOptions struct {
+	// Lists every descendant instead of the direct children only
+	Recursive bool
+	// One of SortName, SortSize, SortModified or SortType, SortName if empty
+	Sort    string
+	Reverse bool
+	// Window of the sorted entries to return, a limit of zero returns all
+	Offset int
+	Limit  int
+	// Lists only the files of this content type, or of this media type family
+	// when ending in a slash, such as "image/"
+	ContentType string
+	// Name of the user listing, whose read permission decides which entries
+	// are listed and counted into folder sizes
+	User string
+}
+
+type ListEntry struct {
+	Name        string    `json:"name"`
+	Path        string    `json:"path"`
+	Type        EntryType `json:"type"`
+	Size        int64     `json:"size"`
+	Modified    time.Time `json:"modified"`
+	ContentType string    `json:"content_type,omitempty"`
+	Checksum    string    `json:"checksum,omitempty"`
+	Metadata    *Metadata `json:"metadata,omitempty"`
+	Annotations
+}
+
+type Listing struct {
+	Path    string      `json:"path"`
+	Total   int         `json:"total"`
+	Offset  int         `json:"offset"`
+	Entries []ListEntry `json:"entries"`
+	// Entries left out as the user may not read them. Not told to clients,
+	// it lets callers tell whether they saw the whole folder.
+	Hidden int `json:"-"`
+}
+
+// Guesses the content type of a file from its extension
+func contentType(key string) string {
+	if t := mime.TypeByExtension(path.Ext(key)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// Reports whether a listed file is of the content type, or of the media type
+// family when it ends in a slash. Folders never match.
+func matchesContentType(entry *ListEntry, contentType string) bool {
+	if entry.Type == EntryDir {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(entry.ContentType)
+	if family, ok := strings.CutSuffix(contentType, "/"); ok {
+		return strings.HasPrefix(mediaType, family+"/")
+	}
+	return mediaType == contentType
+}
+
+func newListEntry(key string, entry Entry) ListEntry {
+	listEntry := ListEntry{
+		Name:        path.Base(key),
+		Path:        key,
+		Type:        entry.Type,
+		Size:        entry.Size,
+		Modified:    entry.Modified,
+		Annotations: entry.Annotations,
+	}
+	if !entry.IsDir() {
+		listEntry.ContentType = contentType(key)
+		listEntry.Checksum = "sha256:" + entry.Object
+	}
+	return listEntry
+}
+
+// Lists the content of a folder in curr. Folder sizes are the total size of
+// the files they contain.
+func (f *Atlas) List(p Path, options ListOptions) (*Listing, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	if options.Offset < 0 || options.Limit < 0 {
+		return nil, ErrInvalidListing
+	}
+
+	var compare func(a, b ListEntry) int
+	switch options.Sort {
+	case "", SortName:
+		compare = func(a, b ListEntry) int { return strings.Compare(a.Name, b.Name) }
+	case SortSize:
+		compare = func(a, b ListEntry) int { return cmp.Compare(a.Size, b.Size) }
+	case SortModified:
+		compare = func(a, b ListEntry) int { return a.Modified.Compare(b.Modified) }
+	case SortType:
+		compare = func(a, b ListEntry) int { return strings.Compare(string(a.Type), string(b.Type)) }
+	default:
+		return nil, ErrInvalidListing
+	}
+
+	f.mu.Lock()
+	key := p.Key()
+	folder, ok := f.curr.Get(key)
+	if !ok || !f.canRead(options.User, key) {
+		f.mu.Unlock()
+		return nil, ErrResourceNotFound
+	}
+	if !folder.IsDir() {
+		f.mu.Unlock()
+		return nil, ErrIsFile
+	}
+	subtree := f.curr.Subtree(key)
+	hidden := 0
+	for k := range subtree {
+		if k != key && !f.canRead(options.User, k) {
+			delete(subtree, k)
+			if options.Recursive || parentKey(k) == key {
+				hidden++
+			}
+		}
+	}
+	described := map[string]Metadata{}
+	for _, entry := range subtree {
+		if meta, ok := f.metadata[entry.Object]; ok && !entry.IsDir() {
+			described[entry.Object] = meta
+		}
+	}
+	f.mu.Unlock()
+
+	entries := map[string]*ListEntry{}
+	for k, entry := range subtree {
+		if k == key {
+			continue
+		}
+		if options.Recursive || parentKey(k) == key {
+			listEntry := newListEntry(k, entry)
+			if meta, ok := described[entry.Object]; ok && !entry.IsDir() {
+				listEntry.ContentType = meta.ContentType
+				listEntry.Metadata = &meta
+			}
+			entries[k] = &listEntry
+		}
+	}
+
+	// Sum up file sizes into every listed folder above them
+	for k, entry := range subtree {
+		if entry.IsDir() {
+			continue
+		}
+		for dir := parentKey(k); dir != key && dir != ""; dir = parentKey(dir) {
+			if listEntry, ok := entries[dir]; ok {
+				listEntry.Size += entry.Size
+			}
+		}
+	}
+
+	sorted := make([]ListEntry, 0, len(entries))
+	for _, listEntry := range entries {
+		if options.ContentType != "" && !matchesContentType(listEntry, options.ContentType) {
+			continue
+		}
+		sorted = append(sorted, *listEntry)
+	}
+	slices.SortFunc(sorted, func(a, b ListEntry) int {
+		order := compare(a, b)
+		if order == 0 {
+			order = strings.Compare(a.Path, b.Path)
+		}
+		if options.Reverse {
+			return -order
+		}
+		return order
+	})
+
+	listing := &Listing{
+		Path:   key,
+		Total:  len(sorted),
+		Offset: options.Offset,
+		Hidden: hidden,
+	}
+
+	start := min(options.Offset, len(sorted))
+	end := len(sorted)
+	if options.Limit > 0 {
+		end = min(start+options.Limit, end)
+	}
+	listing.Entries = sorted[start:end]
+
+	return listing, nil
+}
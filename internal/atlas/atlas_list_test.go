@@ -0,0 +1,102 @@
+package atlas_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/mnemosynefs/mnemo/internal/atlas"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func listPaths(listing *atlas.Listing) []string {
+	paths := []string{}
+	for _, entry := range listing.Entries {
+		paths = append(paths, entry.Path)
+	}
+	return paths
+}
+
+func newListingAtlas(t *testing.T) *atlas.Atlas {
+	t.Helper()
+	files := newTestAtlas(t)
+	writeFile(t, files, "b.txt", "bbb")
+	writeFile(t, files, "a.json", "{}")
+	writeFile(t, files, "docs/readme.md", "hello")
+	writeFile(t, files, "docs/img/logo.png", "png")
+	return files
+}
+
+func TestList(t *testing.T) {
+	files := newListingAtlas(t)
+
+	listing, err := files.List(atlas.NewPath(""), atlas.ListOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 3, listing.Total)
+	assert.Equal(t, []string{"a.json", "b.txt", "docs"}, listPaths(listing))
+
+	json := listing.Entries[0]
+	assert.Equal(t, atlas.EntryFile, json.Type)
+	assert.Equal(t, "application/json", json.ContentType)
+	assert.Equal(t, "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a", json.Checksum)
+
+	docs := listing.Entries[2]
+	assert.Equal(t, atlas.EntryDir, docs.Type)
+	assert.Equal(t, int64(8), docs.Size)
+	assert.Empty(t, docs.Checksum)
+
+	listing, err = files.List(atlas.NewPath("docs"), atlas.ListOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"docs/img", "docs/readme.md"}, listPaths(listing))
+}
+
+func TestList_Options(t *testing.T) {
+	files := newListingAtlas(t)
+
+	listing, err := files.List(atlas.NewPath(""), atlas.ListOptions{Recursive: true})
+	require.NoError(t, err)
+	assert.Equal(t, 6, listing.Total)
+
+	listing, err = files.List(atlas.NewPath(""), atlas.ListOptions{Sort: atlas.SortSize, Reverse: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"docs", "b.txt", "a.json"}, listPaths(listing))
+
+	listing, err = files.List(atlas.NewPath(""), atlas.ListOptions{Recursive: true, Offset: 2, Limit: 2})
+	require.NoError(t, err)
+	assert.Equal(t, 6, listing.Total)
+	assert.Equal(t, []string{"docs", "docs/img"}, listPaths(listing))
+
+	listing, err = files.List(atlas.NewPath(""), atlas.ListOptions{Offset: 10})
+	require.NoError(t, err)
+	assert.Empty(t, listing.Entries)
+
+	_, err = files.List(atlas.NewPath(""), atlas.ListOptions{Sort: "colour"})
+	assert.ErrorIs(t, err, atlas.ErrInvalidListing)
+
+	_, err = files.List(atlas.NewPath("b.txt"), atlas.ListOptions{})
+	assert.ErrorIs(t, err, atlas.ErrIsFile)
+
+	_, err = files.List(atlas.NewPath("missing"), atlas.ListOptions{})
+	assert.ErrorIs(t, err, atlas.ErrResourceNotFound)
+}
+
+func TestHandlers_List(t *testing.T) {
+	files := newListingAtlas(t)
+	mux := newTestMux(files)
+	mux.HandleFunc("GET /list/{path...}", files.ListHandler)
+
+	rec := serve(mux, http.MethodGet, "/list/docs?recursive=true&sort=name&order=desc&limit=2", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var listing atlas.Listing
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &listing))
+	assert.Equal(t, 3, listing.Total)
+	assert.Equal(t, []string{"docs/readme.md", "docs/img/logo.png"}, listPaths(&listing))
+
+	rec = serve(mux, http.MethodGet, "/list/?order=sideways", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = serve(mux, http.MethodGet, "/list/missing", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
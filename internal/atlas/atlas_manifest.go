@@ -0,0 +1,217 @@
+package atlas
+
+import (
+	"encoding/json"
+	"io/fs"
+	"maps"
+	"path"
+	"strings"
+	"time"
+)
+
+type EntryType string
+
+const (
+	EntryFile EntryType = "file"
+	EntryDir  EntryType = "dir"
+)
+
+// Entry describes a single file or folder of a tree. Files point at the object
+// holding their content.
+type Entry struct {
+	Type     EntryType `json:"type"`
+	Object   string    `json:"object,omitempty"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Author   string    `json:"author,omitempty"`
+	Version  int       `json:"version,omitempty"`
+	Annotations
+}
+
+func (e Entry) IsDir() bool {
+	return e.Type == EntryDir
+}
+
+// Manifest maps slash separated paths onto entries. The root folder is
+// implicit and never stored.
+type Manifest struct {
+	Entries map[string]Entry `json:"entries"`
+
+	// Running totals of the file sizes per author and per top-level folder,
+	// counted on first use and kept up by Put and Remove
+	users   map[string]int64
+	folders map[string]int64
+}
+
+func NewManifest() *Manifest {
+	return &Manifest{Entries: map[string]Entry{}}
+}
+
+func (m *Manifest) Get(key string) (Entry, bool) {
+	if key == "" {
+		return Entry{Type: EntryDir}, true
+	}
+	entry, ok := m.Entries[key]
+	return entry, ok
+}
+
+// Returns the entry at key and everything below it
+func (m *Manifest) Subtree(key string) map[string]Entry {
+	subtree := map[string]Entry{}
+	for k, entry := range m.Entries {
+		if isWithin(k, key) {
+			subtree[k] = entry
+		}
+	}
+	return subtree
+}
+
+// Stores entry at key, replacing the entry there
+func (m *Manifest) Put(key string, entry Entry) {
+	if replaced, ok := m.Entries[key]; ok {
+		m.count(key, replaced, -1)
+	}
+	m.Entries[key] = entry
+	m.count(key, entry, 1)
+}
+
+// Removes the entry at key and everything below it, returning what was removed
+func (m *Manifest) Remove(key string) map[string]Entry {
+	removed := m.Subtree(key)
+	for k, entry := range removed {
+		delete(m.Entries, k)
+		m.count(k, entry, -1)
+	}
+	return removed
+}
+
+// Adds the size of a file entry to the totals, or subtracts it
+func (m *Manifest) count(key string, entry Entry, sign int64) {
+	if m.users == nil || entry.IsDir() {
+		return
+	}
+	m.users[entry.Author] += sign * entry.Size
+	if m.users[entry.Author] == 0 {
+		delete(m.users, entry.Author)
+	}
+	folder := topFolder(key)
+	m.folders[folder] += sign * entry.Size
+	if m.folders[folder] == 0 {
+		delete(m.folders, folder)
+	}
+}
+
+// Returns the total file sizes per author and per top-level folder. The maps
+// are the running totals and must not be modified.
+func (m *Manifest) Usage() (map[string]int64, map[string]int64) {
+	if m.users == nil {
+		m.users, m.folders = map[string]int64{}, map[string]int64{}
+		for key, entry := range m.Entries {
+			m.count(key, entry, 1)
+		}
+	}
+	return m.users, m.folders
+}
+
+// Creates the folders leading up to key. Files standing in the way are
+// reported with ErrIsFile.
+func (m *Manifest) MakeParents(key string, modified time.Time) error {
+	parents := []string{}
+	for dir := parentKey(key); dir != ""; dir = parentKey(dir) {
+		parents = append(parents, dir)
+	}
+
+	for i := len(parents) - 1; i >= 0; i-- {
+		entry, ok := m.Entries[parents[i]]
+		if ok && !entry.IsDir() {
+			return ErrIsFile
+		}
+		if !ok {
+			m.Entries[parents[i]] = Entry{Type: EntryDir, Modified: modified}
+		}
+	}
+
+	return nil
+}
+
+// Calls fn for every file entry of the manifest
+func (m *Manifest) EachFile(fn func(key string, entry Entry)) {
+	for key, entry := range m.Entries {
+		if !entry.IsDir() {
+			fn(key, entry)
+		}
+	}
+}
+
+func (m *Manifest) Clone() *Manifest {
+	clone := NewManifest()
+	for key, entry := range m.Entries {
+		clone.Entries[key] = entry
+	}
+	if m.users != nil {
+		clone.users, clone.folders = maps.Clone(m.users), maps.Clone(m.folders)
+	}
+	return clone
+}
+
+func parentKey(key string) string {
+	dir := path.Dir(key)
+	if dir == "." || dir == "/" {
+		return ""
+	}
+	return dir
+}
+
+// Reports whether key is root or lies below it
+func isWithin(key string, root string) bool {
+	return root == "" || key == root || strings.HasPrefix(key, root+"/")
+}
+
+// entryInfo exposes a manifest entry as an fs.FileInfo
+type entryInfo struct {
+	name  string
+	entry Entry
+}
+
+func (i entryInfo) Name() string       { return i.name }
+func (i entryInfo) Size() int64        { return i.entry.Size }
+func (i entryInfo) ModTime() time.Time { return i.entry.Modified }
+func (i entryInfo) IsDir() bool        { return i.entry.IsDir() }
+func (i entryInfo) Sys() any           { return i.entry }
+
+func (i entryInfo) Mode() fs.FileMode {
+	if i.entry.IsDir() {
+		return fs.ModeDir | dirPerm
+	}
+	return filePerm
+}
+
+// Loads a JSON document written by saveJSON
+func (f *Atlas) loadJSON(name string, v any) error {
+	file, err := f.backend.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return json.NewDecoder(file).Decode(v)
+}
+
+// Writes a JSON document. Backends only publish it once complete, so a crash
+// never leaves a half written document behind.
+func (f *Atlas) saveJSON(name string, v any) error {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	w, err := f.backend.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(content); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Commit()
+}
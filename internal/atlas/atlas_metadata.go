@@ -0,0 +1,562 @@
+package atlas
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/charmbracelet/log"
+)
+
+// Metadata describes what the content of a file is. It is extracted when the
+// content is written and kept in atlas/metadata.json keyed by object, so moved,
+// copied and restored files keep theirs and identical content is only
+// inspected once. The index is not encrypted, so with a master key set it
+// leaves out the EXIF tags of images, which are read from the content when
+// asked for instead.
+
+// Archives with more entries are reported as holding this many
+const maxCountedEntries = 100_000
+
+type ImageMetadata struct {
+	Format string `json:"format"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	// Camera and timestamp tags of the EXIF data of JPEG images. Not listed
+	// for encrypted atlases.
+	EXIF map[string]string `json:"exif,omitempty"`
+}
+
+type TextMetadata struct {
+	// us-ascii, utf-8, utf-16le, utf-16be or unknown
+	Encoding string `json:"encoding"`
+	Lines    int    `json:"lines"`
+}
+
+type ArchiveMetadata struct {
+	Format  string `json:"format"`
+	Entries int    `json:"entries"`
+}
+
+type Metadata struct {
+	ContentType string           `json:"content_type"`
+	Image       *ImageMetadata   `json:"image,omitempty"`
+	Text        *TextMetadata    `json:"text,omitempty"`
+	Archive     *ArchiveMetadata `json:"archive,omitempty"`
+}
+
+// Metadata of a file in curr together with its entry
+type FileMetadata struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Checksum string    `json:"checksum"`
+	Metadata
+}
+
+func (f *Atlas) metadataFile() string {
+	return "metadata.json"
+}
+
+func (f *Atlas) loadMetadata() error {
+	err := f.loadJSON(f.metadataFile(), &f.metadata)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Records the metadata of objects not described yet and persists the index.
+// An index failing to save only costs inspecting the content again, so it
+// does not fail the write. Must be called with the atlas lock held.
+func (f *Atlas) recordMetadata(objects map[string]*Metadata) {
+	changed := false
+	for object, meta := range objects {
+		if _, ok := f.metadata[object]; ok || meta == nil {
+			continue
+		}
+		stored := *meta
+		if f.masterKey() != nil {
+			stored = stored.withoutEXIF()
+		}
+		f.metadata[object] = stored
+		changed = true
+	}
+	if !changed {
+		return
+	}
+	if err := f.saveJSON(f.metadataFile(), f.metadata); err != nil {
+		log.Warnf("Failed to save the metadata index: %v", err)
+	}
+}
+
+// Returns a copy without EXIF tags
+func (m Metadata) withoutEXIF() Metadata {
+	if m.Image != nil && m.Image.EXIF != nil {
+		img := *m.Image
+		img.EXIF = nil
+		m.Image = &img
+	}
+	return m
+}
+
+// Drops the EXIF tags kept in the index, as done when the atlas gets
+// encrypted. Must be called with the atlas lock held.
+func (f *Atlas) dropEXIF() error {
+	changed := false
+	for object, meta := range f.metadata {
+		if meta.Image != nil && meta.Image.EXIF != nil {
+			f.metadata[object] = meta.withoutEXIF()
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return f.saveJSON(f.metadataFile(), f.metadata)
+}
+
+// Drops the metadata of objects no longer referenced. Must be called with the
+// atlas lock held and the references counted.
+func (f *Atlas) collectMetadata() error {
+	changed := false
+	for object := range f.metadata {
+		if f.refs[object] <= 0 {
+			delete(f.metadata, object)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return f.saveJSON(f.metadataFile(), f.metadata)
+}
+
+// Inspects staged content about to be stored for key. Failing to inspect
+// never fails the write, the file is then described on first request.
+func (f *Atlas) inspectStaged(w *objectWriter, key string) *Metadata {
+	if err := w.stage(); err != nil {
+		return nil
+	}
+	content, err := f.backend.Open(w.name)
+	if err != nil {
+		return nil
+	}
+	defer content.Close()
+
+	meta, err := inspect(key, content)
+	if err != nil {
+		log.Warnf("Failed to inspect %v: %v", key, err)
+		return nil
+	}
+	return meta
+}
+
+// Returns the metadata of the file at path, inspecting its content if that
+// was not done on write. Files the user may not read are reported missing.
+func (f *Atlas) Metadata(p Path, user string) (*FileMetadata, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := p.Key()
+	entry, ok := f.curr.Get(key)
+	if !ok || !f.canRead(user, key) {
+		return nil, ErrResourceNotFound
+	}
+	if entry.IsDir() {
+		return nil, ErrIsFolder
+	}
+
+	file := &FileMetadata{
+		Path:     key,
+		Size:     entry.Size,
+		Modified: entry.Modified,
+		Checksum: "sha256:" + entry.Object,
+	}
+	if meta, ok := f.metadata[entry.Object]; ok {
+		file.Metadata = meta
+		if f.masterKey() == nil || meta.Image == nil || meta.Image.Format != "jpeg" {
+			return file, nil
+		}
+
+		content, err := f.openObject(entry.Object, entry.Size)
+		if err != nil {
+			return nil, err
+		}
+		defer content.Close()
+
+		img := *meta.Image
+		img.EXIF = readEXIF(bufio.NewReader(content))
+		file.Image = &img
+		return file, nil
+	}
+
+	content, err := f.openObject(entry.Object, entry.Size)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	meta, err := inspect(key, content)
+	if err != nil {
+		return nil, err
+	}
+	f.recordMetadata(map[string]*Metadata{entry.Object: meta})
+	file.Metadata = *meta
+	return file, nil
+}
+
+// Sniffs the type of content from its first bytes. Generic answers give way
+// to the type the extension of key suggests, so JSON is not plain text and a
+// document is not just a zip archive.
+func sniff(key string, head []byte) string {
+	sniffed := http.DetectContentType(head)
+	switch sniffed {
+	case "application/octet-stream", "text/plain; charset=utf-8", "application/zip", "application/x-gzip":
+		if byExt := mime.TypeByExtension(path.Ext(key)); byExt != "" {
+			return byExt
+		}
+	}
+	return sniffed
+}
+
+func isText(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case strings.HasPrefix(mediaType, "text/"), strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "application/x-sh", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// Describes content stored at key
+func inspect(key string, content io.ReadSeeker) (*Metadata, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(content, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	meta := &Metadata{ContentType: sniff(key, head[:n])}
+	err = nil
+
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	mediaType, _, _ := mime.ParseMediaType(meta.ContentType)
+
+	switch {
+	case isText(meta.ContentType):
+		meta.Text, err = inspectText(content)
+	case mediaType == "image/png" || mediaType == "image/jpeg" || mediaType == "image/gif" || mediaType == "image/webp":
+		meta.Image, err = inspectImage(content)
+	case mediaType == "application/zip":
+		meta.Archive = inspectZip(content)
+	case mediaType == "application/x-tar":
+		meta.Archive = inspectTar(content, "tar")
+	case mediaType == "application/gzip" || mediaType == "application/x-gzip":
+		if strings.HasSuffix(key, ".tar.gz") || strings.HasSuffix(key, ".tgz") {
+			if gz, err := gzip.NewReader(content); err == nil {
+				meta.Archive = inspectTar(gz, "tar.gz")
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// Counts lines and guesses the encoding of text, reading it once
+func inspectText(content io.Reader) (*TextMetadata, error) {
+	in := bufio.NewReader(content)
+	bom, _ := in.Peek(3)
+
+	text := &TextMetadata{Encoding: "us-ascii"}
+	switch {
+	case bytes.HasPrefix(bom, []byte{0xef, 0xbb, 0xbf}):
+		text.Encoding = "utf-8"
+	case bytes.HasPrefix(bom, []byte{0xff, 0xfe}):
+		text.Encoding = "utf-16le"
+	case bytes.HasPrefix(bom, []byte{0xfe, 0xff}):
+		text.Encoding = "utf-16be"
+	}
+	switch text.Encoding {
+	case "utf-16le":
+		return text, countUTF16Lines(in, binary.LittleEndian, text)
+	case "utf-16be":
+		return text, countUTF16Lines(in, binary.BigEndian, text)
+	}
+
+	buf := make([]byte, 32*1024)
+	// Bytes of a character cut in two by the end of the buffer
+	carry := 0
+	// Last byte read
+	last := byte('\n')
+	for {
+		n, err := in.Read(buf[carry:])
+		chunk := buf[:carry+n]
+		if n > 0 {
+			text.Lines += bytes.Count(buf[carry:carry+n], []byte{'\n'})
+			last = chunk[len(chunk)-1]
+		}
+
+		// A character cut by the end of the buffer is validated with the
+		// next read
+		end := len(chunk)
+		if err == nil {
+			for i := 1; i < utf8.UTFMax && i <= len(chunk); i++ {
+				if utf8.RuneStart(chunk[len(chunk)-i]) {
+					if !utf8.FullRune(chunk[len(chunk)-i:]) {
+						end = len(chunk) - i
+					}
+					break
+				}
+			}
+		}
+		if text.Encoding != "unknown" {
+			switch {
+			case !utf8.Valid(chunk[:end]):
+				text.Encoding = "unknown"
+			case text.Encoding == "us-ascii" && !isASCII(chunk[:end]):
+				text.Encoding = "utf-8"
+			}
+		}
+		carry = copy(buf, chunk[end:])
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// A last line without line break still counts
+	if last != '\n' {
+		text.Lines++
+	}
+	return text, nil
+}
+
+// Counts the lines of UTF-16 text by its code units, so only U+000A breaks a
+// line and not every 0x0A byte. Units of surrogate pairs never equal U+000A.
+func countUTF16Lines(in io.Reader, order binary.ByteOrder, text *TextMetadata) error {
+	buf := make([]byte, 32*1024)
+	// Byte of a unit cut in two by the end of the buffer
+	carry := 0
+	last := uint16('\n')
+	for {
+		n, err := in.Read(buf[carry:])
+		chunk := buf[:carry+n]
+		units := len(chunk) &^ 1
+		for i := 0; i < units; i += 2 {
+			last = order.Uint16(chunk[i:])
+			if last == '\n' {
+				text.Lines++
+			}
+		}
+		carry = copy(buf, chunk[units:])
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if last != '\n' {
+		text.Lines++
+	}
+	return nil
+}
+
+func isASCII(p []byte) bool {
+	for _, b := range p {
+		if b >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+func inspectImage(content io.ReadSeeker) (*ImageMetadata, error) {
+	config, format, err := image.DecodeConfig(content)
+	if err != nil {
+		// Content merely looking like an image has no dimensions to report
+		return nil, nil
+	}
+
+	img := &ImageMetadata{Format: format, Width: config.Width, Height: config.Height}
+	if format == "jpeg" {
+		if _, err := content.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		img.EXIF = readEXIF(bufio.NewReader(content))
+	}
+	return img, nil
+}
+
+func inspectZip(content io.ReadSeeker) *ArchiveMetadata {
+	// Backends without random access cannot read the central directory
+	at, ok := content.(io.ReaderAt)
+	if !ok {
+		return nil
+	}
+	size, err := content.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil
+	}
+	zr, err := zip.NewReader(at, size)
+	if err != nil && !errors.Is(err, zip.ErrInsecurePath) {
+		return nil
+	}
+	return &ArchiveMetadata{Format: ArchiveZip, Entries: len(zr.File)}
+}
+
+func inspectTar(content io.Reader, format string) *ArchiveMetadata {
+	tr := tar.NewReader(content)
+	archive := &ArchiveMetadata{Format: format}
+	for archive.Entries < maxCountedEntries {
+		if _, err := tr.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil
+		}
+		archive.Entries++
+	}
+	return archive
+}
+
+// EXIF tags reported, by TIFF tag number
+var exifTags = map[uint16]string{
+	0x010f: "Make",
+	0x0110: "Model",
+	0x0112: "Orientation",
+	0x0131: "Software",
+	0x0132: "DateTime",
+	0x9003: "DateTimeOriginal",
+	0xa002: "PixelXDimension",
+	0xa003: "PixelYDimension",
+}
+
+// Tag of the IFD0 entry pointing at the EXIF sub-IFD
+const exifPointer = 0x8769
+
+// Finds the APP1 segment of a JPEG stream and reads the tags of exifTags from
+// it. Streams without one, or with a damaged one, yield nil.
+func readEXIF(r io.Reader) map[string]string {
+	var marker [4]byte
+	if _, err := io.ReadFull(r, marker[:2]); err != nil || marker[0] != 0xff || marker[1] != 0xd8 {
+		return nil
+	}
+
+	for {
+		if _, err := io.ReadFull(r, marker[:]); err != nil || marker[0] != 0xff {
+			return nil
+		}
+		// Image data starts, no metadata segment follows
+		if marker[1] == 0xda || marker[1] == 0xd9 {
+			return nil
+		}
+
+		length := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		if length < 0 {
+			return nil
+		}
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return nil
+		}
+		if marker[1] == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return parseTIFF(segment[6:])
+		}
+	}
+}
+
+// Reads the tags of exifTags from TIFF structured data
+func parseTIFF(data []byte) map[string]string {
+	if len(data) < 8 {
+		return nil
+	}
+	var order binary.ByteOrder
+	switch string(data[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return nil
+	}
+
+	tags := map[string]string{}
+	var readIFD func(offset uint32, depth int)
+	readIFD = func(offset uint32, depth int) {
+		if depth > 1 || int(offset)+2 > len(data) {
+			return
+		}
+		count := int(order.Uint16(data[offset:]))
+		for i := range count {
+			start := int(offset) + 2 + i*12
+			if start+12 > len(data) {
+				return
+			}
+			entry := data[start : start+12]
+			tag, kind, n := order.Uint16(entry), order.Uint16(entry[2:]), order.Uint32(entry[4:])
+
+			if tag == exifPointer && kind == 4 {
+				readIFD(order.Uint32(entry[8:]), depth+1)
+				continue
+			}
+			name, ok := exifTags[tag]
+			if !ok {
+				continue
+			}
+
+			switch kind {
+			case 2: // ASCII, inline when it fits four bytes
+				value := entry[8:12]
+				if n > 4 {
+					at := order.Uint32(entry[8:])
+					if uint64(at)+uint64(n) > uint64(len(data)) {
+						continue
+					}
+					value = data[at : at+n]
+				}
+				tags[name] = strings.TrimRight(string(value[:min(int(n), len(value))]), "\x00 ")
+			case 3: // SHORT
+				tags[name] = strconv.Itoa(int(order.Uint16(entry[8:])))
+			case 4: // LONG
+				tags[name] = strconv.Itoa(int(order.Uint32(entry[8:])))
+			}
+		}
+	}
+	readIFD(order.Uint32(data[4:]), 0)
+
+	if len(tags) == 0 {
+		return nil
+	}
+	return tags
+}
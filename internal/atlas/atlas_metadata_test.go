@@ -0,0 +1,178 @@
+package atlas_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/mnemosynefs/mnemo/internal/atlas"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Inserts an EXIF segment with Make, Model and Orientation tags into a JPEG
+func withEXIF(t *testing.T, jpeg string) string {
+	t.Helper()
+	tiff := &bytes.Buffer{}
+	order := binary.LittleEndian
+	tiff.WriteString("II*\x00")
+	binary.Write(tiff, order, uint32(8))
+
+	// Three entries, the strings placed after the IFD
+	binary.Write(tiff, order, uint16(3))
+	strings := 8 + 2 + 3*12 + 4
+	entry := func(tag uint16, kind uint16, count uint32, value uint32) {
+		binary.Write(tiff, order, tag)
+		binary.Write(tiff, order, kind)
+		binary.Write(tiff, order, count)
+		binary.Write(tiff, order, value)
+	}
+	entry(0x010f, 2, 6, uint32(strings))
+	entry(0x0110, 2, 4, order.Uint32([]byte("X1\x00\x00")))
+	entry(0x0112, 3, 1, 6)
+	binary.Write(tiff, order, uint32(0))
+	tiff.WriteString("Canon\x00")
+
+	segment := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	app1 := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(segment)+2))
+	return jpeg[:2] + string(app1) + string(segment) + jpeg[2:]
+}
+
+func TestMetadata(t *testing.T) {
+	files := newTestAtlas(t)
+
+	tarball := buildTar(t, true, []*tar.Header{
+		{Name: "a", Typeflag: tar.TypeReg},
+		{Name: "b", Typeflag: tar.TypeReg},
+	}, "a", "b")
+
+	for _, test := range []struct {
+		path    string
+		content string
+		want    atlas.Metadata
+	}{
+		{"notes.txt", "one\ntwo\nthree", atlas.Metadata{
+			ContentType: "text/plain; charset=utf-8",
+			Text:        &atlas.TextMetadata{Encoding: "us-ascii", Lines: 3},
+		}},
+		{"data.json", "{\n  \"name\": \"Zoë\"\n}\n", atlas.Metadata{
+			ContentType: "application/json",
+			Text:        &atlas.TextMetadata{Encoding: "utf-8", Lines: 3},
+		}},
+		{"wide.txt", "\xff\xfeh\x00i\x00\n\x00", atlas.Metadata{
+			ContentType: "text/plain; charset=utf-16le",
+			Text:        &atlas.TextMetadata{Encoding: "utf-16le", Lines: 1},
+		}},
+		// U+010A and U+0A0D hold 0x0A bytes without breaking lines
+		{"wider.txt", "\xff\xfe\x0a\x01\n\x00\x0d\x0a", atlas.Metadata{
+			ContentType: "text/plain; charset=utf-16le",
+			Text:        &atlas.TextMetadata{Encoding: "utf-16le", Lines: 2},
+		}},
+		{"big.txt", "\xfe\xff\x01\x0a\x00x\x0a\x0d", atlas.Metadata{
+			ContentType: "text/plain; charset=utf-16be",
+			Text:        &atlas.TextMetadata{Encoding: "utf-16be", Lines: 1},
+		}},
+		{"latin.txt", "caf\xe9\n", atlas.Metadata{
+			ContentType: "text/plain; charset=utf-8",
+			Text:        &atlas.TextMetadata{Encoding: "unknown", Lines: 1},
+		}},
+		{"renamed.bin", encodeImage(t, "png", 30, 20), atlas.Metadata{
+			ContentType: "image/png",
+			Image:       &atlas.ImageMetadata{Format: "png", Width: 30, Height: 20},
+		}},
+		{"sticker.webp", encodeImage(t, "webp", 30, 20), atlas.Metadata{
+			ContentType: "image/webp",
+			Image:       &atlas.ImageMetadata{Format: "webp", Width: 30, Height: 20},
+		}},
+		{"photo.jpg", withEXIF(t, encodeImage(t, "jpeg", 40, 10)), atlas.Metadata{
+			ContentType: "image/jpeg",
+			Image: &atlas.ImageMetadata{Format: "jpeg", Width: 40, Height: 10, EXIF: map[string]string{
+				"Make": "Canon", "Model": "X1", "Orientation": "6",
+			}},
+		}},
+		{"bundle.zip", string(buildZip(t, "a", "a", "b/", "", "b/c", "c")), atlas.Metadata{
+			ContentType: "application/zip",
+			Archive:     &atlas.ArchiveMetadata{Format: "zip", Entries: 3},
+		}},
+		{"bundle.tar.gz", string(tarball), atlas.Metadata{
+			ContentType: "application/gzip",
+			Archive:     &atlas.ArchiveMetadata{Format: "tar.gz", Entries: 2},
+		}},
+		{"blob", "\x00\x01\x02", atlas.Metadata{ContentType: "application/octet-stream"}},
+	} {
+		writeFile(t, files, test.path, test.content)
+		meta, err := files.Metadata(atlas.NewPath(test.path), "tester")
+		require.NoError(t, err, test.path)
+		assert.Equal(t, test.want, meta.Metadata, test.path)
+		assert.Equal(t, int64(len(test.content)), meta.Size, test.path)
+	}
+
+	_, err := files.Metadata(atlas.NewPath("missing"), "tester")
+	assert.ErrorIs(t, err, atlas.ErrResourceNotFound)
+}
+
+func TestMetadata_Index(t *testing.T) {
+	backend := atlas.NewMemoryBackend()
+	files, err := atlas.NewAtlasWithBackend(backend)
+	require.NoError(t, err)
+	writeFile(t, files, "a.txt", "a\nb\n")
+	writeFile(t, files, "img/shot.png", encodeImage(t, "png", 8, 8))
+
+	// Copies share the object and so the metadata
+	_, err = files.Copy(atlas.NewPath("a.txt"), atlas.NewPath("b.txt"), false, "tester")
+	require.NoError(t, err)
+	meta, err := files.Metadata(atlas.NewPath("b.txt"), "tester")
+	require.NoError(t, err)
+	assert.Equal(t, 2, meta.Text.Lines)
+
+	// Content written before the index existed is described on request
+	require.NoError(t, backend.Remove("metadata.json"))
+	files, err = atlas.NewAtlasWithBackend(backend)
+	require.NoError(t, err)
+	meta, err = files.Metadata(atlas.NewPath("img/shot.png"), "tester")
+	require.NoError(t, err)
+	assert.Equal(t, 8, meta.Image.Width)
+	_, err = backend.Stat("metadata.json")
+	assert.NoError(t, err)
+
+	listing, err := files.List(atlas.NewPath(""), atlas.ListOptions{Recursive: true, ContentType: "image/"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"img/shot.png"}, listPaths(listing))
+	assert.Equal(t, "image/png", listing.Entries[0].ContentType)
+	assert.Equal(t, 8, listing.Entries[0].Metadata.Image.Height)
+
+	listing, err = files.List(atlas.NewPath(""), atlas.ListOptions{ContentType: "text/plain"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.txt", "b.txt"}, listPaths(listing))
+}
+
+func TestHandlers_Metadata(t *testing.T) {
+	files := newTestAtlas(t)
+	mux := newTestMux(files)
+	mux.HandleFunc("GET /metadata/{path...}", files.MetadataHandler)
+	mux.HandleFunc("GET /list/{path...}", files.ListHandler)
+	writeFile(t, files, "docs/readme.md", "# Title\n")
+	writeFile(t, files, "docs/logo.png", encodeImage(t, "png", 4, 2))
+
+	rec := serve(mux, http.MethodGet, "/metadata/docs/logo.png", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	meta := atlas.FileMetadata{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &meta))
+	assert.Equal(t, "docs/logo.png", meta.Path)
+	assert.Equal(t, "image/png", meta.ContentType)
+	assert.Equal(t, &atlas.ImageMetadata{Format: "png", Width: 4, Height: 2}, meta.Image)
+
+	rec = serve(mux, http.MethodGet, "/list/docs?content_type=text/", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	listing := atlas.Listing{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &listing))
+	assert.Equal(t, []string{"docs/readme.md"}, listPaths(&listing))
+	assert.Equal(t, 1, listing.Entries[0].Metadata.Text.Lines)
+
+	assert.Equal(t, http.StatusConflict, serve(mux, http.MethodGet, "/metadata/docs", "").Code)
+	assert.Equal(t, http.StatusNotFound, serve(mux, http.MethodGet, "/metadata/missing", "").Code)
+}
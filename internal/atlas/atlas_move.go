@@ -0,0 +1,175 @@
+package atlas
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidTransfer   = errors.New("move or copy is not valid")
+	ErrDestinationExists = errors.New("destination already exists")
+)
+
+// Moves the file or folder at src to dst, reporting whether dst was created
+// rather than replaced. An existing dst is only replaced when overwrite is set,
+// its content is kept as versions like on a write. Files carry their version
+// history along unless dst already has one of its own, in which case they
+// become the next version at dst.
+func (f *Atlas) Move(src Path, dst Path, overwrite bool, author string) (bool, error) {
+	return f.transfer(src, dst, overwrite, author, true, Condition{})
+}
+
+// Moves like Move if the source matches cond.IfMatch and the destination
+// matches none of cond.IfNoneMatch, "*" making the move only create dst
+func (f *Atlas) MoveIf(src Path, dst Path, overwrite bool, author string, cond Condition) (bool, error) {
+	return f.transfer(src, dst, overwrite, author, true, cond)
+}
+
+// Copies the file or folder at src to dst, reporting whether dst was created
+// rather than replaced. Copies are new versions written by author and do not
+// take over the history of the original. Content is shared, not duplicated.
+func (f *Atlas) Copy(src Path, dst Path, overwrite bool, author string) (bool, error) {
+	return f.transfer(src, dst, overwrite, author, false, Condition{})
+}
+
+// Copies like Copy under the same conditions as MoveIf
+func (f *Atlas) CopyIf(src Path, dst Path, overwrite bool, author string, cond Condition) (bool, error) {
+	return f.transfer(src, dst, overwrite, author, false, cond)
+}
+
+// Renames the file or folder at p within its folder
+func (f *Atlas) Rename(p Path, name string, overwrite bool, author string) (bool, error) {
+	return f.RenameIf(p, name, overwrite, author, Condition{})
+}
+
+// Renames like Rename under the same conditions as MoveIf
+func (f *Atlas) RenameIf(p Path, name string, overwrite bool, author string, cond Condition) (bool, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return false, ErrInvalidTransfer
+	}
+
+	dst := name
+	if parent := parentKey(p.Key()); parent != "" {
+		dst = parent + "/" + name
+	}
+	return f.MoveIf(p, NewPath(dst), overwrite, author, cond)
+}
+
+func (f *Atlas) transfer(src Path, dst Path, overwrite bool, author string, move bool, cond Condition) (bool, error) {
+	if err := src.Validate(); err != nil {
+		return false, err
+	}
+	if err := dst.Validate(); err != nil {
+		return false, err
+	}
+	if src.Root() || dst.Root() {
+		return false, ErrUploadToRoot
+	}
+
+	srcKey, dstKey := src.Key(), dst.Key()
+	if move && srcKey == dstKey {
+		return false, nil
+	}
+	// Replacing an ancestor would remove the source, and a folder cannot
+	// contain itself
+	if isWithin(srcKey, dstKey) || isWithin(dstKey, srcKey) {
+		return false, ErrInvalidTransfer
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	source, ok := f.curr.Get(srcKey)
+	target, replaced := f.curr.Get(dstKey)
+	err := Condition{IfMatch: cond.IfMatch}.check(source, ok)
+	if err == nil {
+		err = Condition{IfNoneMatch: cond.IfNoneMatch}.check(target, replaced)
+	}
+	if err != nil {
+		return false, err
+	}
+	// Moves change the source, copies only read it
+	if !ok || !f.canRead(author, srcKey) {
+		return false, ErrResourceNotFound
+	}
+	if move {
+		err = f.checkPermission(author, srcKey)
+	}
+	if err == nil {
+		err = f.checkPermission(author, dstKey)
+	}
+	if err != nil {
+		return false, err
+	}
+	if replaced && !overwrite {
+		return false, ErrDestinationExists
+	}
+	if err := f.checkParents(dstKey); err != nil {
+		return false, err
+	}
+
+	// Moves keep their authors and only count against folder quotas, copies
+	// belong to whoever made them
+	remove := []string{dstKey}
+	if move {
+		remove = append(remove, srcKey)
+	}
+	added := map[string]Entry{}
+	for key, entry := range f.curr.Subtree(srcKey) {
+		if !move {
+			entry.Author = author
+		}
+		added[dstKey+strings.TrimPrefix(key, srcKey)] = entry
+	}
+	if err := f.checkQuota(remove, added); err != nil {
+		return false, err
+	}
+
+	now := time.Now().UTC()
+	f.archive(f.curr.Remove(dstKey))
+	if err := f.curr.MakeParents(dstKey, now); err != nil {
+		return false, err
+	}
+
+	entries := f.curr.Subtree(srcKey)
+	if move {
+		f.curr.Remove(srcKey)
+	}
+
+	for key, entry := range entries {
+		target := dstKey + strings.TrimPrefix(key, srcKey)
+
+		switch {
+		case entry.IsDir():
+			if !move {
+				entry.Modified = now
+			}
+		case move && len(f.history[target]) == 0:
+			if versions, ok := f.history[key]; ok {
+				f.history[target] = versions
+				delete(f.history, key)
+			}
+		case move:
+			entry.Version = f.nextVersion(target)
+		default:
+			entry.Modified = now
+			entry.Author = author
+			entry.Version = f.nextVersion(target)
+			f.retainObject(entry.Object)
+		}
+
+		f.curr.Put(target, entry)
+	}
+
+	if err := f.saveCurr(); err != nil {
+		return false, err
+	}
+	event := Event{Type: EventCreated, Path: dstKey, EntryType: source.Type, Author: author}
+	if move {
+		event.Type = EventMoved
+		event.From = srcKey
+	}
+	f.emit(event)
+	return !replaced, nil
+}
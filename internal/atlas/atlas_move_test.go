@@ -0,0 +1,159 @@
+package atlas_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/mnemosynefs/mnemo/internal/atlas"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMove(t *testing.T) {
+	files := newTestAtlas(t)
+	writeFile(t, files, "docs/readme.md", "one")
+	writeFile(t, files, "docs/readme.md", "two")
+	writeFile(t, files, "docs/img/logo.png", "png")
+
+	created, err := files.Move(atlas.NewPath("docs"), atlas.NewPath("archive/2024/docs"), false, "mover")
+	require.NoError(t, err)
+	assert.True(t, created)
+	assert.False(t, files.Exists(atlas.NewPath("docs")))
+	assert.Equal(t, "two", readFile(t, files, "archive/2024/docs/readme.md"))
+	assert.Equal(t, "png", readFile(t, files, "archive/2024/docs/img/logo.png"))
+
+	// The history travels with the file
+	versions, err := files.Versions(atlas.NewPath("archive/2024/docs/readme.md"), "tester")
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	assert.Equal(t, "tester", versions[0].Author)
+	_, err = files.Versions(atlas.NewPath("docs/readme.md"), "tester")
+	assert.ErrorIs(t, err, atlas.ErrResourceNotFound)
+}
+
+func TestMove_Overwrite(t *testing.T) {
+	files := newTestAtlas(t)
+	writeFile(t, files, "a.txt", "a")
+	writeFile(t, files, "b.txt", "b")
+
+	_, err := files.Move(atlas.NewPath("a.txt"), atlas.NewPath("b.txt"), false, "mover")
+	assert.ErrorIs(t, err, atlas.ErrDestinationExists)
+	assert.Equal(t, "b", readFile(t, files, "b.txt"))
+
+	created, err := files.Move(atlas.NewPath("a.txt"), atlas.NewPath("b.txt"), true, "mover")
+	require.NoError(t, err)
+	assert.False(t, created)
+	assert.False(t, files.Exists(atlas.NewPath("a.txt")))
+	assert.Equal(t, "a", readFile(t, files, "b.txt"))
+
+	// The replaced content stays available as a version
+	versions, err := files.Versions(atlas.NewPath("b.txt"), "tester")
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	assert.Equal(t, 2, versions[0].ID)
+	assert.Equal(t, "b", readVersion(t, files, "b.txt", 1))
+}
+
+func TestMove_Invalid(t *testing.T) {
+	files := newTestAtlas(t)
+	writeFile(t, files, "docs/readme.md", "hello")
+	writeFile(t, files, "a.txt", "a")
+
+	_, err := files.Move(atlas.NewPath("docs"), atlas.NewPath("docs/inner"), true, "mover")
+	assert.ErrorIs(t, err, atlas.ErrInvalidTransfer)
+	_, err = files.Move(atlas.NewPath("docs/readme.md"), atlas.NewPath("docs"), true, "mover")
+	assert.ErrorIs(t, err, atlas.ErrInvalidTransfer)
+	_, err = files.Move(atlas.NewPath("docs"), atlas.NewPath("../escape"), false, "mover")
+	assert.ErrorIs(t, err, atlas.ErrInvalidPath)
+	_, err = files.Move(atlas.NewPath("docs"), atlas.NewPath(""), false, "mover")
+	assert.ErrorIs(t, err, atlas.ErrUploadToRoot)
+	_, err = files.Move(atlas.NewPath("missing"), atlas.NewPath("other"), false, "mover")
+	assert.ErrorIs(t, err, atlas.ErrResourceNotFound)
+	_, err = files.Move(atlas.NewPath("docs"), atlas.NewPath("a.txt/docs"), false, "mover")
+	assert.ErrorIs(t, err, atlas.ErrIsFile)
+
+	created, err := files.Move(atlas.NewPath("a.txt"), atlas.NewPath("a.txt"), false, "mover")
+	require.NoError(t, err)
+	assert.False(t, created)
+	assert.Equal(t, "a", readFile(t, files, "a.txt"))
+}
+
+func TestCopy(t *testing.T) {
+	files := newTestAtlas(t)
+	writeFile(t, files, "docs/readme.md", "one")
+	writeFile(t, files, "docs/readme.md", "two")
+
+	created, err := files.Copy(atlas.NewPath("docs"), atlas.NewPath("backup"), false, "copier")
+	require.NoError(t, err)
+	assert.True(t, created)
+	assert.Equal(t, "two", readFile(t, files, "docs/readme.md"))
+	assert.Equal(t, "two", readFile(t, files, "backup/readme.md"))
+
+	// A copy starts a history of its own
+	versions, err := files.Versions(atlas.NewPath("backup/readme.md"), "tester")
+	require.NoError(t, err)
+	require.Len(t, versions, 1)
+	assert.Equal(t, "copier", versions[0].Author)
+
+	_, err = files.Copy(atlas.NewPath("docs"), atlas.NewPath("backup"), false, "copier")
+	assert.ErrorIs(t, err, atlas.ErrDestinationExists)
+	_, err = files.Copy(atlas.NewPath("docs"), atlas.NewPath("docs"), true, "copier")
+	assert.ErrorIs(t, err, atlas.ErrInvalidTransfer)
+
+	// Deleting the original leaves the copy intact, even after collecting garbage
+	require.NoError(t, files.Delete(atlas.NewPath("docs"), "tester"))
+	_, err = files.CollectGarbage()
+	require.NoError(t, err)
+	assert.Equal(t, "two", readFile(t, files, "backup/readme.md"))
+}
+
+func TestRename(t *testing.T) {
+	files := newTestAtlas(t)
+	writeFile(t, files, "docs/readme.md", "hello")
+
+	_, err := files.Rename(atlas.NewPath("docs/readme.md"), "README.md", false, "mover")
+	require.NoError(t, err)
+	assert.Equal(t, "hello", readFile(t, files, "docs/README.md"))
+
+	_, err = files.Rename(atlas.NewPath("docs"), "notes", false, "mover")
+	require.NoError(t, err)
+	assert.Equal(t, "hello", readFile(t, files, "notes/README.md"))
+
+	_, err = files.Rename(atlas.NewPath("notes"), "a/b", false, "mover")
+	assert.ErrorIs(t, err, atlas.ErrInvalidTransfer)
+	_, err = files.Rename(atlas.NewPath("notes"), "..", false, "mover")
+	assert.ErrorIs(t, err, atlas.ErrInvalidTransfer)
+}
+
+func TestHandlers_MoveCopy(t *testing.T) {
+	files := newTestAtlas(t)
+	mux := newTestMux(files)
+	mux.HandleFunc("POST /move/{path...}", files.MoveHandler)
+	mux.HandleFunc("POST /copy/{path...}", files.CopyHandler)
+	mux.HandleFunc("POST /rename/{path...}", files.RenameHandler)
+	writeFile(t, files, "docs/readme.md", "hello")
+	writeFile(t, files, "a.txt", "a")
+
+	rec := serve(mux, http.MethodPost, "/copy/docs?to=backup", "")
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	rec = serve(mux, http.MethodPost, "/move/a.txt?to=backup/readme.md", "")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	rec = serve(mux, http.MethodPost, "/move/a.txt?to=backup/readme.md&overwrite=true", "")
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "a", readFile(t, files, "backup/readme.md"))
+
+	rec = serve(mux, http.MethodPost, "/rename/backup?name=old", "")
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, "a", readFile(t, files, "old/readme.md"))
+
+	rec = serve(mux, http.MethodPost, "/move/docs", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = serve(mux, http.MethodPost, "/copy/docs?to=other&overwrite=maybe", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = serve(mux, http.MethodPost, "/move/missing?to=other", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -0,0 +1,378 @@
+package atlas
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// File contents are stored once in atlas/objects, addressed by the SHA-256 of
+// their content. Trees only ever reference objects by hash.
+
+type GCReport struct {
+	Removed int `json:"removed"`
+	// Cached previews of the objects no longer referenced
+	Previews int   `json:"previews"`
+	Freed    int64 `json:"freed"`
+}
+
+func (f *Atlas) objectPath(object string) string {
+	return "objects/" + object[:2] + "/" + object
+}
+
+// objectWriter stages incoming content in atlas/tmp while hashing it
+type objectWriter struct {
+	backend Backend
+	name    string
+	// Writes the staged content until it is committed to be read back
+	out  BackendWriter
+	hash hash.Hash
+	size int64
+	// Set once the staged content is gzipped or encrypted
+	compressed bool
+	encrypted  bool
+}
+
+func (f *Atlas) newObject() (*objectWriter, error) {
+	name := "tmp/object-" + uuid.NewString()
+	out, err := f.backend.Create(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &objectWriter{backend: f.backend, name: name, out: out, hash: sha256.New()}, nil
+}
+
+func (w *objectWriter) Write(p []byte) (int, error) {
+	if w.out == nil {
+		return 0, os.ErrClosed
+	}
+	n, err := w.out.Write(p)
+	w.hash.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+// Checksum of the content written so far as "sha256:<hex>"
+func (w *objectWriter) checksum() string {
+	return "sha256:" + hex.EncodeToString(w.hash.Sum(nil))
+}
+
+// Commits the content written so far so it can be read back
+func (w *objectWriter) stage() error {
+	if w.out == nil {
+		return nil
+	}
+	out := w.out
+	w.out = nil
+	return out.Commit()
+}
+
+// Drops the staged content
+func (w *objectWriter) discard() {
+	if w.out != nil {
+		w.out.Abort()
+		w.out = nil
+		return
+	}
+	w.backend.Remove(w.name)
+}
+
+// Rewrites the staged content through fn into a new staging file, returning
+// its name and size
+func (f *Atlas) restage(w *objectWriter, fn func(dst io.Writer, src io.Reader) error) (string, int64, error) {
+	if err := w.stage(); err != nil {
+		return "", 0, err
+	}
+	in, err := f.backend.Open(w.name)
+	if err != nil {
+		return "", 0, err
+	}
+	defer in.Close()
+
+	name := "tmp/object-" + uuid.NewString()
+	out, err := f.backend.Create(name)
+	if err != nil {
+		return "", 0, err
+	}
+	counter := &countingWriter{Writer: out}
+	if err := fn(counter, in); err != nil {
+		out.Abort()
+		return "", 0, err
+	}
+	return name, counter.n, out.Commit()
+}
+
+type countingWriter struct {
+	io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// Moves staged content into the object store. Content that is already stored
+// is dropped. Must be called with the atlas lock held so a concurrent garbage
+// collection cannot remove the object before it is referenced.
+func (f *Atlas) storeObject(w *objectWriter) (string, error) {
+	if err := w.stage(); err != nil {
+		return "", err
+	}
+
+	object := hex.EncodeToString(w.hash.Sum(nil))
+	if f.objectExists(object) {
+		w.discard()
+		return object, nil
+	}
+
+	dst := f.objectPath(object)
+	if w.compressed {
+		dst += compressedSuffix
+	}
+	if w.encrypted {
+		dst += encryptedSuffix
+	}
+
+	if err := f.backend.Rename(w.name, dst); err != nil {
+		w.discard()
+		return "", err
+	}
+	return object, nil
+}
+
+func (f *Atlas) objectExists(object string) bool {
+	for _, suffix := range objectSuffixes {
+		if _, err := f.backend.Stat(f.objectPath(object) + suffix); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Opens the content of an object holding size bytes, decrypting and
+// decompressing it as stored
+func (f *Atlas) openObject(object string, size int64) (io.ReadSeekCloser, error) {
+	for _, suffix := range objectSuffixes {
+		file, err := f.backend.Open(f.objectPath(object) + suffix)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		content := file
+		_, compressed, encrypted := objectName(object + suffix)
+		if encrypted {
+			if content, err = f.newDecrypter(file); err != nil {
+				file.Close()
+				return nil, err
+			}
+		}
+		if compressed {
+			return newDecompressor(content, size)
+		}
+		return content, nil
+	}
+
+	return nil, ErrResourceNotFound
+}
+
+func (f *Atlas) retainObject(object string) {
+	f.refs[object]++
+}
+
+// Drops a reference from an object. Objects reaching zero stay on disk until
+// the next garbage collection.
+func (f *Atlas) releaseObject(object string) {
+	f.refs[object]--
+	if f.refs[object] <= 0 {
+		delete(f.refs, object)
+	}
+}
+
+// Adds a reference to the object of every file entry
+func (f *Atlas) retain(entries map[string]Entry) {
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			f.retainObject(entry.Object)
+		}
+	}
+}
+
+// Drops a reference from the object of every file entry
+func (f *Atlas) release(entries map[string]Entry) {
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			f.releaseObject(entry.Object)
+		}
+	}
+}
+
+// Calls fn for every object reference held by curr, the version history, the
+// trash and every tag, together with the size of the content
+func (f *Atlas) eachReference(fn func(object string, size int64)) error {
+	file := func(_ string, entry Entry) {
+		fn(entry.Object, entry.Size)
+	}
+
+	f.curr.EachFile(file)
+	for _, versions := range f.history {
+		for _, version := range versions {
+			fn(version.Object, version.Size)
+		}
+	}
+	for _, items := range f.trash {
+		for _, item := range items {
+			item.EachFile(file)
+		}
+	}
+
+	names, err := f.tagNames()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		t, err := f.loadTag(name)
+		if err != nil {
+			return err
+		}
+		t.EachFile(file)
+	}
+
+	return nil
+}
+
+// Recounts the references held by curr, the version history, the trash and
+// every tag
+func (f *Atlas) countReferences() error {
+	f.refs = map[string]int{}
+	return f.eachReference(func(object string, _ int64) {
+		f.retainObject(object)
+	})
+}
+
+// Removes every object that is no longer referenced by curr, the version
+// history, the trash or a tag, along with its previews
+func (f *Atlas) CollectGarbage() (*GCReport, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.countReferences(); err != nil {
+		return nil, err
+	}
+
+	infos, err := f.backend.List("objects/")
+	if err != nil {
+		return nil, err
+	}
+
+	report := &GCReport{}
+	for _, info := range infos {
+		if object, _, _ := objectName(path.Base(info.Name)); f.refs[object] > 0 {
+			continue
+		}
+		if err := f.backend.Remove(info.Name); err != nil {
+			return nil, err
+		}
+
+		report.Removed++
+		report.Freed += info.Size
+	}
+
+	if err := f.collectPreviews(report); err != nil {
+		return nil, err
+	}
+	if err := f.collectMetadata(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// Stores every regular file below dir of root as an object and returns the
+// matching manifest. Used to import trees written before the object store
+// existed. Symbolic links are skipped rather than followed.
+func (f *Atlas) importTree(root *os.Root, dir string) (*Manifest, error) {
+	manifest := NewManifest()
+
+	err := fs.WalkDir(root.FS(), dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if name == dir {
+			return nil
+		}
+		key := strings.TrimPrefix(name, dir+"/")
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case d.IsDir():
+			manifest.Entries[key] = Entry{Type: EntryDir, Modified: info.ModTime().UTC()}
+		case d.Type().IsRegular():
+			object, size, err := f.importFile(root, name, info)
+			if err != nil {
+				return err
+			}
+			manifest.Entries[key] = Entry{
+				Type:     EntryFile,
+				Object:   object,
+				Size:     size,
+				Modified: info.ModTime().UTC(),
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// Stores the file name of root as an object, returning the object and the
+// size of its content. The file opened must still be the one walked, so a
+// link swapped in meanwhile is not followed.
+func (f *Atlas) importFile(root *os.Root, name string, walked fs.FileInfo) (string, int64, error) {
+	in, err := root.Open(name)
+	if err != nil {
+		return "", 0, err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+	if !os.SameFile(info, walked) {
+		return "", 0, fmt.Errorf("%w: %s changed while importing", ErrInvalidPath, name)
+	}
+
+	w, err := f.newObject()
+	if err != nil {
+		return "", 0, err
+	}
+	if _, err := io.Copy(w, in); err != nil {
+		w.discard()
+		return "", 0, err
+	}
+
+	object, err := f.storeObject(w)
+	return object, w.size, err
+}
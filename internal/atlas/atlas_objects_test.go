@@ -0,0 +1,179 @@
+package atlas_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mnemosynefs/mnemo/internal/atlas"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func countObjects(t *testing.T, root string) int {
+	t.Helper()
+	count := 0
+	err := filepath.WalkDir(filepath.Join(root, "atlas", "objects"), func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			count++
+		}
+		return err
+	})
+	require.NoError(t, err)
+	return count
+}
+
+func TestObjects_Deduplicate(t *testing.T) {
+	root := t.TempDir()
+	files, err := atlas.NewAtlas(root)
+	require.NoError(t, err)
+
+	writeFile(t, files, "a.txt", "same content")
+	writeFile(t, files, "docs/b.txt", "same content")
+	assert.Equal(t, 1, countObjects(t, root))
+
+	// Tags only reference the existing objects
+	_, err = files.CreateTag("v1", "tester")
+	require.NoError(t, err)
+	_, err = files.CreateTag("v2", "tester")
+	require.NoError(t, err)
+	assert.Equal(t, 1, countObjects(t, root))
+
+	writeFile(t, files, "a.txt", "other content")
+	assert.Equal(t, 2, countObjects(t, root))
+}
+
+func TestCollectGarbage(t *testing.T) {
+	root := t.TempDir()
+	files, err := atlas.NewAtlas(root)
+	require.NoError(t, err)
+	files.SetVersionLimit(1)
+
+	writeFile(t, files, "a.txt", "first")
+	_, err = files.CreateTag("v1", "tester")
+	require.NoError(t, err)
+	writeFile(t, files, "a.txt", "second")
+	writeFile(t, files, "a.txt", "third")
+
+	// The tag still holds the first version after it left the history
+	report, err := files.CollectGarbage()
+	require.NoError(t, err)
+	assert.Equal(t, 0, report.Removed)
+	assert.Equal(t, 3, countObjects(t, root))
+
+	require.NoError(t, files.DeleteTag("v1", "tester"))
+	assert.ErrorIs(t, files.DeleteTag("v1", "tester"), atlas.ErrTagNotFound)
+
+	report, err = files.CollectGarbage()
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Removed)
+	assert.Equal(t, int64(len("first")), report.Freed)
+	assert.Equal(t, "third", readFile(t, files, "a.txt"))
+
+	// Deleting pushes the second version out of the history
+	require.NoError(t, files.Delete(atlas.NewPath("a.txt"), "tester"))
+	report, err = files.CollectGarbage()
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Removed)
+	assert.Equal(t, int64(len("second")), report.Freed)
+	assert.Equal(t, 1, countObjects(t, root))
+}
+
+func TestNewAtlas_Reload(t *testing.T) {
+	root := t.TempDir()
+	files, err := atlas.NewAtlas(root)
+	require.NoError(t, err)
+
+	writeFile(t, files, "docs/readme.md", "hello")
+	_, err = files.CreateTag("v1", "tester")
+	require.NoError(t, err)
+	require.NoError(t, files.Delete(atlas.NewPath("docs"), "tester"))
+
+	files, err = atlas.NewAtlas(root)
+	require.NoError(t, err)
+	assert.False(t, files.Exists(atlas.NewPath("docs")))
+
+	// References held by tags survive a restart
+	report, err := files.CollectGarbage()
+	require.NoError(t, err)
+	assert.Equal(t, 0, report.Removed)
+
+	require.NoError(t, files.Restore("v1", atlas.NewPath(""), "tester"))
+	assert.Equal(t, "hello", readFile(t, files, "docs/readme.md"))
+}
+
+func TestNewAtlas_MigratePlainTrees(t *testing.T) {
+	root := t.TempDir()
+
+	curr := filepath.Join(root, "atlas", "curr", "docs")
+	require.NoError(t, os.MkdirAll(curr, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(curr, "readme.md"), []byte("current"), 0644))
+
+	tag := filepath.Join(root, "atlas", "tags", "v1")
+	require.NoError(t, os.MkdirAll(filepath.Join(tag, "tree", "docs"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(tag, "tree", "docs", "readme.md"), []byte("tagged"), 0644))
+	info, err := json.Marshal(atlas.TagInfo{Name: "v1", Size: 6, Files: 1})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(tag, "tag.json"), info, 0644))
+
+	files, err := atlas.NewAtlas(root)
+	require.NoError(t, err)
+
+	assert.Equal(t, "current", readFile(t, files, "docs/readme.md"))
+
+	reader, err := files.ReadTag("v1", atlas.NewPath("docs/readme.md"), "tester")
+	require.NoError(t, err)
+	reader.Close()
+
+	diff, err := files.Diff("v1", "", "tester")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"docs/readme.md"}, diff.Modified)
+
+	assert.NoDirExists(t, filepath.Join(root, "atlas", "curr"))
+	assert.NoDirExists(t, tag)
+}
+
+func TestNewAtlas_MigrateSkipsLinks(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644))
+
+	curr := filepath.Join(root, "atlas", "curr")
+	require.NoError(t, os.MkdirAll(curr, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(curr, "readme.md"), []byte("current"), 0644))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "secret"), filepath.Join(curr, "secret")))
+	require.NoError(t, os.Symlink(outside, filepath.Join(curr, "outside")))
+
+	files, err := atlas.NewAtlas(root)
+	require.NoError(t, err)
+
+	assert.Equal(t, "current", readFile(t, files, "readme.md"))
+	assert.False(t, files.Exists(atlas.NewPath("secret")))
+	assert.False(t, files.Exists(atlas.NewPath("outside")))
+	assert.FileExists(t, filepath.Join(outside, "secret"))
+}
+
+func TestHandlers_CollectGarbage(t *testing.T) {
+	files := newTestAtlas(t)
+	mux := newTestMux(files)
+	mux.HandleFunc("DELETE /tags/{tag}", files.DeleteTagHandler)
+	mux.HandleFunc("POST /gc", files.CollectGarbageHandler)
+	files.SetVersionLimit(1)
+
+	serve(mux, http.MethodPut, "/files/a.txt", "first")
+	serve(mux, http.MethodPost, "/tags/v1", "")
+	serve(mux, http.MethodPut, "/files/a.txt", "second")
+	serve(mux, http.MethodPut, "/files/a.txt", "third")
+
+	rec := serve(mux, http.MethodDelete, "/tags/v1", "")
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	rec = serve(mux, http.MethodPost, "/gc", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var report atlas.GCReport
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+	assert.Equal(t, 1, report.Removed)
+}
@@ -0,0 +1,81 @@
+package atlas
+
+import "errors"
+
+// Permissions decide which files a user may see and change. Files a user may
+// not read are reported missing when asked for by path, and are left out of
+// listings, diffs, archives, queries and events. Writing, deleting, moving,
+// restoring and annotating a file take write permission on it, and on
+// everything below a folder. Deleting tags is left to administrators. Guests
+// admitted without a session may read but never change anything over HTTP.
+
+var (
+	ErrPermissionDenied = errors.New("permission denied")
+	ErrNotAuthenticated = errors.New("authentication required")
+)
+
+// Sets the check deciding which files a user may read. Without a check every
+// file is readable.
+func (f *Atlas) SetReadPermission(check func(username string, key string) bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.readable = check
+}
+
+// Reports whether username may read key. Must be called with the atlas lock
+// held.
+func (f *Atlas) canRead(username string, key string) bool {
+	return f.readable == nil || f.readable(username, key)
+}
+
+// Sets the check deciding which files a user may change. Without a check every
+// file is writable.
+func (f *Atlas) SetWritePermission(check func(username string, key string) bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.writable = check
+}
+
+// Reports whether username may change key. Must be called with the atlas lock
+// held.
+func (f *Atlas) canWrite(username string, key string) bool {
+	return f.writable == nil || f.writable(username, key)
+}
+
+// Checks that username may change the entry at key and everything below it.
+// An existing entry they may not read is reported missing, as reads report
+// it. Must be called with the atlas lock held.
+func (f *Atlas) checkPermission(username string, key string) error {
+	if f.writable == nil {
+		return nil
+	}
+	if !f.canWrite(username, key) {
+		if _, ok := f.curr.Get(key); ok && !f.canRead(username, key) {
+			return ErrResourceNotFound
+		}
+		return ErrPermissionDenied
+	}
+	for below := range f.curr.Subtree(key) {
+		if !f.canWrite(username, below) {
+			return ErrPermissionDenied
+		}
+	}
+	return nil
+}
+
+// Sets the check deciding which users are administrators. Without a check
+// every user is.
+func (f *Atlas) SetAdminPermission(check func(username string) bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.admin = check
+}
+
+// Reports whether username is an administrator. Guests never are. Must be
+// called with the atlas lock held.
+func (f *Atlas) isAdmin(username string) bool {
+	return username != "" && (f.admin == nil || f.admin(username))
+}
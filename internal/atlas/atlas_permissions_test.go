@@ -0,0 +1,303 @@
+package atlas_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mnemosynefs/mnemo/internal/atlas"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Returns an atlas where only admin may read below private
+func newPrivateAtlas(t *testing.T) *atlas.Atlas {
+	t.Helper()
+	files := newTestAtlas(t)
+	writeFile(t, files, "docs/readme.md", "hello")
+	writeFile(t, files, "docs/private/secret.txt", "secret")
+	_, err := files.CreateTag("v1", "tester")
+	require.NoError(t, err)
+	writeFile(t, files, "docs/private/secret.txt", "changed")
+	writeFile(t, files, "docs/private/new.txt", "new")
+	writeFile(t, files, "docs/new.md", "new")
+
+	files.SetReadPermission(func(username string, key string) bool {
+		return username == "admin" || !strings.HasPrefix(key, "docs/private")
+	})
+	return files
+}
+
+func TestReadPermission(t *testing.T) {
+	files := newPrivateAtlas(t)
+	secret := atlas.NewPath("docs/private/secret.txt")
+
+	_, err := files.Read(secret, "guest")
+	assert.ErrorIs(t, err, atlas.ErrResourceNotFound)
+	_, err = files.ReadVersion(secret, 1, "guest")
+	assert.ErrorIs(t, err, atlas.ErrResourceNotFound)
+	_, err = files.Versions(secret, "guest")
+	assert.ErrorIs(t, err, atlas.ErrResourceNotFound)
+	_, err = files.ReadTag("v1", secret, "guest")
+	assert.ErrorIs(t, err, atlas.ErrResourceNotFound)
+	_, err = files.List(atlas.NewPath("docs/private"), atlas.ListOptions{User: "guest"})
+	assert.ErrorIs(t, err, atlas.ErrResourceNotFound)
+
+	file, err := files.Read(secret, "admin")
+	require.NoError(t, err)
+	file.Close()
+	versions, err := files.Versions(secret, "admin")
+	require.NoError(t, err)
+	assert.Len(t, versions, 2)
+}
+
+func TestReadPermission_Filtered(t *testing.T) {
+	files := newPrivateAtlas(t)
+
+	// Unreadable entries are neither listed nor counted into folder sizes
+	listing, err := files.List(atlas.NewPath(""), atlas.ListOptions{User: "guest", Recursive: true})
+	require.NoError(t, err)
+	paths := []string{}
+	for _, entry := range listing.Entries {
+		paths = append(paths, entry.Path)
+	}
+	assert.Equal(t, []string{"docs", "docs/new.md", "docs/readme.md"}, paths)
+	assert.Equal(t, int64(8), listing.Entries[0].Size)
+	assert.Equal(t, 3, listing.Hidden)
+
+	listing, err = files.List(atlas.NewPath("docs"), atlas.ListOptions{User: "admin"})
+	require.NoError(t, err)
+	assert.Equal(t, 3, listing.Total)
+	assert.Zero(t, listing.Hidden)
+
+	diff, err := files.Diff("v1", "", "guest")
+	require.NoError(t, err)
+	assert.Equal(t, &atlas.TreeDiff{Added: []string{"docs/new.md"}, Removed: []string{}, Modified: []string{}}, diff)
+	diff, err = files.Diff("v1", "", "admin")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"docs/new.md", "docs/private/new.txt"}, diff.Added)
+	assert.Equal(t, []string{"docs/private/secret.txt"}, diff.Modified)
+}
+
+func TestHandlers_ReadPermission(t *testing.T) {
+	files := newPrivateAtlas(t)
+	mux := newTestMux(files)
+	mux.HandleFunc("GET /list/{path...}", files.ListHandler)
+	mux.HandleFunc("GET /versions/{path...}", files.ListVersionsHandler)
+
+	request := func(target string) *http.Request {
+		req, _ := http.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("username", "guest")
+		return req
+	}
+	for _, target := range []string{
+		"/files/docs/private/secret.txt",
+		"/files/docs/private/secret.txt?version=1",
+		"/versions/docs/private/secret.txt",
+		"/tags/v1/files/docs/private/secret.txt",
+		"/list/docs/private",
+	} {
+		rec := serveRequest(mux, request(target))
+		assert.Equal(t, http.StatusNotFound, rec.Code, target)
+		assert.NotContains(t, rec.Body.String(), "secret", target)
+	}
+
+	rec := serveRequest(mux, request("/list/docs"))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "private")
+
+	rec = serveRequest(mux, request("/tags/v1/diff"))
+	require.Equal(t, http.StatusOK, rec.Code)
+	diff := atlas.TreeDiff{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &diff))
+	assert.Equal(t, []string{"docs/new.md"}, diff.Added)
+	assert.Empty(t, diff.Modified)
+
+	req := request("/files/docs/private/secret.txt")
+	req.Header.Set("username", "admin")
+	rec = serveRequest(mux, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "changed", rec.Body.String())
+}
+
+func TestHandlers_Guest(t *testing.T) {
+	files := newTestAtlas(t)
+	mux := newTestMux(files)
+	mux.HandleFunc("POST /move/{path...}", files.MoveHandler)
+	mux.HandleFunc("POST /extract/{path...}", files.ExtractHandler)
+	writeFile(t, files, "docs/readme.md", "hello")
+
+	// Requests without a session reach the handlers as the guest user ""
+	for _, test := range []struct{ method, target string }{
+		{http.MethodPut, "/files/docs/readme.md"},
+		{http.MethodPut, "/files/new.md"},
+		{http.MethodDelete, "/files/docs/readme.md"},
+		{http.MethodPost, "/move/docs/readme.md?to=moved.md"},
+		{http.MethodPost, "/extract/docs"},
+		{http.MethodPost, "/tags/v1"},
+	} {
+		req := httptest.NewRequest(test.method, test.target, strings.NewReader("changed"))
+		rec := serveRequest(mux, req)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, test.target)
+	}
+	assert.Equal(t, "hello", readFile(t, files, "docs/readme.md"))
+	assert.False(t, files.Exists(atlas.NewPath("new.md")))
+	assert.False(t, files.Exists(atlas.NewPath("moved.md")))
+
+	rec := serveRequest(mux, httptest.NewRequest(http.MethodGet, "/files/docs/readme.md", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+// Returns an atlas where only admin may change files below docs/locked, and
+// may read or change those below docs/private
+func newLockedAtlas(t *testing.T) *atlas.Atlas {
+	t.Helper()
+	files := newPrivateAtlas(t)
+	writeFile(t, files, "docs/locked/a.txt", "first")
+	writeFile(t, files, "docs/locked/a.txt", "second")
+	files.SetWritePermission(func(username string, key string) bool {
+		return username == "admin" || !strings.HasPrefix(key, "docs/locked") && !strings.HasPrefix(key, "docs/private")
+	})
+	return files
+}
+
+func TestWritePermission_Write(t *testing.T) {
+	files := newLockedAtlas(t)
+
+	_, err := files.Write(atlas.NewPath("docs/locked/b.txt"), "guest")
+	assert.ErrorIs(t, err, atlas.ErrPermissionDenied)
+	// Files the user may not read stay hidden
+	_, err = files.Write(atlas.NewPath("docs/private/secret.txt"), "guest")
+	assert.ErrorIs(t, err, atlas.ErrResourceNotFound)
+
+	// Permission is checked again when the content is published
+	files.SetWritePermission(nil)
+	writer, err := files.Write(atlas.NewPath("docs/locked/a.txt"), "guest")
+	require.NoError(t, err)
+	defer writer.Abort()
+	files.SetWritePermission(func(username string, key string) bool { return username == "admin" })
+	_, err = io.WriteString(writer, "changed")
+	require.NoError(t, err)
+	assert.ErrorIs(t, writer.Commit(), atlas.ErrPermissionDenied)
+	assert.Equal(t, "second", readFile(t, files, "docs/locked/a.txt"))
+}
+
+func TestWritePermission_Delete(t *testing.T) {
+	files := newLockedAtlas(t)
+
+	assert.ErrorIs(t, files.Delete(atlas.NewPath("docs/locked/a.txt"), "guest"), atlas.ErrPermissionDenied)
+	// Folders take permission on everything below them
+	assert.ErrorIs(t, files.Delete(atlas.NewPath("docs"), "guest"), atlas.ErrPermissionDenied)
+	assert.True(t, files.Exists(atlas.NewPath("docs/locked/a.txt")))
+
+	require.NoError(t, files.Delete(atlas.NewPath("docs/locked"), "admin"))
+	require.NoError(t, files.Delete(atlas.NewPath("docs/readme.md"), "guest"))
+}
+
+func TestWritePermission_Transfer(t *testing.T) {
+	files := newLockedAtlas(t)
+
+	_, err := files.Move(atlas.NewPath("docs/locked/a.txt"), atlas.NewPath("a.txt"), false, "guest")
+	assert.ErrorIs(t, err, atlas.ErrPermissionDenied)
+	_, err = files.Copy(atlas.NewPath("docs/readme.md"), atlas.NewPath("docs/locked/readme.md"), false, "guest")
+	assert.ErrorIs(t, err, atlas.ErrPermissionDenied)
+	_, err = files.Copy(atlas.NewPath("docs/private/secret.txt"), atlas.NewPath("secret.txt"), false, "guest")
+	assert.ErrorIs(t, err, atlas.ErrResourceNotFound)
+	assert.False(t, files.Exists(atlas.NewPath("a.txt")))
+
+	// Copies only read their source
+	_, err = files.Copy(atlas.NewPath("docs/locked/a.txt"), atlas.NewPath("a.txt"), false, "guest")
+	require.NoError(t, err)
+	assert.Equal(t, "second", readFile(t, files, "a.txt"))
+}
+
+func TestWritePermission_Extract(t *testing.T) {
+	files := newLockedAtlas(t)
+
+	archive := buildZip(t, "locked/b.txt", "b", "free.txt", "free")
+	report, err := files.Extract(atlas.NewPath("docs"), "guest", bytes.NewReader(archive))
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Created)
+	assert.Equal(t, 1, report.Skipped)
+	assert.False(t, files.Exists(atlas.NewPath("docs/locked/b.txt")))
+	assert.Equal(t, "free", readFile(t, files, "docs/free.txt"))
+}
+
+func TestWritePermission_RestoreTrash(t *testing.T) {
+	files := newLockedAtlas(t)
+	require.NoError(t, files.Delete(atlas.NewPath("docs/readme.md"), "guest"))
+	trash := files.Trash("guest")
+	require.Len(t, trash, 1)
+
+	_, err := files.RestoreTrash("guest", trash[0].ID, atlas.NewPath("docs/locked/readme.md"), false)
+	assert.ErrorIs(t, err, atlas.ErrPermissionDenied)
+	assert.False(t, files.Exists(atlas.NewPath("docs/locked/readme.md")))
+
+	_, err = files.RestoreTrash("guest", trash[0].ID, atlas.NewPath(""), false)
+	require.NoError(t, err)
+}
+
+func TestWritePermission_PromoteVersion(t *testing.T) {
+	files := newLockedAtlas(t)
+
+	err := files.PromoteVersion(atlas.NewPath("docs/locked/a.txt"), 1, "guest")
+	assert.ErrorIs(t, err, atlas.ErrPermissionDenied)
+	assert.Equal(t, "second", readFile(t, files, "docs/locked/a.txt"))
+
+	require.NoError(t, files.PromoteVersion(atlas.NewPath("docs/locked/a.txt"), 1, "admin"))
+	assert.Equal(t, "first", readFile(t, files, "docs/locked/a.txt"))
+}
+
+func TestWritePermission_CreateUpload(t *testing.T) {
+	files := newLockedAtlas(t)
+
+	_, err := files.CreateUpload(atlas.NewPath("docs/locked/b.txt"), "guest", 1, "")
+	assert.ErrorIs(t, err, atlas.ErrPermissionDenied)
+	_, err = files.CreateUpload(atlas.NewPath("docs/b.txt"), "guest", 1, "")
+	assert.NoError(t, err)
+}
+
+func TestHandlers_WritePermission(t *testing.T) {
+	files := newLockedAtlas(t)
+	mux := newTestMux(files)
+
+	for _, method := range []string{http.MethodPut, http.MethodDelete} {
+		req := httptest.NewRequest(method, "/files/docs/locked/a.txt", strings.NewReader("changed"))
+		req.Header.Set("username", "guest")
+		assert.Equal(t, http.StatusForbidden, serveRequest(mux, req).Code, method)
+
+		req = httptest.NewRequest(method, "/files/docs/private/secret.txt", strings.NewReader("changed"))
+		req.Header.Set("username", "guest")
+		assert.Equal(t, http.StatusNotFound, serveRequest(mux, req).Code, method)
+	}
+	assert.Equal(t, "second", readFile(t, files, "docs/locked/a.txt"))
+}
+
+func TestWritePermission_RestoreTag(t *testing.T) {
+	files := newLockedAtlas(t)
+	writeFile(t, files, "docs/readme.md", "changed")
+	sub, err := files.Subscribe(atlas.NewPath("docs"), "guest", 0, false)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	// Restoring docs would remove the locked files created since the tag
+	err = files.Restore("v1", atlas.NewPath("docs"), "guest")
+	assert.ErrorIs(t, err, atlas.ErrPermissionDenied)
+	err = files.Restore("v1", atlas.NewPath("docs/private/secret.txt"), "guest")
+	assert.ErrorIs(t, err, atlas.ErrResourceNotFound)
+	assert.Equal(t, "changed", readFile(t, files, "docs/readme.md"))
+	assert.True(t, files.Exists(atlas.NewPath("docs/locked/a.txt")))
+
+	require.NoError(t, files.Restore("v1", atlas.NewPath("docs/readme.md"), "guest"))
+	assert.Equal(t, "hello", readFile(t, files, "docs/readme.md"))
+	events := drain(sub)
+	require.Len(t, events, 1)
+	assert.Equal(t, "guest", events[0].Author)
+
+	require.NoError(t, files.Restore("v1", atlas.NewPath("docs"), "admin"))
+	assert.False(t, files.Exists(atlas.NewPath("docs/locked/a.txt")))
+}
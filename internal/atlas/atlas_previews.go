@@ -0,0 +1,271 @@
+package atlas
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	_ "golang.org/x/image/webp"
+)
+
+// Previews are scaled down renderings of images, cached in atlas/previews
+// under the object they were rendered from. A changed file points at another
+// object and so at other previews, the stale ones go with the next garbage
+// collection. Cached previews are encrypted like objects when a master key is
+// set, and removed when it is replaced.
+
+var (
+	ErrInvalidPreview = errors.New("preview size is not valid")
+	ErrNoPreview      = errors.New("file has no preview")
+)
+
+// Bounding boxes of the preview sizes, in pixels
+var PreviewSizes = map[string]int{
+	"small":  128,
+	"medium": 512,
+	"large":  1024,
+}
+
+const DefaultPreviewSize = "medium"
+
+// Images with more pixels are not decoded, to keep memory bounded
+const MaxPreviewPixels = 50_000_000
+
+type Preview struct {
+	Key  string
+	Size string
+	// Object the preview was rendered from
+	Object      string
+	Modified    time.Time
+	ContentType string
+	Data        []byte
+}
+
+// Entity tag of the preview, changing with the content it shows
+func (p *Preview) ETag() string {
+	return `"` + p.Object + "-" + p.Size + `"`
+}
+
+func (f *Atlas) previewPath(object string, size string) string {
+	return "previews/" + object[:2] + "/" + object + "-" + size
+}
+
+// Returns a preview of the image at path, rendering it unless it is cached.
+// Files the user may not read are reported missing.
+func (f *Atlas) Preview(path Path, size string, user string) (*Preview, error) {
+	if err := path.Validate(); err != nil {
+		return nil, err
+	}
+	box, ok := PreviewSizes[size]
+	if !ok {
+		return nil, ErrInvalidPreview
+	}
+
+	f.mu.Lock()
+	entry, ok := f.curr.Get(path.Key())
+	readable := ok && f.canRead(user, path.Key())
+	f.mu.Unlock()
+	if !readable {
+		return nil, ErrResourceNotFound
+	}
+	if entry.IsDir() {
+		return nil, ErrIsFolder
+	}
+
+	preview := &Preview{Key: path.Key(), Size: size, Object: entry.Object, Modified: entry.Modified}
+	if data, ok := f.loadPreview(entry.Object, size); ok {
+		preview.Data = data
+		preview.ContentType = http.DetectContentType(data)
+		return preview, nil
+	}
+
+	// Open while holding the lock so garbage collection cannot remove the
+	// object in between
+	f.mu.Lock()
+	file, err := f.openFile(path.Key(), entry)
+	f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	preview.Data, preview.ContentType, err = renderPreview(file, box)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.savePreview(entry.Object, size, preview.Data); err != nil {
+		log.Warnf("Failed to cache the %v preview of %v: %v", size, path, err)
+	}
+	return preview, nil
+}
+
+// Reads a cached preview. Previews that cannot be read, such as those sealed
+// under a master key since replaced, count as missing and are rendered anew.
+func (f *Atlas) loadPreview(object string, size string) ([]byte, bool) {
+	name := f.previewPath(object, size)
+	if file, err := f.backend.Open(name + encryptedSuffix); err == nil {
+		defer file.Close()
+		content, err := f.newDecrypter(file)
+		if err != nil {
+			return nil, false
+		}
+		data, err := io.ReadAll(content)
+		return data, err == nil
+	}
+
+	file, err := f.backend.Open(name)
+	if err != nil {
+		return nil, false
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	return data, err == nil
+}
+
+func (f *Atlas) savePreview(object string, size string, data []byte) error {
+	name := f.previewPath(object, size)
+	master := f.masterKey()
+	if master != nil {
+		name += encryptedSuffix
+	}
+
+	out, err := f.backend.Create(name)
+	if err != nil {
+		return err
+	}
+	if master != nil {
+		err = encrypt(out, bytes.NewReader(data), master)
+	} else {
+		_, err = out.Write(data)
+	}
+	if err != nil {
+		out.Abort()
+		return err
+	}
+	return out.Commit()
+}
+
+// Removes the cached previews of objects no longer referenced. Must be called
+// with the atlas lock held and the references counted.
+func (f *Atlas) collectPreviews(report *GCReport) error {
+	infos, err := f.backend.List("previews/")
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		base := info.Name[strings.LastIndex(info.Name, "/")+1:]
+		object, _, _ := strings.Cut(base, "-")
+		if f.refs[object] > 0 {
+			continue
+		}
+		if err := f.backend.Remove(info.Name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		report.Previews++
+		report.Freed += info.Size
+	}
+	return nil
+}
+
+// Removes every cached preview. Must be called with the atlas lock held.
+func (f *Atlas) dropPreviews(report *RekeyReport) error {
+	infos, err := f.backend.List("previews/")
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		if err := f.backend.Remove(info.Name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		report.Previews++
+	}
+	return nil
+}
+
+// Decodes the image in src and scales it to fit a box of the given size.
+// JPEG images are encoded as JPEG again, everything else as PNG.
+func renderPreview(src io.ReadSeeker, box int) ([]byte, string, error) {
+	config, format, err := image.DecodeConfig(src)
+	if err != nil {
+		return nil, "", ErrNoPreview
+	}
+	if config.Width*config.Height > MaxPreviewPixels {
+		return nil, "", fmt.Errorf("%w: image of %dx%d pixels is too large", ErrNoPreview, config.Width, config.Height)
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, "", err
+	}
+
+	img, _, err := image.Decode(src)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %w", ErrNoPreview, err)
+	}
+	scaled := scale(img, box)
+
+	buf := &bytes.Buffer{}
+	if format == "jpeg" {
+		err = jpeg.Encode(buf, scaled, &jpeg.Options{Quality: 85})
+		return buf.Bytes(), "image/jpeg", err
+	}
+	err = png.Encode(buf, scaled)
+	return buf.Bytes(), "image/png", err
+}
+
+// Scales img down to fit a box of the given size, averaging the source pixels
+// covered by each target pixel. Images that fit already keep their size.
+func scale(img image.Image, box int) *image.RGBA {
+	bounds := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	sw, sh := bounds.Dx(), bounds.Dy()
+	if sw <= box && sh <= box {
+		return src
+	}
+	dw, dh := box, box
+	if sw > sh {
+		dh = max(sh*box/sw, 1)
+	} else {
+		dw = max(sw*box/sh, 1)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := range dh {
+		y0, y1 := y*sh/dh, max((y+1)*sh/dh, y*sh/dh+1)
+		for x := range dw {
+			x0, x1 := x*sw/dw, max((x+1)*sw/dw, x*sw/dw+1)
+
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride+x0*4 : sy*src.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i+1])
+					sum[2] += int(row[i+2])
+					sum[3] += int(row[i+3])
+				}
+			}
+
+			n := (x1 - x0) * (y1 - y0)
+			i := y*dst.Stride + x*4
+			for c := range sum {
+				dst.Pix[i+c] = uint8(sum[c] / n)
+			}
+		}
+	}
+	return dst
+}
@@ -0,0 +1,234 @@
+package atlas_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/mnemosynefs/mnemo/internal/atlas"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Encodes a width by height image, red on the left half and blue on the right
+func encodeImage(t *testing.T, format string, width int, height int) string {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			c := color.RGBA{R: 255, A: 255}
+			if x >= width/2 {
+				c = color.RGBA{B: 255, A: 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	switch format {
+	case "png":
+		require.NoError(t, png.Encode(buf, img))
+	case "jpeg":
+		require.NoError(t, jpeg.Encode(buf, img, nil))
+	case "gif":
+		require.NoError(t, gif.Encode(buf, img, nil))
+	case "webp":
+		buf.Write(encodeWebP(img))
+	}
+	return buf.String()
+}
+
+// Encodes an image of opaque red and blue pixels as lossless WebP. Green and
+// alpha get a code of a single symbol, red and blue one bit per pixel.
+func encodeWebP(img *image.RGBA) []byte {
+	var stream []byte
+	var acc uint64
+	var n uint
+	write := func(v uint64, bits uint) {
+		acc |= v << n
+		for n += bits; n >= 8; n -= 8 {
+			stream = append(stream, byte(acc))
+			acc >>= 8
+		}
+	}
+
+	bounds := img.Bounds()
+	write(0x2f, 8)
+	write(uint64(bounds.Dx()-1), 14)
+	write(uint64(bounds.Dy()-1), 14)
+	// No alpha, version 0, no transform, color cache or meta prefix codes
+	write(0, 1+3+1+1+1)
+	single := func(symbol uint64) {
+		write(1, 1)
+		write(0, 1)
+		write(1, 1)
+		write(symbol, 8)
+	}
+	pair := func() {
+		write(1, 1)
+		write(1, 1)
+		write(1, 1)
+		write(0, 8)
+		write(255, 8)
+	}
+	single(0)
+	pair()
+	pair()
+	single(255)
+	single(0)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := img.RGBAAt(x, y)
+			write(uint64(c.R>>7), 1)
+			write(uint64(c.B>>7), 1)
+		}
+	}
+	write(0, 7)
+	if len(stream)%2 == 1 {
+		stream = append(stream, 0)
+	}
+
+	out := []byte("RIFF")
+	out = binary.LittleEndian.AppendUint32(out, uint32(12+len(stream)))
+	out = append(out, "WEBPVP8L"...)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(stream)))
+	return append(out, stream...)
+}
+
+func decodePreview(t *testing.T, preview *atlas.Preview) (image.Image, string) {
+	t.Helper()
+	img, format, err := image.Decode(bytes.NewReader(preview.Data))
+	require.NoError(t, err)
+	return img, format
+}
+
+func TestPreview(t *testing.T) {
+	files := newTestAtlas(t)
+	writeFile(t, files, "photo.jpg", encodeImage(t, "jpeg", 600, 300))
+	writeFile(t, files, "shot.png", encodeImage(t, "png", 300, 600))
+	writeFile(t, files, "anim.gif", encodeImage(t, "gif", 100, 50))
+	writeFile(t, files, "sticker.webp", encodeImage(t, "webp", 200, 100))
+
+	preview, err := files.Preview(atlas.NewPath("photo.jpg"), "small", "tester")
+	require.NoError(t, err)
+	img, format := decodePreview(t, preview)
+	assert.Equal(t, "jpeg", format)
+	assert.Equal(t, "image/jpeg", preview.ContentType)
+	assert.Equal(t, image.Rect(0, 0, 128, 64), img.Bounds())
+
+	preview, err = files.Preview(atlas.NewPath("shot.png"), "small", "tester")
+	require.NoError(t, err)
+	img, format = decodePreview(t, preview)
+	assert.Equal(t, "png", format)
+	assert.Equal(t, image.Rect(0, 0, 64, 128), img.Bounds())
+	r, _, b, _ := img.At(0, 0).RGBA()
+	assert.Equal(t, uint32(0xffff), r)
+	_, _, b, _ = img.At(63, 0).RGBA()
+	assert.Equal(t, uint32(0xffff), b)
+
+	// Small images are never scaled up
+	preview, err = files.Preview(atlas.NewPath("anim.gif"), "large", "tester")
+	require.NoError(t, err)
+	img, format = decodePreview(t, preview)
+	assert.Equal(t, "png", format)
+	assert.Equal(t, image.Rect(0, 0, 100, 50), img.Bounds())
+
+	preview, err = files.Preview(atlas.NewPath("sticker.webp"), "small", "tester")
+	require.NoError(t, err)
+	img, format = decodePreview(t, preview)
+	assert.Equal(t, "png", format)
+	assert.Equal(t, "image/png", preview.ContentType)
+	assert.Equal(t, image.Rect(0, 0, 128, 64), img.Bounds())
+	r, _, _, _ = img.At(0, 0).RGBA()
+	assert.Equal(t, uint32(0xffff), r)
+	_, _, b, _ = img.At(127, 0).RGBA()
+	assert.Equal(t, uint32(0xffff), b)
+
+	writeFile(t, files, "notes.txt", "not an image")
+	_, err = files.Preview(atlas.NewPath("notes.txt"), "small", "tester")
+	assert.ErrorIs(t, err, atlas.ErrNoPreview)
+	_, err = files.Preview(atlas.NewPath("photo.jpg"), "huge", "tester")
+	assert.ErrorIs(t, err, atlas.ErrInvalidPreview)
+	_, err = files.Preview(atlas.NewPath("missing.png"), "small", "tester")
+	assert.ErrorIs(t, err, atlas.ErrResourceNotFound)
+
+	files.SetReadPermission(func(username string, key string) bool { return username == "tester" })
+	_, err = files.Preview(atlas.NewPath("photo.jpg"), "small", "guest")
+	assert.ErrorIs(t, err, atlas.ErrResourceNotFound)
+}
+
+func TestPreview_Cache(t *testing.T) {
+	backend := atlas.NewMemoryBackend()
+	files, err := atlas.NewAtlasWithBackend(backend)
+	require.NoError(t, err)
+	require.NoError(t, files.SetEncryptionKey(newKey(t)))
+
+	writeFile(t, files, "shot.png", encodeImage(t, "png", 400, 400))
+	first, err := files.Preview(atlas.NewPath("shot.png"), "small", "tester")
+	require.NoError(t, err)
+
+	cached, err := backend.List("previews/")
+	require.NoError(t, err)
+	require.Len(t, cached, 1)
+	assert.True(t, strings.HasSuffix(cached[0].Name, "-small.enc"))
+
+	second, err := files.Preview(atlas.NewPath("shot.png"), "small", "tester")
+	require.NoError(t, err)
+	assert.Equal(t, first.Data, second.Data)
+	assert.Equal(t, first.ETag(), second.ETag())
+
+	// A changed file is another object with previews of its own
+	writeFile(t, files, "shot.png", encodeImage(t, "png", 200, 400))
+	changed, err := files.Preview(atlas.NewPath("shot.png"), "small", "tester")
+	require.NoError(t, err)
+	assert.NotEqual(t, first.ETag(), changed.ETag())
+	img, _ := decodePreview(t, changed)
+	assert.Equal(t, image.Rect(0, 0, 64, 128), img.Bounds())
+
+	// Previews of objects nobody references are collected with them
+	stale, err := backend.Create("previews/ab/" + strings.Repeat("ab", 32) + "-small")
+	require.NoError(t, err)
+	_, err = stale.Write([]byte("stale"))
+	require.NoError(t, err)
+	require.NoError(t, stale.Commit())
+
+	report, err := files.CollectGarbage()
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Previews)
+	cached, err = backend.List("previews/")
+	require.NoError(t, err)
+	assert.Len(t, cached, 2)
+}
+
+func TestHandlers_Preview(t *testing.T) {
+	files := newTestAtlas(t)
+	mux := newTestMux(files)
+	mux.HandleFunc("GET /previews/{path...}", files.PreviewHandler)
+	writeFile(t, files, "shot.png", encodeImage(t, "png", 800, 600))
+	writeFile(t, files, "notes.txt", "text")
+
+	rec := serve(mux, http.MethodGet, "/previews/shot.png", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "image/png", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "private, no-cache", rec.Header().Get("Cache-Control"))
+	etag := rec.Header().Get("ETag")
+	assert.True(t, strings.HasSuffix(etag, `-medium"`))
+	img, _, err := image.Decode(rec.Body)
+	require.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 512, 384), img.Bounds())
+
+	req, _ := http.NewRequest(http.MethodGet, "/previews/shot.png", nil)
+	req.Header.Set("If-None-Match", etag)
+	assert.Equal(t, http.StatusNotModified, serveRequest(mux, req).Code)
+
+	assert.Equal(t, http.StatusBadRequest, serve(mux, http.MethodGet, "/previews/shot.png?size=huge", "").Code)
+	assert.Equal(t, http.StatusUnsupportedMediaType, serve(mux, http.MethodGet, "/previews/notes.txt", "").Code)
+	assert.Equal(t, http.StatusNotFound, serve(mux, http.MethodGet, "/previews/missing.png", "").Code)
+}
@@ -0,0 +1,172 @@
+package atlas
+
+import (
+	"errors"
+	"os"
+	"strings"
+)
+
+// Quotas cap the bytes of current files per author and per top-level folder.
+// Versions, trash and tags do not count. Limits are read from
+// atlas/quotas.json, a limit of zero or less is unlimited.
+
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+type Quotas struct {
+	// Limit of users not listed in Users
+	DefaultUser int64            `json:"default_user,omitempty"`
+	Users       map[string]int64 `json:"users,omitempty"`
+	// Limits keyed by the name of a top-level folder
+	Folders map[string]int64 `json:"folders,omitempty"`
+}
+
+type Usage struct {
+	Used  int64 `json:"used"`
+	Limit int64 `json:"limit,omitempty"`
+}
+
+type UsageReport struct {
+	User    string           `json:"user"`
+	Usage   Usage            `json:"usage"`
+	Folders map[string]Usage `json:"folders"`
+}
+
+func (f *Atlas) quotasFile() string {
+	return "quotas.json"
+}
+
+func (f *Atlas) loadQuotas() error {
+	err := f.loadJSON(f.quotasFile(), &f.quotas)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Replaces the configured quotas. Content already stored is kept even when it
+// exceeds the new limits, only further growth is refused.
+func (f *Atlas) SetQuotas(quotas Quotas) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.quotas = quotas
+	return f.saveJSON(f.quotasFile(), f.quotas)
+}
+
+// Sets the limit of users without a quota of their own, without persisting it
+func (f *Atlas) SetDefaultUserQuota(limit int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.quotas.DefaultUser = limit
+}
+
+func (f *Atlas) userLimit(user string) int64 {
+	if limit, ok := f.quotas.Users[user]; ok {
+		return limit
+	}
+	return f.quotas.DefaultUser
+}
+
+// Name of the top-level folder holding key, empty for files at the root
+func topFolder(key string) string {
+	folder, _, ok := strings.Cut(key, "/")
+	if !ok {
+		return ""
+	}
+	return folder
+}
+
+// Returns the current file sizes per author and per top-level folder. Must be
+// called with the atlas lock held.
+func (f *Atlas) usage() (map[string]int64, map[string]int64) {
+	return f.curr.Usage()
+}
+
+// Checks that replacing the subtrees at remove with the entries of add keeps
+// every user and folder that grows within its quota. Must be called with the
+// atlas lock held.
+func (f *Atlas) checkQuota(remove []string, add map[string]Entry) error {
+	userDelta, folderDelta := map[string]int64{}, map[string]int64{}
+	for _, key := range remove {
+		for k, entry := range f.curr.Subtree(key) {
+			if !entry.IsDir() {
+				userDelta[entry.Author] -= entry.Size
+				folderDelta[topFolder(k)] -= entry.Size
+			}
+		}
+	}
+	for key, entry := range add {
+		if !entry.IsDir() {
+			userDelta[entry.Author] += entry.Size
+			folderDelta[topFolder(key)] += entry.Size
+		}
+	}
+
+	users, folders := f.usage()
+	for user, delta := range userDelta {
+		limit := f.userLimit(user)
+		if delta > 0 && limit > 0 && users[user]+delta > limit {
+			return ErrQuotaExceeded
+		}
+	}
+	for folder, delta := range folderDelta {
+		limit := f.quotas.Folders[folder]
+		if delta > 0 && folder != "" && limit > 0 && folders[folder]+delta > limit {
+			return ErrQuotaExceeded
+		}
+	}
+
+	return nil
+}
+
+// Returns how many bytes author may write to the file at key, or -1 when no
+// quota applies. Must be called with the atlas lock held.
+func (f *Atlas) quotaBudget(author string, key string) int64 {
+	users, folders := f.usage()
+
+	var replaced Entry
+	if entry, ok := f.curr.Get(key); ok && !entry.IsDir() {
+		replaced = entry
+	}
+
+	budget := int64(-1)
+	if limit := f.userLimit(author); limit > 0 {
+		budget = limit - users[author]
+		if replaced.Author == author {
+			budget += replaced.Size
+		}
+		budget = max(budget, 0)
+	}
+	if folder := topFolder(key); folder != "" {
+		if limit := f.quotas.Folders[folder]; limit > 0 {
+			remaining := max(limit-folders[folder]+replaced.Size, 0)
+			if budget < 0 || remaining < budget {
+				budget = remaining
+			}
+		}
+	}
+
+	return budget
+}
+
+// Reports the storage used by user and by every top-level folder, together
+// with their limits
+func (f *Atlas) Usage(user string) *UsageReport {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	users, folders := f.usage()
+	report := &UsageReport{
+		User:    user,
+		Usage:   Usage{Used: users[user], Limit: max(f.userLimit(user), 0)},
+		Folders: map[string]Usage{},
+	}
+	for key, entry := range f.curr.Entries {
+		if entry.IsDir() && topFolder(key) == "" {
+			report.Folders[key] = Usage{Used: folders[key], Limit: max(f.quotas.Folders[key], 0)}
+		}
+	}
+
+	return report
+}
@@ -0,0 +1,158 @@
+package atlas_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mnemosynefs/mnemo/internal/atlas"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeAs(files *atlas.Atlas, author string, path string, content string) error {
+	writer, err := files.Write(atlas.NewPath(path), author)
+	if err != nil {
+		return err
+	}
+	defer writer.Abort()
+
+	if _, err := io.WriteString(writer, content); err != nil {
+		return err
+	}
+	return writer.Commit()
+}
+
+func TestQuota_User(t *testing.T) {
+	root := t.TempDir()
+	files, err := atlas.NewAtlas(root)
+	require.NoError(t, err)
+	require.NoError(t, files.SetQuotas(atlas.Quotas{
+		DefaultUser: 10,
+		Users:       map[string]int64{"bob": 0},
+	}))
+
+	require.NoError(t, writeAs(files, "alice", "a.txt", "12345"))
+	require.NoError(t, writeAs(files, "alice", "b.txt", "12345"))
+	assert.ErrorIs(t, writeAs(files, "alice", "c.txt", "1"), atlas.ErrQuotaExceeded)
+	assert.False(t, files.Exists(atlas.NewPath("c.txt")))
+
+	// Replacing a file only counts the difference
+	require.NoError(t, writeAs(files, "alice", "a.txt", "123"))
+	require.NoError(t, writeAs(files, "alice", "c.txt", "12"))
+
+	// Other users have a quota of their own, bob has none at all
+	require.NoError(t, writeAs(files, "carol", "d.txt", "1234567890"))
+	require.NoError(t, writeAs(files, "bob", "e.txt", strings.Repeat("x", 100)))
+
+	// Quotas survive a restart and shrinking is always allowed
+	files, err = atlas.NewAtlas(root)
+	require.NoError(t, err)
+	assert.ErrorIs(t, writeAs(files, "alice", "f.txt", "1"), atlas.ErrQuotaExceeded)
+	require.NoError(t, files.Delete(atlas.NewPath("a.txt"), "alice"))
+	require.NoError(t, writeAs(files, "alice", "f.txt", "1"))
+
+	usage := files.Usage("alice")
+	assert.Equal(t, atlas.Usage{Used: 8, Limit: 10}, usage.Usage)
+}
+
+func TestQuota_Folder(t *testing.T) {
+	files := newTestAtlas(t)
+	require.NoError(t, files.SetQuotas(atlas.Quotas{
+		Folders: map[string]int64{"team": 8},
+	}))
+
+	require.NoError(t, writeAs(files, "alice", "team/a.txt", "1234"))
+	require.NoError(t, writeAs(files, "bob", "team/docs/b.txt", "1234"))
+	assert.ErrorIs(t, writeAs(files, "carol", "team/c.txt", "1"), atlas.ErrQuotaExceeded)
+	require.NoError(t, writeAs(files, "carol", "other/c.txt", "123456789"))
+
+	// Copies and moves into the folder count as well
+	_, err := files.Copy(atlas.NewPath("other/c.txt"), atlas.NewPath("team/c.txt"), false, "carol")
+	assert.ErrorIs(t, err, atlas.ErrQuotaExceeded)
+	_, err = files.Move(atlas.NewPath("other"), atlas.NewPath("team/other"), false, "carol")
+	assert.ErrorIs(t, err, atlas.ErrQuotaExceeded)
+	_, err = files.Move(atlas.NewPath("team/a.txt"), atlas.NewPath("team/docs/a.txt"), false, "carol")
+	require.NoError(t, err)
+
+	usage := files.Usage("alice")
+	assert.Equal(t, atlas.Usage{Used: 8, Limit: 8}, usage.Folders["team"])
+	assert.Equal(t, atlas.Usage{Used: 9}, usage.Folders["other"])
+	assert.Equal(t, atlas.Usage{Used: 4}, usage.Usage)
+}
+
+func TestQuota_RunningTotals(t *testing.T) {
+	backend := atlas.NewMemoryBackend()
+	files, err := atlas.NewAtlasWithBackend(backend)
+	require.NoError(t, err)
+
+	require.NoError(t, writeAs(files, "alice", "team/a.txt", "1234"))
+	require.NoError(t, writeAs(files, "bob", "team/a.txt", "12"))
+	require.NoError(t, writeAs(files, "alice", "team/docs/b.txt", "123"))
+	_, err = files.Copy(atlas.NewPath("team/docs"), atlas.NewPath("other/docs"), false, "bob")
+	require.NoError(t, err)
+	_, err = files.Move(atlas.NewPath("team/a.txt"), atlas.NewPath("other/a.txt"), false, "bob")
+	require.NoError(t, err)
+	require.NoError(t, files.Delete(atlas.NewPath("team/docs"), "alice"))
+	_, err = files.RestoreTrash("alice", files.Trash("alice")[0].ID, atlas.NewPath(""), false)
+	require.NoError(t, err)
+	_, err = files.Extract(atlas.NewPath("team"), "alice", bytes.NewReader(buildZip(t, "c.txt", "12345")))
+	require.NoError(t, err)
+
+	// The totals kept along the way match those counted from scratch
+	reopened, err := atlas.NewAtlasWithBackend(backend)
+	require.NoError(t, err)
+	for _, user := range []string{"alice", "bob"} {
+		assert.Equal(t, reopened.Usage(user), files.Usage(user), user)
+	}
+	assert.Equal(t, int64(8), files.Usage("alice").Usage.Used)
+	assert.Equal(t, int64(5), files.Usage("bob").Usage.Used)
+}
+
+func TestQuota_Upload(t *testing.T) {
+	files := newTestAtlas(t)
+	files.SetDefaultUserQuota(5)
+
+	_, err := files.CreateUpload(atlas.NewPath("big.bin"), "alice", 6, "")
+	assert.ErrorIs(t, err, atlas.ErrQuotaExceeded)
+
+	upload, err := files.CreateUpload(atlas.NewPath("small.bin"), "alice", 5, "")
+	require.NoError(t, err)
+
+	// The quota is checked again when the upload is published
+	require.NoError(t, writeAs(files, "alice", "a.txt", "1"))
+	_, err = files.AppendUpload(upload.ID, 0, strings.NewReader("12345"))
+	assert.ErrorIs(t, err, atlas.ErrQuotaExceeded)
+	assert.False(t, files.Exists(atlas.NewPath("small.bin")))
+}
+
+func TestHandlers_Quota(t *testing.T) {
+	files := newTestAtlas(t)
+	mux := newTestMux(files)
+	mux.HandleFunc("GET /usage", files.UsageHandler)
+	files.SetDefaultUserQuota(5)
+
+	request := func(method string, target string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("username", "alice")
+		return serveRequest(mux, req)
+	}
+
+	rec := request(http.MethodPut, "/files/a.txt", "123")
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	rec = request(http.MethodPut, "/files/b.txt", "123")
+	assert.Equal(t, http.StatusInsufficientStorage, rec.Code)
+	assert.False(t, files.Exists(atlas.NewPath("b.txt")))
+
+	rec = request(http.MethodGet, "/usage", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var report atlas.UsageReport
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+	assert.Equal(t, "alice", report.User)
+	assert.Equal(t, atlas.Usage{Used: 3, Limit: 5}, report.Usage)
+}
@@ -0,0 +1,196 @@
+package atlas
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Tags live in atlas/tags/<name>.json, holding the tag description together
+// with a frozen copy of the curr manifest. Content is shared through the
+// object store so a tag costs no more than its manifest.
+
+// Layout of the tag directories written before the object store existed
+const (
+	tagTreeDir  = "tree"
+	tagInfoFile = "tag.json"
+)
+
+type TagInfo struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	Author  string    `json:"author,omitempty"`
+	Size    int64     `json:"size"`
+	Files   int       `json:"files"`
+}
+
+type tag struct {
+	TagInfo
+	Manifest
+}
+
+func (f *Atlas) tagFile(name string) string {
+	return "tags/" + name + ".json"
+}
+
+func (f *Atlas) TagExists(name string) bool {
+	if _, err := f.backend.Stat(f.tagFile(name)); err != nil {
+		return false
+	}
+	return true
+}
+
+func (f *Atlas) loadTag(name string) (*tag, error) {
+	if err := ValidateTag(name); err != nil {
+		return nil, err
+	}
+
+	t := &tag{}
+	err := f.loadJSON(f.tagFile(name), t)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrTagNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if t.Entries == nil {
+		t.Entries = map[string]Entry{}
+	}
+
+	return t, nil
+}
+
+func (f *Atlas) tagNames() ([]string, error) {
+	infos, err := f.backend.List("tags/")
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, info := range infos {
+		name, ok := strings.CutSuffix(strings.TrimPrefix(info.Name, "tags/"), ".json")
+		if !ok || ValidateTag(name) != nil {
+			continue
+		}
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// Freezes the current state of curr under the given tag name on behalf of
+// author
+func (f *Atlas) CreateTag(name string, author string) (*TagInfo, error) {
+	if err := ValidateTag(name); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.TagExists(name) {
+		return nil, ErrTagExists
+	}
+
+	t := &tag{
+		TagInfo: TagInfo{
+			Name:    name,
+			Created: time.Now().UTC(),
+			Author:  author,
+		},
+		Manifest: *f.curr.Clone(),
+	}
+	t.Manifest.EachFile(func(key string, entry Entry) {
+		t.Size += entry.Size
+		t.Files++
+	})
+
+	if err := f.saveJSON(f.tagFile(name), t); err != nil {
+		return nil, err
+	}
+	f.retain(t.Entries)
+	f.emit(Event{Type: EventTagCreated, Tag: name, Author: author})
+
+	return &t.TagInfo, nil
+}
+
+func (f *Atlas) Tag(name string) (*TagInfo, error) {
+	t, err := f.loadTag(name)
+	if err != nil {
+		return nil, err
+	}
+	return &t.TagInfo, nil
+}
+
+// Lists every tag, oldest first
+func (f *Atlas) Tags() ([]TagInfo, error) {
+	names, err := f.tagNames()
+	if err != nil {
+		return nil, err
+	}
+
+	tags := []TagInfo{}
+	for _, name := range names {
+		info, err := f.Tag(name)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, *info)
+	}
+
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].Created.Before(tags[j].Created)
+	})
+
+	return tags, nil
+}
+
+// Removes a tag on behalf of user, who must be an administrator. Objects only
+// it referenced are freed by the next garbage collection, so the snapshot is
+// gone for good.
+func (f *Atlas) DeleteTag(name string, user string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.isAdmin(user) {
+		return ErrPermissionDenied
+	}
+	t, err := f.loadTag(name)
+	if err != nil {
+		return err
+	}
+
+	if err := f.backend.Remove(f.tagFile(name)); err != nil {
+		return err
+	}
+	f.release(t.Entries)
+	f.emit(Event{Type: EventTagDeleted, Tag: name, Author: user})
+
+	return nil
+}
+
+// Reads a file as it was when the tag was created, on behalf of user
+func (f *Atlas) ReadTag(name string, path Path, user string) (*File, error) {
+	if err := path.Validate(); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t, err := f.loadTag(name)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, ok := t.Get(path.Key())
+	if !ok || !f.canRead(user, path.Key()) {
+		return nil, ErrResourceNotFound
+	}
+	if entry.IsDir() {
+		return nil, ErrIsFolder
+	}
+
+	return f.openFile(path.Key(), entry)
+}
@@ -0,0 +1,523 @@
+package atlas_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mnemosynefs/mnemo/internal/atlas"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestAtlas(t *testing.T) *atlas.Atlas {
+	t.Helper()
+	files, err := atlas.NewAtlas(t.TempDir())
+	require.NoError(t, err)
+	return files
+}
+
+func writeFile(t *testing.T, files *atlas.Atlas, path string, content string) {
+	t.Helper()
+	writer, err := files.Write(atlas.NewPath(path), "tester")
+	require.NoError(t, err)
+	_, err = io.WriteString(writer, content)
+	require.NoError(t, err)
+	require.NoError(t, writer.Commit())
+}
+
+func readFile(t *testing.T, files *atlas.Atlas, path string) string {
+	t.Helper()
+	reader, err := files.Read(atlas.NewPath(path), "tester")
+	require.NoError(t, err)
+	defer reader.Close()
+	content, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	return string(content)
+}
+
+func newTestMux(files *atlas.Atlas) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /files/{path...}", files.ReadHandler)
+	mux.HandleFunc("PUT /files/{path...}", files.WriteHandler)
+	mux.HandleFunc("DELETE /files/{path...}", files.DeleteHandler)
+	mux.HandleFunc("GET /tags", files.ListTagsHandler)
+	mux.HandleFunc("POST /tags/{tag}", files.CreateTagHandler)
+	mux.HandleFunc("GET /tags/{tag}/files/{path...}", files.ReadTagHandler)
+	mux.HandleFunc("GET /tags/{tag}/diff", files.DiffTagHandler)
+	mux.HandleFunc("POST /tags/{tag}/restore/{path...}", files.RestoreTagHandler)
+	return mux
+}
+
+// Serves a request of the user tester, as the session middleware would pass it
+func serve(mux http.Handler, method string, target string, body string) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, target, reader)
+	req.Header.Set("username", "tester")
+	return serveRequest(mux, req)
+}
+
+func serveRequest(mux http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+//
+// Validation Testing
+//
+
+func TestValidateTag(t *testing.T) {
+	assert.NoError(t, atlas.ValidateTag("release-2026.10"))
+	assert.NoError(t, atlas.ValidateTag("friday snapshot"))
+	assert.ErrorIs(t, atlas.ValidateTag(""), atlas.ErrInvalidTag)
+	assert.ErrorIs(t, atlas.ValidateTag("../curr"), atlas.ErrInvalidTag)
+	assert.ErrorIs(t, atlas.ValidateTag(".."), atlas.ErrInvalidTag)
+}
+
+func TestValidatePath(t *testing.T) {
+	assert.NoError(t, atlas.ValidatePath("docs/readme.md"))
+	assert.NoError(t, atlas.ValidatePath(""))
+	assert.ErrorIs(t, atlas.ValidatePath("/etc/passwd"), atlas.ErrInvalidPath)
+	assert.ErrorIs(t, atlas.ValidatePath("../outside"), atlas.ErrInvalidPath)
+	assert.ErrorIs(t, atlas.ValidatePath("docs/../../outside"), atlas.ErrInvalidPath)
+}
+
+//
+// Atlas Testing
+//
+
+func TestWriteRead(t *testing.T) {
+	files := newTestAtlas(t)
+
+	writeFile(t, files, "docs/readme.md", "hello")
+	assert.True(t, files.Exists(atlas.NewPath("docs/readme.md")))
+	assert.Equal(t, "hello", readFile(t, files, "docs/readme.md"))
+
+	writeFile(t, files, "docs/readme.md", "bye")
+	assert.Equal(t, "bye", readFile(t, files, "docs/readme.md"))
+}
+
+func TestWrite_Invalid(t *testing.T) {
+	files := newTestAtlas(t)
+	writeFile(t, files, "docs/readme.md", "hello")
+
+	_, err := files.Write(atlas.NewPath(""), "tester")
+	assert.ErrorIs(t, err, atlas.ErrUploadToRoot)
+
+	_, err = files.Write(atlas.NewPath("docs"), "tester")
+	assert.ErrorIs(t, err, atlas.ErrIsFolder)
+
+	_, err = files.Write(atlas.NewPath("../escape"), "tester")
+	assert.ErrorIs(t, err, atlas.ErrInvalidPath)
+}
+
+func TestWrite_Abort(t *testing.T) {
+	root := t.TempDir()
+	files, err := atlas.NewAtlas(root)
+	require.NoError(t, err)
+	writeFile(t, files, "docs/readme.md", "hello")
+
+	writer, err := files.Write(atlas.NewPath("docs/readme.md"), "tester")
+	require.NoError(t, err)
+	_, err = io.WriteString(writer, "partial")
+	require.NoError(t, err)
+
+	// Nothing is visible before the commit
+	assert.Equal(t, "hello", readFile(t, files, "docs/readme.md"))
+
+	writer.Abort()
+	assert.Equal(t, "hello", readFile(t, files, "docs/readme.md"))
+	assert.ErrorIs(t, writer.Commit(), os.ErrClosed)
+
+	staged, err := os.ReadDir(filepath.Join(root, "atlas", "tmp"))
+	require.NoError(t, err)
+	assert.Empty(t, staged)
+
+	writer, err = files.Write(atlas.NewPath("docs/new.md"), "tester")
+	require.NoError(t, err)
+	writer.Abort()
+	assert.False(t, files.Exists(atlas.NewPath("docs/new.md")))
+}
+
+func TestWrite_StaleStaging(t *testing.T) {
+	root := t.TempDir()
+	files, err := atlas.NewAtlas(root)
+	require.NoError(t, err)
+
+	// A writer that is never finished, as after a crash
+	writer, err := files.Write(atlas.NewPath("a.txt"), "tester")
+	require.NoError(t, err)
+	_, err = io.WriteString(writer, "partial")
+	require.NoError(t, err)
+
+	_, err = atlas.NewAtlas(root)
+	require.NoError(t, err)
+	staged, err := os.ReadDir(filepath.Join(root, "atlas", "tmp"))
+	require.NoError(t, err)
+	assert.Empty(t, staged)
+	assert.False(t, files.Exists(atlas.NewPath("a.txt")))
+}
+
+func TestRead_Invalid(t *testing.T) {
+	files := newTestAtlas(t)
+	writeFile(t, files, "docs/readme.md", "hello")
+
+	_, err := files.Read(atlas.NewPath("missing"), "tester")
+	assert.ErrorIs(t, err, atlas.ErrResourceNotFound)
+
+	_, err = files.Read(atlas.NewPath("docs"), "tester")
+	assert.ErrorIs(t, err, atlas.ErrIsFolder)
+}
+
+func TestDelete(t *testing.T) {
+	files := newTestAtlas(t)
+	writeFile(t, files, "docs/readme.md", "hello")
+
+	assert.ErrorIs(t, files.Delete(atlas.NewPath(""), "tester"), atlas.ErrUploadToRoot)
+	assert.ErrorIs(t, files.Delete(atlas.NewPath("missing"), "tester"), atlas.ErrResourceNotFound)
+
+	require.NoError(t, files.Delete(atlas.NewPath("docs"), "tester"))
+	assert.False(t, files.Exists(atlas.NewPath("docs/readme.md")))
+}
+
+func TestMakeDir(t *testing.T) {
+	files := newTestAtlas(t)
+	writeFile(t, files, "readme.md", "hello")
+
+	require.NoError(t, files.MakeDir(atlas.NewPath("docs/drafts"), "tester"))
+	drafts := atlas.NewPath("docs/drafts")
+	info, err := drafts.Stat(files)
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+	assert.True(t, files.Exists(atlas.NewPath("docs")))
+
+	assert.ErrorIs(t, files.MakeDir(atlas.NewPath("docs"), "tester"), atlas.ErrDestinationExists)
+	assert.ErrorIs(t, files.MakeDir(atlas.NewPath("readme.md"), "tester"), atlas.ErrDestinationExists)
+	assert.ErrorIs(t, files.MakeDir(atlas.NewPath("readme.md/sub"), "tester"), atlas.ErrIsFile)
+	assert.ErrorIs(t, files.MakeDir(atlas.NewPath("../outside"), "tester"), atlas.ErrInvalidPath)
+
+	listing, err := files.List(atlas.NewPath("docs/drafts"), atlas.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, listing.Entries)
+}
+
+//
+// Tag Testing
+//
+
+func TestCreateTag(t *testing.T) {
+	files := newTestAtlas(t)
+	writeFile(t, files, "docs/readme.md", "hello")
+	writeFile(t, files, "notes.txt", "abc")
+
+	info, err := files.CreateTag("release-2026-10", "tester")
+	require.NoError(t, err)
+	assert.Equal(t, "release-2026-10", info.Name)
+	assert.Equal(t, "tester", info.Author)
+	assert.Equal(t, int64(8), info.Size)
+	assert.Equal(t, 2, info.Files)
+
+	_, err = files.CreateTag("release-2026-10", "tester")
+	assert.ErrorIs(t, err, atlas.ErrTagExists)
+
+	_, err = files.CreateTag("../curr", "tester")
+	assert.ErrorIs(t, err, atlas.ErrInvalidTag)
+
+	tags, err := files.Tags()
+	require.NoError(t, err)
+	require.Len(t, tags, 1)
+	assert.Equal(t, *info, tags[0])
+}
+
+func TestDeleteTag(t *testing.T) {
+	files := newTestAtlas(t)
+	writeFile(t, files, "notes.txt", "abc")
+	_, err := files.CreateTag("v1", "tester")
+	require.NoError(t, err)
+	files.SetAdminPermission(func(username string) bool { return username == "admin" })
+
+	assert.ErrorIs(t, files.DeleteTag("v1", "tester"), atlas.ErrPermissionDenied)
+	assert.ErrorIs(t, files.DeleteTag("v1", ""), atlas.ErrPermissionDenied)
+	assert.True(t, files.TagExists("v1"))
+
+	require.NoError(t, files.DeleteTag("v1", "admin"))
+	assert.False(t, files.TagExists("v1"))
+}
+
+func TestReadTag(t *testing.T) {
+	files := newTestAtlas(t)
+	writeFile(t, files, "docs/readme.md", "hello")
+
+	_, err := files.CreateTag("v1", "tester")
+	require.NoError(t, err)
+
+	writeFile(t, files, "docs/readme.md", "changed")
+
+	reader, err := files.ReadTag("v1", atlas.NewPath("docs/readme.md"), "tester")
+	require.NoError(t, err)
+	content, err := io.ReadAll(reader)
+	reader.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(content))
+
+	_, err = files.ReadTag("v2", atlas.NewPath("docs/readme.md"), "tester")
+	assert.ErrorIs(t, err, atlas.ErrTagNotFound)
+
+	_, err = files.ReadTag("v1", atlas.NewPath("docs"), "tester")
+	assert.ErrorIs(t, err, atlas.ErrIsFolder)
+
+	_, err = files.ReadTag("v1", atlas.NewPath("missing"), "tester")
+	assert.ErrorIs(t, err, atlas.ErrResourceNotFound)
+}
+
+func TestDiff(t *testing.T) {
+	files := newTestAtlas(t)
+	writeFile(t, files, "keep.txt", "same")
+	writeFile(t, files, "docs/readme.md", "hello")
+	writeFile(t, files, "old.txt", "old")
+
+	_, err := files.CreateTag("v1", "tester")
+	require.NoError(t, err)
+
+	writeFile(t, files, "docs/readme.md", "world")
+	writeFile(t, files, "new.txt", "new")
+	require.NoError(t, files.Delete(atlas.NewPath("old.txt"), "tester"))
+
+	diff, err := files.Diff("v1", "", "tester")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"new.txt"}, diff.Added)
+	assert.Equal(t, []string{"old.txt"}, diff.Removed)
+	assert.Equal(t, []string{"docs/readme.md"}, diff.Modified)
+
+	_, err = files.CreateTag("v2", "tester")
+	require.NoError(t, err)
+
+	diff, err = files.Diff("v2", "v1", "tester")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"old.txt"}, diff.Added)
+	assert.Equal(t, []string{"new.txt"}, diff.Removed)
+
+	_, err = files.Diff("v3", "", "tester")
+	assert.ErrorIs(t, err, atlas.ErrTagNotFound)
+}
+
+func TestRestore(t *testing.T) {
+	files := newTestAtlas(t)
+	writeFile(t, files, "docs/readme.md", "hello")
+	writeFile(t, files, "docs/guide.md", "guide")
+	writeFile(t, files, "notes.txt", "notes")
+
+	_, err := files.CreateTag("v1", "tester")
+	require.NoError(t, err)
+
+	writeFile(t, files, "docs/readme.md", "broken")
+	writeFile(t, files, "docs/upload.bin", "junk")
+	writeFile(t, files, "notes.txt", "edited")
+
+	// Subpath restore leaves the rest of curr alone
+	require.NoError(t, files.Restore("v1", atlas.NewPath("docs"), "tester"))
+	assert.Equal(t, "hello", readFile(t, files, "docs/readme.md"))
+	assert.False(t, files.Exists(atlas.NewPath("docs/upload.bin")))
+	assert.Equal(t, "edited", readFile(t, files, "notes.txt"))
+
+	require.NoError(t, files.Restore("v1", atlas.NewPath(""), "tester"))
+	assert.Equal(t, "notes", readFile(t, files, "notes.txt"))
+
+	diff, err := files.Diff("v1", "", "tester")
+	require.NoError(t, err)
+	assert.Empty(t, diff.Added)
+	assert.Empty(t, diff.Removed)
+	assert.Empty(t, diff.Modified)
+
+	assert.ErrorIs(t, files.Restore("v1", atlas.NewPath("missing"), "tester"), atlas.ErrResourceNotFound)
+	assert.ErrorIs(t, files.Restore("v2", atlas.NewPath(""), "tester"), atlas.ErrTagNotFound)
+}
+
+//
+// HTTP Handler Testing
+//
+
+func TestHandlers_RoundTrip(t *testing.T) {
+	mux := newTestMux(newTestAtlas(t))
+
+	rec := serve(mux, http.MethodPut, "/files/docs/readme.md", "hello")
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	rec = serve(mux, http.MethodGet, "/files/docs/readme.md", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "hello", rec.Body.String())
+
+	rec = serve(mux, http.MethodDelete, "/files/docs/readme.md", "")
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	rec = serve(mux, http.MethodGet, "/files/docs/readme.md", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestHandlers_Range(t *testing.T) {
+	mux := newTestMux(newTestAtlas(t))
+	serve(mux, http.MethodPut, "/files/digits.txt", "0123456789")
+
+	req := httptest.NewRequest(http.MethodGet, "/files/digits.txt", nil)
+	req.Header.Set("Range", "bytes=2-5")
+	rec := serveRequest(mux, req)
+	require.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, "2345", rec.Body.String())
+	assert.Equal(t, "bytes 2-5/10", rec.Header().Get("Content-Range"))
+	assert.Equal(t, "4", rec.Header().Get("Content-Length"))
+
+	req.Header.Set("Range", "bytes=0-1,-2")
+	rec = serveRequest(mux, req)
+	require.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.True(t, strings.HasPrefix(rec.Header().Get("Content-Type"), "multipart/byteranges"))
+	assert.Contains(t, rec.Body.String(), "01")
+	assert.Contains(t, rec.Body.String(), "89")
+
+	req.Header.Set("Range", "bytes=20-")
+	rec = serveRequest(mux, req)
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, rec.Code)
+
+	rec = serve(mux, http.MethodGet, "/files/digits.txt", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "bytes", rec.Header().Get("Accept-Ranges"))
+	assert.Equal(t, "text/plain; charset=utf-8", rec.Header().Get("Content-Type"))
+}
+
+func TestHandlers_Conditional(t *testing.T) {
+	mux := newTestMux(newTestAtlas(t))
+	serve(mux, http.MethodPut, "/files/readme.md", "hello")
+
+	rec := serve(mux, http.MethodGet, "/files/readme.md", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	etag := rec.Header().Get("ETag")
+	modified := rec.Header().Get("Last-Modified")
+	require.NotEmpty(t, etag)
+	require.NotEmpty(t, modified)
+
+	req := httptest.NewRequest(http.MethodGet, "/files/readme.md", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = serveRequest(mux, req)
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	assert.Empty(t, rec.Body.String())
+
+	req = httptest.NewRequest(http.MethodGet, "/files/readme.md", nil)
+	req.Header.Set("If-Modified-Since", modified)
+	rec = serveRequest(mux, req)
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+
+	// Once the content changes the old entity tag no longer matches, and a
+	// range conditional on it is answered with the whole file
+	serve(mux, http.MethodPut, "/files/readme.md", "hello world")
+	req = httptest.NewRequest(http.MethodGet, "/files/readme.md", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = serveRequest(mux, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.NotEqual(t, etag, rec.Header().Get("ETag"))
+
+	req.Header.Del("If-None-Match")
+	req.Header.Set("Range", "bytes=0-4")
+	req.Header.Set("If-Range", etag)
+	rec = serveRequest(mux, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "hello world", rec.Body.String())
+
+	// Older versions keep the entity tag of their own content
+	rec = serve(mux, http.MethodGet, "/files/readme.md?version=1", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, etag, rec.Header().Get("ETag"))
+}
+
+func TestHandlers_InterruptedWrite(t *testing.T) {
+	files := newTestAtlas(t)
+	mux := newTestMux(files)
+	writeFile(t, files, "docs/readme.md", "hello")
+
+	req := httptest.NewRequest(http.MethodPut, "/files/docs/readme.md", &brokenReader{strings.NewReader("partial")})
+	req.Header.Set("username", "tester")
+	rec := serveRequest(mux, req)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Equal(t, "hello", readFile(t, files, "docs/readme.md"))
+}
+
+func TestHandlers_ErrorStatus(t *testing.T) {
+	mux := newTestMux(newTestAtlas(t))
+	serve(mux, http.MethodPut, "/files/docs/readme.md", "hello")
+
+	rec := serve(mux, http.MethodGet, "/files/docs", "")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	rec = serve(mux, http.MethodPut, "/files/", "hello")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	rec = serve(mux, http.MethodDelete, "/files/missing", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestHandlers_Tags(t *testing.T) {
+	files := newTestAtlas(t)
+	mux := newTestMux(files)
+	mux.HandleFunc("DELETE /tags/{tag}", files.DeleteTagHandler)
+	serve(mux, http.MethodPut, "/files/docs/readme.md", "hello")
+
+	rec := serve(mux, http.MethodPost, "/tags/v1", "")
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	rec = serve(mux, http.MethodPost, "/tags/v1", "")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	serve(mux, http.MethodPut, "/files/docs/readme.md", "changed")
+
+	rec = serve(mux, http.MethodGet, "/tags/v1/files/docs/readme.md", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "hello", rec.Body.String())
+
+	rec = serve(mux, http.MethodGet, "/tags", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var tags []atlas.TagInfo
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &tags))
+	require.Len(t, tags, 1)
+	assert.Equal(t, "v1", tags[0].Name)
+
+	rec = serve(mux, http.MethodGet, "/tags/v2/files/docs/readme.md", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	files.SetAdminPermission(func(username string) bool { return username == "admin" })
+	rec = serve(mux, http.MethodDelete, "/tags/v1", "")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	req := httptest.NewRequest(http.MethodDelete, "/tags/v1", nil)
+	req.Header.Set("username", "admin")
+	assert.Equal(t, http.StatusNoContent, serveRequest(mux, req).Code)
+}
+
+func TestHandlers_DiffRestore(t *testing.T) {
+	mux := newTestMux(newTestAtlas(t))
+	serve(mux, http.MethodPut, "/files/docs/readme.md", "hello")
+	serve(mux, http.MethodPost, "/tags/v1", "")
+	serve(mux, http.MethodPut, "/files/docs/readme.md", "broken")
+
+	rec := serve(mux, http.MethodGet, "/tags/v1/diff", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var diff atlas.TreeDiff
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &diff))
+	assert.Equal(t, []string{"docs/readme.md"}, diff.Modified)
+
+	rec = serve(mux, http.MethodPost, "/tags/v1/restore/docs/readme.md", "")
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	rec = serve(mux, http.MethodGet, "/files/docs/readme.md", "")
+	assert.Equal(t, "hello", rec.Body.String())
+
+	rec = serve(mux, http.MethodGet, "/tags/v1/diff?to=v2", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -0,0 +1,241 @@
+package atlas
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/google/uuid"
+)
+
+// Deleted files and folders are kept per user in atlas/trash.json until they
+// are restored or purged. Trashed entries keep referencing their objects, so
+// content survives garbage collection while it can still be restored.
+
+var ErrTrashNotFound = errors.New("trash item does not exist")
+
+// Age after which trash is purged unless configured otherwise
+const DefaultTrashAge = 30 * 24 * time.Hour
+
+type TrashItem struct {
+	ID      string    `json:"id"`
+	Path    string    `json:"path"`
+	Type    EntryType `json:"type"`
+	Size    int64     `json:"size"`
+	Deleted time.Time `json:"deleted"`
+}
+
+// trashed is a deleted subtree, keyed by the paths it had in curr
+type trashed struct {
+	TrashItem
+	Manifest
+}
+
+func (f *Atlas) trashFile() string {
+	return "trash.json"
+}
+
+func (f *Atlas) saveTrash() error {
+	return f.saveJSON(f.trashFile(), f.trash)
+}
+
+// Moves the removed entries of a delete by user into the trash. Must be called
+// with the atlas lock held.
+func (f *Atlas) moveToTrash(user string, key string, removed map[string]Entry) {
+	item := &trashed{
+		TrashItem: TrashItem{
+			ID:      uuid.NewString(),
+			Path:    key,
+			Type:    removed[key].Type,
+			Deleted: time.Now().UTC(),
+		},
+		Manifest: Manifest{Entries: removed},
+	}
+	item.EachFile(func(_ string, entry Entry) {
+		item.Size += entry.Size
+	})
+
+	f.retain(removed)
+	f.trash[user] = append(f.trash[user], item)
+}
+
+// Looks up a trash item of user. Must be called with the atlas lock held.
+func (f *Atlas) trashItem(user string, id string) (int, *trashed, error) {
+	for i, item := range f.trash[user] {
+		if item.ID == id {
+			return i, item, nil
+		}
+	}
+	return 0, nil, ErrTrashNotFound
+}
+
+// Lists the trash of user, most recently deleted first
+func (f *Atlas) Trash(user string) []TrashItem {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	items := []TrashItem{}
+	trash := f.trash[user]
+	for i := len(trash) - 1; i >= 0; i-- {
+		items = append(items, trash[i].TrashItem)
+	}
+
+	return items
+}
+
+// Puts a trash item of user back into curr, at its original path or at to if
+// given. Reports whether the path was created rather than replaced; existing
+// files are only replaced when overwrite is set. Restored files become the
+// next version at their path.
+func (f *Atlas) RestoreTrash(user string, id string, to Path, overwrite bool) (bool, error) {
+	if err := to.Validate(); err != nil {
+		return false, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	i, item, err := f.trashItem(user, id)
+	if err != nil {
+		return false, err
+	}
+
+	target := item.Path
+	if !to.Root() {
+		target = to.Key()
+	}
+
+	if err := f.checkPermission(user, target); err != nil {
+		return false, err
+	}
+	_, replaced := f.curr.Get(target)
+	if replaced && !overwrite {
+		return false, ErrDestinationExists
+	}
+	if err := f.checkParents(target); err != nil {
+		return false, err
+	}
+
+	restored := map[string]Entry{}
+	for key, entry := range item.Entries {
+		restored[target+strings.TrimPrefix(key, item.Path)] = entry
+	}
+	if err := f.checkQuota([]string{target}, restored); err != nil {
+		return false, err
+	}
+
+	f.archive(f.curr.Remove(target))
+	if err := f.curr.MakeParents(target, time.Now().UTC()); err != nil {
+		return false, err
+	}
+
+	for key, entry := range restored {
+		if !entry.IsDir() {
+			entry.Version = f.nextVersion(key)
+		}
+		f.curr.Put(key, entry)
+	}
+
+	f.trash[user] = slices.Delete(f.trash[user], i, i+1)
+	if err := f.saveTrash(); err != nil {
+		return false, err
+	}
+	if err := f.saveCurr(); err != nil {
+		return false, err
+	}
+
+	event := Event{Type: EventCreated, Path: target, EntryType: restored[target].Type, Author: user}
+	if replaced {
+		event.Type = EventModified
+	}
+	f.emit(event)
+	return !replaced, nil
+}
+
+// Permanently removes a trash item of user. Its content is freed by the next
+// garbage collection unless still referenced elsewhere.
+func (f *Atlas) PurgeTrash(user string, id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	i, item, err := f.trashItem(user, id)
+	if err != nil {
+		return err
+	}
+
+	f.release(item.Entries)
+	f.trash[user] = slices.Delete(f.trash[user], i, i+1)
+
+	return f.saveTrash()
+}
+
+// Permanently removes every trash item of user
+func (f *Atlas) EmptyTrash(user string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, item := range f.trash[user] {
+		f.release(item.Entries)
+	}
+	delete(f.trash, user)
+
+	return f.saveTrash()
+}
+
+// Permanently removes the trash items of every user that were deleted more
+// than maxAge ago, returning how many were removed
+func (f *Atlas) PurgeExpiredTrash(maxAge time.Duration) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cutoff := time.Now().Add(-maxAge)
+	purged := 0
+	for user, items := range f.trash {
+		f.trash[user] = slices.DeleteFunc(items, func(item *trashed) bool {
+			if item.Deleted.After(cutoff) {
+				return false
+			}
+			f.release(item.Entries)
+			purged++
+			return true
+		})
+		if len(f.trash[user]) == 0 {
+			delete(f.trash, user)
+		}
+	}
+
+	if purged == 0 {
+		return 0, nil
+	}
+	return purged, f.saveTrash()
+}
+
+// Purges expired trash in the background every interval until the returned
+// function is called
+func (f *Atlas) StartTrashPurge(maxAge time.Duration, interval time.Duration) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				purged, err := f.PurgeExpiredTrash(maxAge)
+				if err != nil {
+					log.Errorf("Failed to purge trash: %v", err)
+				} else if purged > 0 {
+					log.Infof("Purged %d expired trash items", purged)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
@@ -0,0 +1,164 @@
+package atlas_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mnemosynefs/mnemo/internal/atlas"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrash_DeleteRestore(t *testing.T) {
+	root := t.TempDir()
+	files, err := atlas.NewAtlas(root)
+	require.NoError(t, err)
+	writeFile(t, files, "docs/readme.md", "hello")
+	writeFile(t, files, "docs/img/logo.png", "png")
+
+	require.NoError(t, files.Delete(atlas.NewPath("docs"), "alice"))
+	assert.False(t, files.Exists(atlas.NewPath("docs")))
+
+	// Trash is kept per user and survives a restart
+	assert.Empty(t, files.Trash("bob"))
+	files, err = atlas.NewAtlas(root)
+	require.NoError(t, err)
+
+	trash := files.Trash("alice")
+	require.Len(t, trash, 1)
+	assert.Equal(t, "docs", trash[0].Path)
+	assert.Equal(t, atlas.EntryDir, trash[0].Type)
+	assert.Equal(t, int64(8), trash[0].Size)
+
+	// Trashed content is not garbage
+	report, err := files.CollectGarbage()
+	require.NoError(t, err)
+	assert.Equal(t, 0, report.Removed)
+
+	_, err = files.RestoreTrash("bob", trash[0].ID, atlas.NewPath(""), false)
+	assert.ErrorIs(t, err, atlas.ErrTrashNotFound)
+
+	created, err := files.RestoreTrash("alice", trash[0].ID, atlas.NewPath(""), false)
+	require.NoError(t, err)
+	assert.True(t, created)
+	assert.Equal(t, "hello", readFile(t, files, "docs/readme.md"))
+	assert.Equal(t, "png", readFile(t, files, "docs/img/logo.png"))
+	assert.Empty(t, files.Trash("alice"))
+
+	versions, err := files.Versions(atlas.NewPath("docs/readme.md"), "tester")
+	require.NoError(t, err)
+	assert.Equal(t, 2, versions[0].ID)
+}
+
+func TestTrash_RestoreConflict(t *testing.T) {
+	files := newTestAtlas(t)
+	writeFile(t, files, "a.txt", "old")
+	require.NoError(t, files.Delete(atlas.NewPath("a.txt"), "alice"))
+	writeFile(t, files, "a.txt", "new")
+	id := files.Trash("alice")[0].ID
+
+	_, err := files.RestoreTrash("alice", id, atlas.NewPath(""), false)
+	assert.ErrorIs(t, err, atlas.ErrDestinationExists)
+	assert.Equal(t, "new", readFile(t, files, "a.txt"))
+
+	created, err := files.RestoreTrash("alice", id, atlas.NewPath("restored/a.txt"), false)
+	require.NoError(t, err)
+	assert.True(t, created)
+	assert.Equal(t, "old", readFile(t, files, "restored/a.txt"))
+
+	require.NoError(t, files.Delete(atlas.NewPath("restored"), "alice"))
+	id = files.Trash("alice")[0].ID
+	writeFile(t, files, "restored", "in the way")
+	_, err = files.RestoreTrash("alice", id, atlas.NewPath(""), true)
+	require.NoError(t, err)
+	assert.Equal(t, "old", readFile(t, files, "restored/a.txt"))
+
+	// The replaced file is kept as a version
+	assert.Equal(t, "in the way", readVersion(t, files, "restored", 1))
+}
+
+func TestTrash_Purge(t *testing.T) {
+	files := newTestAtlas(t)
+	writeFile(t, files, "a.txt", "a")
+	writeFile(t, files, "b.txt", "b")
+	writeFile(t, files, "c.txt", "c")
+	require.NoError(t, files.Delete(atlas.NewPath("a.txt"), "alice"))
+	require.NoError(t, files.Delete(atlas.NewPath("b.txt"), "alice"))
+	require.NoError(t, files.Delete(atlas.NewPath("c.txt"), "bob"))
+
+	trash := files.Trash("alice")
+	require.Len(t, trash, 2)
+	assert.Equal(t, "b.txt", trash[0].Path)
+
+	require.NoError(t, files.PurgeTrash("alice", trash[0].ID))
+	assert.ErrorIs(t, files.PurgeTrash("alice", trash[0].ID), atlas.ErrTrashNotFound)
+	assert.Len(t, files.Trash("alice"), 1)
+
+	require.NoError(t, files.EmptyTrash("alice"))
+	assert.Empty(t, files.Trash("alice"))
+
+	purged, err := files.PurgeExpiredTrash(time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 0, purged)
+	purged, err = files.PurgeExpiredTrash(0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	assert.Empty(t, files.Trash("bob"))
+}
+
+func TestTrash_BackgroundPurge(t *testing.T) {
+	files := newTestAtlas(t)
+	writeFile(t, files, "a.txt", "a")
+	require.NoError(t, files.Delete(atlas.NewPath("a.txt"), "alice"))
+
+	stop := files.StartTrashPurge(0, time.Millisecond)
+	defer stop()
+
+	assert.Eventually(t, func() bool {
+		return len(files.Trash("alice")) == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestHandlers_Trash(t *testing.T) {
+	files := newTestAtlas(t)
+	mux := newTestMux(files)
+	mux.HandleFunc("GET /trash", files.ListTrashHandler)
+	mux.HandleFunc("DELETE /trash", files.EmptyTrashHandler)
+	mux.HandleFunc("POST /trash/{id}/restore", files.RestoreTrashHandler)
+	mux.HandleFunc("DELETE /trash/{id}", files.PurgeTrashHandler)
+	writeFile(t, files, "a.txt", "a")
+
+	request := func(method string, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("username", "alice")
+		return serveRequest(mux, req)
+	}
+
+	rec := request(http.MethodDelete, "/files/a.txt")
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	rec = request(http.MethodGet, "/trash")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var trash []atlas.TrashItem
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &trash))
+	require.Len(t, trash, 1)
+
+	writeFile(t, files, "a.txt", "new")
+	rec = request(http.MethodPost, "/trash/"+trash[0].ID+"/restore")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	rec = request(http.MethodPost, "/trash/"+trash[0].ID+"/restore?overwrite=true")
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "a", readFile(t, files, "a.txt"))
+
+	rec = request(http.MethodDelete, "/trash/"+trash[0].ID)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	request(http.MethodDelete, "/files/a.txt")
+	rec = request(http.MethodDelete, "/trash")
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Empty(t, files.Trash("alice"))
+}
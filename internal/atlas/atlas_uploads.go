@@ -0,0 +1,376 @@
+package atlas
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/google/uuid"
+)
+
+// Age after which uploads that receive no more content are removed unless
+// configured otherwise
+const DefaultUploadAge = 24 * time.Hour
+
+var (
+	ErrInvalidUpload    = errors.New("upload is not valid")
+	ErrUploadNotFound   = errors.New("upload does not exist")
+	ErrUploadOffset     = errors.New("upload offset does not match")
+	ErrUploadBusy       = errors.New("upload is already receiving data")
+	ErrUploadTooLarge   = errors.New("upload exceeds its declared length")
+	ErrChecksumMismatch = errors.New("content does not match checksum")
+)
+
+// Upload is a resumable upload session. The content is received in chunks
+// into atlas/uploads and only published into curr once all of it arrived and
+// matches the checksum, if one was given.
+type Upload struct {
+	ID     string `json:"id"`
+	Path   string `json:"path"`
+	Author string `json:"author"`
+	// Total size of the file, the upload completes once offset reaches it
+	Length int64 `json:"length"`
+	Offset int64 `json:"offset"`
+	// Optional expected checksum of the content, as "sha256:<hex>"
+	Checksum string    `json:"checksum,omitempty"`
+	Created  time.Time `json:"created"`
+}
+
+// Complete reports whether the upload received all of its content
+func (u *Upload) Complete() bool {
+	return u.Offset == u.Length
+}
+
+func (f *Atlas) uploadFile(id string) string {
+	return "uploads/" + id + ".json"
+}
+
+// Prefix of the chunks received by an upload. Chunks are named after their
+// offset, so listing them yields the content in order. Chunks are encrypted
+// like objects when a master key is set.
+func (f *Atlas) uploadChunks(id string) string {
+	return "uploads/" + id + ".part-"
+}
+
+func (f *Atlas) uploadChunk(id string, offset int64) string {
+	return fmt.Sprintf("%s%020d", f.uploadChunks(id), offset)
+}
+
+// Starts an upload of length bytes to path on behalf of author
+func (f *Atlas) CreateUpload(path Path, author string, length int64, checksum string) (*Upload, error) {
+	if err := path.Validate(); err != nil {
+		return nil, err
+	}
+	if path.Root() {
+		return nil, ErrUploadToRoot
+	}
+	if length < 0 {
+		return nil, ErrInvalidUpload
+	}
+	if err := validateChecksum(checksum); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidUpload, err)
+	}
+
+	f.mu.Lock()
+	err := f.checkPermission(author, path.Key())
+	if err == nil {
+		err = f.checkWritable(path.Key())
+	}
+	if err == nil {
+		err = f.checkQuota([]string{path.Key()}, map[string]Entry{
+			path.Key(): {Type: EntryFile, Size: length, Author: author},
+		})
+	}
+	f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	upload := &Upload{
+		ID:       uuid.NewString(),
+		Path:     path.Key(),
+		Author:   author,
+		Length:   length,
+		Checksum: strings.ToLower(checksum),
+		Created:  time.Now().UTC(),
+	}
+
+	if err := f.saveJSON(f.uploadFile(upload.ID), upload); err != nil {
+		return nil, err
+	}
+
+	return upload, nil
+}
+
+// Looks up an upload session together with the amount of content received
+func (f *Atlas) Upload(id string) (*Upload, error) {
+	if err := uuid.Validate(id); err != nil {
+		return nil, ErrUploadNotFound
+	}
+
+	upload := &Upload{}
+	if err := f.loadJSON(f.uploadFile(id), upload); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrUploadNotFound
+		}
+		return nil, err
+	}
+
+	chunks, err := f.backend.List(f.uploadChunks(id))
+	if err != nil {
+		return nil, err
+	}
+	for _, chunk := range chunks {
+		size := chunk.Size
+		if strings.HasSuffix(chunk.Name, encryptedSuffix) {
+			size, _, _ = plaintextSize(chunk.Size)
+		}
+		upload.Offset += size
+	}
+
+	return upload, nil
+}
+
+// Marks an upload as receiving data so chunks cannot interleave
+func (f *Atlas) claimUpload(id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.uploading[id] {
+		return ErrUploadBusy
+	}
+	f.uploading[id] = true
+	return nil
+}
+
+func (f *Atlas) releaseUpload(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.uploading, id)
+}
+
+// Appends a chunk starting at offset, which must be the amount of content
+// received so far. Content received before a failing read is kept, so a client
+// can query the offset and resume from there. The file is published once the
+// upload is complete.
+func (f *Atlas) AppendUpload(id string, offset int64, chunk io.Reader) (*Upload, error) {
+	if err := f.claimUpload(id); err != nil {
+		return nil, err
+	}
+	defer f.releaseUpload(id)
+
+	upload, err := f.Upload(id)
+	if err != nil {
+		return nil, err
+	}
+	if offset != upload.Offset {
+		return upload, ErrUploadOffset
+	}
+
+	name := f.uploadChunk(id, offset)
+	master := f.masterKey()
+	if master != nil {
+		name += encryptedSuffix
+	}
+	part, err := f.backend.Create(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// A chunk running past the declared length is refused as a whole, so
+	// the upload never completes with a cut off tail
+	remaining := upload.Length - upload.Offset
+	src := &chunkReader{r: io.LimitReader(chunk, remaining+1)}
+	if master != nil {
+		err = encrypt(part, src, master)
+	} else {
+		_, err = io.Copy(part, src)
+	}
+	if err != nil {
+		part.Abort()
+		return upload, err
+	}
+	if src.n > remaining {
+		part.Abort()
+		return upload, ErrUploadTooLarge
+	}
+	if src.n == 0 {
+		part.Abort()
+	} else if err := part.Commit(); err != nil {
+		return upload, err
+	}
+	upload.Offset += src.n
+	if src.err != nil {
+		return upload, src.err
+	}
+
+	if upload.Complete() {
+		return upload, f.finishUpload(upload)
+	}
+	return upload, nil
+}
+
+// chunkReader counts the bytes of a chunk and ends it at the first failing
+// read, keeping the error, so what arrived before can still be stored
+type chunkReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if err != nil && err != io.EOF {
+		c.err = err
+		return n, io.EOF
+	}
+	return n, err
+}
+
+// Verifies a complete upload and publishes it into curr. The session is gone
+// once published or when the content does not match the checksum. Other
+// failures, such as exceeding a quota, keep it so the client can retry by
+// appending an empty chunk at the final offset.
+func (f *Atlas) finishUpload(upload *Upload) error {
+	chunks, err := f.backend.List(f.uploadChunks(upload.ID))
+	if err != nil {
+		return err
+	}
+
+	w, err := f.newObject()
+	if err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		if err := f.copyChunk(w, chunk.Name); err != nil {
+			w.discard()
+			return err
+		}
+	}
+
+	if upload.Checksum != "" && upload.Checksum != w.checksum() {
+		w.discard()
+		f.removeUpload(upload.ID)
+		return ErrChecksumMismatch
+	}
+
+	if _, err := f.publish(upload.Path, upload.Author, w, Condition{}); err != nil {
+		return err
+	}
+	return f.removeUpload(upload.ID)
+}
+
+func (f *Atlas) copyChunk(w *objectWriter, name string) error {
+	chunk, err := f.backend.Open(name)
+	if err != nil {
+		return err
+	}
+	defer chunk.Close()
+
+	var content io.Reader = chunk
+	if strings.HasSuffix(name, encryptedSuffix) {
+		if content, err = f.newDecrypter(chunk); err != nil {
+			return err
+		}
+	}
+	_, err = io.Copy(w, content)
+	return err
+}
+
+func (f *Atlas) removeUpload(id string) error {
+	chunks, err := f.backend.List(f.uploadChunks(id))
+	if err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		err := f.backend.Remove(chunk.Name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return f.backend.Remove(f.uploadFile(id))
+}
+
+// Removes the uploads that received nothing for longer than maxAge, returning
+// how many were removed. Uploads busy receiving a chunk are left alone.
+func (f *Atlas) ExpireUploads(maxAge time.Duration) (int, error) {
+	infos, err := f.backend.List("uploads/")
+	if err != nil {
+		return 0, err
+	}
+
+	// The session file and every chunk count as activity
+	active := map[string]time.Time{}
+	for _, info := range infos {
+		base := info.Name[strings.LastIndex(info.Name, "/")+1:]
+		id, _, _ := strings.Cut(base, ".")
+		if uuid.Validate(id) != nil {
+			continue
+		}
+		if info.Modified.After(active[id]) {
+			active[id] = info.Modified
+		}
+	}
+
+	cutoff := time.Now().Add(-maxAge)
+	expired := 0
+	for id, modified := range active {
+		if modified.After(cutoff) || f.claimUpload(id) != nil {
+			continue
+		}
+		err := f.removeUpload(id)
+		f.releaseUpload(id)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return expired, err
+		}
+		expired++
+	}
+	return expired, nil
+}
+
+// Expires abandoned uploads in the background every interval until the
+// returned function is called
+func (f *Atlas) StartUploadExpiry(maxAge time.Duration, interval time.Duration) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				expired, err := f.ExpireUploads(maxAge)
+				if err != nil {
+					log.Errorf("Failed to expire uploads: %v", err)
+				} else if expired > 0 {
+					log.Infof("Expired %d abandoned uploads", expired)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
+
+// Abandons an upload and drops the content received so far
+func (f *Atlas) CancelUpload(id string) error {
+	if err := f.claimUpload(id); err != nil {
+		return err
+	}
+	defer f.releaseUpload(id)
+
+	if _, err := f.Upload(id); err != nil {
+		return err
+	}
+	return f.removeUpload(id)
+}
@@ -0,0 +1,247 @@
+package atlas_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mnemosynefs/mnemo/internal/atlas"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// brokenReader yields its content and then fails like a dropped connection
+type brokenReader struct {
+	content io.Reader
+}
+
+func (r *brokenReader) Read(p []byte) (int, error) {
+	n, err := r.content.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func checksum(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func TestUpload_Chunks(t *testing.T) {
+	files := newTestAtlas(t)
+
+	upload, err := files.CreateUpload(atlas.NewPath("docs/big.bin"), "tester", 10, checksum("0123456789"))
+	require.NoError(t, err)
+	assert.Equal(t, "docs/big.bin", upload.Path)
+	assert.False(t, files.Exists(atlas.NewPath("docs/big.bin")))
+
+	upload, err = files.AppendUpload(upload.ID, 0, strings.NewReader("0123"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), upload.Offset)
+	assert.False(t, upload.Complete())
+	assert.False(t, files.Exists(atlas.NewPath("docs/big.bin")))
+
+	// A chunk at the wrong offset is refused without touching the upload
+	_, err = files.AppendUpload(upload.ID, 2, strings.NewReader("23"))
+	assert.ErrorIs(t, err, atlas.ErrUploadOffset)
+
+	upload, err = files.AppendUpload(upload.ID, 4, strings.NewReader("456789"))
+	require.NoError(t, err)
+	assert.True(t, upload.Complete())
+	assert.Equal(t, "0123456789", readFile(t, files, "docs/big.bin"))
+
+	_, err = files.Upload(upload.ID)
+	assert.ErrorIs(t, err, atlas.ErrUploadNotFound)
+}
+
+func TestUpload_Resume(t *testing.T) {
+	root := t.TempDir()
+	files, err := atlas.NewAtlas(root)
+	require.NoError(t, err)
+
+	upload, err := files.CreateUpload(atlas.NewPath("a.txt"), "tester", 11, "")
+	require.NoError(t, err)
+
+	_, err = files.AppendUpload(upload.ID, 0, &brokenReader{strings.NewReader("hello")})
+	assert.Error(t, err)
+
+	// The received content survives the failure and a restart
+	files, err = atlas.NewAtlas(root)
+	require.NoError(t, err)
+	upload, err = files.Upload(upload.ID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), upload.Offset)
+
+	_, err = files.AppendUpload(upload.ID, upload.Offset, strings.NewReader(" world"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", readFile(t, files, "a.txt"))
+}
+
+func TestUpload_Invalid(t *testing.T) {
+	files := newTestAtlas(t)
+	writeFile(t, files, "docs/readme.md", "hello")
+
+	_, err := files.CreateUpload(atlas.NewPath(""), "tester", 1, "")
+	assert.ErrorIs(t, err, atlas.ErrUploadToRoot)
+	_, err = files.CreateUpload(atlas.NewPath("docs"), "tester", 1, "")
+	assert.ErrorIs(t, err, atlas.ErrIsFolder)
+	_, err = files.CreateUpload(atlas.NewPath("a.txt"), "tester", -1, "")
+	assert.ErrorIs(t, err, atlas.ErrInvalidUpload)
+	_, err = files.CreateUpload(atlas.NewPath("a.txt"), "tester", 1, "md5:abc")
+	assert.ErrorIs(t, err, atlas.ErrInvalidUpload)
+	_, err = files.Upload("../curr")
+	assert.ErrorIs(t, err, atlas.ErrUploadNotFound)
+
+	// A chunk running past the declared length is refused as a whole
+	upload, err := files.CreateUpload(atlas.NewPath("a.txt"), "tester", 3, "")
+	require.NoError(t, err)
+	_, err = files.AppendUpload(upload.ID, 0, strings.NewReader("abcdef"))
+	assert.ErrorIs(t, err, atlas.ErrUploadTooLarge)
+	upload, err = files.AppendUpload(upload.ID, 0, strings.NewReader(""))
+	require.NoError(t, err)
+	assert.Zero(t, upload.Offset)
+	assert.False(t, files.Exists(atlas.NewPath("a.txt")))
+	_, err = files.AppendUpload(upload.ID, 0, strings.NewReader("abc"))
+	require.NoError(t, err)
+	assert.Equal(t, "abc", readFile(t, files, "a.txt"))
+
+	// Content that does not match the checksum is never published
+	upload, err = files.CreateUpload(atlas.NewPath("b.txt"), "tester", 3, checksum("abc"))
+	require.NoError(t, err)
+	_, err = files.AppendUpload(upload.ID, 0, strings.NewReader("xyz"))
+	assert.ErrorIs(t, err, atlas.ErrChecksumMismatch)
+	assert.False(t, files.Exists(atlas.NewPath("b.txt")))
+	_, err = files.Upload(upload.ID)
+	assert.ErrorIs(t, err, atlas.ErrUploadNotFound)
+
+	upload, err = files.CreateUpload(atlas.NewPath("c.txt"), "tester", 3, "")
+	require.NoError(t, err)
+	require.NoError(t, files.CancelUpload(upload.ID))
+	_, err = files.Upload(upload.ID)
+	assert.ErrorIs(t, err, atlas.ErrUploadNotFound)
+}
+
+func TestUpload_Retry(t *testing.T) {
+	files := newTestAtlas(t)
+	upload, err := files.CreateUpload(atlas.NewPath("a.txt"), "tester", 5, "")
+	require.NoError(t, err)
+
+	// The session outlives a failure to publish, such as a quota filled up
+	// meanwhile
+	require.NoError(t, files.SetQuotas(atlas.Quotas{Users: map[string]int64{"tester": 4}}))
+	_, err = files.AppendUpload(upload.ID, 0, strings.NewReader("hello"))
+	assert.ErrorIs(t, err, atlas.ErrQuotaExceeded)
+	upload, err = files.Upload(upload.ID)
+	require.NoError(t, err)
+	assert.True(t, upload.Complete())
+
+	require.NoError(t, files.SetQuotas(atlas.Quotas{}))
+	_, err = files.AppendUpload(upload.ID, upload.Offset, strings.NewReader(""))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", readFile(t, files, "a.txt"))
+	_, err = files.Upload(upload.ID)
+	assert.ErrorIs(t, err, atlas.ErrUploadNotFound)
+}
+
+func TestExpireUploads(t *testing.T) {
+	files := newTestAtlas(t)
+	upload, err := files.CreateUpload(atlas.NewPath("a.txt"), "tester", 10, "")
+	require.NoError(t, err)
+	_, err = files.AppendUpload(upload.ID, 0, strings.NewReader("hello"))
+	require.NoError(t, err)
+
+	expired, err := files.ExpireUploads(time.Hour)
+	require.NoError(t, err)
+	assert.Zero(t, expired)
+	_, err = files.Upload(upload.ID)
+	require.NoError(t, err)
+
+	expired, err = files.ExpireUploads(0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, expired)
+	_, err = files.Upload(upload.ID)
+	assert.ErrorIs(t, err, atlas.ErrUploadNotFound)
+}
+
+func TestHandlers_Upload(t *testing.T) {
+	files := newTestAtlas(t)
+	mux := newTestMux(files)
+	mux.HandleFunc("POST /uploads/{path...}", files.CreateUploadHandler)
+	mux.HandleFunc("GET /uploads/{id}", files.UploadHandler)
+	mux.HandleFunc("PATCH /uploads/{id}", files.AppendUploadHandler)
+	mux.HandleFunc("DELETE /uploads/{id}", files.CancelUploadHandler)
+
+	req := httptest.NewRequest(http.MethodPost, "/uploads/docs/readme.md", nil)
+	req.Header.Set("username", "tester")
+	req.Header.Set("Upload-Length", "11")
+	req.Header.Set("Upload-Checksum", checksum("hello world"))
+	rec := serveRequest(mux, req)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	var upload atlas.Upload
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &upload))
+	location := rec.Header().Get("Location")
+	assert.Equal(t, "/uploads/"+upload.ID, location)
+
+	req = httptest.NewRequest(http.MethodPatch, location, strings.NewReader("hello"))
+	req.Header.Set("username", "tester")
+	req.Header.Set("Upload-Offset", "0")
+	rec = serveRequest(mux, req)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "5", rec.Header().Get("Upload-Offset"))
+
+	rec = serve(mux, http.MethodHead, location, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "5", rec.Header().Get("Upload-Offset"))
+	assert.Equal(t, "11", rec.Header().Get("Upload-Length"))
+
+	req = httptest.NewRequest(http.MethodPatch, location, strings.NewReader("world"))
+	req.Header.Set("username", "tester")
+	req.Header.Set("Upload-Offset", "0")
+	rec = serveRequest(mux, req)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Equal(t, "5", rec.Header().Get("Upload-Offset"))
+
+	req = httptest.NewRequest(http.MethodPatch, location, strings.NewReader(" world"))
+	req.Header.Set("username", "tester")
+	req.Header.Set("Upload-Offset", "5")
+	rec = serveRequest(mux, req)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, "hello world", readFile(t, files, "docs/readme.md"))
+
+	rec = serve(mux, http.MethodGet, location, "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	req = httptest.NewRequest(http.MethodPost, "/uploads/a.txt", nil)
+	req.Header.Set("username", "tester")
+	rec = serveRequest(mux, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestHandlers_UploadOwner(t *testing.T) {
+	files := newTestAtlas(t)
+	mux := newTestMux(files)
+	mux.HandleFunc("GET /uploads/{id}", files.UploadHandler)
+	mux.HandleFunc("DELETE /uploads/{id}", files.CancelUploadHandler)
+
+	upload, err := files.CreateUpload(atlas.NewPath("a.txt"), "alice", 3, "")
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/uploads/"+upload.ID, nil)
+	req.Header.Set("username", "bob")
+	rec := serveRequest(mux, req)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	req = httptest.NewRequest(http.MethodDelete, "/uploads/"+upload.ID, nil)
+	req.Header.Set("username", "alice")
+	rec = serveRequest(mux, req)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+}
@@ -0,0 +1,245 @@
+package atlas
+
+import (
+	"errors"
+	"slices"
+	"time"
+)
+
+var (
+	ErrInvalidVersion  = errors.New("version is not valid")
+	ErrVersionNotFound = errors.New("version does not exist")
+)
+
+// Number of replaced versions kept per file unless configured otherwise
+const DefaultVersionLimit = 20
+
+// Version describes one revision of a file. Replaced and deleted revisions are
+// kept in atlas/history.json until they fall off the version limit.
+type Version struct {
+	ID       int       `json:"id"`
+	Object   string    `json:"object"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Author   string    `json:"author"`
+	Current  bool      `json:"current,omitempty"`
+	Annotations
+}
+
+func (v Version) entry() Entry {
+	return Entry{
+		Type:        EntryFile,
+		Object:      v.Object,
+		Size:        v.Size,
+		Modified:    v.Modified,
+		Author:      v.Author,
+		Version:     v.ID,
+		Annotations: v.Annotations,
+	}
+}
+
+func (f *Atlas) historyFile() string {
+	return "history.json"
+}
+
+// Sets how many replaced versions are kept per file. A limit of zero or less
+// keeps every version.
+func (f *Atlas) SetVersionLimit(limit int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.versionLimit = limit
+}
+
+// Moves the file entries replaced in curr into the version history. Must be
+// called with the atlas lock held.
+func (f *Atlas) archive(entries map[string]Entry) {
+	for key, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		f.history[key] = append(f.history[key], Version{
+			ID:          entry.Version,
+			Object:      entry.Object,
+			Size:        entry.Size,
+			Modified:    entry.Modified,
+			Author:      entry.Author,
+			Annotations: entry.Annotations,
+		})
+		f.trimHistory(key)
+	}
+}
+
+// Drops the oldest versions of a file above the version limit
+func (f *Atlas) trimHistory(key string) {
+	versions := f.history[key]
+	excess := len(versions) - f.versionLimit
+	if f.versionLimit <= 0 || excess <= 0 {
+		return
+	}
+
+	for _, version := range versions[:excess] {
+		f.releaseObject(version.Object)
+	}
+	f.history[key] = slices.Clone(versions[excess:])
+}
+
+func (f *Atlas) nextVersion(key string) int {
+	latest := 0
+	if entry, ok := f.curr.Get(key); ok && !entry.IsDir() {
+		latest = entry.Version
+	}
+	for _, version := range f.history[key] {
+		latest = max(latest, version.ID)
+	}
+	return latest + 1
+}
+
+// Looks up a version of the file at key, current or historic. Must be called
+// with the atlas lock held.
+func (f *Atlas) version(key string, id int) (Version, error) {
+	if entry, ok := f.curr.Get(key); ok && !entry.IsDir() && entry.Version == id {
+		return Version{
+			ID:          entry.Version,
+			Object:      entry.Object,
+			Size:        entry.Size,
+			Modified:    entry.Modified,
+			Author:      entry.Author,
+			Current:     true,
+			Annotations: entry.Annotations,
+		}, nil
+	}
+
+	for _, version := range f.history[key] {
+		if version.ID == id {
+			return version, nil
+		}
+	}
+
+	return Version{}, ErrVersionNotFound
+}
+
+// Lists every known version of a file, newest first. Files that were deleted
+// still list their history.
+func (f *Atlas) Versions(path Path, user string) ([]Version, error) {
+	if err := path.Validate(); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := path.Key()
+	if !f.canRead(user, key) {
+		return nil, ErrResourceNotFound
+	}
+	entry, ok := f.curr.Get(key)
+	if ok && entry.IsDir() {
+		return nil, ErrIsFolder
+	}
+
+	history := f.history[key]
+	if !ok && len(history) == 0 {
+		return nil, ErrResourceNotFound
+	}
+
+	versions := []Version{}
+	if ok {
+		current, err := f.version(key, entry.Version)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, current)
+	}
+	for i := len(history) - 1; i >= 0; i-- {
+		versions = append(versions, history[i])
+	}
+
+	return versions, nil
+}
+
+// Opens a version of a file on behalf of user
+func (f *Atlas) ReadVersion(path Path, id int, user string) (*File, error) {
+	if err := path.Validate(); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.canRead(user, path.Key()) {
+		return nil, ErrResourceNotFound
+	}
+	version, err := f.version(path.Key(), id)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.openFile(path.Key(), version.entry())
+}
+
+// Makes an older version the current content of the file again. The content
+// it replaces is kept as a version of its own.
+func (f *Atlas) PromoteVersion(path Path, id int, author string) error {
+	if err := path.Validate(); err != nil {
+		return err
+	}
+	if path.Root() {
+		return ErrUploadToRoot
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := path.Key()
+	version, err := f.version(key, id)
+	if err != nil {
+		return err
+	}
+	if version.Current {
+		return nil
+	}
+	if err := f.checkPermission(author, key); err != nil {
+		return err
+	}
+	if err := f.checkWritable(key); err != nil {
+		return err
+	}
+	err = f.checkQuota([]string{key}, map[string]Entry{
+		key: {Type: EntryFile, Size: version.Size, Author: author},
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	if err := f.curr.MakeParents(key, now); err != nil {
+		return err
+	}
+
+	entry := Entry{
+		Type:        EntryFile,
+		Object:      version.Object,
+		Size:        version.Size,
+		Modified:    now,
+		Author:      author,
+		Version:     f.nextVersion(key),
+		Annotations: version.Annotations,
+	}
+	// The file keeps its own annotations, only a deleted file gets those of
+	// the version back
+	if current, ok := f.curr.Get(key); ok {
+		entry.Annotations = current.Annotations
+	}
+
+	f.retainObject(entry.Object)
+	f.archive(f.curr.Remove(key))
+	f.curr.Put(key, entry)
+
+	if err := f.saveCurr(); err != nil {
+		return err
+	}
+	f.emit(Event{Type: EventModified, Path: key, EntryType: EntryFile, Author: author})
+	return nil
+}
@@ -0,0 +1,142 @@
+package atlas_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/mnemosynefs/mnemo/internal/atlas"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readVersion(t *testing.T, files *atlas.Atlas, path string, id int) string {
+	t.Helper()
+	reader, err := files.ReadVersion(atlas.NewPath(path), id, "tester")
+	require.NoError(t, err)
+	defer reader.Close()
+	content, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	return string(content)
+}
+
+func TestVersions_Overwrite(t *testing.T) {
+	files := newTestAtlas(t)
+	writeFile(t, files, "a.txt", "one")
+	writeFile(t, files, "a.txt", "two")
+	writeFile(t, files, "a.txt", "three")
+
+	versions, err := files.Versions(atlas.NewPath("a.txt"), "tester")
+	require.NoError(t, err)
+	require.Len(t, versions, 3)
+
+	assert.Equal(t, 3, versions[0].ID)
+	assert.True(t, versions[0].Current)
+	assert.Equal(t, int64(5), versions[0].Size)
+	assert.Equal(t, "tester", versions[0].Author)
+	assert.Equal(t, 1, versions[2].ID)
+	assert.False(t, versions[2].Current)
+
+	assert.Equal(t, "one", readVersion(t, files, "a.txt", 1))
+	assert.Equal(t, "three", readVersion(t, files, "a.txt", 3))
+
+	_, err = files.ReadVersion(atlas.NewPath("a.txt"), 7, "tester")
+	assert.ErrorIs(t, err, atlas.ErrVersionNotFound)
+
+	_, err = files.Versions(atlas.NewPath("missing.txt"), "tester")
+	assert.ErrorIs(t, err, atlas.ErrResourceNotFound)
+}
+
+func TestVersions_Delete(t *testing.T) {
+	files := newTestAtlas(t)
+	writeFile(t, files, "docs/a.txt", "kept")
+	require.NoError(t, files.Delete(atlas.NewPath("docs"), "tester"))
+
+	versions, err := files.Versions(atlas.NewPath("docs/a.txt"), "tester")
+	require.NoError(t, err)
+	require.Len(t, versions, 1)
+	assert.False(t, versions[0].Current)
+
+	// Promoting brings a deleted file back
+	require.NoError(t, files.PromoteVersion(atlas.NewPath("docs/a.txt"), 1, "admin"))
+	assert.Equal(t, "kept", readFile(t, files, "docs/a.txt"))
+
+	versions, err = files.Versions(atlas.NewPath("docs/a.txt"), "tester")
+	require.NoError(t, err)
+	assert.Equal(t, 2, versions[0].ID)
+	assert.Equal(t, "admin", versions[0].Author)
+}
+
+func TestVersions_Promote(t *testing.T) {
+	files := newTestAtlas(t)
+	writeFile(t, files, "a.txt", "good")
+	writeFile(t, files, "a.txt", "bad")
+
+	require.NoError(t, files.PromoteVersion(atlas.NewPath("a.txt"), 1, "admin"))
+	assert.Equal(t, "good", readFile(t, files, "a.txt"))
+
+	// The replaced content is a version of its own
+	assert.Equal(t, "bad", readVersion(t, files, "a.txt", 2))
+
+	assert.ErrorIs(t, files.PromoteVersion(atlas.NewPath("a.txt"), 9, "admin"), atlas.ErrVersionNotFound)
+}
+
+func TestVersions_Limit(t *testing.T) {
+	root := t.TempDir()
+	files, err := atlas.NewAtlas(root)
+	require.NoError(t, err)
+	files.SetVersionLimit(2)
+
+	for _, content := range []string{"1", "2", "3", "4", "5"} {
+		writeFile(t, files, "a.txt", content)
+	}
+
+	versions, err := files.Versions(atlas.NewPath("a.txt"), "tester")
+	require.NoError(t, err)
+	require.Len(t, versions, 3)
+	assert.Equal(t, []int{5, 4, 3}, []int{versions[0].ID, versions[1].ID, versions[2].ID})
+
+	report, err := files.CollectGarbage()
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Removed)
+	assert.Equal(t, 3, countObjects(t, root))
+
+	// History survives a restart
+	files, err = atlas.NewAtlas(root)
+	require.NoError(t, err)
+	assert.Equal(t, "3", readVersion(t, files, "a.txt", 3))
+}
+
+func TestHandlers_Versions(t *testing.T) {
+	files := newTestAtlas(t)
+	mux := newTestMux(files)
+	mux.HandleFunc("GET /versions/{path...}", files.ListVersionsHandler)
+	mux.HandleFunc("POST /versions/{path...}", files.PromoteVersionHandler)
+
+	serve(mux, http.MethodPut, "/files/a.txt", "good")
+	serve(mux, http.MethodPut, "/files/a.txt", "bad")
+
+	rec := serve(mux, http.MethodGet, "/versions/a.txt", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var versions []atlas.Version
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &versions))
+	require.Len(t, versions, 2)
+
+	rec = serve(mux, http.MethodGet, "/files/a.txt?version=1", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "good", rec.Body.String())
+
+	rec = serve(mux, http.MethodGet, "/files/a.txt?version=one", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = serve(mux, http.MethodPost, "/versions/a.txt?version=1", "")
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	rec = serve(mux, http.MethodGet, "/files/a.txt", "")
+	assert.Equal(t, "good", rec.Body.String())
+
+	rec = serve(mux, http.MethodPost, "/versions/a.txt", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
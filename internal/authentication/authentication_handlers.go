@@ -29,7 +29,6 @@ func (d *AuthDatabase) SessionMiddlewareHandler(next http.Handler) http.Handler
 		}
 
 		r.Header.Set("username", username)
-		w.Write([]byte("success"))
 
 		next.ServeHTTP(w, r)
 	}
@@ -37,6 +36,64 @@ func (d *AuthDatabase) SessionMiddlewareHandler(next http.Handler) http.Handler
 	return http.HandlerFunc(f)
 }
 
+// Admits only requests of administrators. Runs behind SessionMiddlewareHandler,
+// which names the user; guests are asked to log in, other users are refused.
+func (d *AuthDatabase) AdminMiddlewareHandler(next http.Handler) http.Handler {
+	f := func(w http.ResponseWriter, r *http.Request) {
+		username := r.Header.Get("username")
+		if username == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			log.Infof("Guest refused on admin route %v", r.URL.Path)
+			return
+		}
+		if !d.IsAdmin(username) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			log.Infof("User %v refused on admin route %v", username, r.URL.Path)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(f)
+}
+
+// Admits requests carrying either a valid session token or Basic credentials
+// of a user, for clients such as WebDAV mounts that cannot log in first.
+// Anyone else is challenged for Basic credentials.
+func (d *AuthDatabase) CredentialsMiddlewareHandler(next http.Handler) http.Handler {
+	f := func(w http.ResponseWriter, r *http.Request) {
+		if session_token := r.Header.Get("session_token"); session_token != "" {
+			username, err := d.GetUserFromToken(session_token)
+			if err != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte("invalid token"))
+				log.Infof("Login attempt by invalid token: %v", session_token)
+				return
+			}
+
+			r.Header.Set("username", username)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		username, password, ok := r.BasicAuth()
+		if !ok || !d.CheckAuth(username, password) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="mnemo", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			if ok {
+				log.Infof("Incorrect credentials for user %v", username)
+			}
+			return
+		}
+
+		r.Header.Set("username", username)
+		next.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(f)
+}
+
 func (d *AuthDatabase) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	username, password, ok := r.BasicAuth()
 	if !ok {
@@ -0,0 +1,40 @@
+package authentication
+
+import (
+	"path"
+	"slices"
+	"strings"
+)
+
+// Permission bits of the levels stored in AuthDatabase.Permissions
+const (
+	PermissionRead  = 1
+	PermissionWrite = 2
+)
+
+// CheckPermission reports whether username holds every bit of permission on
+// file, a slash separated path below the root of the atlas. The closest
+// folder of Permissions naming the user decides; users named on none of the
+// folders above the file have no access at all.
+func (d *AuthDatabase) CheckPermission(username string, file string, permission int) bool {
+	if username == "" {
+		return false
+	}
+
+	dir := path.Clean("/" + strings.TrimPrefix(file, "/"))
+	for {
+		if level, ok := d.Permissions[dir][username]; ok {
+			return level&permission == permission
+		}
+		if dir == "/" {
+			return false
+		}
+		dir = path.Dir(dir)
+	}
+}
+
+// IsAdmin reports whether username is one of the administrators listed in
+// Admin. The guest user never is.
+func (d *AuthDatabase) IsAdmin(username string) bool {
+	return username != "" && slices.Contains(d.Admin, username)
+}
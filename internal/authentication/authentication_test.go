@@ -409,6 +409,34 @@ func TestRemoveUser_UserNotExists(t *testing.T) {
 	assert.ErrorIs(t, err, internal.ErrUserNotExists)
 }
 
+func TestCheckPermission(t *testing.T) {
+	database := &authentication.AuthDatabase{
+		Permissions: map[string]authentication.UserPermission{
+			"/":              {"admin": 3, "bob": 1},
+			"/design":        {"bob": 3, "carol": 1},
+			"/design/secret": {"bob": 0},
+		},
+	}
+
+	assert.True(t, database.CheckPermission("admin", "/design/secret/plan.txt", authentication.PermissionWrite))
+	assert.True(t, database.CheckPermission("bob", "notes.txt", authentication.PermissionRead))
+	assert.False(t, database.CheckPermission("bob", "notes.txt", authentication.PermissionWrite))
+	assert.True(t, database.CheckPermission("bob", "design/logo.png", authentication.PermissionRead|authentication.PermissionWrite))
+	assert.False(t, database.CheckPermission("bob", "/design/secret", authentication.PermissionRead))
+	assert.False(t, database.CheckPermission("bob", "/design/../design/secret/a", authentication.PermissionRead))
+	assert.True(t, database.CheckPermission("carol", "/design", authentication.PermissionRead))
+	assert.False(t, database.CheckPermission("carol", "/", authentication.PermissionRead))
+	assert.False(t, database.CheckPermission("", "/", authentication.PermissionRead))
+}
+
+func TestIsAdmin(t *testing.T) {
+	database := &authentication.AuthDatabase{Admin: []string{"admin"}}
+
+	assert.True(t, database.IsAdmin("admin"))
+	assert.False(t, database.IsAdmin("bob"))
+	assert.False(t, database.IsAdmin(""))
+}
+
 //
 // HTTP Handler/Middleware Testing
 //
@@ -426,6 +454,7 @@ func TestSessionMiddlewareHandler_ValidToken(t *testing.T) {
 	dummy_handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		require.Equal(t, "admin", r.Header.Get("username"))
 		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("success"))
 	})
 
 	middleware := database.SessionMiddlewareHandler(dummy_handler)
@@ -488,6 +517,25 @@ func TestSessionMiddlewareHandler_NoToken(t *testing.T) {
 	assert.Contains(t, rec.Body.String(), "guest login")
 }
 
+func TestAdminMiddlewareHandler(t *testing.T) {
+	database := &authentication.AuthDatabase{Admin: []string{"admin"}}
+	middleware := database.AdminMiddlewareHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("admitted"))
+	}))
+
+	for username, status := range map[string]int{
+		"":      http.StatusUnauthorized,
+		"bob":   http.StatusForbidden,
+		"admin": http.StatusOK,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/gc", nil)
+		req.Header.Set("username", username)
+		rec := httptest.NewRecorder()
+		middleware.ServeHTTP(rec, req)
+		assert.Equal(t, status, rec.Code, username)
+	}
+}
+
 func TestLoginHandler_MissingAuthHeader(t *testing.T) {
 	tmp := t.TempDir()
 	filename := filepath.Join(tmp, "auth.json")
@@ -560,3 +608,54 @@ func TestLoginHandler_ValidLogin(t *testing.T) {
 
 	assert.Equal(t, http.StatusOK, rec.Code)
 }
+
+func TestCredentialsMiddlewareHandler(t *testing.T) {
+	tmp := t.TempDir()
+	filename := filepath.Join(tmp, "auth.json")
+
+	database, err := authentication.CreateNewDatabase(filename)
+	require.NoError(t, err)
+
+	admin_token, err := database.LoginUser("admin", "admin")
+	require.NoError(t, err)
+
+	dummy_handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("username")))
+	})
+	middleware := database.CredentialsMiddlewareHandler(dummy_handler)
+
+	// Basic credentials and session tokens both identify the user
+	req := httptest.NewRequest("PROPFIND", "/dav/", nil)
+	req.SetBasicAuth("admin", "admin")
+	req.Header.Set("username", "spoofed")
+	rec := httptest.NewRecorder()
+	middleware.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "admin", rec.Body.String())
+
+	req = httptest.NewRequest("PROPFIND", "/dav/", nil)
+	req.Header.Set("session_token", admin_token)
+	rec = httptest.NewRecorder()
+	middleware.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "admin", rec.Body.String())
+
+	// Guests are challenged rather than admitted
+	req = httptest.NewRequest("PROPFIND", "/dav/", nil)
+	rec = httptest.NewRecorder()
+	middleware.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Header().Get("WWW-Authenticate"), "Basic")
+
+	req = httptest.NewRequest("PROPFIND", "/dav/", nil)
+	req.SetBasicAuth("admin", "wrong")
+	rec = httptest.NewRecorder()
+	middleware.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	req = httptest.NewRequest("PROPFIND", "/dav/", nil)
+	req.Header.Set("session_token", "badtoken")
+	rec = httptest.NewRecorder()
+	middleware.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
@@ -11,6 +11,9 @@ type MnemoServer struct {
 	mux     *http.ServeMux
 	server  *http.Server
 
+	sessionMiddleware func(http.Handler) http.Handler
+	adminMiddleware   func(http.Handler) http.Handler
+
 	running bool
 }
 
@@ -29,15 +32,45 @@ func (s *MnemoServer) GetAddress() string {
 	return s.address
 }
 
-// func (s *MnemoServer) RegisterSessionValidatedHandler(pattern string, fn http.HandlerFunc) {
-// 	wrapped_function := s.sessionMiddlewareHandler(http.HandlerFunc(fn))
-// 	s.mux.Handle(pattern, wrapped_function)
-// }
+func (s *MnemoServer) SetSessionMiddleware(middleware func(http.Handler) http.Handler) {
+	s.sessionMiddleware = middleware
+}
+
+func (s *MnemoServer) RegisterSessionValidatedHandler(pattern string, fn http.HandlerFunc) {
+	if s.sessionMiddleware == nil {
+		log.Errorf("No session middleware set, refusing to register %v", pattern)
+		return
+	}
+	wrapped_function := s.sessionMiddleware(http.HandlerFunc(fn))
+	s.mux.Handle(pattern, wrapped_function)
+}
+
+func (s *MnemoServer) SetAdminMiddleware(middleware func(http.Handler) http.Handler) {
+	s.adminMiddleware = middleware
+}
+
+// Registers a handler only administrators may reach. The admin middleware
+// runs behind the session middleware, which tells it who made the request.
+func (s *MnemoServer) RegisterAdminHandler(pattern string, fn http.HandlerFunc) {
+	if s.sessionMiddleware == nil || s.adminMiddleware == nil {
+		log.Errorf("No session or admin middleware set, refusing to register %v", pattern)
+		return
+	}
+	wrapped_function := s.sessionMiddleware(s.adminMiddleware(http.HandlerFunc(fn)))
+	s.mux.Handle(pattern, wrapped_function)
+}
 
 func (s *MnemoServer) RegisterHandler(pattern string, fn http.HandlerFunc) {
 	s.mux.HandleFunc(pattern, fn)
 }
 
+// Serves every request below prefix with handler, whatever its method. Used
+// for protocols such as WebDAV that bring their own methods and
+// authentication.
+func (s *MnemoServer) Mount(prefix string, handler http.Handler) {
+	s.mux.Handle(prefix, handler)
+}
+
 func (s *MnemoServer) StartServer() error {
 	log.Infof("Starting server on %v", s.address)
 	s.server = &http.Server{
@@ -33,6 +33,20 @@ func TestRegistrationHandler(t *testing.T) {
 	assert.Equal(t, "pong", string(body))
 }
 
+func TestMount(t *testing.T) {
+	server := CreateMnemoServer(":8080")
+	server.Mount("/dav/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Method + " " + r.URL.Path))
+	}))
+
+	req := httptest.NewRequest("PROPFIND", "/dav/docs/readme.md", nil)
+	rec := httptest.NewRecorder()
+	server.mux.ServeHTTP(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "PROPFIND /dav/docs/readme.md", rec.Body.String())
+}
+
 func TestLogMiddlewareHandler(t *testing.T) {
 	server := CreateMnemoServer(":8080")
 
@@ -89,3 +103,77 @@ func TestStartServer(t *testing.T) {
 	defer cancel()
 	_ = server.server.Shutdown(ctx)
 }
+
+func TestRegisterSessionValidatedHandler(t *testing.T) {
+	server := CreateMnemoServer(":8080")
+
+	// Without a middleware nothing is registered
+	server.RegisterSessionValidatedHandler("/secret", func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("handler registered without session middleware")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/secret", nil)
+	rec := httptest.NewRecorder()
+	server.mux.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	server = CreateMnemoServer(":8080")
+	server.SetSessionMiddleware(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Header.Set("username", "admin")
+			next.ServeHTTP(w, r)
+		})
+	})
+	server.RegisterSessionValidatedHandler("/secret", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("username")))
+	})
+
+	rec = httptest.NewRecorder()
+	server.mux.ServeHTTP(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "admin", rec.Body.String())
+}
+
+func TestRegisterAdminHandler(t *testing.T) {
+	server := CreateMnemoServer(":8080")
+	server.SetSessionMiddleware(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Header.Set("username", r.Header.Get("session_token"))
+			next.ServeHTTP(w, r)
+		})
+	})
+
+	// Without an admin middleware nothing is registered
+	server.RegisterAdminHandler("/admin", func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("handler registered without admin middleware")
+	})
+	req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+	rec := httptest.NewRecorder()
+	server.mux.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	server.SetAdminMiddleware(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("username") != "admin" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	server.RegisterAdminHandler("/admin", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("username")))
+	})
+
+	req.Header.Set("session_token", "bob")
+	rec = httptest.NewRecorder()
+	server.mux.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	req.Header.Set("session_token", "admin")
+	rec = httptest.NewRecorder()
+	server.mux.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "admin", rec.Body.String())
+}
@@ -0,0 +1,253 @@
+package networking
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal server side of the WebSocket protocol (RFC 6455), enough to push
+// messages to clients. Messages the client sends are read and dropped, pings
+// are answered and a close from the client ends the connection.
+
+var ErrNotWebSocket = errors.New("request is not a websocket handshake")
+
+// Appended to the key of the client to prove the handshake was understood
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	opText  = 0x1
+	opClose = 0x8
+	opPing  = 0x9
+	opPong  = 0xa
+)
+
+const (
+	// Longest frame accepted from the client, in bytes
+	maxWebSocketFrame = 1 << 20
+	// Time a single frame may take to reach the client
+	webSocketWriteTimeout = 10 * time.Second
+)
+
+// Close status codes
+const (
+	CloseNormal        = 1000
+	CloseGoingAway     = 1001
+	CloseProtocolError = 1002
+	CloseTooLarge      = 1009
+)
+
+type WebSocket struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+
+	// Serializes writes of the sender and of the ping answers
+	mu     sync.Mutex
+	done   chan struct{}
+	closed sync.Once
+}
+
+// Reports whether the request asks to be upgraded to a WebSocket
+func IsWebSocketRequest(r *http.Request) bool {
+	return headerContains(r.Header, "Connection", "upgrade") && headerContains(r.Header, "Upgrade", "websocket")
+}
+
+func headerContains(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Completes the WebSocket handshake of the request and takes over its
+// connection. Invalid handshakes are answered with 400 and ErrNotWebSocket.
+func UpgradeWebSocket(w http.ResponseWriter, r *http.Request) (*WebSocket, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || !IsWebSocketRequest(r) || key == "" {
+		http.Error(w, ErrNotWebSocket.Error(), http.StatusBadRequest)
+		return nil, ErrNotWebSocket
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, ErrNotWebSocket
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "connection cannot be upgraded", http.StatusInternalServerError)
+		return nil, err
+	}
+
+	accept := sha1.Sum([]byte(key + webSocketGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	rw.WriteString("Upgrade: websocket\r\n")
+	rw.WriteString("Connection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(accept[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	ws := &WebSocket{conn: conn, rw: rw, done: make(chan struct{})}
+	go ws.readLoop()
+	return ws, nil
+}
+
+// Closed once the connection is over, whoever ended it
+func (ws *WebSocket) Done() <-chan struct{} {
+	return ws.done
+}
+
+func (ws *WebSocket) WriteText(message []byte) error {
+	return ws.writeFrame(opText, message)
+}
+
+func (ws *WebSocket) Ping() error {
+	return ws.writeFrame(opPing, nil)
+}
+
+// Sends a close frame with the status code and closes the connection
+func (ws *WebSocket) Close(code int) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	err := ws.writeFrame(opClose, payload)
+	ws.shutdown()
+	return err
+}
+
+func (ws *WebSocket) shutdown() {
+	ws.closed.Do(func() {
+		close(ws.done)
+		ws.conn.Close()
+	})
+}
+
+// Writes a single unmasked frame, as servers do
+func (ws *WebSocket) writeFrame(opcode byte, payload []byte) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	select {
+	case <-ws.done:
+		return net.ErrClosed
+	default:
+	}
+
+	header := []byte{0x80 | opcode}
+	switch length := len(payload); {
+	case length < 126:
+		header = append(header, byte(length))
+	case length <= 0xffff:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(length))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(length))
+	}
+
+	ws.conn.SetWriteDeadline(time.Now().Add(webSocketWriteTimeout))
+	ws.rw.Write(header)
+	ws.rw.Write(payload)
+	return ws.rw.Flush()
+}
+
+// Reads frames of the client until it closes the connection or breaks the
+// protocol
+func (ws *WebSocket) readLoop() {
+	defer ws.shutdown()
+
+	for {
+		opcode, payload, err := ws.readFrame()
+		switch {
+		case errors.Is(err, errFrameTooLarge):
+			ws.Close(CloseTooLarge)
+			return
+		case errors.Is(err, errProtocol):
+			ws.Close(CloseProtocolError)
+			return
+		case err != nil:
+			return
+		}
+
+		switch opcode {
+		case opPing:
+			ws.writeFrame(opPong, payload)
+		case opClose:
+			// Echo the status code of the client, if it gave one
+			ws.writeFrame(opClose, payload[:min(len(payload), 2)])
+			return
+		}
+	}
+}
+
+var (
+	errFrameTooLarge = errors.New("websocket frame is too large")
+	errProtocol      = errors.New("websocket protocol violation")
+)
+
+// Reads one frame of the client. Control frames come back unmasked, the
+// payload of data frames is skipped.
+func (ws *WebSocket) readFrame() (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(ws.rw, header[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode := header[0] & 0x0f
+	control := opcode&0x8 != 0
+	// Clients must mask every frame
+	if header[1]&0x80 == 0 {
+		return 0, nil, errProtocol
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.rw, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(ws.rw, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if control && (length > 125 || header[0]&0x80 == 0) {
+		return 0, nil, errProtocol
+	}
+	if length > maxWebSocketFrame {
+		return 0, nil, errFrameTooLarge
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.rw, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	if !control {
+		_, err := io.CopyN(io.Discard, ws.rw, int64(length))
+		return opcode, nil, err
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ws.rw, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
@@ -0,0 +1,133 @@
+package networking
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Opens a WebSocket to the test server, returning the connection and a reader
+// positioned after the handshake response
+func dialWebSocket(t *testing.T, server *httptest.Server) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: mnemo\r\nConnection: keep-alive, Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", res.Header.Get("Sec-WebSocket-Accept"))
+	return conn, reader
+}
+
+// Writes a masked frame, as clients do
+func writeClientFrame(t *testing.T, conn net.Conn, opcode byte, payload string) {
+	t.Helper()
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i := range len(payload) {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	_, err := conn.Write(frame)
+	require.NoError(t, err)
+}
+
+func readServerFrame(t *testing.T, reader *bufio.Reader) (byte, string) {
+	t.Helper()
+	header := make([]byte, 2)
+	_, err := io.ReadFull(reader, header)
+	require.NoError(t, err)
+	require.Zero(t, header[1]&0x80, "server frames are not masked")
+	payload := make([]byte, header[1])
+	_, err = io.ReadFull(reader, payload)
+	require.NoError(t, err)
+	return header[0], string(payload)
+}
+
+func TestWebSocket(t *testing.T) {
+	closed := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := UpgradeWebSocket(w, r)
+		if err != nil {
+			return
+		}
+		ws.WriteText([]byte("hello"))
+		<-ws.Done()
+		close(closed)
+	}))
+	defer server.Close()
+
+	conn, reader := dialWebSocket(t, server)
+	opcode, payload := readServerFrame(t, reader)
+	assert.Equal(t, byte(0x81), opcode)
+	assert.Equal(t, "hello", payload)
+
+	// Data from the client is dropped, pings are answered
+	writeClientFrame(t, conn, opText, "ignored")
+	writeClientFrame(t, conn, opPing, "are you there")
+	opcode, payload = readServerFrame(t, reader)
+	assert.Equal(t, byte(0x80|opPong), opcode)
+	assert.Equal(t, "are you there", payload)
+
+	writeClientFrame(t, conn, opClose, "\x03\xe8")
+	opcode, payload = readServerFrame(t, reader)
+	assert.Equal(t, byte(0x80|opClose), opcode)
+	assert.Equal(t, "\x03\xe8", payload)
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not closed")
+	}
+}
+
+func TestWebSocket_Unmasked(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ws, err := UpgradeWebSocket(w, r); err == nil {
+			<-ws.Done()
+		}
+	}))
+	defer server.Close()
+
+	conn, reader := dialWebSocket(t, server)
+	conn.Write([]byte{0x81, 0x02, 'h', 'i'})
+	opcode, payload := readServerFrame(t, reader)
+	assert.Equal(t, byte(0x80|opClose), opcode)
+	assert.Equal(t, "\x03\xea", payload)
+}
+
+func TestUpgradeWebSocket_Invalid(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		UpgradeWebSocket(w, r)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.False(t, IsWebSocketRequest(req))
+
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "8")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.True(t, IsWebSocketRequest(req))
+	assert.Equal(t, http.StatusUpgradeRequired, rec.Code)
+	assert.Equal(t, "13", rec.Header().Get("Sec-WebSocket-Version"))
+}
@@ -2,18 +2,22 @@ package services
 
 import (
 	"github.com/charmbracelet/log"
+	atlas "github.com/mnemosynefs/mnemo/internal/atlas"
 	authentication "github.com/mnemosynefs/mnemo/internal/authentication"
 	networking "github.com/mnemosynefs/mnemo/internal/networking"
+	webdav "github.com/mnemosynefs/mnemo/internal/webdav"
 )
 
 type Services struct {
 	Database authentication.Database
+	Atlas    *atlas.Atlas
 	Mnemo    *networking.MnemoServer
 }
 
 func CreateServices(
 	serverAddress string,
 	databaseFilename string,
+	root string,
 	fileOps ...authentication.FileInterface,
 ) (*Services, error) {
 	mnemo := networking.CreateMnemoServer(serverAddress)
@@ -34,8 +38,74 @@ func CreateServices(
 		return nil, err
 	}
 
+	files, err := atlas.OpenAtlas(root)
+	if err != nil {
+		log.Errorf("Failed to create atlas at location %v. Program abort recommended.", root)
+		return nil, err
+	}
+
+	files.SetReadPermission(func(username string, key string) bool {
+		return database.CheckPermission(username, key, authentication.PermissionRead)
+	})
+	files.SetWritePermission(func(username string, key string) bool {
+		return database.CheckPermission(username, key, authentication.PermissionWrite)
+	})
+	files.SetAdminPermission(database.IsAdmin)
+
+	mnemo.SetSessionMiddleware(database.SessionMiddlewareHandler)
+	mnemo.SetAdminMiddleware(database.AdminMiddlewareHandler)
+	mnemo.RegisterHandler("POST /login", database.LoginHandler)
+
+	mnemo.RegisterSessionValidatedHandler("GET /files/{path...}", files.ReadHandler)
+	mnemo.RegisterSessionValidatedHandler("PUT /files/{path...}", files.WriteHandler)
+	mnemo.RegisterSessionValidatedHandler("DELETE /files/{path...}", files.DeleteHandler)
+	mnemo.RegisterSessionValidatedHandler("POST /move/{path...}", files.MoveHandler)
+	mnemo.RegisterSessionValidatedHandler("POST /copy/{path...}", files.CopyHandler)
+	mnemo.RegisterSessionValidatedHandler("POST /rename/{path...}", files.RenameHandler)
+	mnemo.RegisterSessionValidatedHandler("GET /list/{path...}", files.ListHandler)
+	mnemo.RegisterSessionValidatedHandler("GET /archive/{path...}", files.ArchiveHandler)
+	mnemo.RegisterSessionValidatedHandler("POST /extract/{path...}", files.ExtractHandler)
+	mnemo.RegisterSessionValidatedHandler("GET /previews/{path...}", files.PreviewHandler)
+	mnemo.RegisterSessionValidatedHandler("GET /metadata/{path...}", files.MetadataHandler)
+	mnemo.RegisterSessionValidatedHandler("GET /annotations/{path...}", files.AnnotationsHandler)
+	mnemo.RegisterSessionValidatedHandler("PUT /annotations/{path...}", files.AnnotateHandler)
+	mnemo.RegisterSessionValidatedHandler("PATCH /annotations/{path...}", files.PatchAnnotationsHandler)
+	mnemo.RegisterSessionValidatedHandler("GET /query/{path...}", files.QueryHandler)
+	mnemo.RegisterSessionValidatedHandler("GET /events/{path...}", files.EventsHandler)
+	mnemo.RegisterSessionValidatedHandler("GET /usage", files.UsageHandler)
+	mnemo.RegisterSessionValidatedHandler("GET /versions/{path...}", files.ListVersionsHandler)
+	mnemo.RegisterSessionValidatedHandler("POST /versions/{path...}", files.PromoteVersionHandler)
+
+	mnemo.RegisterSessionValidatedHandler("GET /trash", files.ListTrashHandler)
+	mnemo.RegisterSessionValidatedHandler("DELETE /trash", files.EmptyTrashHandler)
+	mnemo.RegisterSessionValidatedHandler("POST /trash/{id}/restore", files.RestoreTrashHandler)
+	mnemo.RegisterSessionValidatedHandler("DELETE /trash/{id}", files.PurgeTrashHandler)
+
+	mnemo.RegisterSessionValidatedHandler("POST /uploads/{path...}", files.CreateUploadHandler)
+	mnemo.RegisterSessionValidatedHandler("GET /uploads/{id}", files.UploadHandler)
+	mnemo.RegisterSessionValidatedHandler("PATCH /uploads/{id}", files.AppendUploadHandler)
+	mnemo.RegisterSessionValidatedHandler("DELETE /uploads/{id}", files.CancelUploadHandler)
+
+	mnemo.RegisterSessionValidatedHandler("GET /tags", files.ListTagsHandler)
+	mnemo.RegisterSessionValidatedHandler("POST /tags/{tag}", files.CreateTagHandler)
+	mnemo.RegisterSessionValidatedHandler("DELETE /tags/{tag}", files.DeleteTagHandler)
+	mnemo.RegisterSessionValidatedHandler("GET /tags/{tag}/files/{path...}", files.ReadTagHandler)
+	mnemo.RegisterSessionValidatedHandler("GET /tags/{tag}/diff", files.DiffTagHandler)
+	mnemo.RegisterSessionValidatedHandler("POST /tags/{tag}/restore/{path...}", files.RestoreTagHandler)
+
+	mnemo.RegisterAdminHandler("POST /gc", files.CollectGarbageHandler)
+	mnemo.RegisterAdminHandler("POST /scrub", files.ScrubHandler)
+	mnemo.RegisterAdminHandler("GET /storage", files.StorageHandler)
+
+	// File managers mount the tree over WebDAV and authenticate with Basic
+	// credentials rather than logging in first
+	dav := database.CredentialsMiddlewareHandler(webdav.NewHandler("/dav/", files, database))
+	mnemo.Mount("/dav", dav)
+	mnemo.Mount("/dav/", dav)
+
 	return &Services{
 		Database: database,
+		Atlas:    files,
 		Mnemo:    mnemo,
 	}, nil
 }
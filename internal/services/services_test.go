@@ -15,7 +15,7 @@ func TestCreateServices_Success(t *testing.T) {
 	tmp := t.TempDir()
 	filename := filepath.Join(tmp, "auth.json")
 
-	services, err := services.CreateServices(":8080", filename)
+	services, err := services.CreateServices(":8080", filename, tmp)
 	assert.NoError(t, err)
 	assert.NotNil(t, services)
 }
@@ -28,7 +28,7 @@ func TestCreateServices_OSFileFailure(t *testing.T) {
 	mockOps := new(mocks.FileInterface)
 	mockOps.On("Create", mock.Anything).Return(nil, createError)
 
-	services, err := services.CreateServices(":8080", filename, mockOps)
+	services, err := services.CreateServices(":8080", filename, tmp, mockOps)
 	assert.ErrorIs(t, err, createError)
 	assert.Nil(t, services)
 }
@@ -0,0 +1,443 @@
+package webdav
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"github.com/mnemosynefs/mnemo/internal/atlas"
+	"github.com/mnemosynefs/mnemo/internal/authentication"
+)
+
+var (
+	ErrNotMounted = errors.New("path is not served over WebDAV")
+	ErrForbidden  = errors.New("permission denied")
+	ErrBadRequest = errors.New("malformed WebDAV request")
+)
+
+// Authorizer decides which paths a user may read and write, as
+// authentication.AuthDatabase does from its Permissions
+type Authorizer interface {
+	CheckPermission(username string, file string, permission int) bool
+}
+
+// Handler serves the working tree of an atlas over WebDAV (RFC 4918) so it can
+// be mounted as a network drive. Requests must carry the user in the username
+// header, as set by the authentication middlewares.
+type Handler struct {
+	// URL path the tree is served at, without trailing slash
+	prefix string
+	files  *atlas.Atlas
+	auth   Authorizer
+	locks  *lockSystem
+}
+
+// Returns a handler serving files below the URL path prefix, such as "/dav/"
+func NewHandler(prefix string, files *atlas.Atlas, auth Authorizer) *Handler {
+	return &Handler{
+		prefix: strings.TrimSuffix(prefix, "/"),
+		files:  files,
+		auth:   auth,
+		locks:  newLockSystem(),
+	}
+}
+
+const allowedMethods = "OPTIONS, GET, HEAD, PUT, DELETE, MKCOL, COPY, MOVE, PROPFIND, PROPPATCH, LOCK, UNLOCK"
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var status int
+	var err error
+
+	// Requests whose If header does not hold are refused before anything
+	// else, whatever their method
+	if r.Method != "OPTIONS" {
+		status, err = h.checkIf(r)
+	}
+	if status == 0 {
+		switch r.Method {
+		case "OPTIONS":
+			status, err = h.handleOptions(w, r)
+		case "GET", "HEAD":
+			status, err = h.handleGet(w, r)
+		case "PUT":
+			status, err = h.handlePut(w, r)
+		case "DELETE":
+			status, err = h.handleDelete(w, r)
+		case "MKCOL":
+			status, err = h.handleMkcol(w, r)
+		case "COPY":
+			status, err = h.handleCopyMove(w, r, false)
+		case "MOVE":
+			status, err = h.handleCopyMove(w, r, true)
+		case "PROPFIND":
+			status, err = h.handlePropfind(w, r)
+		case "PROPPATCH":
+			status, err = h.handleProppatch(w, r)
+		case "LOCK":
+			status, err = h.handleLock(w, r)
+		case "UNLOCK":
+			status, err = h.handleUnlock(w, r)
+		default:
+			w.Header().Set("Allow", allowedMethods)
+			status = http.StatusMethodNotAllowed
+		}
+	}
+
+	// Handlers answering themselves report no status
+	switch {
+	case status == 0:
+	case status == http.StatusInternalServerError:
+		http.Error(w, "Internal server error", status)
+		log.Errorf("Internal WebDAV error on %v %v: %v", r.Method, r.URL.Path, err)
+	case err != nil:
+		http.Error(w, err.Error(), status)
+		log.Infof("Rejected %v %v: %v", r.Method, r.URL.Path, err)
+	default:
+		w.WriteHeader(status)
+	}
+}
+
+// Converts a URL path below the prefix into a manifest key
+func (h *Handler) key(urlPath string) (string, error) {
+	rest, ok := strings.CutPrefix(urlPath, h.prefix)
+	if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+		return "", ErrNotMounted
+	}
+
+	p := atlas.NewPath(strings.Trim(rest, "/"))
+	if err := p.Validate(); err != nil {
+		return "", err
+	}
+	return p.Key(), nil
+}
+
+// URL path of the resource at key. Folders end with a slash.
+func (h *Handler) href(key string, dir bool) string {
+	href := h.prefix + "/"
+	for i, segment := range strings.Split(key, "/") {
+		if i > 0 {
+			href += "/"
+		}
+		href += url.PathEscape(segment)
+	}
+	if dir && key != "" {
+		href += "/"
+	}
+	return href
+}
+
+func parentKey(key string) string {
+	dir := path.Dir(key)
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
+
+// Reports whether key is root or lies below it
+func isWithin(key string, root string) bool {
+	return root == "" || key == root || strings.HasPrefix(key, root+"/")
+}
+
+// Looks up the entry at key in the working tree
+func (h *Handler) stat(key string) (atlas.Entry, bool) {
+	p := atlas.NewPath(key)
+	info, err := p.Stat(h.files)
+	if err != nil {
+		return atlas.Entry{}, false
+	}
+	return info.Sys().(atlas.Entry), true
+}
+
+// Strong entity tag of a file, empty for folders
+func etag(entry atlas.Entry) string {
+	if entry.IsDir() {
+		return ""
+	}
+	return entry.ETag()
+}
+
+func (h *Handler) allowed(user string, key string, permission int) bool {
+	return h.auth.CheckPermission(user, "/"+key, permission)
+}
+
+// Reports whether user holds permission on key and everything below it
+func (h *Handler) allowedTree(user string, key string, permission int) bool {
+	if !h.allowed(user, key, permission) {
+		return false
+	}
+
+	listing, err := h.files.List(atlas.NewPath(key), atlas.ListOptions{Recursive: true, User: user})
+	if err != nil {
+		// Files and missing resources have nothing below them
+		return true
+	}
+	// Entries the user may not even read are taken as denied
+	if listing.Hidden > 0 {
+		return false
+	}
+	for _, entry := range listing.Entries {
+		if !h.allowed(user, entry.Path, permission) {
+			return false
+		}
+	}
+	return true
+}
+
+// Reports whether the folder that would hold key exists
+func (h *Handler) parentExists(key string) bool {
+	parent, ok := h.stat(parentKey(key))
+	return ok && parent.IsDir()
+}
+
+// Maps an atlas error onto the status of a WebDAV response
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, atlas.ErrDestinationExists):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, atlas.ErrUploadToRoot):
+		return http.StatusForbidden
+	case errors.Is(err, atlas.ErrIsFolder):
+		return http.StatusMethodNotAllowed
+	default:
+		return atlas.ErrorStatus(err)
+	}
+}
+
+func (h *Handler) handleOptions(w http.ResponseWriter, r *http.Request) (int, error) {
+	w.Header().Set("Allow", allowedMethods)
+	w.Header().Set("DAV", "1, 2")
+	w.Header().Set("MS-Author-Via", "DAV")
+	return http.StatusOK, nil
+}
+
+func (h *Handler) handleGet(w http.ResponseWriter, r *http.Request) (int, error) {
+	key, err := h.key(r.URL.Path)
+	if err != nil {
+		return errorStatus(err), err
+	}
+	if !h.allowed(r.Header.Get("username"), key, authentication.PermissionRead) {
+		return http.StatusForbidden, ErrForbidden
+	}
+
+	file, err := h.files.Read(atlas.NewPath(key), r.Header.Get("username"))
+	if err != nil {
+		return errorStatus(err), err
+	}
+	defer file.Close()
+
+	atlas.ServeFile(w, r, file)
+	return 0, nil
+}
+
+func (h *Handler) handlePut(w http.ResponseWriter, r *http.Request) (int, error) {
+	username := r.Header.Get("username")
+	key, err := h.key(r.URL.Path)
+	if err != nil {
+		return errorStatus(err), err
+	}
+	if !h.allowed(username, key, authentication.PermissionWrite) {
+		return http.StatusForbidden, ErrForbidden
+	}
+	if !h.parentExists(key) {
+		return http.StatusConflict, atlas.ErrResourceNotFound
+	}
+
+	entry, exists := h.stat(key)
+	if exists && entry.IsDir() {
+		return http.StatusMethodNotAllowed, atlas.ErrIsFolder
+	}
+	if err := h.locks.confirm(username, submittedTokens(r), key, false, !exists); err != nil {
+		return http.StatusLocked, err
+	}
+
+	cond := atlas.RequestCondition(r)
+	if err := h.files.CheckCondition(atlas.NewPath(key), cond); err != nil {
+		return errorStatus(err), err
+	}
+
+	writer, err := h.files.Write(atlas.NewPath(key), username)
+	if err != nil {
+		return errorStatus(err), err
+	}
+	defer writer.Abort()
+	writer.Require(cond)
+
+	_, err = io.Copy(writer, r.Body)
+	if err == nil {
+		err = writer.Commit()
+	}
+	if err != nil {
+		return errorStatus(err), err
+	}
+
+	log.Infof("User %q wrote %v over WebDAV", username, key)
+	w.Header().Set("ETag", writer.ETag())
+	if exists {
+		return http.StatusNoContent, nil
+	}
+	return http.StatusCreated, nil
+}
+
+func (h *Handler) handleDelete(w http.ResponseWriter, r *http.Request) (int, error) {
+	username := r.Header.Get("username")
+	key, err := h.key(r.URL.Path)
+	if err != nil {
+		return errorStatus(err), err
+	}
+	if !h.allowedTree(username, key, authentication.PermissionWrite) {
+		return http.StatusForbidden, ErrForbidden
+	}
+	if err := h.locks.confirm(username, submittedTokens(r), key, true, true); err != nil {
+		return http.StatusLocked, err
+	}
+
+	if err := h.files.DeleteIf(atlas.NewPath(key), username, atlas.RequestCondition(r)); err != nil {
+		return errorStatus(err), err
+	}
+	h.locks.removeTree(key)
+
+	log.Infof("User %q deleted %v over WebDAV", username, key)
+	return http.StatusNoContent, nil
+}
+
+func (h *Handler) handleMkcol(w http.ResponseWriter, r *http.Request) (int, error) {
+	username := r.Header.Get("username")
+	key, err := h.key(r.URL.Path)
+	if err != nil {
+		return errorStatus(err), err
+	}
+	if !h.allowed(username, key, authentication.PermissionWrite) {
+		return http.StatusForbidden, ErrForbidden
+	}
+	// Folders are always created empty
+	if r.ContentLength > 0 {
+		return http.StatusUnsupportedMediaType, ErrBadRequest
+	}
+	if _, exists := h.stat(key); exists {
+		return http.StatusMethodNotAllowed, atlas.ErrDestinationExists
+	}
+	if !h.parentExists(key) {
+		return http.StatusConflict, atlas.ErrResourceNotFound
+	}
+	if err := h.locks.confirm(username, submittedTokens(r), key, false, true); err != nil {
+		return http.StatusLocked, err
+	}
+
+	if err := h.files.MakeDir(atlas.NewPath(key), username); err != nil {
+		return errorStatus(err), err
+	}
+
+	log.Infof("User %q created folder %v over WebDAV", username, key)
+	return http.StatusCreated, nil
+}
+
+func (h *Handler) handleCopyMove(w http.ResponseWriter, r *http.Request, move bool) (int, error) {
+	username := r.Header.Get("username")
+	src, err := h.key(r.URL.Path)
+	if err != nil {
+		return errorStatus(err), err
+	}
+
+	destination, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || r.Header.Get("Destination") == "" {
+		return http.StatusBadRequest, ErrBadRequest
+	}
+	if destination.Host != "" && destination.Host != r.Host {
+		return http.StatusBadGateway, ErrNotMounted
+	}
+	dst, err := h.key(destination.Path)
+	if errors.Is(err, ErrNotMounted) {
+		return http.StatusBadGateway, err
+	} else if err != nil {
+		return errorStatus(err), err
+	}
+	if src == dst || src == "" || dst == "" {
+		return http.StatusForbidden, atlas.ErrInvalidTransfer
+	}
+
+	overwrite := true
+	switch r.Header.Get("Overwrite") {
+	case "", "T":
+	case "F":
+		overwrite = false
+	default:
+		return http.StatusBadRequest, ErrBadRequest
+	}
+
+	// Moves always take the whole tree along, copies may leave it behind
+	depth := r.Header.Get("Depth")
+	if depth != "" && depth != "infinity" && (move || depth != "0") {
+		return http.StatusBadRequest, ErrBadRequest
+	}
+
+	srcPermission := authentication.PermissionRead
+	if move {
+		srcPermission = authentication.PermissionWrite
+	}
+	if !h.allowedTree(username, src, srcPermission) || !h.allowedTree(username, dst, authentication.PermissionWrite) {
+		return http.StatusForbidden, ErrForbidden
+	}
+
+	entry, ok := h.stat(src)
+	if !ok {
+		return http.StatusNotFound, atlas.ErrResourceNotFound
+	}
+	if !h.parentExists(dst) {
+		return http.StatusConflict, atlas.ErrResourceNotFound
+	}
+
+	tokens := submittedTokens(r)
+	if move {
+		if err := h.locks.confirm(username, tokens, src, true, true); err != nil {
+			return http.StatusLocked, err
+		}
+	}
+	if err := h.locks.confirm(username, tokens, dst, true, true); err != nil {
+		return http.StatusLocked, err
+	}
+
+	var created bool
+	cond := atlas.RequestCondition(r)
+	switch {
+	case move:
+		created, err = h.files.MoveIf(atlas.NewPath(src), atlas.NewPath(dst), overwrite, username, cond)
+	case depth == "0" && entry.IsDir():
+		created, err = h.copyFolder(src, dst, overwrite, username, cond)
+	default:
+		created, err = h.files.CopyIf(atlas.NewPath(src), atlas.NewPath(dst), overwrite, username, cond)
+	}
+	if err != nil {
+		return errorStatus(err), err
+	}
+
+	if move {
+		// Locks stay with the resource they were taken on, which is gone
+		h.locks.removeTree(src)
+		log.Infof("User %q moved %v to %v over WebDAV", username, src, dst)
+	} else {
+		log.Infof("User %q copied %v to %v over WebDAV", username, src, dst)
+	}
+	if created {
+		return http.StatusCreated, nil
+	}
+	return http.StatusNoContent, nil
+}
+
+// Copies the folder at src without its content, as asked by Depth: 0
+func (h *Handler) copyFolder(src string, dst string, overwrite bool, username string, cond atlas.Condition) (bool, error) {
+	_, exists := h.stat(dst)
+	if exists && !overwrite {
+		return false, atlas.ErrDestinationExists
+	}
+	if exists {
+		if err := h.files.DeleteIf(atlas.NewPath(dst), username, atlas.Condition{IfNoneMatch: cond.IfNoneMatch}); err != nil {
+			return false, err
+		}
+	}
+	return !exists, h.files.MakeDir(atlas.NewPath(dst), username)
+}
@@ -0,0 +1,495 @@
+package webdav
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/google/uuid"
+	"github.com/mnemosynefs/mnemo/internal/atlas"
+	"github.com/mnemosynefs/mnemo/internal/authentication"
+)
+
+var (
+	ErrLocked     = errors.New("resource is locked")
+	ErrNoSuchLock = errors.New("no such lock")
+)
+
+const (
+	// Lifetime of locks when the client does not ask for one
+	DefaultLockTimeout = time.Hour
+	// Longest lifetime granted, also given to clients asking for an infinite
+	// one
+	MaxLockTimeout = 24 * time.Hour
+	// Largest XML body accepted by LOCK, PROPFIND and PROPPATCH
+	maxXMLBody = 1 << 20
+)
+
+// lock is a write lock held by a user on a resource and, for depth infinity
+// locks, everything below it. Locks live in memory only.
+type lock struct {
+	token     string
+	key       string
+	infinite  bool
+	exclusive bool
+	// Owner information given by the client, as raw XML
+	owner   string
+	user    string
+	expires time.Time
+}
+
+// Reports whether the lock applies to the resource at key
+func (l *lock) covers(key string) bool {
+	return l.key == key || (l.infinite && isWithin(key, l.key))
+}
+
+type lockSystem struct {
+	mu    sync.Mutex
+	locks map[string]*lock
+}
+
+func newLockSystem() *lockSystem {
+	return &lockSystem{locks: map[string]*lock{}}
+}
+
+// Drops expired locks. Must be called with the lock system lock held.
+func (s *lockSystem) expire() {
+	now := time.Now()
+	for token, l := range s.locks {
+		if now.After(l.expires) {
+			delete(s.locks, token)
+		}
+	}
+}
+
+// Takes a new lock on key, unless it conflicts with one already held
+func (s *lockSystem) create(key string, infinite bool, exclusive bool, owner string, user string, timeout time.Duration) (lock, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+
+	for _, l := range s.locks {
+		overlaps := l.covers(key) || (infinite && isWithin(l.key, key))
+		if overlaps && (l.exclusive || exclusive) {
+			return lock{}, ErrLocked
+		}
+	}
+
+	l := &lock{
+		token:     "opaquelocktoken:" + uuid.NewString(),
+		key:       key,
+		infinite:  infinite,
+		exclusive: exclusive,
+		owner:     owner,
+		user:      user,
+		expires:   time.Now().Add(timeout),
+	}
+	s.locks[l.token] = l
+	return *l, nil
+}
+
+// Extends the lifetime of the lock of user covering key among tokens
+func (s *lockSystem) refresh(tokens []string, key string, user string, timeout time.Duration) (lock, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+
+	for _, token := range tokens {
+		if l, ok := s.locks[token]; ok && l.user == user && l.covers(key) {
+			l.expires = time.Now().Add(timeout)
+			return *l, nil
+		}
+	}
+	return lock{}, ErrNoSuchLock
+}
+
+// Releases the lock of user identified by token, which must cover key
+func (s *lockSystem) unlock(token string, key string, user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+
+	l, ok := s.locks[token]
+	if !ok || !l.covers(key) {
+		return ErrNoSuchLock
+	}
+	if l.user != user {
+		return ErrForbidden
+	}
+	delete(s.locks, token)
+	return nil
+}
+
+// Checks that user submitted the token of every lock protecting a change of
+// key. Changes to a whole tree are also protected by the locks below key, and
+// adding or removing key by the locks on its folder.
+func (s *lockSystem) confirm(user string, tokens []string, key string, tree bool, member bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+
+	for _, l := range s.locks {
+		applies := l.covers(key) || (tree && isWithin(l.key, key)) || (member && key != "" && l.covers(parentKey(key)))
+		if applies && (l.user != user || !slices.Contains(tokens, l.token)) {
+			return fmt.Errorf("%w: %v", ErrLocked, l.key)
+		}
+	}
+	return nil
+}
+
+// Reports whether token identifies a lock covering key
+func (s *lockSystem) valid(token string, key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+
+	l, ok := s.locks[token]
+	return ok && l.covers(key)
+}
+
+// Returns the locks covering key
+func (s *lockSystem) active(key string) []lock {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+
+	locks := []lock{}
+	for _, l := range s.locks {
+		if l.covers(key) {
+			locks = append(locks, *l)
+		}
+	}
+	slices.SortFunc(locks, func(a, b lock) int {
+		return strings.Compare(a.token, b.token)
+	})
+	return locks
+}
+
+// Drops every lock on key or below it
+func (s *lockSystem) removeTree(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for token, l := range s.locks {
+		if isWithin(l.key, key) {
+			delete(s.locks, token)
+		}
+	}
+}
+
+// ifCondition is a single state token or entity tag of an If header
+type ifCondition struct {
+	not   bool
+	token string
+	etag  string
+}
+
+// ifList is a parenthesized list of conditions, applying to resource if the
+// list is tagged with one
+type ifList struct {
+	resource   string
+	conditions []ifCondition
+}
+
+// Parses an If header (RFC 4918 section 10.4)
+func parseIf(field string) ([]ifList, bool) {
+	lists := []ifList{}
+	resource := ""
+	s := strings.TrimSpace(field)
+	for s != "" {
+		switch s[0] {
+		case '<':
+			end := strings.IndexByte(s, '>')
+			if end < 0 {
+				return nil, false
+			}
+			resource = s[1:end]
+			s = s[end+1:]
+		case '(':
+			end := strings.IndexByte(s, ')')
+			if end < 0 {
+				return nil, false
+			}
+			conditions, ok := parseIfConditions(s[1:end])
+			if !ok {
+				return nil, false
+			}
+			lists = append(lists, ifList{resource: resource, conditions: conditions})
+			s = s[end+1:]
+		default:
+			return nil, false
+		}
+		s = strings.TrimSpace(s)
+	}
+	return lists, len(lists) > 0
+}
+
+func parseIfConditions(s string) ([]ifCondition, bool) {
+	conditions := []ifCondition{}
+	for {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			return conditions, len(conditions) > 0
+		}
+
+		condition := ifCondition{}
+		if rest, ok := strings.CutPrefix(s, "Not"); ok {
+			condition.not = true
+			s = strings.TrimSpace(rest)
+		}
+
+		var end int
+		switch {
+		case strings.HasPrefix(s, "<"):
+			end = strings.IndexByte(s, '>')
+			if end > 0 {
+				condition.token = s[1:end]
+			}
+		case strings.HasPrefix(s, "["):
+			end = strings.IndexByte(s, ']')
+			if end > 0 {
+				condition.etag = s[1:end]
+			}
+		default:
+			return nil, false
+		}
+		if end <= 0 {
+			return nil, false
+		}
+
+		conditions = append(conditions, condition)
+		s = s[end+1:]
+	}
+}
+
+// Returns the lock tokens submitted in the If header of a request
+func submittedTokens(r *http.Request) []string {
+	lists, _ := parseIf(r.Header.Get("If"))
+	tokens := []string{}
+	for _, list := range lists {
+		for _, condition := range list.conditions {
+			if condition.token != "" && !condition.not {
+				tokens = append(tokens, condition.token)
+			}
+		}
+	}
+	return tokens
+}
+
+// Evaluates the If header of a request. It holds when all conditions of any
+// of its lists hold for the resource the list applies to.
+func (h *Handler) checkIf(r *http.Request) (int, error) {
+	field := r.Header.Get("If")
+	if field == "" {
+		return 0, nil
+	}
+	lists, ok := parseIf(field)
+	if !ok {
+		return http.StatusBadRequest, ErrBadRequest
+	}
+
+	requested, err := h.key(r.URL.Path)
+	if err != nil {
+		return errorStatus(err), err
+	}
+
+	for _, list := range lists {
+		key := requested
+		if list.resource != "" {
+			resource, err := url.Parse(list.resource)
+			if err != nil {
+				continue
+			}
+			if key, err = h.key(resource.Path); err != nil {
+				continue
+			}
+		}
+
+		holds := true
+		for _, condition := range list.conditions {
+			var matches bool
+			if condition.token != "" {
+				matches = h.locks.valid(condition.token, key)
+			} else {
+				entry, exists := h.stat(key)
+				matches = exists && !entry.IsDir() && condition.etag == etag(entry)
+			}
+			if matches == condition.not {
+				holds = false
+				break
+			}
+		}
+		if holds {
+			return 0, nil
+		}
+	}
+	return http.StatusPreconditionFailed, atlas.ErrPreconditionFailed
+}
+
+// Parses a Timeout header, which lists the lifetimes the client would like
+// in order of preference
+func parseTimeout(field string) time.Duration {
+	for value := range strings.SplitSeq(field, ",") {
+		value = strings.TrimSpace(value)
+		if value == "Infinite" {
+			return MaxLockTimeout
+		}
+		if seconds, ok := strings.CutPrefix(value, "Second-"); ok {
+			n, err := strconv.ParseInt(seconds, 10, 64)
+			if err != nil || n <= 0 {
+				continue
+			}
+			return min(time.Duration(n)*time.Second, MaxLockTimeout)
+		}
+	}
+	return DefaultLockTimeout
+}
+
+type lockInfo struct {
+	XMLName   xml.Name  `xml:"DAV: lockinfo"`
+	Exclusive *struct{} `xml:"DAV: lockscope>exclusive"`
+	Shared    *struct{} `xml:"DAV: lockscope>shared"`
+	Write     *struct{} `xml:"DAV: locktype>write"`
+	Owner     struct {
+		InnerXML string `xml:",innerxml"`
+	} `xml:"DAV: owner"`
+}
+
+// Renders the activelock element describing a lock
+func (h *Handler) activeLock(l lock) string {
+	scope, depth := "shared", "0"
+	if l.exclusive {
+		scope = "exclusive"
+	}
+	if l.infinite {
+		depth = "infinity"
+	}
+	remaining := max(int64(time.Until(l.expires)/time.Second), 0)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<D:activelock><D:locktype><D:write/></D:locktype><D:lockscope><D:%s/></D:lockscope>", scope)
+	fmt.Fprintf(&b, "<D:depth>%s</D:depth>", depth)
+	if l.owner != "" {
+		fmt.Fprintf(&b, "<D:owner>%s</D:owner>", l.owner)
+	}
+	fmt.Fprintf(&b, "<D:timeout>Second-%d</D:timeout>", remaining)
+	fmt.Fprintf(&b, "<D:locktoken><D:href>%s</D:href></D:locktoken>", escape(l.token))
+	fmt.Fprintf(&b, "<D:lockroot><D:href>%s</D:href></D:lockroot>", escape(h.href(l.key, false)))
+	b.WriteString("</D:activelock>")
+	return b.String()
+}
+
+func (h *Handler) writeLock(w http.ResponseWriter, l lock, status int) {
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>`+"\n"+`<D:prop xmlns:D="DAV:"><D:lockdiscovery>%s</D:lockdiscovery></D:prop>`, h.activeLock(l))
+}
+
+func (h *Handler) handleLock(w http.ResponseWriter, r *http.Request) (int, error) {
+	username := r.Header.Get("username")
+	key, err := h.key(r.URL.Path)
+	if err != nil {
+		return errorStatus(err), err
+	}
+	if !h.allowed(username, key, authentication.PermissionWrite) {
+		return http.StatusForbidden, ErrForbidden
+	}
+	timeout := parseTimeout(r.Header.Get("Timeout"))
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxXMLBody))
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	// Without a body the request refreshes a lock named in the If header
+	if len(bytes.TrimSpace(body)) == 0 {
+		l, err := h.locks.refresh(submittedTokens(r), key, username, timeout)
+		if err != nil {
+			return http.StatusPreconditionFailed, err
+		}
+		h.writeLock(w, l, http.StatusOK)
+		return 0, nil
+	}
+
+	info := lockInfo{}
+	if err := xml.Unmarshal(body, &info); err != nil {
+		return http.StatusBadRequest, ErrBadRequest
+	}
+	if info.Write == nil || (info.Exclusive == nil) == (info.Shared == nil) {
+		return http.StatusBadRequest, ErrBadRequest
+	}
+
+	infinite := true
+	switch r.Header.Get("Depth") {
+	case "", "infinity":
+	case "0":
+		infinite = false
+	default:
+		return http.StatusBadRequest, ErrBadRequest
+	}
+
+	// Locking an unmapped URL creates an empty file there
+	_, exists := h.stat(key)
+	if !exists {
+		if !h.parentExists(key) {
+			return http.StatusConflict, atlas.ErrResourceNotFound
+		}
+		if err := h.locks.confirm(username, submittedTokens(r), key, false, true); err != nil {
+			return http.StatusLocked, err
+		}
+	}
+
+	l, err := h.locks.create(key, infinite, info.Exclusive != nil, info.Owner.InnerXML, username, timeout)
+	if err != nil {
+		return http.StatusLocked, err
+	}
+	w.Header().Set("Lock-Token", "<"+l.token+">")
+
+	if !exists {
+		writer, err := h.files.Write(atlas.NewPath(key), username)
+		if err == nil {
+			err = writer.Commit()
+		}
+		if err != nil {
+			h.locks.unlock(l.token, key, username)
+			return errorStatus(err), err
+		}
+		log.Infof("User %q created %v over WebDAV", username, key)
+		h.writeLock(w, l, http.StatusCreated)
+		return 0, nil
+	}
+
+	h.writeLock(w, l, http.StatusOK)
+	return 0, nil
+}
+
+func (h *Handler) handleUnlock(w http.ResponseWriter, r *http.Request) (int, error) {
+	username := r.Header.Get("username")
+	key, err := h.key(r.URL.Path)
+	if err != nil {
+		return errorStatus(err), err
+	}
+
+	token := strings.TrimSuffix(strings.TrimPrefix(r.Header.Get("Lock-Token"), "<"), ">")
+	if token == "" {
+		return http.StatusBadRequest, ErrBadRequest
+	}
+
+	switch err := h.locks.unlock(token, key, username); {
+	case errors.Is(err, ErrNoSuchLock):
+		return http.StatusConflict, err
+	case err != nil:
+		return http.StatusForbidden, err
+	}
+	return http.StatusNoContent, nil
+}
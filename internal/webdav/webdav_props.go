@@ -0,0 +1,281 @@
+package webdav
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/mnemosynefs/mnemo/internal/atlas"
+	"github.com/mnemosynefs/mnemo/internal/authentication"
+)
+
+// Live properties of every resource, as returned for allprop and propname
+var liveProperties = []string{
+	"displayname", "resourcetype", "getcontentlength", "getcontenttype",
+	"getetag", "getlastmodified", "supportedlock", "lockdiscovery",
+}
+
+type xmlName struct {
+	XMLName xml.Name
+}
+
+type propNames struct {
+	Names []xmlName `xml:",any"`
+}
+
+type propfind struct {
+	XMLName  xml.Name   `xml:"DAV: propfind"`
+	AllProp  *struct{}  `xml:"DAV: allprop"`
+	PropName *struct{}  `xml:"DAV: propname"`
+	Prop     *propNames `xml:"DAV: prop"`
+}
+
+type propertyUpdate struct {
+	XMLName xml.Name     `xml:"DAV: propertyupdate"`
+	Set     []propAction `xml:"DAV: set"`
+	Remove  []propAction `xml:"DAV: remove"`
+}
+
+type propAction struct {
+	Prop propNames `xml:"DAV: prop"`
+}
+
+func escape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// Renders an element, with content if any
+func element(name xml.Name, content string) string {
+	open, end := name.Local, name.Local
+	switch name.Space {
+	case "DAV:":
+		open, end = "D:"+name.Local, "D:"+name.Local
+	case "":
+		open += ` xmlns=""`
+	default:
+		open, end = "P:"+name.Local, "P:"+name.Local
+		open += ` xmlns:P="` + escape(name.Space) + `"`
+	}
+	if content == "" {
+		return "<" + open + "/>"
+	}
+	return "<" + open + ">" + content + "</" + end + ">"
+}
+
+// resource is a file or folder of the tree listed in a multistatus response
+type resource struct {
+	key   string
+	entry atlas.Entry
+}
+
+// Returns the content of a property of the resource, reporting whether it has
+// one by that name
+func (h *Handler) property(res resource, name xml.Name) (string, bool) {
+	if name.Space != "DAV:" {
+		return "", false
+	}
+
+	dir := res.entry.IsDir()
+	switch name.Local {
+	case "displayname":
+		return escape(path.Base("/" + res.key)), true
+	case "resourcetype":
+		if dir {
+			return "<D:collection/>", true
+		}
+		return "", true
+	case "getcontentlength":
+		return fmt.Sprint(res.entry.Size), !dir
+	case "getcontenttype":
+		contentType := mime.TypeByExtension(path.Ext(res.key))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		return escape(contentType), !dir
+	case "getetag":
+		return escape(etag(res.entry)), !dir
+	case "getlastmodified":
+		return res.entry.Modified.UTC().Format(http.TimeFormat), true
+	case "supportedlock":
+		return "<D:lockentry><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockentry>" +
+			"<D:lockentry><D:lockscope><D:shared/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockentry>", true
+	case "lockdiscovery":
+		var b strings.Builder
+		for _, l := range h.locks.active(res.key) {
+			b.WriteString(h.activeLock(l))
+		}
+		return b.String(), true
+	}
+	return "", false
+}
+
+// Renders the response element of a resource, the properties found under 200
+// and the others under 404
+func (h *Handler) propResponse(res resource, request propfind) string {
+	var found, missing strings.Builder
+	switch {
+	case request.PropName != nil:
+		for _, local := range liveProperties {
+			name := xml.Name{Space: "DAV:", Local: local}
+			if _, ok := h.property(res, name); ok {
+				found.WriteString(element(name, ""))
+			}
+		}
+	case request.Prop != nil:
+		for _, prop := range request.Prop.Names {
+			if content, ok := h.property(res, prop.XMLName); ok {
+				found.WriteString(element(prop.XMLName, content))
+			} else {
+				missing.WriteString(element(prop.XMLName, ""))
+			}
+		}
+	default:
+		for _, local := range liveProperties {
+			name := xml.Name{Space: "DAV:", Local: local}
+			if content, ok := h.property(res, name); ok {
+				found.WriteString(element(name, content))
+			}
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<D:response><D:href>%s</D:href>", escape(h.href(res.key, res.entry.IsDir())))
+	if found.Len() > 0 {
+		fmt.Fprintf(&b, "<D:propstat><D:prop>%s</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat>", found.String())
+	}
+	if missing.Len() > 0 {
+		fmt.Fprintf(&b, "<D:propstat><D:prop>%s</D:prop><D:status>HTTP/1.1 404 Not Found</D:status></D:propstat>", missing.String())
+	}
+	b.WriteString("</D:response>")
+	return b.String()
+}
+
+func writeMultistatus(w http.ResponseWriter, responses []string) {
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, `<?xml version="1.0" encoding="utf-8"?>`+"\n"+`<D:multistatus xmlns:D="DAV:">`)
+	for _, response := range responses {
+		io.WriteString(w, response)
+	}
+	io.WriteString(w, "</D:multistatus>")
+}
+
+// Reads the XML body of a request into v. Empty bodies leave v untouched and
+// report false.
+func readXML(r *http.Request, v any) (bool, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxXMLBody))
+	if err != nil {
+		return false, err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return false, nil
+	}
+	if err := xml.Unmarshal(body, v); err != nil {
+		return false, ErrBadRequest
+	}
+	return true, nil
+}
+
+func (h *Handler) handlePropfind(w http.ResponseWriter, r *http.Request) (int, error) {
+	username := r.Header.Get("username")
+	key, err := h.key(r.URL.Path)
+	if err != nil {
+		return errorStatus(err), err
+	}
+	if !h.allowed(username, key, authentication.PermissionRead) {
+		return http.StatusForbidden, ErrForbidden
+	}
+
+	entry, ok := h.stat(key)
+	if !ok {
+		return http.StatusNotFound, atlas.ErrResourceNotFound
+	}
+
+	depth := r.Header.Get("Depth")
+	if depth != "0" && depth != "1" && depth != "infinity" && depth != "" {
+		return http.StatusBadRequest, ErrBadRequest
+	}
+
+	// An empty body asks for every property
+	request := propfind{}
+	if _, err := readXML(r, &request); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	responses := []string{h.propResponse(resource{key: key, entry: entry}, request)}
+	if entry.IsDir() && depth != "0" {
+		options := atlas.ListOptions{Recursive: depth != "1", User: username}
+		listing, err := h.files.List(atlas.NewPath(key), options)
+		if err != nil {
+			return errorStatus(err), err
+		}
+
+		// Listings sort by base name, responses read better in tree order
+		slices.SortFunc(listing.Entries, func(a, b atlas.ListEntry) int {
+			return strings.Compare(a.Path, b.Path)
+		})
+		for _, child := range listing.Entries {
+			// Files the user may not read are left out rather than refused
+			if !h.allowed(username, child.Path, authentication.PermissionRead) {
+				continue
+			}
+			childEntry := atlas.Entry{
+				Type:     child.Type,
+				Object:   strings.TrimPrefix(child.Checksum, "sha256:"),
+				Size:     child.Size,
+				Modified: child.Modified,
+			}
+			responses = append(responses, h.propResponse(resource{key: child.Path, entry: childEntry}, request))
+		}
+	}
+
+	writeMultistatus(w, responses)
+	return 0, nil
+}
+
+// Answers PROPPATCH. Only live properties exist and none of them can be set,
+// so every change is refused.
+func (h *Handler) handleProppatch(w http.ResponseWriter, r *http.Request) (int, error) {
+	username := r.Header.Get("username")
+	key, err := h.key(r.URL.Path)
+	if err != nil {
+		return errorStatus(err), err
+	}
+	if !h.allowed(username, key, authentication.PermissionWrite) {
+		return http.StatusForbidden, ErrForbidden
+	}
+
+	entry, ok := h.stat(key)
+	if !ok {
+		return http.StatusNotFound, atlas.ErrResourceNotFound
+	}
+	if err := h.locks.confirm(username, submittedTokens(r), key, false, false); err != nil {
+		return http.StatusLocked, err
+	}
+
+	update := propertyUpdate{}
+	if ok, err := readXML(r, &update); err != nil || !ok {
+		return http.StatusBadRequest, ErrBadRequest
+	}
+
+	var props strings.Builder
+	for _, action := range append(update.Set, update.Remove...) {
+		for _, prop := range action.Prop.Names {
+			props.WriteString(element(prop.XMLName, ""))
+		}
+	}
+
+	writeMultistatus(w, []string{fmt.Sprintf(
+		"<D:response><D:href>%s</D:href><D:propstat><D:prop>%s</D:prop><D:status>HTTP/1.1 403 Forbidden</D:status></D:propstat></D:response>",
+		escape(h.href(key, entry.IsDir())), props.String(),
+	)})
+	return 0, nil
+}
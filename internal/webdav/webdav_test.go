@@ -0,0 +1,277 @@
+package webdav_test
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mnemosynefs/mnemo/internal/atlas"
+	"github.com/mnemosynefs/mnemo/internal/authentication"
+	"github.com/mnemosynefs/mnemo/internal/webdav"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type davServer struct {
+	t       *testing.T
+	files   *atlas.Atlas
+	handler http.Handler
+}
+
+func newDAVServer(t *testing.T) *davServer {
+	t.Helper()
+	files, err := atlas.NewAtlasWithBackend(atlas.NewMemoryBackend())
+	require.NoError(t, err)
+
+	database := &authentication.AuthDatabase{
+		Users: map[string]string{"alice": "alice", "bob": "bob"},
+		Permissions: map[string]authentication.UserPermission{
+			"/":               {"alice": 3, "bob": 1},
+			"/shared":         {"bob": 3},
+			"/private":        {"bob": 0},
+			"/shared/archive": {"bob": 1},
+		},
+	}
+	handler := database.CredentialsMiddlewareHandler(webdav.NewHandler("/dav/", files, database))
+	return &davServer{t: t, files: files, handler: handler}
+}
+
+func (s *davServer) request(user string, method string, target string, body string, headers ...string) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, target, reader)
+	if user != "" {
+		req.SetBasicAuth(user, user)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+type multistatus struct {
+	Responses []struct {
+		Href      string `xml:"href"`
+		Propstats []struct {
+			Prop struct {
+				Inner string `xml:",innerxml"`
+			} `xml:"prop"`
+			Status string `xml:"status"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+func parseMultistatus(t *testing.T, rec *httptest.ResponseRecorder) multistatus {
+	t.Helper()
+	require.Equal(t, http.StatusMultiStatus, rec.Code, rec.Body.String())
+	ms := multistatus{}
+	require.NoError(t, xml.Unmarshal(rec.Body.Bytes(), &ms))
+	return ms
+}
+
+func (ms multistatus) hrefs() []string {
+	hrefs := []string{}
+	for _, response := range ms.Responses {
+		hrefs = append(hrefs, response.Href)
+	}
+	return hrefs
+}
+
+const lockBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype><D:owner><D:href>alice</D:href></D:owner></D:lockinfo>`
+
+func TestHandler_Authentication(t *testing.T) {
+	s := newDAVServer(t)
+
+	rec := s.request("", "PROPFIND", "/dav/", "")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Header().Get("WWW-Authenticate"), "Basic")
+
+	rec = s.request("alice", "OPTIONS", "/dav/", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "1, 2", rec.Header().Get("DAV"))
+	assert.Contains(t, rec.Header().Get("Allow"), "PROPFIND")
+}
+
+func TestHandler_Files(t *testing.T) {
+	s := newDAVServer(t)
+
+	rec := s.request("alice", "PUT", "/dav/readme.md", "hello")
+	require.Equal(t, http.StatusCreated, rec.Code)
+	etag := rec.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+
+	rec = s.request("alice", "PUT", "/dav/readme.md", "hello world", "If-Match", etag)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	rec = s.request("alice", "PUT", "/dav/readme.md", "stale", "If-Match", etag)
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+
+	rec = s.request("alice", "GET", "/dav/readme.md", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "hello world", rec.Body.String())
+
+	rec = s.request("alice", "PUT", "/dav/missing/readme.md", "hello")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	assert.Equal(t, http.StatusCreated, s.request("alice", "MKCOL", "/dav/docs", "").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, s.request("alice", "MKCOL", "/dav/docs", "").Code)
+	assert.Equal(t, http.StatusConflict, s.request("alice", "MKCOL", "/dav/a/b", "").Code)
+	assert.Equal(t, http.StatusUnsupportedMediaType, s.request("alice", "MKCOL", "/dav/body", "<x/>").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, s.request("alice", "GET", "/dav/docs", "").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, s.request("alice", "PUT", "/dav/docs", "x").Code)
+
+	assert.Equal(t, http.StatusNoContent, s.request("alice", "DELETE", "/dav/readme.md", "").Code)
+	assert.Equal(t, http.StatusNotFound, s.request("alice", "GET", "/dav/readme.md", "").Code)
+	assert.Equal(t, http.StatusNotFound, s.request("alice", "DELETE", "/dav/readme.md", "").Code)
+}
+
+func TestHandler_Propfind(t *testing.T) {
+	s := newDAVServer(t)
+	s.request("alice", "MKCOL", "/dav/docs", "")
+	s.request("alice", "PUT", "/dav/docs/read%20me.md", "hello")
+	s.request("alice", "PUT", "/dav/notes.txt", "abc")
+
+	ms := parseMultistatus(t, s.request("alice", "PROPFIND", "/dav/", "", "Depth", "1"))
+	assert.Equal(t, []string{"/dav/", "/dav/docs/", "/dav/notes.txt"}, ms.hrefs())
+	assert.Contains(t, ms.Responses[1].Propstats[0].Prop.Inner, "<D:collection/>")
+	assert.Contains(t, ms.Responses[2].Propstats[0].Prop.Inner, "<D:getcontentlength>3</D:getcontentlength>")
+	assert.Contains(t, ms.Responses[2].Propstats[0].Prop.Inner, "<D:getcontenttype>text/plain; charset=utf-8</D:getcontenttype>")
+
+	ms = parseMultistatus(t, s.request("alice", "PROPFIND", "/dav/docs", "", "Depth", "infinity"))
+	assert.Equal(t, []string{"/dav/docs/", "/dav/docs/read%20me.md"}, ms.hrefs())
+
+	ms = parseMultistatus(t, s.request("alice", "PROPFIND", "/dav/notes.txt", `<?xml version="1.0"?>
+<propfind xmlns="DAV:" xmlns:x="urn:example"><prop><getetag/><x:color/></prop></propfind>`, "Depth", "0"))
+	require.Len(t, ms.Responses, 1)
+	require.Len(t, ms.Responses[0].Propstats, 2)
+	assert.Contains(t, ms.Responses[0].Propstats[0].Prop.Inner, "<D:getetag>&#34;")
+	assert.Equal(t, "HTTP/1.1 200 OK", ms.Responses[0].Propstats[0].Status)
+	assert.Contains(t, ms.Responses[0].Propstats[1].Prop.Inner, `xmlns:P="urn:example"`)
+	assert.Equal(t, "HTTP/1.1 404 Not Found", ms.Responses[0].Propstats[1].Status)
+
+	ms = parseMultistatus(t, s.request("alice", "PROPFIND", "/dav/notes.txt", `<propfind xmlns="DAV:"><propname/></propfind>`, "Depth", "0"))
+	assert.Contains(t, ms.Responses[0].Propstats[0].Prop.Inner, "<D:getetag/>")
+
+	assert.Equal(t, http.StatusNotFound, s.request("alice", "PROPFIND", "/dav/missing", "").Code)
+	assert.Equal(t, http.StatusBadRequest, s.request("alice", "PROPFIND", "/dav/", "<propfind", "Depth", "0").Code)
+
+	ms = parseMultistatus(t, s.request("alice", "PROPPATCH", "/dav/notes.txt", `<propertyupdate xmlns="DAV:"><set><prop><displayname>x</displayname></prop></set></propertyupdate>`))
+	assert.Equal(t, "HTTP/1.1 403 Forbidden", ms.Responses[0].Propstats[0].Status)
+}
+
+func TestHandler_CopyMove(t *testing.T) {
+	s := newDAVServer(t)
+	s.request("alice", "MKCOL", "/dav/docs", "")
+	s.request("alice", "PUT", "/dav/docs/readme.md", "hello")
+	s.request("alice", "PUT", "/dav/notes.txt", "abc")
+
+	rec := s.request("alice", "COPY", "/dav/docs", "", "Destination", "http://example.com/dav/backup")
+	require.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, "hello", s.request("alice", "GET", "/dav/backup/readme.md", "").Body.String())
+
+	rec = s.request("alice", "COPY", "/dav/docs", "", "Destination", "/dav/empty", "Depth", "0")
+	require.Equal(t, http.StatusCreated, rec.Code)
+	ms := parseMultistatus(t, s.request("alice", "PROPFIND", "/dav/empty", "", "Depth", "1"))
+	assert.Equal(t, []string{"/dav/empty/"}, ms.hrefs())
+
+	rec = s.request("alice", "MOVE", "/dav/notes.txt", "", "Destination", "/dav/docs/readme.md", "Overwrite", "F")
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+	rec = s.request("alice", "MOVE", "/dav/notes.txt", "", "Destination", "/dav/docs/readme.md")
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "abc", s.request("alice", "GET", "/dav/docs/readme.md", "").Body.String())
+
+	assert.Equal(t, http.StatusConflict, s.request("alice", "MOVE", "/dav/docs", "", "Destination", "/dav/a/b").Code)
+	assert.Equal(t, http.StatusBadGateway, s.request("alice", "MOVE", "/dav/docs", "", "Destination", "http://elsewhere/dav/x").Code)
+	assert.Equal(t, http.StatusBadGateway, s.request("alice", "MOVE", "/dav/docs", "", "Destination", "/files/x").Code)
+	assert.Equal(t, http.StatusBadRequest, s.request("alice", "MOVE", "/dav/docs", "").Code)
+	assert.Equal(t, http.StatusForbidden, s.request("alice", "MOVE", "/dav/docs", "", "Destination", "/dav/docs/").Code)
+	assert.Equal(t, http.StatusNotFound, s.request("alice", "MOVE", "/dav/missing", "", "Destination", "/dav/x").Code)
+}
+
+func TestHandler_Locks(t *testing.T) {
+	s := newDAVServer(t)
+	s.request("alice", "MKCOL", "/dav/shared", "")
+	s.request("alice", "PUT", "/dav/shared/plan.txt", "v1")
+
+	rec := s.request("alice", "LOCK", "/dav/shared/plan.txt", lockBody, "Timeout", "Second-600")
+	require.Equal(t, http.StatusOK, rec.Code)
+	token := strings.Trim(rec.Header().Get("Lock-Token"), "<>")
+	require.True(t, strings.HasPrefix(token, "opaquelocktoken:"))
+	assert.Contains(t, rec.Body.String(), "<D:timeout>Second-")
+	assert.Contains(t, rec.Body.String(), "<D:owner><D:href>alice</D:href></D:owner>")
+
+	// Nobody may change the file without the token, not even its owner
+	assert.Equal(t, http.StatusLocked, s.request("bob", "PUT", "/dav/shared/plan.txt", "bob").Code)
+	assert.Equal(t, http.StatusLocked, s.request("alice", "PUT", "/dav/shared/plan.txt", "v2").Code)
+	assert.Equal(t, http.StatusLocked, s.request("alice", "DELETE", "/dav/shared", "").Code)
+	assert.Equal(t, http.StatusLocked, s.request("bob", "PUT", "/dav/shared/plan.txt", "bob", "If", "(<"+token+">)").Code)
+	assert.Equal(t, http.StatusLocked, s.request("bob", "LOCK", "/dav/shared/plan.txt", lockBody).Code)
+	assert.Equal(t, http.StatusNoContent, s.request("alice", "PUT", "/dav/shared/plan.txt", "v2", "If", "(<"+token+">)").Code)
+	assert.Equal(t, http.StatusPreconditionFailed, s.request("alice", "PUT", "/dav/shared/plan.txt", "v3", "If", "(<opaquelocktoken:bogus>)").Code)
+
+	ms := parseMultistatus(t, s.request("bob", "PROPFIND", "/dav/shared/plan.txt", `<propfind xmlns="DAV:"><prop><lockdiscovery/></prop></propfind>`, "Depth", "0"))
+	assert.Contains(t, ms.Responses[0].Propstats[0].Prop.Inner, token)
+
+	rec = s.request("alice", "LOCK", "/dav/shared/plan.txt", "", "If", "(<"+token+">)", "Timeout", "Infinite")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get("Lock-Token"))
+	assert.Equal(t, http.StatusPreconditionFailed, s.request("alice", "LOCK", "/dav/shared/plan.txt", "").Code)
+
+	assert.Equal(t, http.StatusForbidden, s.request("bob", "UNLOCK", "/dav/shared/plan.txt", "", "Lock-Token", "<"+token+">").Code)
+	assert.Equal(t, http.StatusConflict, s.request("alice", "UNLOCK", "/dav/shared/plan.txt", "", "Lock-Token", "<opaquelocktoken:bogus>").Code)
+	assert.Equal(t, http.StatusNoContent, s.request("alice", "UNLOCK", "/dav/shared/plan.txt", "", "Lock-Token", "<"+token+">").Code)
+	assert.Equal(t, http.StatusNoContent, s.request("bob", "PUT", "/dav/shared/plan.txt", "bob").Code)
+
+	// Locking an unmapped URL reserves it with an empty file, and a depth
+	// infinity lock on a folder protects what is added to it
+	rec = s.request("bob", "LOCK", "/dav/shared/new.txt", lockBody)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	assert.True(t, s.files.Exists(atlas.NewPath("shared/new.txt")))
+
+	rec = s.request("bob", "LOCK", "/dav/shared", lockBody)
+	assert.Equal(t, http.StatusLocked, rec.Code)
+	rec = s.request("alice", "LOCK", "/dav/shared/missing/drafts", lockBody)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	s.request("alice", "MKCOL", "/dav/shared/drafts", "")
+	rec = s.request("alice", "LOCK", "/dav/shared/drafts", lockBody, "Depth", "infinity")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, http.StatusLocked, s.request("bob", "PUT", "/dav/shared/drafts/a.txt", "bob").Code)
+	assert.Equal(t, http.StatusLocked, s.request("bob", "MOVE", "/dav/shared/plan.txt", "", "Destination", "/dav/shared/drafts/plan.txt").Code)
+}
+
+func TestHandler_Permissions(t *testing.T) {
+	s := newDAVServer(t)
+	s.request("alice", "MKCOL", "/dav/shared", "")
+	s.request("alice", "MKCOL", "/dav/private", "")
+	s.request("alice", "PUT", "/dav/private/secret.txt", "secret")
+	s.request("alice", "PUT", "/dav/notes.txt", "abc")
+
+	// Bob reads everything but the private folder and only writes to shared
+	assert.Equal(t, http.StatusOK, s.request("bob", "GET", "/dav/notes.txt", "").Code)
+	assert.Equal(t, http.StatusForbidden, s.request("bob", "GET", "/dav/private/secret.txt", "").Code)
+	assert.Equal(t, http.StatusForbidden, s.request("bob", "PROPFIND", "/dav/private", "").Code)
+	assert.Equal(t, http.StatusForbidden, s.request("bob", "PUT", "/dav/notes.txt", "bob").Code)
+	assert.Equal(t, http.StatusForbidden, s.request("bob", "DELETE", "/dav/notes.txt", "").Code)
+	assert.Equal(t, http.StatusForbidden, s.request("bob", "LOCK", "/dav/notes.txt", lockBody).Code)
+	assert.Equal(t, http.StatusCreated, s.request("bob", "PUT", "/dav/shared/bob.txt", "bob").Code)
+	assert.Equal(t, http.StatusForbidden, s.request("bob", "MOVE", "/dav/shared/bob.txt", "", "Destination", "/dav/bob.txt").Code)
+	assert.Equal(t, http.StatusForbidden, s.request("bob", "COPY", "/dav/private/secret.txt", "", "Destination", "/dav/shared/secret.txt").Code)
+	assert.Equal(t, http.StatusCreated, s.request("bob", "COPY", "/dav/notes.txt", "", "Destination", "/dav/shared/notes.txt").Code)
+
+	ms := parseMultistatus(t, s.request("bob", "PROPFIND", "/dav/", ""))
+	assert.Equal(t, []string{"/dav/", "/dav/notes.txt", "/dav/shared/", "/dav/shared/bob.txt", "/dav/shared/notes.txt"}, ms.hrefs())
+
+	// Removing a folder needs write access to everything inside it
+	s.request("alice", "MKCOL", "/dav/shared/archive", "")
+	s.request("alice", "PUT", "/dav/shared/archive/old.txt", "old")
+	assert.Equal(t, http.StatusForbidden, s.request("bob", "DELETE", "/dav/shared", "").Code)
+	assert.Equal(t, http.StatusNoContent, s.request("bob", "DELETE", "/dav/shared/bob.txt", "").Code)
+}
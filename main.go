@@ -2,8 +2,10 @@ package main
 
 import (
 	"os"
+	"time"
 
 	"github.com/charmbracelet/log"
+	"github.com/mnemosynefs/mnemo/internal/atlas"
 	"github.com/mnemosynefs/mnemo/internal/services"
 )
 
@@ -13,5 +15,38 @@ func main() {
 		ReportCaller:    true,
 	}))
 
-	services.CreateServices(":8080", "./auth.json")
+	ParseFlags()
+
+	key, err := atlas.LoadKey(Flags.keyFile)
+	if err != nil {
+		log.Fatalf("Failed to load master key: %v", err)
+	}
+
+	if Flags.rekey != "" {
+		os.Exit(rekey(Flags.root, key, Flags.rekey))
+	}
+	if Flags.scrub {
+		os.Exit(scrub(Flags.root, key))
+	}
+
+	services, err := services.CreateServices(Flags.address, "./auth.json", Flags.root)
+	if err != nil {
+		log.Fatalf("Failed to start services: %v", err)
+	}
+	services.Atlas.SetVersionLimit(Flags.versions)
+	services.Atlas.SetCompression(Flags.compress)
+	if err := services.Atlas.SetEncryptionKey(key); err != nil {
+		log.Fatalf("Failed to set master key: %v", err)
+	}
+	if Flags.quota > 0 {
+		services.Atlas.SetDefaultUserQuota(Flags.quota)
+	}
+	if Flags.trashAge > 0 {
+		services.Atlas.StartTrashPurge(Flags.trashAge, time.Hour)
+	}
+	if Flags.uploadAge > 0 {
+		services.Atlas.StartUploadExpiry(Flags.uploadAge, time.Hour)
+	}
+
+	log.Fatal(services.Mnemo.StartServer())
 }